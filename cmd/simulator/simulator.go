@@ -18,7 +18,6 @@ package main
 import (
 	"context"
 	"flag"
-	"math/rand"
 	"os"
 	"os/signal"
 	"path"
@@ -88,6 +87,8 @@ var (
 	pathwaysPerHour = flag.Float64("pathways_per_hour", 1, "Number of pathways that should start per hour")
 	maxPathways     = flag.Int("max_pathways", -1, "Number of pathways to run before stopping. Pathways run from the dashboard do not count towards this limit. "+
 		"If negative, Simulated Hospital will keep running pathways indefinitely")
+	seed = flag.Int64("seed", 0, "Seed for the random values of the generated messages. Running the same pathways with the same seed and configuration "+
+		"generates the same values. If zero, a seed based on the current time is used")
 
 	// Flags that control the dashboard.
 	dashboardURI     = flag.String("dashboard_uri", "simulated-hospital", "Base URI at which the dashboard and endpoints are available")
@@ -115,8 +116,6 @@ func main() {
 			Fatal("Cannot configure HL7 timezone and location")
 	}
 
-	rand.Seed(time.Now().Unix())
-
 	log.Info("Starting Simulated Hospital")
 	hr, err := createRunner()
 	if err != nil {
@@ -205,6 +204,7 @@ func createRunner() (*runner.Hospital, error) {
 		SleepFor:           *sleepFor,
 		Clock:              config.Clock,
 		MaxPathways:        *maxPathways,
+		Seed:               *seed,
 	})
 }
 
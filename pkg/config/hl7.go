@@ -16,9 +16,11 @@ package config
 
 import (
 	"io/ioutil"
+	"regexp"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
+	"github.com/google/simhospital/pkg/message"
 )
 
 // HL7Config is the configuration for HL7 messages where the values are important for HL7 compliance or specific uses of the HL7 standard.
@@ -60,6 +62,91 @@ type HL7Config struct {
 	// CodingSystem is the default coding system of Order Profiles and their Test Types.
 	// It is used to construct the Coded Element.
 	CodingSystem string `yaml:"coding_system"`
+
+	// UnknownCodingSystem is the coding system of the Coded Elements of Order Profiles and Test Types
+	// that are referenced in pathways but not defined in the order profiles configuration, e.g., LOCAL.
+	// Optional. If not set, the coding system of such Coded Elements is left empty.
+	UnknownCodingSystem string `yaml:"unknown_coding_system"`
+
+	// EthnicityCodingSystem is the default coding system to be set in the CE.3.NameOfCodingSystem
+	// field of PID.22-Ethnic Group, e.g., CDCREC. It is only used for ethnicities that don't
+	// specify a coding system already.
+	EthnicityCodingSystem string `yaml:"ethnicity_coding_system"`
+
+	// AlternateCodes maps the ID of a Test Type in the order profiles to its alternate code, e.g.
+	// its LOINC code. The results for Test Types with an alternate code are dual coded: OBX-3 is
+	// set to ID^Text^CodingSystem^AlternateID^Text^AlternateCodingSystem.
+	// Optional.
+	AlternateCodes map[string]AlternateCode `yaml:"alternate_codes"`
+
+	// Encoding is the field separator and the encoding characters of the messages, in the order in
+	// which they appear in MSH.1 and MSH.2, e.g. '|^~\&'.
+	// Optional. If not set, message.DefaultEncoding is used.
+	Encoding string `yaml:"encoding"`
+
+	// HL7Version is the HL7 version of the messages, e.g. 2.5.1, to be set in MSH.12-Version ID.
+	// Optional. If not set, message.DefaultHL7Version is used.
+	HL7Version string `yaml:"hl7_version"`
+
+	// ReferenceRangeFormat is the format of the OBX.7-Reference Range of results with a low and high
+	// limit. It must contain two %s verbs for the limits, e.g. "[%s,%s]".
+	// Optional. If not set, message.DefaultReferenceRangeFormat is used.
+	ReferenceRangeFormat string `yaml:"reference_range_format"`
+
+	// MaxOBXValueLength is the maximum length of OBX.5-Observation Value. Longer values are split
+	// across several OBX segments.
+	// Optional. If not set, the values are not split.
+	MaxOBXValueLength int `yaml:"max_obx_value_length"`
+
+	// PseudoPV1PatientClass is the PV1.2-Patient Class of the PV1 segments of messages that are not
+	// about a visit, e.g. ADT^A31.
+	// Optional. If not set, message.DefaultPseudoPV1PatientClass is used.
+	PseudoPV1PatientClass string `yaml:"pseudo_pv1_patient_class"`
+
+	// ParticipationSegments is whether the attending doctor and the ordering provider are sent in
+	// PRT segments instead of in PV1.7-Attending Doctor and OBR.16-Ordering Provider.
+	ParticipationSegments bool `yaml:"participation_segments"`
+
+	// StrictTemplates is whether building a message fails if a field that HL7 requires is missing,
+	// instead of leaving the field empty.
+	StrictTemplates bool `yaml:"strict_templates"`
+
+	// OmitEmptyPD1 is whether the PD1 segment is left out for patients with neither a primary
+	// facility nor a primary care provider.
+	OmitEmptyPD1 bool `yaml:"omit_empty_pd1"`
+}
+
+// MessageOptions returns the options to build the messages with, as configured in c.
+// It returns an error if the options are not valid, e.g. if the encoding characters are not distinct.
+func (c *HL7Config) MessageOptions() (*message.Options, error) {
+	o := &message.Options{
+		HL7Version:            c.HL7Version,
+		ReferenceRangeFormat:  c.ReferenceRangeFormat,
+		MaxOBXValueLength:     c.MaxOBXValueLength,
+		PseudoPV1PatientClass: c.PseudoPV1PatientClass,
+		ParticipationSegments: c.ParticipationSegments,
+		StrictTemplates:       c.StrictTemplates,
+		OmitEmptyPD1:          c.OmitEmptyPD1,
+	}
+	if c.Encoding != "" {
+		e, err := message.ParseEncoding(c.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		o.Encoding = e
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// AlternateCode is an alternate identifier for a Test Type, e.g. its LOINC code.
+type AlternateCode struct {
+	// ID is the identifier to set in CE.4 Alternate Identifier, e.g. 2160-0.
+	ID string
+	// CodingSystem is the coding system to set in CE.6 Name Of Alternate Coding System, e.g. LN.
+	CodingSystem string `yaml:"coding_system"`
 }
 
 // Header contains the configuration of the Message Header (MSH segment).
@@ -83,6 +170,9 @@ type HeaderForType struct {
 	ReceivingApplication string `yaml:"receiving_application"`
 	// ReceivingFacility is the value to set in MSH-6 Receiving Facility.
 	ReceivingFacility string `yaml:"receiving_facility"`
+	// CountryCode is the 3-letter ISO 3166 code to set in MSH-17 Country Code, e.g. GBR.
+	// Optional. If not present, MSH-17 is set to 44.
+	CountryCode string `yaml:"country_code"`
 }
 
 // HL7Allergy contains the configuration for AL1 segment (allergies).
@@ -94,6 +184,9 @@ type HL7Allergy struct {
 	// CodingSystem is the allergy coding system to be set in the CE.3.NameOfCodingSystem field in the
 	// AL1.3.AllergyCode/Mnemonic/Description.
 	CodingSystem string `yaml:"coding_system"`
+	// UseIAM is whether the allergies in ADT^A08 and ADT^A31 messages are sent in IAM segments
+	// instead of AL1 segments.
+	UseIAM bool `yaml:"use_iam"`
 }
 
 // HL7Diagnosis is the configuration for DG1 segment (diagnosis).
@@ -163,6 +256,29 @@ type PatientClass struct {
 	Outpatient string
 	// Inpatient is the patient class for inpatients (set after an ADT^A01 Admission message).
 	Inpatient string
+	// Mapping maps human-readable patient classes used in pathways, e.g. INPATIENT, to the codes
+	// to set in the PV1.2.PatientClass field, e.g. I.
+	// Optional. If not present, the patient classes in pathways are used as they are.
+	Mapping map[string]string
+}
+
+// Code returns the code to set in the PV1.2.PatientClass field for the given patient class.
+// If the class is one of the configured codes, it is returned unchanged; otherwise it is mapped
+// using Mapping. Returns an error if there is a Mapping and the class is neither a configured
+// code nor in the Mapping.
+func (c PatientClass) Code(class string) (string, error) {
+	if len(c.Mapping) == 0 || class == c.Outpatient || class == c.Inpatient {
+		return class, nil
+	}
+	for _, code := range c.Mapping {
+		if class == code {
+			return class, nil
+		}
+	}
+	if code, ok := c.Mapping[class]; ok {
+		return code, nil
+	}
+	return "", errors.Errorf("unknown patient class %q: it is neither a configured code nor in the patient class mapping", class)
 }
 
 // PatientAccountStatus are the patient account status values to set in the PV1.41.AccountStatus field.
@@ -216,6 +332,14 @@ func LoadHL7Config(fileName string) (*HL7Config, error) {
 	if err := yaml.UnmarshalStrict(data, c); err != nil {
 		return nil, errors.Wrapf(err, "cannot unmarshal HL7 configuration file %s", fileName)
 	}
+	for id, ac := range c.AlternateCodes {
+		if ac.ID == "" || ac.CodingSystem == "" {
+			return nil, errors.Errorf("invalid HL7 configuration file %s: alternate code for %q must have an id and a coding_system", fileName, id)
+		}
+	}
+	if _, err := c.MessageOptions(); err != nil {
+		return nil, errors.Wrapf(err, "invalid HL7 configuration file %s", fileName)
+	}
 
 	return c, nil
 }
@@ -244,6 +368,9 @@ func LoadHeaderConfig(fileName string) (*Header, error) {
 	return h, nil
 }
 
+// countryCodeRegex matches 3-letter ISO 3166 country codes.
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
 func valid(h HeaderForType) error {
 	if h.SendingFacility == "" {
 		return errors.New("SendingFacility not set; this is required")
@@ -257,5 +384,8 @@ func valid(h HeaderForType) error {
 	if h.ReceivingApplication == "" {
 		return errors.New("ReceivingApplication not set; this is required")
 	}
+	if h.CountryCode != "" && !countryCodeRegex.MatchString(h.CountryCode) {
+		return errors.Errorf("invalid CountryCode %q: must be a 3-letter ISO 3166 code, e.g. GBR", h.CountryCode)
+	}
 	return nil
 }
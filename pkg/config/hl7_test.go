@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/test/testwrite"
 )
 
@@ -57,6 +58,185 @@ order_control:
 	}
 }
 
+func TestPatientClassCode(t *testing.T) {
+	c := PatientClass{
+		Outpatient: "O",
+		Inpatient:  "I",
+		Mapping: map[string]string{
+			"INPATIENT":  "I",
+			"OUTPATIENT": "O",
+			"EMERGENCY":  "E",
+		},
+	}
+
+	tests := []struct {
+		class   string
+		want    string
+		wantErr bool
+	}{
+		{class: "INPATIENT", want: "I"},
+		{class: "EMERGENCY", want: "E"},
+		{class: "I", want: "I"},
+		{class: "E", want: "E"},
+		{class: "UNKNOWN", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.class, func(t *testing.T) {
+			got, err := c.Code(tc.class)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Code(%q) got err %v, want err? %t", tc.class, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("Code(%q)=%q, want %q", tc.class, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPatientClassCode_NoMapping(t *testing.T) {
+	c := PatientClass{Outpatient: "O", Inpatient: "I"}
+	class := "EMERGENCY"
+	got, err := c.Code(class)
+	if err != nil {
+		t.Fatalf("Code(%q) failed with %v", class, err)
+	}
+	if got != class {
+		t.Errorf("Code(%q)=%q, want %q", class, got, class)
+	}
+}
+
+func TestLoadHL7Config_PatientClassMapping(t *testing.T) {
+	tmp := testwrite.BytesToFile(t, []byte(`
+patient_class:
+  outpatient: "O"
+  inpatient: "I"
+  mapping:
+    INPATIENT: "I"
+`))
+	c, err := LoadHL7Config(tmp)
+	if err != nil {
+		t.Fatalf("LoadHL7Config(%s) failed with %v", tmp, err)
+	}
+	got, err := c.PatientClass.Code("INPATIENT")
+	if err != nil {
+		t.Fatalf("PatientClass.Code(%q) failed with %v", "INPATIENT", err)
+	}
+	if want := "I"; got != want {
+		t.Errorf("PatientClass.Code(%q)=%q, want %q", "INPATIENT", got, want)
+	}
+}
+
+func TestLoadHL7Config_AlternateCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  []byte
+		want    map[string]AlternateCode
+		wantErr bool
+	}{{
+		name: "valid",
+		config: []byte(`
+alternate_codes:
+  lpdc-2012:
+    id: "2160-0"
+    coding_system: "LN"`),
+		want: map[string]AlternateCode{"lpdc-2012": {ID: "2160-0", CodingSystem: "LN"}},
+	}, {
+		name: "missing coding system",
+		config: []byte(`
+alternate_codes:
+  lpdc-2012:
+    id: "2160-0"`),
+		wantErr: true,
+	}, {
+		name: "missing id",
+		config: []byte(`
+alternate_codes:
+  lpdc-2012:
+    coding_system: "LN"`),
+		wantErr: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp := testwrite.BytesToFile(t, tc.config)
+			c, err := LoadHL7Config(tmp)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("LoadHL7Config(%s) got err %v; want error? %t", tmp, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want, c.AlternateCodes); diff != "" {
+				t.Errorf("LoadHL7Config(%s) got AlternateCodes diff (-want, +got):\n%s", tmp, diff)
+			}
+		})
+	}
+}
+
+func TestLoadHL7Config_MessageOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  []byte
+		want    *message.Options
+		wantErr bool
+	}{{
+		name:   "defaults",
+		config: []byte(`hospital_service: "180"`),
+		want:   &message.Options{},
+	}, {
+		name: "all options",
+		config: []byte(`
+encoding: '#!@$%'
+hl7_version: "2.5.1"
+reference_range_format: "[%s,%s]"
+max_obx_value_length: 100
+pseudo_pv1_patient_class: "U"
+participation_segments: true
+strict_templates: true
+omit_empty_pd1: true`),
+		want: &message.Options{
+			Encoding:              message.Encoding{FieldSeparator: '#', ComponentSeparator: '!', RepetitionSeparator: '@', EscapeCharacter: '$', SubComponentSeparator: '%'},
+			HL7Version:            "2.5.1",
+			ReferenceRangeFormat:  "[%s,%s]",
+			MaxOBXValueLength:     100,
+			PseudoPV1PatientClass: "U",
+			ParticipationSegments: true,
+			StrictTemplates:       true,
+			OmitEmptyPD1:          true,
+		},
+	}, {
+		name:    "invalid encoding",
+		config:  []byte(`encoding: '|^^\&'`),
+		wantErr: true,
+	}, {
+		name:    "invalid HL7 version",
+		config:  []byte(`hl7_version: "3.0"`),
+		wantErr: true,
+	}, {
+		name:    "negative max OBX value length",
+		config:  []byte(`max_obx_value_length: -1`),
+		wantErr: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp := testwrite.BytesToFile(t, tc.config)
+			c, err := LoadHL7Config(tmp)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("LoadHL7Config(%s) got err %v; want error? %t", tmp, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := c.MessageOptions()
+			if err != nil {
+				t.Fatalf("MessageOptions() failed with %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("MessageOptions() diff (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestLoadHeaderConfig(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -205,6 +385,50 @@ oru:
   sending_application: want-sa-oru
   sending_facility: want-sf-oru
   receiving_application: want-ra-oru
+`),
+		wantErr: true,
+	}, {
+		name: "Country code",
+		header: []byte(`
+default:
+  sending_application: want-sa
+  sending_facility: want-sf
+  receiving_application: want-ra
+  receiving_facility: want-rf
+  country_code: GBR
+`),
+		wantDefault: &HeaderForType{
+			SendingFacility:      "want-sf",
+			SendingApplication:   "want-sa",
+			ReceivingApplication: "want-ra",
+			ReceivingFacility:    "want-rf",
+			CountryCode:          "GBR",
+		},
+	}, {
+		name: "Invalid Default.CountryCode",
+		header: []byte(`
+default:
+  sending_application: want-sa
+  sending_facility: want-sf
+  receiving_application: want-ra
+  receiving_facility: want-rf
+  country_code: 44
+`),
+		wantErr: true,
+	}, {
+		name: "Invalid OverrideORU.CountryCode",
+		header: []byte(`
+default:
+  sending_application: want-sa
+  sending_facility: want-sf
+  receiving_application: want-ra
+  receiving_facility: want-rf
+oru:
+  sending_application: want-sa-oru
+  sending_facility: want-sf-oru
+  receiving_application: want-ra-oru
+  receiving_facility: want-rf-oru
+  country_code: gbr
 `),
 		wantErr: true,
 	}, {
@@ -20,6 +20,7 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -89,6 +90,8 @@ func names(filename string) (*Names, error) {
 	for k := range allNames {
 		all = append(all, k)
 	}
+	// Sort the names so that picking a random name only depends on the source of randomness.
+	sort.Strings(all)
 
 	return &Names{ByYear: namesByYear, All: all, MinYear: years[0], MaxYear: years[len(years)-1]}, nil
 }
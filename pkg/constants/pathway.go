@@ -30,6 +30,10 @@ const (
 	// should be set to a random abnormal low value, ie: it should be below
 	// the low end of the normal range.
 	AbnormalLow = "ABNORMAL_LOW"
+	// PercentOfRangePrefix is a prefix used to indicate, that the given value
+	// should be set to the given percentage of the normal range, e.g.: "pct:90"
+	// means the value 90% of the way from the low to the high end of the range.
+	PercentOfRangePrefix = "pct:"
 	// EmptyString is a keyword used to indicate, that the given value
 	// should be left empty.
 	EmptyString = "EMPTY"
@@ -42,6 +46,8 @@ const (
 	NumericalValueType = "NM"
 	// TextualValueType indicates that the value is textual.
 	TextualValueType = "TX"
+	// StructuredNumericValueType indicates that the value is structured numeric, e.g. a titer or a ratio.
+	StructuredNumericValueType = "SN"
 
 	// R01 is the trigger event R01.
 	R01 = "R01"
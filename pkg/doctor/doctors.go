@@ -18,13 +18,13 @@ package doctor
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"reflect"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"github.com/google/simhospital/pkg/logging"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/random"
 )
 
 var log = logging.ForCallerPackage()
@@ -112,6 +112,6 @@ func (d *Doctors) GetRandomDoctor() *message.Doctor {
 		return nil
 	}
 
-	id := rand.Intn(len(d.k))
+	id := random.Intn(len(d.k))
 	return d.m[d.k[id]]
 }
@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export writes generated messages to local directories or GCS.
+package export
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/simhospital/pkg/files"
+	"github.com/google/simhospital/pkg/message"
+	"github.com/pkg/errors"
+)
+
+// corpusFileNameFormat is the format of the names of the files written by WriteCorpus:
+// message type, trigger event and zero-padded index, e.g. ADT_A01_000123.hl7.
+const corpusFileNameFormat = "%s_%s_%06d.hl7"
+
+// WriteCorpus writes each of the messages to its own file in the directory specified by the path,
+// which can be a local directory or a GCS path.
+// The files are named after the type of the message and its index in msgs, e.g. ADT_A01_000123.hl7.
+// Local directories are created if they don't exist.
+func WriteCorpus(dir string, msgs []*message.HL7Message) error {
+	if !files.IsGCSPath(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// All the messages are written with the same Writer, so that at most one GCS client is created.
+	var w files.Writer
+	for i, m := range msgs {
+		if m == nil || m.Type == nil {
+			w.Close()
+			return fmt.Errorf("cannot write message %d: missing message type", i)
+		}
+		name := fmt.Sprintf(corpusFileNameFormat, m.Type.MessageType, m.Type.TriggerEvent, i)
+		p := strings.TrimSuffix(dir, "/") + "/" + name
+		if err := w.Write(p, []byte(m.Message)); err != nil {
+			w.Close()
+			return errors.Wrapf(err, "cannot write message %d to %s", i, p)
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/simhospital/pkg/files"
+	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/test/testwrite"
+)
+
+func TestWriteCorpus(t *testing.T) {
+	dir := filepath.Join(testwrite.TempDir(t), "corpus")
+	msgs := []*message.HL7Message{
+		{Type: &message.Type{MessageType: "ADT", TriggerEvent: "A01"}, Message: "MSH|1\rPID|1"},
+		{Type: &message.Type{MessageType: "ORU", TriggerEvent: "R01"}, Message: "MSH|2\rOBX|1"},
+		{Type: &message.Type{MessageType: "ADT", TriggerEvent: "A01"}, Message: "MSH|3\rPID|1"},
+	}
+
+	if err := WriteCorpus(dir, msgs); err != nil {
+		t.Fatalf("WriteCorpus(%q, %v) failed with %v", dir, msgs, err)
+	}
+	got, err := files.ReadAll(dir)
+	if err != nil {
+		t.Fatalf("files.ReadAll(%q) failed with %v", dir, err)
+	}
+	want := map[string][]byte{
+		"ADT_A01_000000.hl7": []byte("MSH|1\rPID|1"),
+		"ORU_R01_000001.hl7": []byte("MSH|2\rOBX|1"),
+		"ADT_A01_000002.hl7": []byte("MSH|3\rPID|1"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("files.ReadAll(%q) after WriteCorpus() diff (-want, +got):\n%s", dir, diff)
+	}
+}
+
+func TestWriteCorpus_MissingType(t *testing.T) {
+	dir := testwrite.TempDir(t)
+	msgs := []*message.HL7Message{{Message: "MSH|1"}}
+	if err := WriteCorpus(dir, msgs); err == nil {
+		t.Errorf("WriteCorpus(%q, %v) got nil error, want non-nil", dir, msgs)
+	}
+}
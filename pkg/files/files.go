@@ -1,19 +1,120 @@
 // Package files supports reading and writing files from local directories or GCS.
+//
+// Requester-pays GCS buckets are supported by setting the project to be billed for the requests,
+// either with SetGCSUserProject or with the GCS_USER_PROJECT environment variable.
 package files
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
 	"google.golang.org/api/iterator"
 )
 
-const gcsBucketPrefix = "gs://"
+const (
+	gcsBucketPrefix = "gs://"
+	// maxConcurrentReads is the maximum number of files that ReadAll reads at the same time.
+	maxConcurrentReads = 16
+	// gcsUserProjectEnvVar is the environment variable with the project to be billed for
+	// requests to GCS buckets, if SetGCSUserProject is not called.
+	gcsUserProjectEnvVar = "GCS_USER_PROJECT"
+	// DefaultGCSClientTimeout is the default maximum time to create a GCS client.
+	DefaultGCSClientTimeout = 30 * time.Second
+)
+
+var (
+	// gcsUserProject is the project set with SetGCSUserProject.
+	gcsUserProject string
+	// gcsClientTimeout is the maximum time to create a GCS client.
+	gcsClientTimeout = DefaultGCSClientTimeout
+	// listGCS lists the files in GCS with the given path as prefix. Tests replace it to avoid
+	// connecting to GCS.
+	listGCS = listGCSFiles
+)
+
+// SetGCSUserProject sets the project to be billed for requests to GCS buckets, which is
+// required to access requester-pays buckets. It takes precedence over the GCS_USER_PROJECT
+// environment variable.
+// This must be called before any files are listed or read, and not concurrently with them.
+func SetGCSUserProject(project string) {
+	gcsUserProject = project
+}
+
+// SetGCSClientTimeout sets the maximum time to create a GCS client, which includes resolving the
+// credentials. After that, listing or reading files in GCS fails instead of hanging, e.g. if the
+// environment is misconfigured. The default is DefaultGCSClientTimeout.
+// This must be called before any files are listed or read, and not concurrently with them.
+func SetGCSClientTimeout(timeout time.Duration) {
+	gcsClientTimeout = timeout
+}
+
+// newGCSClient creates a GCS client, or returns an error if the client is not created before
+// ctx is done. The caller must close the client after use.
+// The client is not created with ctx, because the client keeps using the context it was
+// created with, e.g. to refresh the credentials, and it would stop working after ctx is done.
+// If ctx is done first, the client that is eventually created is closed in the background.
+func newGCSClient(ctx context.Context) (*storage.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cannot create GCS client: %v", err)
+	}
+	type result struct {
+		c   *storage.Client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := storage.NewClient(context.Background())
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, fmt.Errorf("cannot create GCS client, check the credentials: %v", ctx.Err())
+	}
+}
+
+// gcsClient creates a GCS client with the timeout set with SetGCSClientTimeout.
+// The caller must close the client after use.
+func gcsClient() (*storage.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gcsClientTimeout)
+	defer cancel()
+	return newGCSClient(ctx)
+}
+
+// userProject returns the project to be billed for requests to GCS buckets, or an empty
+// string if none is set.
+func userProject() string {
+	if gcsUserProject != "" {
+		return gcsUserProject
+	}
+	return os.Getenv(gcsUserProjectEnvVar)
+}
+
+// gcsBucket returns the handle for the bucket with the given name, billing the requests to
+// the user project if there is one.
+func gcsBucket(c *storage.Client, name string) *storage.BucketHandle {
+	b := c.Bucket(name)
+	if p := userProject(); p != "" {
+		b = b.UserProject(p)
+	}
+	return b
+}
 
 // File represents a file, either local or remote.
 type File interface {
@@ -23,11 +124,60 @@ type File interface {
 }
 
 // List lists files in the directory specified by the path.
+// The files are sorted by name, so that the order is the same for local directories and GCS.
 func List(path string) ([]File, error) {
+	var files []File
+	var err error
 	if strings.HasPrefix(path, gcsBucketPrefix) {
-		return listGCSFiles(path)
+		files, err = listGCS(path)
+	} else {
+		files, err = listLocalFiles(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortByName(files)
+	return files, nil
+}
+
+// ListMany lists the files in all the given paths, which can be a mix of local directories and GCS
+// paths. Files that are found in more than one path, i.e., that are the same file in the same
+// directory or bucket, are only returned once. The files are sorted by name.
+func ListMany(paths []string) ([]File, error) {
+	var files []File
+	seen := map[string]bool{}
+	for _, p := range paths {
+		f, err := List(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot list files in %s", p)
+		}
+		for _, file := range f {
+			key := uniquePath(file)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			files = append(files, file)
+		}
+	}
+	sortByName(files)
+	return files, nil
+}
+
+// uniquePath returns a path that identifies f among the files of any directory or bucket.
+// The FullPath of GCS files is only the object name, so the bucket is added to it.
+func uniquePath(f File) string {
+	if g, ok := f.(gcsFile); ok {
+		return fmt.Sprintf("%s%s/%s", gcsBucketPrefix, g.bucket, g.name)
 	}
-	return listLocalFiles(path)
+	return f.FullPath()
+}
+
+// sortByName sorts the given files by name.
+func sortByName(files []File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
 }
 
 // Read reads the file specified by the path.
@@ -38,29 +188,239 @@ func Read(path string) ([]byte, error) {
 	return readLocalFile(path)
 }
 
+// ReadAll reads all files in the directory specified by the path, and returns a map from the
+// name of each file to its contents.
+// The files are read concurrently, which is notably faster than reading them one by one for
+// directories in GCS with many files.
+func ReadAll(path string) (map[string][]byte, error) {
+	f, err := List(path)
+	if err != nil {
+		return nil, err
+	}
+	return readAll(f)
+}
+
+// ReadConcat reads all files in the directory specified by the path, or all the GCS objects with
+// the path as prefix, and returns their contents concatenated in name order, separated by newlines.
+// This is useful for configs that are split across several files.
+func ReadConcat(path string) ([]byte, error) {
+	f, err := List(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := readAll(f)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([][]byte, 0, len(f))
+	for _, file := range f {
+		parts = append(parts, contents[file.Name()])
+	}
+	return bytes.Join(parts, []byte("\n")), nil
+}
+
+func readAll(files []File) (map[string][]byte, error) {
+	// GCS files are all read with the same client, instead of creating one client per file.
+	var client *storage.Client
+	for _, f := range files {
+		if _, ok := f.(gcsFile); ok {
+			c, err := gcsClient()
+			if err != nil {
+				return nil, err
+			}
+			defer c.Close()
+			client = c
+			break
+		}
+	}
+	read := func(f File) ([]byte, error) {
+		if g, ok := f.(gcsFile); ok {
+			return g.read(client)
+		}
+		return f.Read()
+	}
+
+	type result struct {
+		name    string
+		content []byte
+		err     error
+	}
+	toRead := make(chan File)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	workers := maxConcurrentReads
+	if len(files) < workers {
+		workers = len(files)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range toRead {
+				b, err := read(f)
+				if err != nil {
+					err = fmt.Errorf("cannot read file %s: %v", f.FullPath(), err)
+				}
+				results <- result{name: f.Name(), content: b, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, f := range files {
+			toRead <- f
+		}
+		close(toRead)
+		wg.Wait()
+		close(results)
+	}()
+
+	contents := make(map[string][]byte, len(files))
+	var firstErr error
+	// Drain all the results even if there are errors so that no goroutines are leaked.
+	for r := range results {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		contents[r.name] = r.content
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return contents, nil
+}
+
+// IsGCSPath returns whether the path refers to GCS, i.e., whether it starts with gs://.
+func IsGCSPath(path string) bool {
+	return strings.HasPrefix(path, gcsBucketPrefix)
+}
+
+// Write writes the content to the file specified by the path, replacing the file if it exists.
+// Use a Writer to write many files.
+func Write(path string, content []byte) error {
+	var w Writer
+	defer w.Close()
+	return w.Write(path, content)
+}
+
+// Writer writes files to local paths or GCS. The zero value is ready to use.
+// The GCS client is created the first time that a file is written to GCS and reused for all the
+// subsequent writes, so Close must be called after writing the files to release it.
+// A Writer must not be used concurrently.
+type Writer struct {
+	client *storage.Client
+}
+
+// Write writes the content to the file specified by the path, replacing the file if it exists.
+func (w *Writer) Write(path string, content []byte) error {
+	if !IsGCSPath(path) {
+		return writeLocalFile(path, content)
+	}
+	if w.client == nil {
+		c, err := gcsClient()
+		if err != nil {
+			return err
+		}
+		w.client = c
+	}
+	return writeGCSFile(w.client, path, content)
+}
+
+// Close releases the GCS client, if any. The Writer can still be used after Close.
+func (w *Writer) Close() error {
+	if w.client == nil {
+		return nil
+	}
+	err := w.client.Close()
+	w.client = nil
+	return err
+}
+
+// Exists returns whether the file specified by the path exists.
+// It returns false and no error if the file does not exist, and an error if the existence
+// of the file cannot be determined, e.g., because of insufficient permissions.
+func Exists(path string) (bool, error) {
+	if strings.HasPrefix(path, gcsBucketPrefix) {
+		return existsGCSFile(path)
+	}
+	return existsLocalFile(path)
+}
+
+func existsGCSFile(path string) (bool, error) {
+	b, name, err := parseGCSPath(path)
+	if err != nil {
+		return false, err
+	}
+	ctx := context.Background()
+	c, err := gcsClient()
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	_, err = gcsBucket(c, b).Object(name).Attrs(ctx)
+	switch {
+	case err == storage.ErrObjectNotExist:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+func writeGCSFile(c *storage.Client, path string, content []byte) error {
+	b, name, err := parseGCSPath(path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("%s does not identify a file", path)
+	}
+	ctx := context.Background()
+	w := gcsBucket(c, b).Object(name).NewWriter(ctx)
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return err
+	}
+	// The object is only created when the writer is closed successfully.
+	return w.Close()
+}
+
 func readGCSFile(path string) ([]byte, error) {
-	f, err := listGCSFiles(path)
+	c, err := gcsClient()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	f, err := listGCSObjects(c, path)
 	if err != nil {
 		return nil, err
 	}
 	if len(f) != 1 {
 		return nil, fmt.Errorf("%s does not identify a file", path)
 	}
-	return f[0].Read()
+	return f[0].(gcsFile).read(c)
 }
 
 func listGCSFiles(path string) ([]File, error) {
-	b, prefix, err := parseGCSPath(path)
+	c, err := gcsClient()
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	c, err := storage.NewClient(ctx)
+	defer c.Close()
+	return listGCSObjects(c, path)
+}
+
+func listGCSObjects(c *storage.Client, path string) ([]File, error) {
+	b, prefix, err := parseGCSPath(path)
 	if err != nil {
 		return nil, err
 	}
-	bucket := c.Bucket(b)
-	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	ctx := context.Background()
+	it := gcsBucket(c, b).Objects(ctx, &storage.Query{Prefix: prefix})
 	var files []File
 	for {
 		attrs, err := it.Next()
@@ -70,7 +430,7 @@ func listGCSFiles(path string) ([]File, error) {
 		if err != nil {
 			return nil, err
 		}
-		files = append(files, gcsFile{prefix, bucket.Object(attrs.Name)})
+		files = append(files, gcsFile{prefix: prefix, bucket: b, name: attrs.Name})
 	}
 	return files, nil
 }
@@ -87,22 +447,35 @@ func parseGCSPath(path string) (string, string, error) {
 	return p[:i], p[i+1:], nil
 }
 
+// gcsFile is a GCS object. It only holds the names of the bucket and the object, and not a
+// handle to the object, so that it does not keep a GCS client open.
 type gcsFile struct {
 	prefix string
-	object *storage.ObjectHandle
+	bucket string
+	name   string
 }
 
 func (f gcsFile) Name() string {
-	return strings.TrimPrefix(f.object.ObjectName(), fmt.Sprintf("%s/", f.prefix))
+	return strings.TrimPrefix(f.name, fmt.Sprintf("%s/", f.prefix))
 }
 
 func (f gcsFile) FullPath() string {
-	return f.object.ObjectName()
+	return f.name
 }
 
+// Read reads the object with a new GCS client, which is closed afterwards.
 func (f gcsFile) Read() ([]byte, error) {
+	c, err := gcsClient()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return f.read(c)
+}
+
+func (f gcsFile) read(c *storage.Client) ([]byte, error) {
 	ctx := context.Background()
-	r, err := f.object.NewReader(ctx)
+	r, err := gcsBucket(c, f.bucket).Object(f.name).NewReader(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +495,22 @@ func readLocalFile(path string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+func writeLocalFile(path string, content []byte) error {
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+func existsLocalFile(path string) (bool, error) {
+	_, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
 func listLocalFiles(path string) ([]File, error) {
 	dirFiles, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -0,0 +1,363 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/simhospital/pkg/test/testwrite"
+)
+
+func TestExists(t *testing.T) {
+	dir := testwrite.BytesToDir(t, []byte("content"), "file.yml")
+
+	cases := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "file", path: filepath.Join(dir, "file.yml"), want: true},
+		{name: "directory", path: dir, want: true},
+		{name: "absent file", path: filepath.Join(dir, "absent.yml"), want: false},
+		{name: "absent directory", path: filepath.Join(dir, "absent", "file.yml"), want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Exists(tc.path)
+			if err != nil {
+				t.Fatalf("Exists(%q) failed with %v", tc.path, err)
+			}
+			if got != tc.want {
+				t.Errorf("Exists(%q)=%t, want %t", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExists_PermissionError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir := testwrite.BytesToDir(t, []byte("content"), "file.yml")
+	if err := os.Chmod(dir, 0); err != nil {
+		t.Fatalf("os.Chmod(%q, 0) failed with %v", dir, err)
+	}
+	// Restore the permissions so that the directory can be cleaned up.
+	defer os.Chmod(dir, 0700)
+
+	path := filepath.Join(dir, "file.yml")
+	if got, err := Exists(path); err == nil {
+		t.Errorf("Exists(%q)=%t, <nil>, want error", path, got)
+	}
+}
+
+type fakeFile struct {
+	name    string
+	content []byte
+	err     error
+}
+
+func (f fakeFile) Read() ([]byte, error) {
+	return f.content, f.err
+}
+
+func (f fakeFile) Name() string {
+	return f.name
+}
+
+func (f fakeFile) FullPath() string {
+	return "gs://bucket/dir/" + f.name
+}
+
+func TestReadAll(t *testing.T) {
+	var files []File
+	want := map[string][]byte{}
+	// More files than workers, so that some workers read more than one file.
+	for i := 0; i < 2*maxConcurrentReads+1; i++ {
+		f := fakeFile{name: fmt.Sprintf("pathway-%d.yml", i), content: []byte(fmt.Sprintf("content %d", i))}
+		files = append(files, f)
+		want[f.name] = f.content
+	}
+
+	got, err := readAll(files)
+	if err != nil {
+		t.Fatalf("readAll(%v) failed with %v", files, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("readAll(%v) diff (-want, +got):\n%s", files, diff)
+	}
+}
+
+func TestReadAll_Empty(t *testing.T) {
+	got, err := readAll(nil)
+	if err != nil {
+		t.Fatalf("readAll(nil) failed with %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("readAll(nil)=%v, want empty", got)
+	}
+}
+
+func TestReadAll_Error(t *testing.T) {
+	files := []File{
+		fakeFile{name: "first.yml", content: []byte("first")},
+		fakeFile{name: "broken.yml", err: errors.New("broken")},
+		fakeFile{name: "second.yml", content: []byte("second")},
+	}
+	if got, err := readAll(files); err == nil {
+		t.Errorf("readAll(%v)=%v, <nil>, want error", files, got)
+	}
+}
+
+func TestReadAll_Local(t *testing.T) {
+	dir := testwrite.BytesToDir(t, []byte("first"), "first.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("second"), dir, "second.yml")
+
+	want := map[string][]byte{
+		"first.yml":  []byte("first"),
+		"second.yml": []byte("second"),
+	}
+	got, err := ReadAll(dir)
+	if err != nil {
+		t.Fatalf("ReadAll(%q) failed with %v", dir, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadAll(%q) diff (-want, +got):\n%s", dir, diff)
+	}
+}
+
+func TestList_GCSSortedByName(t *testing.T) {
+	defer func() { listGCS = listGCSFiles }()
+	gcsPath := "gs://bucket/dir"
+	// GCS iterators don't guarantee any order.
+	listGCS = func(path string) ([]File, error) {
+		if path != gcsPath {
+			return nil, fmt.Errorf("unexpected path %s", path)
+		}
+		return []File{
+			fakeFile{name: "pathway-b.yml"},
+			fakeFile{name: "pathway-c.yml"},
+			fakeFile{name: "another.yml"},
+			fakeFile{name: "pathway-a.yml"},
+		}, nil
+	}
+
+	files, err := List(gcsPath)
+	if err != nil {
+		t.Fatalf("List(%q) failed with %v", gcsPath, err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name())
+	}
+	want := []string{"another.yml", "pathway-a.yml", "pathway-b.yml", "pathway-c.yml"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List(%q) diff (-want, +got):\n%s", gcsPath, diff)
+	}
+}
+
+func TestList_Local(t *testing.T) {
+	dir := testwrite.BytesToDir(t, []byte("b"), "b.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("c"), dir, "c.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("a"), dir, "a.yml")
+
+	files, err := List(dir)
+	if err != nil {
+		t.Fatalf("List(%q) failed with %v", dir, err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name())
+	}
+	want := []string{"a.yml", "b.yml", "c.yml"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List(%q) diff (-want, +got):\n%s", dir, diff)
+	}
+}
+
+func TestListMany(t *testing.T) {
+	defer func() { listGCS = listGCSFiles }()
+	gcsPath := "gs://bucket/dir"
+	listGCS = func(path string) ([]File, error) {
+		if path != gcsPath {
+			return nil, fmt.Errorf("unexpected path %s", path)
+		}
+		return []File{fakeFile{name: "d.yml"}, fakeFile{name: "b-remote.yml"}}, nil
+	}
+	dir := testwrite.BytesToDir(t, []byte("c"), "c.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("a"), dir, "a.yml")
+
+	// The local directory is listed twice, but its files must only be returned once.
+	paths := []string{dir, gcsPath, dir}
+	files, err := ListMany(paths)
+	if err != nil {
+		t.Fatalf("ListMany(%v) failed with %v", paths, err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.FullPath())
+	}
+	want := []string{
+		filepath.Join(dir, "a.yml"),
+		"gs://bucket/dir/b-remote.yml",
+		filepath.Join(dir, "c.yml"),
+		"gs://bucket/dir/d.yml",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListMany(%v) diff (-want, +got):\n%s", paths, diff)
+	}
+}
+
+func TestListMany_SameObjectInDifferentBuckets(t *testing.T) {
+	defer func() { listGCS = listGCSFiles }()
+	listGCS = func(path string) ([]File, error) {
+		bucket, _, err := parseGCSPath(path)
+		if err != nil {
+			return nil, err
+		}
+		return []File{gcsFile{prefix: "dir", bucket: bucket, name: "dir/a.yml"}}, nil
+	}
+
+	paths := []string{"gs://first/dir", "gs://second/dir", "gs://first/dir"}
+	files, err := ListMany(paths)
+	if err != nil {
+		t.Fatalf("ListMany(%v) failed with %v", paths, err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, uniquePath(f))
+	}
+	want := []string{"gs://first/dir/a.yml", "gs://second/dir/a.yml"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListMany(%v) diff (-want, +got):\n%s", paths, diff)
+	}
+}
+
+func TestListMany_Error(t *testing.T) {
+	defer func() { listGCS = listGCSFiles }()
+	listGCS = func(path string) ([]File, error) {
+		return nil, errors.New("bucket not found")
+	}
+	dir := testwrite.BytesToDir(t, []byte("a"), "a.yml")
+
+	gcsPath := "gs://missing/dir"
+	paths := []string{dir, gcsPath}
+	got, err := ListMany(paths)
+	if err == nil {
+		t.Fatalf("ListMany(%v)=%v, <nil>, want error", paths, got)
+	}
+	if !strings.Contains(err.Error(), gcsPath) {
+		t.Errorf("ListMany(%v) got error %q, want it to contain the failing path %q", paths, err, gcsPath)
+	}
+}
+
+func TestReadConcat(t *testing.T) {
+	dir := testwrite.BytesToDir(t, []byte("b: 2"), "b.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("c: 3"), dir, "c.yml")
+	testwrite.BytesToFileInExistingDir(t, []byte("a: 1"), dir, "a.yml")
+
+	got, err := ReadConcat(dir)
+	if err != nil {
+		t.Fatalf("ReadConcat(%q) failed with %v", dir, err)
+	}
+	want := "a: 1\nb: 2\nc: 3"
+	if string(got) != want {
+		t.Errorf("ReadConcat(%q)=%q, want %q", dir, got, want)
+	}
+}
+
+func TestWrite_Local(t *testing.T) {
+	dir := testwrite.TempDir(t)
+	p := filepath.Join(dir, "file.hl7")
+
+	for _, content := range []string{"first", "second"} {
+		if err := Write(p, []byte(content)); err != nil {
+			t.Fatalf("Write(%q, %q) failed with %v", p, content, err)
+		}
+		got, err := Read(p)
+		if err != nil {
+			t.Fatalf("Read(%q) failed with %v", p, err)
+		}
+		if string(got) != content {
+			t.Errorf("Read(%q)=%q, want %q", p, got, content)
+		}
+	}
+}
+
+func TestNewGCSClient_CancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c, err := newGCSClient(ctx); err == nil {
+		t.Errorf("newGCSClient(cancelled context)=%v, <nil>, want error", c)
+	}
+}
+
+func TestSetGCSClientTimeout(t *testing.T) {
+	defer SetGCSClientTimeout(DefaultGCSClientTimeout)
+	SetGCSClientTimeout(0)
+
+	path := "gs://bucket/dir"
+	if got, err := List(path); err == nil {
+		t.Errorf("List(%q)=%v, <nil>, want error", path, got)
+	}
+	if got, err := Exists(path); err == nil {
+		t.Errorf("Exists(%q)=%t, <nil>, want error", path, got)
+	}
+}
+
+func TestUserProject(t *testing.T) {
+	original, ok := os.LookupEnv(gcsUserProjectEnvVar)
+	defer func() {
+		SetGCSUserProject("")
+		if ok {
+			os.Setenv(gcsUserProjectEnvVar, original)
+		} else {
+			os.Unsetenv(gcsUserProjectEnvVar)
+		}
+	}()
+
+	cases := []struct {
+		name   string
+		env    string
+		setter string
+		want   string
+	}{
+		{name: "none", want: ""},
+		{name: "environment variable", env: "env-project", want: "env-project"},
+		{name: "setter", setter: "setter-project", want: "setter-project"},
+		{name: "setter takes precedence", env: "env-project", setter: "setter-project", want: "setter-project"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env == "" {
+				os.Unsetenv(gcsUserProjectEnvVar)
+			} else {
+				os.Setenv(gcsUserProjectEnvVar, tc.env)
+			}
+			SetGCSUserProject(tc.setter)
+
+			if got := userProject(); got != tc.want {
+				t.Errorf("userProject()=%q, want %q", got, tc.want)
+			}
+		})
+	}
+}
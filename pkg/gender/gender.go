@@ -16,10 +16,9 @@
 package gender
 
 import (
-	"math/rand"
-
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // Internal is an internal representation of the gender.
@@ -37,7 +36,7 @@ const (
 // Random generates a random gender from the options of Male or Female
 // with equal probability.
 func Random() Internal {
-	switch rand.Intn(2) {
+	switch random.Intn(2) {
 	case 0:
 		return Male
 	default:
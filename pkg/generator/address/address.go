@@ -17,11 +17,11 @@ package address
 
 import (
 	"fmt"
-	"math/rand"
 	"strings"
 
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // Generator is a generator of addresses.
@@ -64,30 +64,30 @@ func (g *Generator) Random() *message.Address {
 		Type:       "HOME",
 	}
 
-	if rand.Intn(2) == 0 {
+	if random.Intn(2) == 0 {
 		// 1 line address
-		a.FirstLine = fmt.Sprintf("%d %s %s", rand.Intn(200)+1, strings.Title(g.noun()), g.street())
+		a.FirstLine = fmt.Sprintf("%d %s %s", random.Intn(200)+1, strings.Title(g.noun()), g.street())
 	} else {
 		// 2 lines address
-		a.FirstLine = fmt.Sprintf("%d %s House", rand.Intn(100)+1, strings.Title(g.noun()))
+		a.FirstLine = fmt.Sprintf("%d %s House", random.Intn(100)+1, strings.Title(g.noun()))
 		a.SecondLine = fmt.Sprintf("%s %s", strings.Title(g.noun()), g.street())
 	}
 	return a
 }
 
 func (g *Generator) city() string {
-	return random(g.Address.Cities)
+	return randomItem(g.Address.Cities)
 }
 
 func (g *Generator) street() string {
-	return random(g.Address.Streets)
+	return randomItem(g.Address.Streets)
 }
 
 func (g *Generator) noun() string {
-	return random(g.Nouns)
+	return randomItem(g.Nouns)
 }
 
-// random returns a random item from the given slice.
-func random(s []string) string {
-	return s[rand.Intn(len(s))]
+// randomItem returns a random item from the given slice.
+func randomItem(s []string) string {
+	return s[random.Intn(len(s))]
 }
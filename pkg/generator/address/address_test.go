@@ -16,15 +16,15 @@ package address
 
 import (
 	"math"
-	"math/rand"
 	"strings"
 	"testing"
 
 	"github.com/google/simhospital/pkg/config"
+	"github.com/google/simhospital/pkg/random"
 )
 
 func TestRandom(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	cities := []string{"London", "Cambridge"}
 	types := []string{"HOME"}
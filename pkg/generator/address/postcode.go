@@ -16,7 +16,8 @@ package address
 
 import (
 	"fmt"
-	"math/rand"
+
+	"github.com/google/simhospital/pkg/random"
 )
 
 // UKPostcode is a generator of UK postcodes.
@@ -31,11 +32,11 @@ type UKPostcode struct{}
 //
 // The returned postcode might exist or not.
 func (g *UKPostcode) Random() string {
-	return fmt.Sprintf("%s%s%d %d%s%s", randomLetter(), randomLetter(), rand.Intn(99)+1, rand.Intn(9)+1, randomLetter(), randomLetter())
+	return fmt.Sprintf("%s%s%d %d%s%s", randomLetter(), randomLetter(), random.Intn(99)+1, random.Intn(9)+1, randomLetter(), randomLetter())
 }
 
 func randomLetter() string {
-	return string(rand.Intn(int('Z')-int('A')) + int('A'))
+	return string(random.Intn(int('Z')-int('A')) + int('A'))
 }
 
 // USPostcode is a generator of US zipcodes.
@@ -52,7 +53,7 @@ func (g *USPostcode) Random() string {
 	chars := []rune("1234567890")
 	udn := make([]rune, 5)
 	for i := range udn {
-		udn[i] = chars[rand.Intn(len(chars))]
+		udn[i] = chars[random.Intn(len(chars))]
 	}
 	return string(udn)
 }
@@ -15,13 +15,14 @@
 package address
 
 import (
-	"math/rand"
 	"regexp"
 	"testing"
+
+	"github.com/google/simhospital/pkg/random"
 )
 
 func TestRandomPostcode(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	tests := []struct {
 		name string
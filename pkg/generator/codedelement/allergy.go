@@ -15,12 +15,11 @@
 package codedelement
 
 import (
-	"math/rand"
-
 	"github.com/google/simhospital/pkg/clock"
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // AllergyGenerator provides functionality to generate an allergy.
@@ -49,12 +48,12 @@ func (g *AllergyGenerator) DeriveCodingSystem(config config.HL7Allergy, a pathwa
 
 // randomSeverity returns a random severity value, where each value has an equal probability to be selected.
 func (g *AllergyGenerator) randomSeverity() string {
-	return g.severities[rand.Intn(len(g.severities))]
+	return g.severities[random.Intn(len(g.severities))]
 }
 
 // randomReaction returns a random reaction value, where each value has an equal probability to be selected.
 func (g *AllergyGenerator) randomReaction() string {
-	return g.reactions[rand.Intn(len(g.reactions))]
+	return g.reactions[random.Intn(len(g.reactions))]
 }
 
 // randomIdentificationDateTime returns a random identification datetime.
@@ -67,11 +66,11 @@ func (g *AllergyGenerator) randomIdentificationDateTime() message.NullTime {
 // After that, the final number of items is picked randomly between 1 to maxAllergies (both inclusive).
 func (g *AllergyGenerator) GenerateRandomDistinctAllergies() []*message.Allergy {
 	var generatedAllergies []*message.Allergy
-	ra := rand.Intn(100)
+	ra := random.Intn(100)
 	if ra >= g.percentage {
 		return generatedAllergies
 	}
-	allergyCount := rand.Intn(g.maxAllergies) + 1
+	allergyCount := random.Intn(g.maxAllergies) + 1
 	selectedCodes := map[string]bool{}
 	for len(generatedAllergies) < allergyCount {
 		a := g.Random()
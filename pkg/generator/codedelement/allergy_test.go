@@ -16,12 +16,12 @@ package codedelement
 
 import (
 	"math"
-	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test"
 	"github.com/google/simhospital/pkg/test/testclock"
 	"github.com/google/simhospital/pkg/test/testdate"
@@ -53,7 +53,7 @@ func TestAllergyGenerator_RandomNoItems(t *testing.T) {
 }
 
 func TestAllergyGenerator_Random(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	fName := testwrite.BytesToFile(t, []byte(`
 J30.1,Allergy1,59
 J45.0,Allergy2,2556
@@ -16,13 +16,13 @@
 package codedelement
 
 import (
-	"math/rand"
 	"time"
 
 	"github.com/google/simhospital/pkg/clock"
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/sample"
 )
 
@@ -91,7 +91,7 @@ func (g *Generator) Random() *message.CodedElement {
 
 // RandomType returns a random type value, where each value has an equal probability to be selected.
 func (g *Generator) RandomType() string {
-	return g.types[rand.Intn(len(g.types))]
+	return g.types[random.Intn(len(g.types))]
 }
 
 // DeriveCodeAndDescription returns underlying CodeDescriptionMapping.
@@ -142,7 +142,7 @@ type SimpleDateGenerator struct{}
 
 // Random returns a random time, up to a year ago based on the given time.
 func (s SimpleDateGenerator) Random(now time.Time) message.NullTime {
-	days := rand.Int63n(364) + 1
+	days := random.Int63n(364) + 1
 	timeFromNow := -time.Duration(days) * 24 * time.Hour
 	return message.NewValidTime(now.Add(timeFromNow))
 }
@@ -16,7 +16,6 @@ package codedelement
 
 import (
 	"math"
-	"math/rand"
 	"testing"
 	"time"
 
@@ -24,6 +23,7 @@ import (
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test"
 	"github.com/google/simhospital/pkg/test/testclock"
 	"github.com/google/simhospital/pkg/test/testdate"
@@ -31,7 +31,7 @@ import (
 )
 
 func TestDiagOrProcGenerator_Random(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	diagnosisFilename := testwrite.BytesToFile(t, []byte(`
 A01.1,Diagnosis1,1
 A02.1,Diagnosis2,1
@@ -174,7 +174,7 @@ P04.1,Procedure4,1
 }
 
 func TestDiagOrProcGenerator_Random_EmptyFile_NoDate(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	emptyFilename := testwrite.BytesToFile(t, []byte(``))
 
@@ -16,13 +16,13 @@
 package document
 
 import (
-	"math/rand"
 	"time"
 
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/generator/text"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 )
 
 const (
@@ -62,7 +62,7 @@ func (g *Generator) Document(eventTime time.Time, d *pathway.Document) *message.
 	cs := obsCS
 
 	if docType == "" {
-		docType = g.DocumentConfig.Types[rand.Intn(len(g.DocumentConfig.Types))]
+		docType = g.DocumentConfig.Types[random.Intn(len(g.DocumentConfig.Types))]
 	}
 	if status == "" {
 		status = completionStatusDocumented
@@ -115,7 +115,7 @@ func (g *Generator) content(d *pathway.Document) []string {
 func randomUniqueDocumentNumber() string {
 	udn := make([]rune, udnLength)
 	for i := range udn {
-		udn[i] = chars[rand.Intn(len(chars))]
+		udn[i] = chars[random.Intn(len(chars))]
 	}
 	return string(udn)
 }
@@ -16,7 +16,6 @@ package document
 
 import (
 	"math"
-	"math/rand"
 	"testing"
 	"time"
 
@@ -25,6 +24,7 @@ import (
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test/testtext"
 )
 
@@ -123,7 +123,7 @@ func TestDocument_RandomDocumentTypeDoesntModifyInput(t *testing.T) {
 }
 
 func TestDocument_RandomDocumentType(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	g := Generator{DocumentConfig: &HL7Document, TextGenerator: textGenerator}
 	runs := float64(1000)
 	docTypeDistr := map[string]int{}
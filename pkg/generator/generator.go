@@ -25,7 +25,6 @@ package generator
 
 import (
 	"fmt"
-	"math/rand"
 	"time"
 
 	"github.com/google/simhospital/pkg/clock"
@@ -46,6 +45,7 @@ import (
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/orderprofile"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/state"
 )
 
@@ -54,7 +54,7 @@ var log = logging.ForCallerPackage()
 type randomIDGenerator struct{}
 
 func (g *randomIDGenerator) NewID() string {
-	return fmt.Sprintf("%d", rand.Uint32())
+	return fmt.Sprintf("%d", random.Uint32())
 }
 
 // Generator implements functionality to generate various patient related information based on the information provided
@@ -195,9 +195,9 @@ func (g Generator) AddAllergies(patientInfo *message.PatientInfo, allergies []pa
 // the list, as there is no way of deleting / amending existing pathwayAllergies.
 func (g Generator) getDedupedAllergiesFromPathway(patientInfo *message.PatientInfo, pathwayAllergies []pathway.Allergy) []*message.Allergy {
 	var dedupedAllergies []*message.Allergy
-	existing := make(map[message.Allergy]bool)
+	existing := make(map[string]bool)
 	for _, a := range patientInfo.Allergies {
-		existing[*a] = true
+		existing[allergyKey(a)] = true
 	}
 
 	for _, a := range pathwayAllergies {
@@ -213,16 +213,23 @@ func (g Generator) getDedupedAllergiesFromPathway(patientInfo *message.PatientIn
 			},
 			Severity:               a.Severity,
 			Reaction:               a.Reaction,
+			Reactions:              a.Reactions,
 			IdentificationDateTime: idt,
 		}
-		if !existing[*allergy] {
-			existing[*allergy] = true
+		if key := allergyKey(allergy); !existing[key] {
+			existing[key] = true
 			dedupedAllergies = append(dedupedAllergies, allergy)
 		}
 	}
 	return dedupedAllergies
 }
 
+// allergyKey returns a key that uniquely identifies the given allergy, to be used for deduplication.
+// message.Allergy cannot be used as a map key directly because it contains a slice.
+func allergyKey(a *message.Allergy) string {
+	return fmt.Sprintf("%+v", *a)
+}
+
 func (g Generator) setDiagnoses(patientInfo *message.PatientInfo, diagnoses []*pathway.DiagnosisOrProcedure) {
 	patientInfo.Diagnoses = make([]*message.DiagnosisOrProcedure, len(diagnoses))
 	g.setDiagnosesOrProcedures(patientInfo.Diagnoses, diagnoses, g.diagnosisGenerator)
@@ -267,7 +274,7 @@ func (g Generator) SetResults(o *message.Order, r *pathway.Results, eventTime ti
 
 // NewVisitID generates a new visit identifier.
 func (g Generator) NewVisitID() uint64 {
-	return rand.Uint64()
+	return random.Uint64()
 }
 
 // NewHeader returns a new header for the given step.
@@ -284,6 +291,7 @@ func (g Generator) NewDocument(eventTime time.Time, d *pathway.Document) *messag
 type Config struct {
 	Clock            clock.Clock
 	HL7Config        *config.HL7Config
+	MessageOptions   *message.Options
 	Header           *config.Header
 	AddressGenerator person.AddressGenerator
 	MRNGenerator     id.Generator
@@ -339,13 +347,14 @@ func NewGenerator(cfg Config) *Generator {
 		Clock:              cfg.Clock,
 		NameGenerator:      &names.Generator{Data: cfg.Data},
 		GenderConvertor:    gender.NewConvertor(cfg.HL7Config),
-		EthnicityGenerator: person.NewEthnicityGenerator(cfg.Data),
+		EthnicityGenerator: person.NewEthnicityGeneratorWithConfig(cfg.Data, cfg.HL7Config),
 		AddressGenerator:   ag,
 		MRNGenerator:       mrnGenerator,
 	}
 
 	orderGenerator := &order.Generator{
 		MessageConfig:         cfg.HL7Config,
+		MessageOptions:        cfg.MessageOptions,
 		OrderProfiles:         cfg.OrderProfiles,
 		NoteGenerator:         ng,
 		PlacerGenerator:       placerGenerator,
@@ -16,7 +16,6 @@ package generator
 
 import (
 	"math"
-	"math/rand"
 	"testing"
 	"time"
 
@@ -29,6 +28,7 @@ import (
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/orderprofile"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/state"
 	"github.com/google/simhospital/pkg/test"
 	"github.com/google/simhospital/pkg/test/testaddress"
@@ -1153,7 +1153,7 @@ func TestNewDocument(t *testing.T) {
 }
 
 func TestNewRegistrationPatientClassAndTypeRandom(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	fPatientClass := testwrite.BytesToFile(t, []byte(`
 EMERGENCY,EMERGENCY,1
@@ -1200,7 +1200,7 @@ RECURRING,RECURRING,5
 }
 
 func TestNewVisitID(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	g := testGenerator(t, Config{})
 
@@ -1213,7 +1213,7 @@ func TestNewVisitID(t *testing.T) {
 }
 
 func TestNewHeader(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	g := testGenerator(t, Config{})
 
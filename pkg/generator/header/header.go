@@ -41,6 +41,8 @@ func (g *Generator) NewHeader(step *pathway.Step) *message.HeaderInfo {
 		SendingFacility:      header.SendingFacility,
 		SendingApplication:   header.SendingApplication,
 		MessageControlID:     g.MsgCtrlGen.NewMessageControlID(),
+		ControlIDGenerator:   g.MsgCtrlGen,
+		CountryCode:          header.CountryCode,
 	}
 	params := step.Parameters
 	if params == nil {
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/Sirupsen/logrus"
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/logging"
@@ -255,9 +256,13 @@ oru:
 		t.Run(tc.name, func(t *testing.T) {
 			g := &Generator{Header: headerCFG, MsgCtrlGen: &MessageControlGenerator{}}
 
-			if diff := cmp.Diff(tc.want, g.NewHeader(tc.step)); diff != "" {
+			got := g.NewHeader(tc.step)
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(message.HeaderInfo{}, "ControlIDGenerator")); diff != "" {
 				t.Errorf("NewHeader(%v) got diff (-want, +got):\n%s ", tc.step, diff)
 			}
+			if got.ControlIDGenerator != g.MsgCtrlGen {
+				t.Errorf("NewHeader(%v).ControlIDGenerator=%v, want %v", tc.step, got.ControlIDGenerator, g.MsgCtrlGen)
+			}
 		})
 	}
 }
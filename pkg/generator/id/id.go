@@ -15,7 +15,30 @@
 // Package id provides the functionality to generate identifiers.
 package id
 
+import (
+	"fmt"
+
+	"github.com/google/simhospital/pkg/random"
+)
+
 // Generator is an interface to generate identifiers.
 type Generator interface {
 	NewID() string
 }
+
+// UUIDGenerator is a Generator that returns random (version 4) UUIDs, e.g.
+// "8f14e45f-ceea-467a-9575-7c1e4e5e5a2b".
+// It can be used for placer and filler numbers, so that the identifiers assigned by
+// different systems never collide.
+// The UUIDs are generated from the shared source of randomness, so they are reproducible
+// with random.Seed.
+type UUIDGenerator struct{}
+
+// NewID returns a new random UUID.
+func (g *UUIDGenerator) NewID() string {
+	var b [16]byte
+	random.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4.
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant RFC 4122.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
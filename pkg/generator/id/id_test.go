@@ -0,0 +1,37 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package id
+
+import (
+	"regexp"
+	"testing"
+)
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestUUIDGenerator(t *testing.T) {
+	g := &UUIDGenerator{}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		got := g.NewID()
+		if !uuidRegex.MatchString(got) {
+			t.Errorf("NewID()=%q, want a version 4 UUID", got)
+		}
+		if seen[got] {
+			t.Errorf("NewID()=%q was already generated, want unique IDs", got)
+		}
+		seen[got] = true
+	}
+}
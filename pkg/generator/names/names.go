@@ -16,10 +16,9 @@
 package names
 
 import (
-	"math/rand"
-
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/gender"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // Generator is a generator of names.
@@ -31,9 +30,9 @@ type Generator struct {
 func (g Generator) Prefix(gen gender.Internal) string {
 	switch gen {
 	case gender.Male:
-		return random(g.Data.PatientName.MalePrefixes)
+		return randomItem(g.Data.PatientName.MalePrefixes)
 	case gender.Female:
-		return random(g.Data.PatientName.FemalePrefixes)
+		return randomItem(g.Data.PatientName.FemalePrefixes)
 	default:
 		return ""
 	}
@@ -53,7 +52,7 @@ func (g Generator) FirstName(gen gender.Internal, year int) string {
 
 // MiddleName returns a random middle name based on the given gender.
 func (g Generator) MiddleName(gen gender.Internal) string {
-	if rand.Intn(100) < g.Data.PatientName.MiddlenamePercentage {
+	if random.Intn(100) < g.Data.PatientName.MiddlenamePercentage {
 		switch gen {
 		case gender.Male:
 			return randomName(g.Data.FirstNames.Boys)
@@ -76,21 +75,21 @@ func (g Generator) Degree() string {
 
 // Surname returns a random surname.
 func (g Generator) Surname() string {
-	return random(g.Data.Surnames)
+	return randomItem(g.Data.Surnames)
 }
 
 // randomWithProb returns a random item from the slice with the probability p/100, where p is an int between [0, 100),
 // or an empty string otherwise.
 func randomWithProb(s []string, p int) string {
-	if rand.Intn(100) < p {
-		return random(s)
+	if random.Intn(100) < p {
+		return randomItem(s)
 	}
 	return ""
 }
 
-// random returns a random item from the slice.
-func random(s []string) string {
-	return s[rand.Intn(len(s))]
+// randomItem returns a random item from the slice.
+func randomItem(s []string) string {
+	return s[random.Intn(len(s))]
 }
 
 // randomByYear returns a random name from the set of Names which were popular among people born in a given year.
@@ -110,10 +109,10 @@ func randomByYear(n *config.Names, year int) string {
 			break
 		}
 	}
-	return n.ByYear[censusYear][rand.Intn(len(n.ByYear[censusYear]))]
+	return n.ByYear[censusYear][random.Intn(len(n.ByYear[censusYear]))]
 }
 
 // randomName returns a random name. Each name has the same probability to be returned.
 func randomName(n *config.Names) string {
-	return n.All[rand.Intn(len(n.All))]
+	return n.All[random.Intn(len(n.All))]
 }
@@ -20,7 +20,6 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -30,6 +29,7 @@ import (
 	"github.com/google/simhospital/pkg/generator/text"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 )
 
 const (
@@ -131,7 +131,7 @@ func (g *Generator) contentAndEncoding(contentType string, documentContent strin
 // 0.1 - 2 notes
 // Each note has between 1 - 10 random words.
 func (g *Generator) RandomNotesForResult() []string {
-	switch r := rand.Intn(10); {
+	switch r := random.Intn(10); {
 	case r < 4:
 		return nil
 	case r < 9:
@@ -146,7 +146,7 @@ func (g *Generator) note(contentType string) ([]byte, error) {
 	if !ok || len(notes) == 0 {
 		return nil, fmt.Errorf("no sample Notes found for %s ContentType: ContentType not supported", contentType)
 	}
-	clinicalNote := notes[rand.Intn(len(notes))]
+	clinicalNote := notes[random.Intn(len(notes))]
 	return ioutil.ReadFile(clinicalNote.Path)
 }
 
@@ -157,7 +157,7 @@ func (g *Generator) id(currID string) string {
 	}
 	var buffer bytes.Buffer
 	for i := 0; i < 10; i++ {
-		buffer.WriteString(strconv.Itoa(rand.Intn(10)))
+		buffer.WriteString(strconv.Itoa(random.Intn(10)))
 	}
 	return fmt.Sprintf("random-%v", buffer.String())
 }
@@ -168,5 +168,5 @@ func (g *Generator) documentType(currType string) string {
 	if currType != "" {
 		return currType
 	}
-	return g.types[rand.Intn(len(g.types))]
+	return g.types[random.Intn(len(g.types))]
 }
@@ -18,7 +18,6 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math"
-	"math/rand"
 	"strings"
 	"testing"
 	"time"
@@ -28,6 +27,7 @@ import (
 	"github.com/google/simhospital/pkg/generator/text"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test/testwrite"
 )
 
@@ -53,7 +53,7 @@ type tuple struct {
 }
 
 func TestRandomDocumentForClinicalNote(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	nc, fc := testSetup(t)
 	g := &Generator{
 		textGenerator: &text.NounGenerator{Nouns: nouns},
@@ -299,7 +299,7 @@ func TestRandomDocumentForClinicalNote(t *testing.T) {
 }
 
 func TestRandomNotesForResult(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	g := Generator{textGenerator: &text.NounGenerator{Nouns: nouns}}
 	runs := float64(1000)
 	runsWithNotes := float64(0)
@@ -369,7 +369,7 @@ func TestRandomInvalidContentTypeError(t *testing.T) {
 }
 
 func TestRandomUniformDistribution(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	nc, fc := testSetup(t)
 	g := &Generator{
 		textGenerator: &text.NounGenerator{Nouns: nouns},
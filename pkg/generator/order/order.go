@@ -43,6 +43,7 @@ type NotesGenerator interface {
 // Generator is a generator of orders and results.
 type Generator struct {
 	MessageConfig         *config.HL7Config
+	MessageOptions        *message.Options
 	OrderProfiles         *orderprofile.OrderProfiles
 	NoteGenerator         NotesGenerator
 	PlacerGenerator       id.Generator
@@ -58,7 +59,7 @@ func (g Generator) NewOrder(o *pathway.Order, eventTime time.Time) *message.Orde
 		orderStatus = g.MessageConfig.OrderStatus.InProcess
 	}
 	return &message.Order{
-		OrderProfile:  g.OrderProfiles.Generate(o.OrderProfile),
+		OrderProfile:  g.orderProfile(o.OrderProfile),
 		Placer:        g.PlacerGenerator.NewID(),
 		OrderDateTime: message.NewValidTime(eventTime),
 		OrderControl:  g.MessageConfig.OrderControl.New,
@@ -66,9 +67,20 @@ func (g Generator) NewOrder(o *pathway.Order, eventTime time.Time) *message.Orde
 	}
 }
 
+// orderProfile returns the CodedElement for the order profile with the given name.
+// Order profiles that are not defined in the configuration are given the configured UnknownCodingSystem.
+func (g Generator) orderProfile(name string) *message.CodedElement {
+	ce := g.OrderProfiles.Generate(name)
+	if _, ok := g.OrderProfiles.Get(name); !ok && name != constants.RandomString {
+		ce.CodingSystem = g.MessageConfig.UnknownCodingSystem
+	}
+	return ce
+}
+
 // OrderWithClinicalNote updates an order with a Clinical Note. If the supplied order is nil, a new order is created.
 // This order will contain a single result with the Clinical Note generated/updated based on the pathway.
-// The DiagnosticServID section is set to DiagnosticServIDMDOC, which indicates that the corresponding HL7 is a Clinical Note.
+// IsClinicalNote is set, which indicates that the corresponding HL7 is a Clinical Note, and the DiagnosticServID
+// section is set to DiagnosticServIDMDOC.
 func (g Generator) OrderWithClinicalNote(order *message.Order, n *pathway.ClinicalNote, eventTime time.Time) (*message.Order, error) {
 	var existingNote *message.ClinicalNote
 	if order != nil {
@@ -91,6 +103,7 @@ func (g Generator) OrderWithClinicalNote(order *message.Order, n *pathway.Clinic
 			ResultsStatus:    g.MessageConfig.DocumentStatus.Authenticated,
 			OrderingProvider: g.Doctors.GetRandomDoctor(),
 			DiagnosticServID: message.DiagnosticServIDMDOC,
+			IsClinicalNote:   true,
 		}
 	}
 
@@ -110,13 +123,19 @@ func (g Generator) OrderWithClinicalNote(order *message.Order, n *pathway.Clinic
 //
 // If the Order already has the Results, they are replaced with Results from the pathway as the corrected results,
 // unless another status is explicitly specified in the pathway.
-// In the case of correction, only results specified in the pathway are included.
+// In the case of correction, only results specified in the pathway are included, unless
+// pathway.Results.AppendCorrection is set, in which case the corrected results are appended
+// to the existing ones.
 func (g Generator) SetResults(o *message.Order, r *pathway.Results, eventTime time.Time) (*message.Order, error) {
 	if o == nil {
 		o = g.NewOrder(&pathway.Order{OrderProfile: r.OrderProfile}, eventTime)
 	}
 	if o.Filler == "" {
 		o.Filler = g.FillerGenerator.NewID()
+		if o.Filler == o.Placer {
+			log.WithField("placer", o.Placer).
+				Warning("Generated filler number is the same as the placer number; use distinct PlacerGenerator and FillerGenerator to tell them apart")
+		}
 	}
 
 	g.setOrderStatuses(o, r)
@@ -208,8 +227,20 @@ func (g Generator) setOrderDates(o *message.Order, r *pathway.Results, eventTime
 //   is included for each test type specified in the Order Profile.
 // Otherwise, if the results are defined for non-existing order profile, then
 // only results specified explicitly are included.
+// If r.AppendCorrection is set, the existing results of the order are kept and the new results
+// are appended after them. NumberOfPreviousResults is decreased by the number of OBX segments of the
+// existing results, so that they keep their original OBX SetIDs and the new results get the subsequent ones.
 func (g Generator) setOrderResults(o *message.Order, r *pathway.Results) error {
-	o.Results = make([]*message.Result, 0)
+	var previous []*message.Result
+	if r.AppendCorrection {
+		previous = o.Results
+		o.NumberOfPreviousResults -= message.NumberOfOBXSegments(g.MessageOptions, previous)
+		if o.NumberOfPreviousResults < 0 {
+			// This can happen if the previous results were sent with ExpectCorrection and never counted.
+			o.NumberOfPreviousResults = 0
+		}
+	}
+	o.Results = append(make([]*message.Result, 0, len(previous)), previous...)
 	opName := o.OrderProfile.Text
 	op, ok := g.OrderProfiles.Get(opName)
 
@@ -296,12 +327,18 @@ func (g Generator) testResult(op *orderprofile.OrderProfile, pathwayResult *path
 		return nil, fmt.Errorf("Test name %q not found in order profile", pathwayResult.TestName)
 	}
 	// Set defaults for Test Type.
-	result.TestName = &tt.Name
+	testName := tt.Name
+	result.TestName = &testName
 	result.ValueType = tt.ValueType
 	result.Range = tt.RefRange
 	if pathwayResult.ID != "" {
 		result.TestName.ID = pathwayResult.ID
 	}
+	if ac, ok := g.MessageConfig.AlternateCodes[tt.Name.ID]; ok {
+		result.TestName.AlternateID = ac.ID
+		result.TestName.AlternateText = tt.Name.Text
+		result.TestName.AlternateCodingSystem = ac.CodingSystem
+	}
 
 	if err := g.setTestResultValue(result, pathwayResult, tt); err != nil {
 		return nil, errors.Wrap(err, "cannot set the value on the result")
@@ -315,7 +352,7 @@ func (g Generator) updateResultForCustomOrderProfile(result *message.Result, pat
 	if id == "" {
 		id = pathwayResult.TestName
 	}
-	result.TestName = &message.CodedElement{ID: id, Text: pathwayResult.TestName}
+	result.TestName = &message.CodedElement{ID: id, Text: pathwayResult.TestName, CodingSystem: g.MessageConfig.UnknownCodingSystem}
 	result.ValueType = pathwayResult.GetValueType()
 
 	switch {
@@ -325,6 +362,12 @@ func (g Generator) updateResultForCustomOrderProfile(result *message.Result, pat
 		}
 		return nil
 
+	case pathwayResult.IsValuePercentOfRange() && pathwayResult.ReferenceRange != "":
+		if err := g.setPercentOfRangeValue(result, pathwayResult, pathwayResult.ReferenceRange, pathwayResult.Unit); err != nil {
+			return errors.Wrap(err, "cannot generate percent of range value from custom reference range")
+		}
+		return nil
+
 	default:
 		af, err := pathwayResult.GetAbnormalFlag(nil)
 		if err != nil {
@@ -345,6 +388,9 @@ func (g Generator) updateResultForCustomOrderProfile(result *message.Result, pat
 // If the value of the results is set to random but the reference range is not
 // specified in the pathway, then the value is generated based on that reference range
 // specified in the TestType.
+// If the value of the results is set to a percent of range, e.g. "pct:90", the value is
+// derived deterministically from the reference range specified in the pathway or, if not
+// specified, from the reference range specified in the TestType.
 // Otherwise, if the value is explicitly set in the pathway, it is being used.
 func (g Generator) setTestResultValue(result *message.Result, pathwayResult *pathway.Result, tt *orderprofile.TestType) error {
 	switch {
@@ -356,6 +402,14 @@ func (g Generator) setTestResultValue(result *message.Result, pathwayResult *pat
 		// Generate random value from the order profile's reference range.
 		return g.setRandomValueBasedOnOrderProfileReferenceRange(result, pathwayResult, tt)
 
+	case pathwayResult.IsValuePercentOfRange() && pathwayResult.ReferenceRange != "":
+		// Derive the value from the custom reference range.
+		return g.setPercentOfRangeValue(result, pathwayResult, pathwayResult.ReferenceRange, pathwayResult.Unit)
+
+	case pathwayResult.IsValuePercentOfRange() && pathwayResult.ReferenceRange == "":
+		// Derive the value from the order profile's reference range.
+		return g.setPercentOfRangeValue(result, pathwayResult, tt.RefRange, tt.Unit)
+
 	default:
 		// Use values specified in the pathway.
 		return g.setValueSpecifiedInThePathway(result, pathwayResult, tt)
@@ -395,13 +449,37 @@ func (g Generator) setRandomValueBasedOnOrderProfileReferenceRange(result *messa
 	return nil
 }
 
+// setPercentOfRangeValue sets the value on the result to the percentage of refRange given
+// in the pathway result. The value is always within the range, so the abnormal flag is empty.
+func (g Generator) setPercentOfRangeValue(result *message.Result, pathwayResult *pathway.Result, refRange string, unit string) error {
+	pct, err := pathwayResult.GetPercentOfRange()
+	if err != nil {
+		return errors.Wrap(err, "cannot get percent of range for result")
+	}
+	vg, err := orderprofile.ValueGeneratorFromRange(refRange)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create value generator for reference range %q", refRange)
+	}
+	v, err := vg.PercentOfRange(pct)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate %v%% of reference range %q", pct, refRange)
+	}
+	result.Value = v
+	result.ValueType = constants.NumericalValueType
+	result.Unit = unit
+	result.Range = refRange
+	result.AbnormalFlag = g.AbnormalFlagConvertor.ToHL7(constants.AbnormalFlagEmpty)
+	return nil
+}
+
 func (g Generator) setValueSpecifiedInThePathway(result *message.Result, pathwayResult *pathway.Result, tt *orderprofile.TestType) error {
 	result.Value = pathwayResult.GetValue()
 	result.Unit = pathwayResult.GetUnit()
 	// It's not always possible to derive the type from the value, e.g., a value of an empty string doesn't necessarily mean
 	// that the type is textual: value="" and valueType="NM" is a valid case. In that case, default to the type from the order profile.
 	// Also default to the order profile one if both value types are textual, as we assume that the order profile is more precise.
-	if vt := pathwayResult.GetValueType(); vt != "" && (vt == constants.NumericalValueType || tt.ValueType == constants.NumericalValueType) {
+	// A value type explicitly set in the pathway always takes precedence.
+	if vt := pathwayResult.GetValueType(); vt != "" && (pathwayResult.ValueType != "" || vt == constants.NumericalValueType || tt.ValueType == constants.NumericalValueType) {
 		result.ValueType = vt
 	}
 	if pathwayResult.ReferenceRange != "" {
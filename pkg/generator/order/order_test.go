@@ -24,6 +24,7 @@ import (
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/doctor"
+	"github.com/google/simhospital/pkg/generator/id"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/orderprofile"
 	"github.com/google/simhospital/pkg/pathway"
@@ -195,6 +196,7 @@ func TestOrderWithClinicalNote(t *testing.T) {
 				},
 				ResultsStatus:    "AUTHVRF",
 				DiagnosticServID: "MDOC",
+				IsClinicalNote:   true,
 				OrderingProvider: singleDoctor,
 			},
 		}, {
@@ -293,6 +295,72 @@ func TestOrderWithClinicalNote(t *testing.T) {
 	}
 }
 
+func TestSetResults_DistinctPlacerAndFiller(t *testing.T) {
+	g, _ := testGenerator(t)
+	g.PlacerGenerator = &id.UUIDGenerator{}
+	g.FillerGenerator = &id.UUIDGenerator{}
+
+	o := g.NewOrder(&pathway.Order{OrderProfile: "UREA AND ELECTROLYTES"}, eventTime)
+	r := &pathway.Results{
+		OrderProfile: "UREA AND ELECTROLYTES",
+		Results: []*pathway.Result{{
+			TestName: "Creatinine",
+			Value:    "52",
+			Unit:     "UMOLL",
+		}},
+	}
+	got, err := g.SetResults(o, r, eventTime)
+	if err != nil {
+		t.Fatalf("SetResults(%+v, %+v, %v) failed with %v", o, r, eventTime, err)
+	}
+	if got.Placer == "" || got.Filler == "" {
+		t.Fatalf("SetResults(%+v, %+v, %v) got Placer=%q, Filler=%q, want both set", o, r, eventTime, got.Placer, got.Filler)
+	}
+	if got.Placer == got.Filler {
+		t.Errorf("SetResults(%+v, %+v, %v) got Placer=Filler=%q, want different values", o, r, eventTime, got.Placer)
+	}
+}
+
+func TestSetResults_AlternateCodes(t *testing.T) {
+	g, hl7Config := testGenerator(t)
+	hl7Config.AlternateCodes = map[string]config.AlternateCode{
+		"lpdc-2012": {ID: "2160-0", CodingSystem: "LN"},
+	}
+
+	r := &pathway.Results{
+		OrderProfile: "UREA AND ELECTROLYTES",
+		Results: []*pathway.Result{{
+			TestName: "Creatinine",
+			Value:    "52",
+			Unit:     "UMOLL",
+		}},
+	}
+	got, err := g.SetResults(nil, r, eventTime)
+	if err != nil {
+		t.Fatalf("SetResults(nil, %+v, %v) failed with %v", r, eventTime, err)
+	}
+	if len(got.Results) != 1 {
+		t.Fatalf("SetResults(nil, %+v, %v) got results %v, want one result", r, eventTime, got.Results)
+	}
+	want := &message.CodedElement{
+		ID:                    "lpdc-2012",
+		Text:                  "Creatinine",
+		CodingSystem:          "WinPath",
+		AlternateID:           "2160-0",
+		AlternateText:         "Creatinine",
+		AlternateCodingSystem: "LN",
+	}
+	if diff := cmp.Diff(want, got.Results[0].TestName); diff != "" {
+		t.Errorf("SetResults(nil, %+v, %v) got TestName diff (-want, +got):\n%s", r, eventTime, diff)
+	}
+
+	// The order profile itself must not be modified.
+	op, _ := g.OrderProfiles.Get("UREA AND ELECTROLYTES")
+	if diff := cmp.Diff(creatinineCE, &op.TestTypes["Creatinine"].Name); diff != "" {
+		t.Errorf("OrderProfiles test type Creatinine got diff (-want, +got):\n%s", diff)
+	}
+}
+
 func TestSetResultsOverrideDates(t *testing.T) {
 	g, hl7Config := testGenerator(t)
 
@@ -799,6 +867,49 @@ func TestSetResultsSetValueType(t *testing.T) {
 			Status:              hl7Config.ResultStatus.Final,
 			ObservationDateTime: message.NewValidTime(eventTime),
 		},
+	}, {
+		name: "Value with comparator is NM",
+		pathwayR: &pathway.Results{
+			OrderProfile: "UREA AND ELECTROLYTES",
+			Results: []*pathway.Result{
+				{
+					TestName: "Creatinine",
+					Value:    "<0.5",
+					Unit:     "UMOLL",
+				},
+			},
+		},
+		order: ureaOrder(eventTime, hl7Config),
+		want: &message.Result{
+			TestName:            creatinineCE,
+			Value:               "<0.5",
+			Unit:                "UMOLL",
+			ValueType:           "NM",
+			Range:               creatinineRange,
+			Status:              hl7Config.ResultStatus.Final,
+			ObservationDateTime: message.NewValidTime(eventTime),
+		},
+	}, {
+		name: "Override TX with NM for value with comparator",
+		pathwayR: &pathway.Results{
+			OrderProfile: "17-OH Prog",
+			Results: []*pathway.Result{
+				{
+					TestName: "17-Hydroxy Progesterone",
+					Value:    ">=100",
+					Unit:     "UMOLL",
+				},
+			},
+		},
+		want: &message.Result{
+			TestName:            hydroxyCE,
+			Value:               ">=100",
+			Unit:                "UMOLL",
+			ValueType:           "NM",
+			Range:               hydroxyRange,
+			Status:              hl7Config.ResultStatus.Final,
+			ObservationDateTime: message.NewValidTime(eventTime),
+		},
 	}, {
 		name: "Don't override CE",
 		pathwayR: &pathway.Results{
@@ -986,6 +1097,91 @@ func TestSetResultsRandomValue(t *testing.T) {
 	}
 }
 
+func TestSetResultsPercentOfRangeValue(t *testing.T) {
+	// Note: the simple order profile used here has only one TestType (Creatinine)
+	// for UREA AND ELECTROLYTES OrderProfile, with reference range 49 - 92.
+	g, _ := testGenerator(t)
+
+	cases := []struct {
+		name      string
+		result    *pathway.Result
+		wantValue string
+		wantRange string
+		wantUnit  string
+	}{
+		{
+			name:      "0% of order profile reference range",
+			result:    &pathway.Result{TestName: "Creatinine", Value: "pct:0"},
+			wantValue: "49.00",
+			wantRange: creatinineRange,
+			wantUnit:  "UMOLL",
+		}, {
+			name:      "50% of order profile reference range",
+			result:    &pathway.Result{TestName: "Creatinine", Value: "pct:50"},
+			wantValue: "70.50",
+			wantRange: creatinineRange,
+			wantUnit:  "UMOLL",
+		}, {
+			name:      "100% of order profile reference range",
+			result:    &pathway.Result{TestName: "Creatinine", Value: "pct:100"},
+			wantValue: "92.00",
+			wantRange: creatinineRange,
+			wantUnit:  "UMOLL",
+		}, {
+			name:      "90% of overridden reference range",
+			result:    &pathway.Result{TestName: "Creatinine", Value: "pct:90", Unit: "MOLL", ReferenceRange: "100 - 200"},
+			wantValue: "190.00",
+			wantRange: "100 - 200",
+			wantUnit:  "MOLL",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var order *message.Order
+			pathwayR := &pathway.Results{
+				OrderProfile: "UREA AND ELECTROLYTES",
+				Results:      []*pathway.Result{tc.result},
+			}
+
+			got, err := g.SetResults(order, pathwayR, eventTime)
+			if err != nil {
+				t.Fatalf("SetResults(%+v, %+v, %+v) failed with %v", order, pathwayR, eventTime, err)
+			}
+			if len(got.Results) != 1 {
+				t.Fatalf("SetResults(%+v, %+v, %+v) got results %v, want one result", order, pathwayR, eventTime, got.Results)
+			}
+
+			gotResult := got.Results[0]
+			if gotResult.Value != tc.wantValue {
+				t.Errorf("SetResults(%+v, %+v, %+v) got Value=%q, want %q", order, pathwayR, eventTime, gotResult.Value, tc.wantValue)
+			}
+			if gotResult.Unit != tc.wantUnit {
+				t.Errorf("SetResults(%+v, %+v, %+v) got Unit=%v, want %v", order, pathwayR, eventTime, gotResult.Unit, tc.wantUnit)
+			}
+			if gotResult.Range != tc.wantRange {
+				t.Errorf("SetResults(%+v, %+v, %+v) got Range=%v, want %v", order, pathwayR, eventTime, gotResult.Range, tc.wantRange)
+			}
+			if gotResult.AbnormalFlag != "" {
+				t.Errorf("SetResults(%+v, %+v, %+v) got AbnormalFlag=%q, want empty", order, pathwayR, eventTime, gotResult.AbnormalFlag)
+			}
+		})
+	}
+}
+
+func TestSetResultsPercentOfRangeValue_OutOfRange(t *testing.T) {
+	g, _ := testGenerator(t)
+	var order *message.Order
+	pathwayR := &pathway.Results{
+		OrderProfile: "UREA AND ELECTROLYTES",
+		Results:      []*pathway.Result{{TestName: "Creatinine", Value: "pct:120"}},
+	}
+
+	if _, err := g.SetResults(order, pathwayR, eventTime); err == nil {
+		t.Errorf("SetResults(%+v, %+v, %+v) got nil error, want non-nil error", order, pathwayR, eventTime)
+	}
+}
+
 func TestSetResultsWithCompexOrderProfiles(t *testing.T) {
 	g, hl7Config := testGeneratorWithOrderProfile(t, test.ComplexOrderProfilesConfigTest)
 
@@ -1064,6 +1260,41 @@ func TestSetResultsWithCompexOrderProfiles(t *testing.T) {
 	}
 }
 
+func TestSetResults_UnknownCodingSystem(t *testing.T) {
+	g, _ := testGenerator(t)
+	g.MessageConfig.UnknownCodingSystem = "LOCAL"
+
+	r := &pathway.Results{
+		OrderProfile: "ARBITRARY UNKNOWN ORDER PROFILE",
+		Results: []*pathway.Result{{
+			TestName: "Bar",
+			Value:    "200",
+			Unit:     "UML",
+		}},
+	}
+	got, err := g.SetResults(nil, r, eventTime)
+	if err != nil {
+		t.Fatalf("SetResults(nil, %+v, %v) failed with %v", r, eventTime, err)
+	}
+	wantOP := &message.CodedElement{ID: "ARBITRARY UNKNOWN ORDER PROFILE", Text: "ARBITRARY UNKNOWN ORDER PROFILE", CodingSystem: "LOCAL"}
+	if diff := cmp.Diff(wantOP, got.OrderProfile); diff != "" {
+		t.Errorf("SetResults(nil, %+v, %v) got OrderProfile diff (-want, +got):\n%s", r, eventTime, diff)
+	}
+	if len(got.Results) != 1 {
+		t.Fatalf("SetResults(nil, %+v, %v) got results %v, want one result", r, eventTime, got.Results)
+	}
+	wantTestName := &message.CodedElement{ID: "Bar", Text: "Bar", CodingSystem: "LOCAL"}
+	if diff := cmp.Diff(wantTestName, got.Results[0].TestName); diff != "" {
+		t.Errorf("SetResults(nil, %+v, %v) got TestName diff (-want, +got):\n%s", r, eventTime, diff)
+	}
+
+	// Order profiles defined in the configuration keep their own coding system.
+	o := g.NewOrder(&pathway.Order{OrderProfile: "UREA AND ELECTROLYTES"}, eventTime)
+	if diff := cmp.Diff(ureaElectrolytesCE, o.OrderProfile); diff != "" {
+		t.Errorf("NewOrder(UREA AND ELECTROLYTES) got OrderProfile diff (-want, +got):\n%s", diff)
+	}
+}
+
 func TestSetResultsUnknownTestTypeOrOrderProfile(t *testing.T) {
 	g, hl7Config := testGenerator(t)
 
@@ -1376,6 +1607,89 @@ func TestSetResultsCorrectedResults(t *testing.T) {
 	}
 }
 
+func TestSetResultsAppendCorrection(t *testing.T) {
+	before := eventTime.Add(-24 * time.Hour)
+	g, hl7Config := testGenerator(t)
+
+	order := ureaOrderWithPotassiumResultAndStatus(before, hl7Config, hl7Config.OrderStatus.Completed, hl7Config.ResultStatus.Final)
+	order.NumberOfPreviousResults = 1
+	pathwayR := &pathway.Results{
+		OrderProfile:     "UREA AND ELECTROLYTES",
+		AppendCorrection: true,
+		Results: []*pathway.Result{
+			{
+				TestName: "Creatinine",
+				Value:    "52",
+				Unit:     "UMOLL",
+			},
+		},
+	}
+	want := &message.Order{
+		OrderProfile:          ureaElectrolytesCE,
+		Placer:                seqID,
+		Filler:                seqID,
+		OrderDateTime:         message.NewValidTime(before),
+		CollectedDateTime:     message.NewValidTime(before),
+		ReceivedInLabDateTime: message.NewValidTime(before),
+		ReportedDateTime:      message.NewValidTime(eventTime),
+		OrderStatus:           hl7Config.OrderStatus.Completed,
+		ResultsStatus:         hl7Config.ResultStatus.Corrected,
+		Results: []*message.Result{
+			{
+				TestName: potassiumCE,
+				Value:    "3.6",
+			},
+			{
+				TestName:            creatinineCE,
+				Value:               "52",
+				Unit:                "UMOLL",
+				ValueType:           "NM",
+				Range:               "49 - 92",
+				ObservationDateTime: message.NewValidTime(before),
+				Status:              hl7Config.ResultStatus.Corrected,
+			},
+		},
+		NumberOfPreviousResults: 0,
+	}
+
+	got, err := g.SetResults(order, pathwayR, eventTime)
+	if err != nil {
+		t.Fatalf("SetResults(%v, %v, %v) failed with %v", order, pathwayR, eventTime, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SetResults(%+v, %+v, %+v) diff (-want, +got):\n%s", order, pathwayR, eventTime, diff)
+	}
+}
+
+func TestSetResultsAppendCorrection_SplitValue(t *testing.T) {
+	before := eventTime.Add(-24 * time.Hour)
+	g, hl7Config := testGenerator(t)
+	// The value of the previous result, 3.6, is sent in two OBX segments.
+	g.MessageOptions = &message.Options{MaxOBXValueLength: 2}
+
+	order := ureaOrderWithPotassiumResultAndStatus(before, hl7Config, hl7Config.OrderStatus.Completed, hl7Config.ResultStatus.Final)
+	order.NumberOfPreviousResults = 3
+	pathwayR := &pathway.Results{
+		OrderProfile:     "UREA AND ELECTROLYTES",
+		AppendCorrection: true,
+		Results: []*pathway.Result{
+			{
+				TestName: "Creatinine",
+				Value:    "52",
+				Unit:     "UMOLL",
+			},
+		},
+	}
+
+	got, err := g.SetResults(order, pathwayR, eventTime)
+	if err != nil {
+		t.Fatalf("SetResults(%v, %v, %v) failed with %v", order, pathwayR, eventTime, err)
+	}
+	if got, want := got.NumberOfPreviousResults, 1; got != want {
+		t.Errorf("SetResults(%+v, %+v, %+v).NumberOfPreviousResults=%d, want %d", order, pathwayR, eventTime, got, want)
+	}
+}
+
 func TestSetResultsOverrideNotes(t *testing.T) {
 	defaultNotes := []string{"note-1", "note-2"}
 	pathwayNotes := []string{"note", "from", "pathway"}
@@ -23,6 +23,8 @@ import (
 // EthnicityGenerator generates ethnicity.
 type EthnicityGenerator struct {
 	*sample.DiscreteDistribution
+	// CodingSystem is the coding system set in the returned ethnicities if they don't have one.
+	CodingSystem string
 }
 
 // NewEthnicityGenerator returns new EthnicityGenerator based on data provided.
@@ -30,11 +32,29 @@ func NewEthnicityGenerator(d *config.Data) EthnicityGenerator {
 	return EthnicityGenerator{DiscreteDistribution: &sample.DiscreteDistribution{WeightedValues: d.Ethnicities}}
 }
 
+// NewEthnicityGeneratorWithConfig returns a new EthnicityGenerator based on the data provided
+// that uses the default ethnicity coding system from the HL7 config.
+func NewEthnicityGeneratorWithConfig(d *config.Data, c *config.HL7Config) EthnicityGenerator {
+	eg := NewEthnicityGenerator(d)
+	if c != nil {
+		eg.CodingSystem = c.EthnicityCodingSystem
+	}
+	return eg
+}
+
 // Random returns a random ethnicity, which can be nil.
 func (eg EthnicityGenerator) Random() *message.Ethnicity {
 	e := eg.DiscreteDistribution.Random()
 	if e == nil {
 		return nil
 	}
-	return e.(*message.Ethnicity)
+	ethnicity := e.(*message.Ethnicity)
+	// The value can be a nil *message.Ethnicity for absent ethnicities, e.g. the "nil,nil" row.
+	if ethnicity == nil || ethnicity.CodingSystem != "" || eg.CodingSystem == "" {
+		return ethnicity
+	}
+	// Return a copy so that the values in the distribution are not modified.
+	withCodingSystem := *ethnicity
+	withCodingSystem.CodingSystem = eg.CodingSystem
+	return &withCodingSystem
 }
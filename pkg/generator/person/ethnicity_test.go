@@ -18,7 +18,10 @@ import (
 	"math"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/simhospital/pkg/config"
+	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/sample"
 	"github.com/google/simhospital/pkg/test"
 	"github.com/google/simhospital/pkg/test/testwrite"
 )
@@ -79,3 +82,53 @@ nil,nil,3
 		}
 	}
 }
+
+func TestEthnicityGenerator_CodingSystem(t *testing.T) {
+	cases := []struct {
+		name         string
+		ethnicity    *message.Ethnicity
+		codingSystem string
+		want         *message.Ethnicity
+	}{{
+		name:         "default coding system",
+		ethnicity:    &message.Ethnicity{ID: "2106-3", Text: "White"},
+		codingSystem: "CDCREC",
+		want:         &message.Ethnicity{ID: "2106-3", Text: "White", CodingSystem: "CDCREC"},
+	}, {
+		name:         "explicit coding system takes precedence",
+		ethnicity:    &message.Ethnicity{ID: "A", Text: "White", CodingSystem: "NHS"},
+		codingSystem: "CDCREC",
+		want:         &message.Ethnicity{ID: "A", Text: "White", CodingSystem: "NHS"},
+	}, {
+		name:      "no default coding system",
+		ethnicity: &message.Ethnicity{ID: "A", Text: "White"},
+		want:      &message.Ethnicity{ID: "A", Text: "White"},
+	}, {
+		name:         "absent ethnicity",
+		ethnicity:    nil,
+		codingSystem: "CDCREC",
+		want:         nil,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var original *message.Ethnicity
+			if tc.ethnicity != nil {
+				e := *tc.ethnicity
+				original = &e
+			}
+			eg := EthnicityGenerator{
+				DiscreteDistribution: &sample.DiscreteDistribution{
+					WeightedValues: []sample.WeightedValue{{Value: tc.ethnicity, Frequency: 1}},
+				},
+				CodingSystem: tc.codingSystem,
+			}
+			if diff := cmp.Diff(tc.want, eg.Random()); diff != "" {
+				t.Errorf("eg.Random() diff (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(original, tc.ethnicity); diff != "" {
+				t.Errorf("eg.Random() modified the ethnicity in the distribution; diff (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
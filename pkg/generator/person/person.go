@@ -21,7 +21,6 @@ package person
 
 import (
 	"fmt"
-	"math/rand"
 
 	"github.com/google/simhospital/pkg/clock"
 	"github.com/google/simhospital/pkg/gender"
@@ -29,6 +28,7 @@ import (
 	"github.com/google/simhospital/pkg/generator/names"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // AddressGenerator is an interface to generate addresses.
@@ -60,6 +60,76 @@ func (g Generator) NewPerson(pathwayPerson *pathway.Person) *message.Person {
 	return person
 }
 
+// Relationships between the members of a household, as per the HL7 table 0063 (Relationship).
+var (
+	relationshipSpouse  = &message.CodedElement{ID: "SPO", Text: "Spouse", CodingSystem: "HL70063"}
+	relationshipChild   = &message.CodedElement{ID: "CHD", Text: "Child", CodingSystem: "HL70063"}
+	relationshipParent  = &message.CodedElement{ID: "PAR", Text: "Parent", CodingSystem: "HL70063"}
+	relationshipSibling = &message.CodedElement{ID: "SIB", Text: "Sibling", CodingSystem: "HL70063"}
+)
+
+// HouseholdMember is a person that belongs to a household.
+type HouseholdMember struct {
+	Person *message.Person
+	// AssociatedParties are the other members of the household, with their relationship to Person.
+	AssociatedParties []*message.AssociatedParty
+}
+
+// NewHousehold returns size people that live together and share the same surname and address,
+// e.g. a family. If surname is empty or address is nil, they are generated randomly.
+// The first two members are adults and spouses of each other, and the rest are their children.
+// Returns an error if size is not positive.
+func (g Generator) NewHousehold(size int, surname string, address *message.Address) ([]*HouseholdMember, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid household size %d; it must be positive", size)
+	}
+	if surname == "" {
+		surname = g.NameGenerator.Surname()
+	}
+	if address == nil {
+		address = g.AddressGenerator.Random()
+	}
+
+	members := make([]*HouseholdMember, size)
+	for i := range members {
+		age := &pathway.Age{From: 25, To: 60}
+		if i >= 2 {
+			age = &pathway.Age{From: 0, To: 17}
+		}
+		p := g.NewPerson(&pathway.Person{Age: age, Surname: pathway.OptionalRandomString(surname)})
+		a := *address
+		p.Address = &a
+		members[i] = &HouseholdMember{Person: p}
+	}
+	for i, m := range members {
+		for j, other := range members {
+			if i == j {
+				continue
+			}
+			m.AssociatedParties = append(m.AssociatedParties, &message.AssociatedParty{
+				Person:       other.Person,
+				Relationship: householdRelationship(i, j),
+			})
+		}
+	}
+	return members, nil
+}
+
+// householdRelationship returns the relationship of the j-th member of a household to the i-th one,
+// where the first two members are the adults and the rest are their children.
+func householdRelationship(i, j int) *message.CodedElement {
+	switch {
+	case i < 2 && j < 2:
+		return relationshipSpouse
+	case i < 2:
+		return relationshipChild
+	case j < 2:
+		return relationshipParent
+	default:
+		return relationshipSibling
+	}
+}
+
 // UpdatePersonFromPathway updates a person with information from a pathway. Calling this method
 // populates all fields of a Person, if they were not already set.
 // Fields that are set in the pathway's person always override the original person's.
@@ -195,19 +265,19 @@ func (g Generator) chooseGenderValue(pathwayGender pathway.Gender, originalHL7 s
 }
 
 func (g Generator) phoneNumber() string {
-	if rand.Intn(2) == 0 {
+	if random.Intn(2) == 0 {
 		// London home phone number
-		return fmt.Sprintf("020 %04d %04d", rand.Intn(10000), rand.Intn(10000))
+		return fmt.Sprintf("020 %04d %04d", random.Intn(10000), random.Intn(10000))
 	}
 	// UK mobile number
-	return fmt.Sprintf("07%d %04d %04d", rand.Intn(10), rand.Intn(10000), rand.Intn(10000))
+	return fmt.Sprintf("07%d %04d %04d", random.Intn(10), random.Intn(10000), random.Intn(10000))
 }
 
 // Return a newly minted NHS number that will pass validation rules. See:
 // http://www.datadictionary.nhs.uk/version2/data_dictionary/data_field_notes/n/nhs_number_de.asp?shownav=0
 func newNHSNumber() string {
 	for {
-		n := rand.Intn(1000000000) * 10
+		n := random.Intn(1000000000) * 10
 		a := n / 10
 		check := 0
 		for i := 0; i < 9; i++ {
@@ -141,6 +141,50 @@ func TestNewPerson(t *testing.T) {
 	}
 }
 
+func TestNewHousehold(t *testing.T) {
+	g, _, _ := testGenerator(t, defaultNow)
+	address := &message.Address{FirstLine: "1 Family Road", City: "London", PostalCode: "AB1 2CD", Country: "UK", Type: "HOME"}
+
+	got, err := g.NewHousehold(4, "Smith", address)
+	if err != nil {
+		t.Fatalf("NewHousehold(4, %q, %+v) failed with %v", "Smith", address, err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("NewHousehold(4, %q, %+v) got %d members, want 4", "Smith", address, len(got))
+	}
+	for i, m := range got {
+		if m.Person.Surname != "Smith" {
+			t.Errorf("NewHousehold() member %d got Surname=%q, want %q", i, m.Person.Surname, "Smith")
+		}
+		if diff := cmp.Diff(address, m.Person.Address); diff != "" {
+			t.Errorf("NewHousehold() member %d got Address diff (-want, +got):\n%s", i, diff)
+		}
+		if len(m.AssociatedParties) != 3 {
+			t.Errorf("NewHousehold() member %d got %d associated parties, want 3", i, len(m.AssociatedParties))
+		}
+	}
+
+	wantRelationships := []string{"SPO", "CHD", "CHD"}
+	for i, ap := range got[0].AssociatedParties {
+		if ap.Relationship.ID != wantRelationships[i] {
+			t.Errorf("NewHousehold() first member associated party %d got Relationship=%q, want %q", i, ap.Relationship.ID, wantRelationships[i])
+		}
+	}
+	wantRelationships = []string{"PAR", "PAR", "SIB"}
+	for i, ap := range got[3].AssociatedParties {
+		if ap.Relationship.ID != wantRelationships[i] {
+			t.Errorf("NewHousehold() last member associated party %d got Relationship=%q, want %q", i, ap.Relationship.ID, wantRelationships[i])
+		}
+	}
+}
+
+func TestNewHousehold_InvalidSize(t *testing.T) {
+	g, _, _ := testGenerator(t, defaultNow)
+	if _, err := g.NewHousehold(0, "Smith", nil); err == nil {
+		t.Error("NewHousehold(0, \"Smith\", nil) got nil error, want non-nil error")
+	}
+}
+
 func TestNewPersonWithNHS(t *testing.T) {
 	g := simpleMaleGenerator(t, defaultNow)
 	want := "0714630667"
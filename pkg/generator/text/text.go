@@ -16,8 +16,9 @@
 package text
 
 import (
-	"math/rand"
 	"strings"
+
+	"github.com/google/simhospital/pkg/random"
 )
 
 // Generator is a generator of text.
@@ -38,7 +39,7 @@ type NounGenerator struct {
 // separated by an empty space.
 // The first word starts with a capital letter.
 func (g *NounGenerator) randomSentence(max int) string {
-	r := rand.Intn(max)
+	r := random.Intn(max)
 	w := make([]string, 0)
 	for i := 0; i <= r; i++ {
 		w = append(w, g.randomNoun())
@@ -48,7 +49,7 @@ func (g *NounGenerator) randomSentence(max int) string {
 }
 
 func (g *NounGenerator) randomNoun() string {
-	return g.Nouns[rand.Intn(len(g.Nouns))]
+	return g.Nouns[random.Intn(len(g.Nouns))]
 }
 
 // Sentences returns an array of n random sentences.
@@ -16,9 +16,10 @@ package text
 
 import (
 	"math"
-	"math/rand"
 	"strings"
 	"testing"
+
+	"github.com/google/simhospital/pkg/random"
 )
 
 var nouns = []string{"one", "two", "three", "four", "five"}
@@ -31,7 +32,7 @@ func TestNounGenerator_Sentences_Length(t *testing.T) {
 }
 
 func TestNounGenerator_Sentences_TextIsRandom(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	g := &NounGenerator{Nouns: nouns}
 	runs := float64(100)
 	sentencesPerRun := 10
@@ -23,9 +23,9 @@ package hardcoded
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -35,6 +35,7 @@ import (
 	"github.com/google/simhospital/pkg/hl7"
 	"github.com/google/simhospital/pkg/logging"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // pidSegmentPlaceholder defines a placeholder for the PID segments, which
@@ -133,7 +134,9 @@ func (m Manager) Message(toIncludeRegex string, p *message.Person, t time.Time)
 	}
 	log.Debugf("Selected %d hardcoded messages based on the regex %q: %v", len(filtered), toIncludeRegex, filtered)
 
-	name := filtered[rand.Intn(len(filtered))]
+	// Sort the names so that picking a random message only depends on the source of randomness.
+	sort.Strings(filtered)
+	name := filtered[random.Intn(len(filtered))]
 	log.Infof("Hardcoded message with name %s chosen at random", name)
 
 	msg := m.messages[name]
@@ -39,14 +39,14 @@ func (h *Hospital) occupyBed(loc, bed string) (*message.PatientLocation, error)
 }
 
 func (h *Hospital) processAdmission(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 
 	*logLocal = *logLocal.WithField(keyLocation, e.Step.Admission.Loc)
 	if patientInfo.ExpectedAdmitDateTime.Valid {
 		patientInfo.AdmissionDate = patientInfo.ExpectedAdmitDateTime
 		patientInfo.Location = patientInfo.PendingLocation
-		logLocal.Debugf("Entered reserved bed %s", patientInfo.PendingLocation)
+		logLocal.Debugf("Entered reserved bed %+v", patientInfo.PendingLocation)
 	} else {
 		patientInfo.AdmissionDate = message.NewValidTime(e.EventTime)
 		loc, err := h.occupyBed(e.Step.Admission.Loc, e.Step.Admission.Bed)
@@ -72,7 +72,7 @@ func (h *Hospital) processAdmission(e *state.Event, logLocal *logging.SimulatedH
 }
 
 func (h *Hospital) processOrder(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patient := h.patients.Get(e.PatientMRN)
 	patientInfo := patient.PatientInfo
 
@@ -99,7 +99,7 @@ func (h *Hospital) processOrder(e *state.Event, logLocal *logging.SimulatedHospi
 	if e.Step.Order.NoAcknowledgementMessage {
 		return nil
 	}
-	msgHeader = h.generator.NewHeader(&e.Step)
+	msgHeader = h.newHeader(&e.Step)
 	o.OrderControl = h.messageConfig.OrderControl.OK
 	patient.AddOrder(e.Step.Order.OrderID, o)
 	delay := h.orderAckDelay.Random()
@@ -113,7 +113,7 @@ func (h *Hospital) processOrder(e *state.Event, logLocal *logging.SimulatedHospi
 }
 
 func (h *Hospital) processResults(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patient := h.patients.Get(e.PatientMRN)
 	patientInfo := patient.PatientInfo
 
@@ -140,13 +140,13 @@ func (h *Hospital) processResults(e *state.Event, logLocal *logging.SimulatedHos
 		return errors.Wrapf(err, "cannot build ORU message; trigger event is %s", te)
 	}
 	if !e.Step.Result.ExpectCorrection {
-		o.NumberOfPreviousResults += len(o.Results)
+		o.NumberOfPreviousResults += message.NumberOfOBXSegments(h.messageOptions, o.Results)
 	}
 	return h.queueMessage(logLocal, msg, e)
 }
 
 func (h *Hospital) processClinicalNote(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patient := h.patients.Get(e.PatientMRN)
 	patientInfo := patient.PatientInfo
 	h.setAdmissionDetailsIfMissing(patientInfo, e.EventTime)
@@ -166,7 +166,7 @@ func (h *Hospital) processClinicalNote(e *state.Event, logLocal *logging.Simulat
 }
 
 func (h *Hospital) processDocument(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patient := h.patients.Get(e.PatientMRN)
 	patientInfo := patient.PatientInfo
 
@@ -179,7 +179,7 @@ func (h *Hospital) processDocument(e *state.Event, logLocal *logging.SimulatedHo
 }
 
 func (h *Hospital) processDischarge(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	mrn := e.PatientMRN
 	patient := h.patients.Get(mrn)
 	patientInfo := patient.PatientInfo
@@ -212,7 +212,7 @@ func (h *Hospital) processDischarge(e *state.Event, logLocal *logging.SimulatedH
 }
 
 func (h *Hospital) processDischargeInError(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 
 	dischargeTime := e.EventTime
@@ -232,8 +232,13 @@ func (h *Hospital) processDischargeInError(e *state.Event, logLocal *logging.Sim
 }
 
 func (h *Hospital) processTransferOrTransferInError(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	if e.Step.StepType() == pathway.StepTransfer && e.Step.Transfer.IsTemporary {
+		return h.temporaryTransfer(e, logLocal, now)
+	}
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
+	// The patient's state is restored from this copy if the message cannot be built.
+	original := *patientInfo
 	pathwayName := e.PathwayName
 	var loc string
 	var bed string
@@ -241,7 +246,9 @@ func (h *Hospital) processTransferOrTransferInError(e *state.Event, logLocal *lo
 	if e.Step.StepType() == pathway.StepTransfer {
 		loc = e.Step.Transfer.Loc
 		bed = e.Step.Transfer.Bed
-		patientInfo.PriorLocation = h.freeLocation(logLocal, patientInfo, pathwayName)
+		// The prior bed is only freed after the message is built, so that the patient is not
+		// transferred to the same bed, and keeps it if the transfer fails.
+		patientInfo.PriorLocation = patientInfo.Location
 	} else if e.Step.StepType() == pathway.StepTransferInError {
 		loc = e.Step.TransferInError.Loc
 		bed = e.Step.TransferInError.Bed
@@ -254,7 +261,7 @@ func (h *Hospital) processTransferOrTransferInError(e *state.Event, logLocal *lo
 		patientInfo.TransferDate = patientInfo.ExpectedTransferDateTime
 		eventTime = patientInfo.TransferDate.Time
 		patientInfo.Location = patientInfo.PendingLocation
-		logLocal.Debugf("Entered reserved bed %s", patientInfo.PendingLocation)
+		logLocal.Debugf("Entered reserved bed %+v", patientInfo.PendingLocation)
 	} else {
 		patientInfo.TransferDate = message.NewValidTime(e.EventTime)
 		// Even if this transfer is in error, we simulate the new bed being allocated to the new
@@ -263,8 +270,7 @@ func (h *Hospital) processTransferOrTransferInError(e *state.Event, logLocal *lo
 		// physically given to a new patient.
 		loc, err := h.occupyBed(loc, bed)
 		if err != nil {
-			// It's safe to call freeSpecificLocation even if the prior location was already freed.
-			h.freeSpecificLocation(logLocal, patientInfo.PriorLocation, pathwayName)
+			*patientInfo = original
 			return errors.Wrap(err, locationError)
 		}
 		patientInfo.Location = loc
@@ -273,16 +279,53 @@ func (h *Hospital) processTransferOrTransferInError(e *state.Event, logLocal *lo
 	patientInfo.ExpectedTransferDateTime = message.NewInvalidTime()
 	h.updateDeathInfo(logLocal, now, pathwayName, patientInfo, e.Step.Parameters)
 
-	msg, err := message.BuildTransferADTA02(msgHeader, patientInfo, eventTime, e.MessageTime)
+	buildTransfer := message.BuildTransferADTA02
+	if patientInfo.PriorLocation == nil || patientInfo.Person.DateOfDeath.Valid {
+		// Patients who were not admitted have no prior location, and patients who die have their
+		// location released, but the transfer is still sent.
+		buildTransfer = message.BuildIncompleteTransferADTA02
+	}
+	msg, err := buildTransfer(msgHeader, patientInfo, eventTime, e.MessageTime)
 	if err != nil {
+		// Free the bed occupied above, but not a reserved bed, as the patient still has it as their
+		// PendingLocation once their state is restored.
+		if !original.ExpectedTransferDateTime.Valid {
+			h.freeSpecificLocation(logLocal, patientInfo.Location, pathwayName)
+		}
+		*patientInfo = original
 		return errors.Wrap(err, "cannot build ADT^A02 message")
 	}
+	if e.Step.StepType() == pathway.StepTransfer {
+		h.freeSpecificLocation(logLocal, original.Location, pathwayName)
+	}
 	patientInfo.PriorLocation = nil
 	return h.queueMessage(logLocal, msg, e)
 }
 
+// temporaryTransfer transfers the patient to a temporary location, e.g. radiology.
+// The patient keeps their permanent location and bed.
+func (h *Hospital) temporaryTransfer(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
+	msgHeader := h.newHeader(&e.Step)
+	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
+	// The patient's state is restored from this copy if the message cannot be built.
+	original := *patientInfo
+	*logLocal = *logLocal.WithField(keyLocation, e.Step.Transfer.Loc)
+
+	// The death information is updated first, as it clears the temporary location of dead patients.
+	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
+	patientInfo.PriorTemporaryLocation = patientInfo.TemporaryLocation
+	patientInfo.TemporaryLocation = &message.PatientLocation{Poc: e.Step.Transfer.Loc}
+
+	msg, err := message.BuildTemporaryTransferADTA02(msgHeader, patientInfo, e.EventTime, e.MessageTime)
+	if err != nil {
+		*patientInfo = original
+		return errors.Wrap(err, "cannot build ADT^A02 message")
+	}
+	return h.queueMessage(logLocal, msg, e)
+}
+
 func (h *Hospital) cancelVisit(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	mrn := e.PatientMRN
 	patient := h.patients.Get(mrn)
 	patientInfo := patient.PatientInfo
@@ -303,7 +346,7 @@ func (h *Hospital) cancelVisit(e *state.Event, logLocal *logging.SimulatedHospit
 }
 
 func (h *Hospital) cancelTransfer(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	mrn := e.PatientMRN
 	patient := h.patients.Get(mrn)
 	patientInfo := patient.PatientInfo
@@ -322,7 +365,7 @@ func (h *Hospital) cancelTransfer(e *state.Event, logLocal *logging.SimulatedHos
 }
 
 func (h *Hospital) cancelDischarge(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
 	patientInfo.AccountStatus = h.messageConfig.PatientAccountStatus.Arrived
@@ -334,7 +377,7 @@ func (h *Hospital) cancelDischarge(e *state.Event, logLocal *logging.SimulatedHo
 }
 
 func (h *Hospital) pendingAdmission(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	pendingLocation, err := h.occupyBed(e.Step.PendingAdmission.Loc, e.Step.PendingAdmission.Bed)
 	if err != nil {
@@ -352,7 +395,7 @@ func (h *Hospital) pendingAdmission(e *state.Event, logLocal *logging.SimulatedH
 }
 
 func (h *Hospital) pendingDischarge(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	patientInfo.ExpectedDischargeDateTime = message.NewValidTime(e.EventTime.Add(*e.Step.PendingDischarge.ExpectedDischargeTimeFromNow))
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
@@ -364,7 +407,7 @@ func (h *Hospital) pendingDischarge(e *state.Event, logLocal *logging.SimulatedH
 }
 
 func (h *Hospital) pendingTransfer(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	pendingLocation, err := h.occupyBed(e.Step.PendingTransfer.Loc, e.Step.PendingTransfer.Bed)
 	if err != nil {
@@ -381,7 +424,7 @@ func (h *Hospital) pendingTransfer(e *state.Event, logLocal *logging.SimulatedHo
 }
 
 func (h *Hospital) registration(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	patientInfo.AdmissionDate = message.NewValidTime(e.EventTime)
 	patientInfo.VisitID = h.generator.NewVisitID()
@@ -390,11 +433,20 @@ func (h *Hospital) registration(e *state.Event, logLocal *logging.SimulatedHospi
 	patientInfo.AccountStatus = h.messageConfig.PatientAccountStatus.Planned
 
 	if e.Step.Registration.PatientClass != "" {
-		patientInfo.Class = e.Step.Registration.PatientClass
-		patientInfo.Type = e.Step.Registration.PatientClass
+		class, err := h.messageConfig.PatientClass.Code(e.Step.Registration.PatientClass)
+		if err != nil {
+			return errors.Wrap(err, "cannot set the patient class")
+		}
+		patientInfo.Class = class
+		patientInfo.Type = class
 	} else {
 		generated := h.generator.NewRegistrationPatientClassAndType()
-		patientInfo.Class = generated.Class
+		// The generated classes can also be human-readable names, so they are mapped too.
+		class, err := h.messageConfig.PatientClass.Code(generated.Class)
+		if err != nil {
+			return errors.Wrap(err, "cannot set the generated patient class")
+		}
+		patientInfo.Class = class
 		patientInfo.Type = generated.Type
 	}
 
@@ -406,7 +458,7 @@ func (h *Hospital) registration(e *state.Event, logLocal *logging.SimulatedHospi
 }
 
 func (h *Hospital) preadmission(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	pendingLocation, err := h.occupyBed(e.Step.PreAdmission.Loc, e.Step.PreAdmission.Bed)
 	if err != nil {
@@ -440,7 +492,7 @@ func (h *Hospital) usePatient(e *state.Event, logLocal *logging.SimulatedHospita
 }
 
 func (h *Hospital) merge(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	mrn := e.PatientMRN
 	patientInfo := h.patients.Get(mrn).PatientInfo
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
@@ -469,7 +521,7 @@ func (h *Hospital) merge(e *state.Event, logLocal *logging.SimulatedHospitalLogg
 }
 
 func (h *Hospital) bedSwap(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	mrn := e.PatientMRN
 	patientInfo := h.patients.Get(mrn).PatientInfo
 	mainMRN := e.ResolveMRN(e.Step.BedSwap.Patient1)
@@ -499,7 +551,7 @@ func (h *Hospital) bedSwap(e *state.Event, logLocal *logging.SimulatedHospitalLo
 }
 
 func (h *Hospital) addPerson(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	h.generator.AddAllergies(patientInfo, e.Step.AddPerson.Allergies)
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
@@ -511,15 +563,21 @@ func (h *Hospital) addPerson(e *state.Event, logLocal *logging.SimulatedHospital
 }
 
 func (h *Hospital) updatePerson(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	h.generator.UpdateFromPathway(patientInfo, e.Step.UpdatePerson)
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
 	var msg *message.HL7Message
 	var err error
-	if patientInfo.Class == h.messageConfig.PatientClass.Inpatient {
+	useIAM := h.messageConfig.Allergy.UseIAM
+	switch {
+	case patientInfo.Class == h.messageConfig.PatientClass.Inpatient && useIAM:
+		msg, err = message.BuildUpdatePatientADTA08WithIAM(msgHeader, patientInfo, e.EventTime, e.MessageTime)
+	case patientInfo.Class == h.messageConfig.PatientClass.Inpatient:
 		msg, err = message.BuildUpdatePatientADTA08(msgHeader, patientInfo, e.EventTime, e.MessageTime)
-	} else {
+	case useIAM:
+		msg, err = message.BuildUpdatePersonADTA31WithIAM(msgHeader, patientInfo, e.EventTime, e.MessageTime)
+	default:
 		msg, err = message.BuildUpdatePersonADTA31(msgHeader, patientInfo, e.EventTime, e.MessageTime)
 	}
 	if err != nil {
@@ -536,7 +594,7 @@ func (h *Hospital) updatePerson(e *state.Event, logLocal *logging.SimulatedHospi
 }
 
 func (h *Hospital) cancelPendingAdmission(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	pathwayName := e.PathwayName
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	patientInfo.PriorPendingLocation = patientInfo.PendingLocation
@@ -554,7 +612,7 @@ func (h *Hospital) cancelPendingAdmission(e *state.Event, logLocal *logging.Simu
 }
 
 func (h *Hospital) cancelPendingTransfer(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	pathwayName := e.PathwayName
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	patientInfo.PriorPendingLocation = patientInfo.PendingLocation
@@ -571,7 +629,7 @@ func (h *Hospital) cancelPendingTransfer(e *state.Event, logLocal *logging.Simul
 }
 
 func (h *Hospital) cancelPendingDischarge(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	h.updateDeathInfo(logLocal, now, e.PathwayName, patientInfo, e.Step.Parameters)
 	msg, err := message.BuildCancelPendingDischargeADTA25(msgHeader, patientInfo, e.EventTime, e.MessageTime)
@@ -583,7 +641,7 @@ func (h *Hospital) cancelPendingDischarge(e *state.Event, logLocal *logging.Simu
 }
 
 func (h *Hospital) deleteVisit(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	patient := h.patients.Get(e.PatientMRN)
 	patientInfo := patient.PatientInfo
 	pastVisitID, err := patient.PopPastVisit()
@@ -606,7 +664,7 @@ func (h *Hospital) deleteVisit(e *state.Event, logLocal *logging.SimulatedHospit
 }
 
 func (h *Hospital) trackDeparture(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	pathwayName := e.PathwayName
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 	h.freeSpecificLocation(logLocal, patientInfo.Location, pathwayName)
@@ -648,7 +706,7 @@ func (h *Hospital) trackDeparture(e *state.Event, logLocal *logging.SimulatedHos
 }
 
 func (h *Hospital) trackArrival(e *state.Event, logLocal *logging.SimulatedHospitalLogger, now time.Time) error {
-	msgHeader := h.generator.NewHeader(&e.Step)
+	msgHeader := h.newHeader(&e.Step)
 	pathwayName := e.PathwayName
 	patientInfo := h.patients.Get(e.PatientMRN).PatientInfo
 
@@ -664,11 +722,11 @@ func (h *Hospital) trackArrival(e *state.Event, logLocal *logging.SimulatedHospi
 	case pathway.TransitMode:
 		matches, err := h.locationManager.Matches(e.Step.TrackArrival.Loc, patientInfo.PendingLocation)
 		if err != nil {
-			log.WithError(err).Errorf("Error matching location in TrackArrival (transit) step %q and patient location %q", e.Step.TrackArrival.Loc, patientInfo.PendingLocation)
+			log.WithError(err).Errorf("Error matching location in TrackArrival (transit) step %q and patient location %+v", e.Step.TrackArrival.Loc, patientInfo.PendingLocation)
 			return errors.Wrap(err, locationError)
 		}
 		if !matches {
-			log.WithError(err).Errorf("Location mismatch in TrackArrival (transit): step %q; patient location: %q", e.Step.TrackArrival.Loc, patientInfo.PendingLocation)
+			log.WithError(err).Errorf("Location mismatch in TrackArrival (transit): step %q; patient location: %+v", e.Step.TrackArrival.Loc, patientInfo.PendingLocation)
 			return errors.New("transit location mismatch")
 		}
 		patientInfo.Location = patientInfo.PendingLocation
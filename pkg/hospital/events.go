@@ -88,7 +88,7 @@ func (h *Hospital) queueFirstEvent(p pathway.Pathway, patientIDs map[pathway.Pat
 
 	now := h.clock.Now()
 
-	eventTime, msgTime := calculateTimes(now, first.Parameters)
+	eventTime, msgTime := h.calculateTimes(now, first.Parameters)
 
 	consistentBefore := h.eventQ.IsConsistent()
 	event := state.Event{
@@ -200,7 +200,7 @@ func (h *Hospital) runEvent(e state.Event) {
 	// Queue the next event, if any.
 	first, history, pathwaySteps := getNextEvents(e.History, e.Pathway)
 	if first != nil {
-		eventTime, msgTime := calculateTimes(now, first.Parameters)
+		eventTime, msgTime := h.calculateTimes(now, first.Parameters)
 
 		logLocal = logLocal.
 			WithField(keyNextEventType, first.StepType()).
@@ -15,6 +15,7 @@
 package hospital
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -22,6 +23,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/google/simhospital/pkg/logging"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/pathway"
 	"github.com/google/simhospital/pkg/state"
 )
 
@@ -36,6 +38,24 @@ func (h *Hospital) processNextMessage() error {
 	if !h.HasMessages() {
 		return errors.New("processNextMessage() was invoked on an empty Message queue")
 	}
+	m, ok, err := h.popMessage()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// An item of the wrong type will never be able to be processed. The item has been
+		// removed from the queue already, so there's no point in signaling this further.
+		return nil
+	}
+	if err := h.processMessage(m); err != nil {
+		return errors.Wrap(err, "failed to process message")
+	}
+	return nil
+}
+
+// popMessage removes the next message from the Message queue and returns it.
+// popMessage returns false if the item removed from the queue is not a message.
+func (h *Hospital) popMessage() (state.HL7Message, bool, error) {
 	// The item retrieved by pq.Get() might not be exactly the same one as the pq.Peek() above (as the items are
 	// submitted to the queue concurrently by another thread). This is OK, because we want to process the item
 	// which due date is the earliest first.
@@ -45,24 +65,67 @@ func (h *Hospital) processNextMessage() error {
 			"pathway_name": unknown,
 			"reason":       "message_queue_get",
 		}).Inc()
-		return errors.Wrap(err, "failed to get message from queue")
+		return state.HL7Message{}, false, errors.Wrap(err, "failed to get message from queue")
 	}
 	item := *i
 	m, ok := item.(state.HL7Message)
 	if !ok {
-		log.WithError(err).Errorf("Unknown item consumed from the message queue: %v", item)
+		log.Errorf("Unknown item consumed from the message queue: %v", item)
 		counters.SimulatedHospital.ErrorsTotal.With(prometheus.Labels{
 			"pathway_name": unknown,
 			"reason":       "message_cast",
 		}).Inc()
-		// An item of the wrong type will never be able to be processed. The item has been
-		// removed from the queue already, so there's no point in signaling this further.
-		return nil
 	}
-	if err := h.processMessage(m); err != nil {
-		return errors.Wrap(err, "failed to process message")
+	return m, ok, nil
+}
+
+// Messages starts the given pathway and returns a channel that yields the messages it generates lazily, in the
+// order in which they are queued. Events are run as soon as the previous messages have been consumed, regardless of
+// when they are due, and the messages are not processed: message processors are not run and the messages are not
+// sent with the hospital's sender.
+// The channel is closed when the pathway finishes, when ctx is done, or when an error occurs. The returned function
+// blocks until the channel is closed and returns the error that caused it to be closed early, if any.
+// Callers that stop reading from the channel before it is closed must cancel ctx: otherwise, the goroutine that
+// generates the messages, and the returned function, block forever.
+// The hospital must not be running other pathways, or processing events or messages, concurrently.
+func (h *Hospital) Messages(ctx context.Context, p *pathway.Pathway) (<-chan *message.HL7Message, func() error) {
+	out := make(chan *message.HL7Message)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		defer close(out)
+		if _, err = h.StartPathway(p); err != nil {
+			err = errors.Wrap(err, "cannot start pathway")
+			return
+		}
+		for h.HasMessages() || h.HasEvents() {
+			if !h.HasMessages() {
+				if err = h.runNextEvent(); err != nil {
+					return
+				}
+				continue
+			}
+			m, ok, popErr := h.popMessage()
+			if popErr != nil {
+				err = popErr
+				return
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case out <- m.Message:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, func() error {
+		<-done
+		return err
 	}
-	return nil
 }
 
 // processMessage processes the message.
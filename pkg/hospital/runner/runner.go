@@ -18,7 +18,6 @@ package runner
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"regexp"
 	"time"
@@ -113,6 +112,9 @@ type Config struct {
 	SleepFor time.Duration
 	// Clock is the clock for the hospital.
 	Clock clock.Clock
+	// Seed is the seed for the source of randomness of the hospital. See hospital.Seed.
+	// If zero, a seed based on the current time is used.
+	Seed int64
 }
 
 func (c Config) isValid() error {
@@ -137,7 +139,12 @@ func New(h *hospital.Hospital, config Config) (*Hospital, error) {
 		return nil, err
 	}
 
-	rand.Seed(time.Now().Unix())
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().Unix()
+	}
+	log.Infof("Using random seed %d", seed)
+	hospital.Seed(seed)
 	return &Hospital{
 		hospital:                     h,
 		pathwayRateController:        rate.NewController(config.PathwaysPerHour, time.Hour),
@@ -36,6 +36,7 @@ import (
 	"github.com/google/simhospital/pkg/orderprofile"
 	"github.com/google/simhospital/pkg/pathway"
 	"github.com/google/simhospital/pkg/processor"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/state/persist"
 	"github.com/google/simhospital/pkg/state"
 )
@@ -251,6 +252,10 @@ type AdditionalConfig struct {
 	// after the corresponding Order message.
 	OrderAckDelay *pathway.Delay
 
+	// MessageTimer computes the time of the messages from the time of the events that trigger them,
+	// e.g. to simulate messages that are sent some time after the event, or senders with clock skew.
+	MessageTimer MessageTimer
+
 	// AddressGenerator generates random addresses.
 	AddressGenerator person.AddressGenerator
 
@@ -326,6 +331,9 @@ func DefaultConfig(arguments Arguments) (Config, error) {
 
 	if c.OrderProfiles != nil && c.Doctors != nil && c.LocationManager != nil {
 		c.PathwayParser = &pathway.Parser{Clock: c.Clock, OrderProfiles: c.OrderProfiles, Doctors: c.Doctors, LocationManager: c.LocationManager}
+		if c.HL7Config != nil {
+			c.PathwayParser.Valid = pathway.ValidPatientClasses(c.HL7Config.PatientClass)
+		}
 
 		if arguments.PathwayArguments != nil {
 			if c.PathwayManager, err = pathwayManager(c.PathwayParser, *arguments.PathwayArguments); err != nil {
@@ -410,7 +418,9 @@ type Hospital struct {
 	patients                *state.PatientsMap
 	processors              Processors
 	messageConfig           *config.HL7Config
+	messageOptions          *message.Options
 	orderAckDelay           *pathway.Delay
+	messageTimer            MessageTimer
 }
 
 func init() {
@@ -563,18 +573,55 @@ func (h Hospital) newPatient(person *pathway.Person, consultant *pathway.Consult
 	return newPerson, h.generator.NewPatient(newPerson, newConsultant)
 }
 
+// MessageTimer computes the time of a message from the time of the event that triggers it.
+// The message is queued to be sent at that time.
+type MessageTimer struct {
+	// Delay is the delay between the event and the message for steps that don't set
+	// parameters.delay_message. If nil, such messages are sent at the time of the event.
+	Delay *pathway.Delay
+	// Skew is added to the MSH.7 Date/Time Of Message of all messages to simulate a sender whose
+	// clock is ahead of (positive values) or behind (negative values) the receiver's.
+	// It does not change the time at which the messages are sent.
+	Skew time.Duration
+}
+
+// MessageTime returns the time of the message for an event that happens at eventTime.
+// The delay_message in params, if set, takes precedence over t.Delay.
+func (t MessageTimer) MessageTime(eventTime time.Time, params *pathway.Parameters) time.Time {
+	delay := t.Delay
+	if params != nil && params.DelayMessage != nil {
+		delay = params.DelayMessage
+	}
+	return eventTime.Add(delay.Random())
+}
+
+// newHeader returns the header of a message for the given step, with the MessageTimer's Skew and
+// the message options of the hospital's HL7 configuration.
+func (h *Hospital) newHeader(step *pathway.Step) *message.HeaderInfo {
+	header := h.generator.NewHeader(step)
+	header.ClockSkew = h.messageTimer.Skew
+	header.Options = h.messageOptions
+	return header
+}
+
 // calculateTimes calculates the time in which the event should take place, and the message should
-// be sent, based on the current time and the specified delays (if any).
-func calculateTimes(now time.Time, params *pathway.Parameters) (eventTime time.Time, msgTime time.Time) {
+// be sent, based on the current time, the specified delays (if any) and the hospital's MessageTimer.
+func (h *Hospital) calculateTimes(now time.Time, params *pathway.Parameters) (eventTime time.Time, msgTime time.Time) {
 	eventTime = now
-	msgTime = now
-	if params != nil {
-		if params.TimeFromNow != nil {
-			eventTime = eventTime.Add(*params.TimeFromNow)
-		}
-		msgTime = eventTime.Add(params.DelayMessage.Random())
+	if params != nil && params.TimeFromNow != nil {
+		eventTime = eventTime.Add(*params.TimeFromNow)
 	}
-	return
+	return eventTime, h.messageTimer.MessageTime(eventTime, params)
+}
+
+// Seed seeds the source of randomness shared by all the randomized components of Simulated
+// Hospital, e.g., the selection of order profiles, the generation of names, addresses, notes,
+// and the random placer and filler numbers. See the random package.
+// Given the same seed, the same configuration and a clock that returns the same times, running the
+// same pathways produces the same messages, byte-for-byte, provided that events are run one at a time.
+// Seed should be called before the Hospital is created.
+func Seed(seed int64) {
+	random.Seed(seed)
 }
 
 // NewHospital creates a new Hospital.
@@ -610,6 +657,13 @@ func NewHospital(c Config) (*Hospital, error) {
 		return nil, errors.New("Config.Clock not provided; this is required")
 	}
 	ac := c.AdditionalConfig
+	if err := ac.MessageTimer.Delay.Valid(); err != nil {
+		return nil, errors.Wrap(err, "invalid AdditionalConfig.MessageTimer.Delay")
+	}
+	messageOptions, err := c.HL7Config.MessageOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Config.HL7Config")
+	}
 
 	dataConfig, err := config.LoadData(c.DataFiles, c.HL7Config)
 	if err != nil {
@@ -619,6 +673,7 @@ func NewHospital(c Config) (*Hospital, error) {
 	genConfig := generator.Config{
 		Clock:            c.Clock,
 		HL7Config:        c.HL7Config,
+		MessageOptions:   messageOptions,
 		Header:           c.Header,
 		Data:             dataConfig,
 		Doctors:          c.Doctors,
@@ -649,7 +704,9 @@ func NewHospital(c Config) (*Hospital, error) {
 		patients:                patientsMap,
 		processors:              c.AdditionalConfig.Processors,
 		messageConfig:           c.HL7Config,
+		messageOptions:          messageOptions,
 		orderAckDelay:           ac.OrderAckDelay,
+		messageTimer:            ac.MessageTimer,
 	}, nil
 }
 
@@ -15,10 +15,10 @@
 package hospital_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
-	"math/rand"
 	"os"
 	"strconv"
 	"strings"
@@ -36,9 +36,11 @@ import (
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/pathway"
 	"github.com/google/simhospital/pkg/processor"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/state/persist"
 	"github.com/google/simhospital/pkg/state"
 	"github.com/google/simhospital/pkg/test"
+	"github.com/google/simhospital/pkg/test/testaddress"
 	"github.com/google/simhospital/pkg/test/testhl7"
 	"github.com/google/simhospital/pkg/test/testhospital"
 	"github.com/google/simhospital/pkg/test/testlocation"
@@ -428,8 +430,233 @@ func TestStartPathway_OrderAckAndResult(t *testing.T) {
 	}
 }
 
+func TestStartPathway_MessageTimer(t *testing.T) {
+	now := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	oneHourAgo := -time.Hour
+	fiveMinutes := &pathway.Delay{From: 5 * time.Minute, To: 5 * time.Minute}
+
+	tests := []struct {
+		name             string
+		timer            MessageTimer
+		orderAckDelay    *pathway.Delay
+		step             pathway.Step
+		wantMessageDelay map[string]time.Duration
+		wantEventDelay   time.Duration
+	}{{
+		name:             "no timer",
+		step:             pathway.Step{Admission: &pathway.Admission{Loc: testLoc}},
+		wantMessageDelay: map[string]time.Duration{"ADT^A01": 0},
+	}, {
+		name:             "delay",
+		timer:            MessageTimer{Delay: fiveMinutes},
+		step:             pathway.Step{Admission: &pathway.Admission{Loc: testLoc}},
+		wantMessageDelay: map[string]time.Duration{"ADT^A01": 5 * time.Minute},
+	}, {
+		name:             "delay and skew",
+		timer:            MessageTimer{Delay: fiveMinutes, Skew: -30 * time.Second},
+		step:             pathway.Step{Admission: &pathway.Admission{Loc: testLoc}},
+		wantMessageDelay: map[string]time.Duration{"ADT^A01": 5*time.Minute - 30*time.Second},
+	}, {
+		name:  "step delay takes precedence over the timer delay",
+		timer: MessageTimer{Delay: fiveMinutes, Skew: -30 * time.Second},
+		step: pathway.Step{
+			Admission:  &pathway.Admission{Loc: testLoc},
+			Parameters: &pathway.Parameters{DelayMessage: &pathway.Delay{From: time.Minute, To: time.Minute}},
+		},
+		wantMessageDelay: map[string]time.Duration{"ADT^A01": time.Minute - 30*time.Second},
+	}, {
+		name:  "historical event",
+		timer: MessageTimer{Delay: fiveMinutes},
+		step: pathway.Step{
+			Admission:  &pathway.Admission{Loc: testLoc},
+			Parameters: &pathway.Parameters{TimeFromNow: &oneHourAgo},
+		},
+		wantMessageDelay: map[string]time.Duration{"ADT^A01": -time.Hour + 5*time.Minute},
+		wantEventDelay:   -time.Hour,
+	}, {
+		name:          "order acknowledgement",
+		timer:         MessageTimer{Delay: fiveMinutes, Skew: time.Minute},
+		orderAckDelay: &pathway.Delay{From: 10 * time.Second, To: 10 * time.Second},
+		step:          pathway.Step{Order: &pathway.Order{OrderProfile: "UREA AND ELECTROLYTES"}},
+		wantMessageDelay: map[string]time.Duration{
+			"ORM^O01": 6 * time.Minute,
+			"ORR^O02": 6*time.Minute + 10*time.Second,
+		},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pathways := map[string]pathway.Pathway{testPathwayName: {Pathway: []pathway.Step{tc.step}}}
+			hospital := hospitalWithTime(t, Config{AdditionalConfig: AdditionalConfig{MessageTimer: tc.timer, OrderAckDelay: tc.orderAckDelay}}, pathways, now)
+			defer hospital.Close()
+
+			startPathway(t, hospital, testPathwayName)
+			_, messages := hospital.ConsumeQueues(t)
+			if got, want := len(messages), len(tc.wantMessageDelay); got != want {
+				t.Fatalf("StartPathway(%v) generated %v messages, want %v", testPathwayName, got, want)
+			}
+			for _, m := range messages {
+				mt := testhl7.MessageType(t, m)
+				want, ok := tc.wantMessageDelay[mt]
+				if !ok {
+					t.Errorf("StartPathway(%v) generated unexpected message type %v", testPathwayName, mt)
+					continue
+				}
+				if got := testhl7.MessageDateTime(t, m).Sub(now); got != want {
+					t.Errorf("Messages[%s] delay got %v, want %v", mt, got, want)
+				}
+				if !strings.HasPrefix(mt, "ADT") {
+					continue
+				}
+				if got := testhl7.EventDateTime(t, m).Sub(now); got != tc.wantEventDelay {
+					t.Errorf("Events[%s] delay got %v, want %v", mt, got, tc.wantEventDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestStartPathway_MessageTimerSkewDoesNotChangeSendTime(t *testing.T) {
+	now := time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)
+	pathways := map[string]pathway.Pathway{testPathwayName: {Pathway: []pathway.Step{{Admission: &pathway.Admission{Loc: testLoc}}}}}
+
+	for _, skew := range []time.Duration{-time.Hour, time.Hour} {
+		t.Run(skew.String(), func(t *testing.T) {
+			timer := MessageTimer{Skew: skew}
+			hospital := hospitalWithTime(t, Config{AdditionalConfig: AdditionalConfig{MessageTimer: timer}}, pathways, now)
+			defer hospital.Close()
+
+			startPathway(t, hospital, testPathwayName)
+			if ran, err := hospital.RunNextEventIfDue(); !ran || err != nil {
+				t.Fatalf("hospital.RunNextEventIfDue() got (%v, %v), want (true, nil)", ran, err)
+			}
+			// The message is due at the time of the event, regardless of the skew.
+			if ran, err := hospital.ProcessNextMessageIfDue(); !ran || err != nil {
+				t.Fatalf("hospital.ProcessNextMessageIfDue() got (%v, %v), want (true, nil)", ran, err)
+			}
+			messages := hospital.Sender.GetSentMessages()
+			if got, want := len(messages), 1; got != want {
+				t.Fatalf("len(hospital.Sender.GetSentMessages()) got %v, want %v", got, want)
+			}
+			if got, want := testhl7.MessageDateTime(t, messages[0]).Sub(now), skew; got != want {
+				t.Errorf("MSH.7 Date/Time Of Message delay got %v, want %v", got, want)
+			}
+			if got, want := testhl7.EventDateTime(t, messages[0]).Sub(now), time.Duration(0); got != want {
+				t.Errorf("EVN.2 Recorded Date/Time delay got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewHospital_InvalidMessageTimerDelay(t *testing.T) {
+	c, err := DefaultConfig(testhospital.Arguments)
+	if err != nil {
+		t.Fatalf("DefaultConfig(%+v) failed with %v", testhospital.Arguments, err)
+	}
+	c.Sender = &testhl7.Sender{}
+	c.AdditionalConfig.MessageTimer = MessageTimer{Delay: &pathway.Delay{From: time.Minute, To: time.Second}}
+	if _, err := NewHospital(c); err == nil {
+		t.Errorf("NewHospital() with MessageTimer.Delay %+v got err=<nil>, want error", c.AdditionalConfig.MessageTimer.Delay)
+	}
+}
+
+func TestSeed_SameMessages(t *testing.T) {
+	pathways := map[string]pathway.Pathway{
+		testPathwayName: {Pathway: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{Result: &pathway.Results{OrderProfile: "RANDOM"}},
+			{Document: &pathway.Document{}},
+			{Discharge: &pathway.Discharge{}},
+		}},
+	}
+
+	run := func() []string {
+		Seed(42)
+		// The default test address generator is shared by all the test hospitals.
+		cfg := Config{AdditionalConfig: AdditionalConfig{AddressGenerator: &testaddress.Generator{Country: "GBR", Cities: []string{"London"}}}}
+		hospital := newHospital(t, cfg, pathways)
+		defer hospital.Close()
+		startPathway(t, hospital, testPathwayName)
+		_, messages := hospital.ConsumeQueues(t)
+		return messages
+	}
+
+	first := run()
+	second := run()
+	if len(first) == 0 {
+		t.Fatalf("StartPathway(%v) generated no messages, want some", testPathwayName)
+	}
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("StartPathway(%v) with the same seed generated messages with diff (-first, +second):\n%s", testPathwayName, diff)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	pathways := map[string]pathway.Pathway{
+		testPathwayName: {Pathway: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{Delay: &pathway.Delay{From: time.Hour, To: time.Hour}},
+			{Transfer: &pathway.Transfer{Loc: testLocAE}},
+			{Delay: &pathway.Delay{From: 24 * time.Hour, To: 24 * time.Hour}},
+			{Discharge: &pathway.Discharge{}},
+		}},
+	}
+	hospital := newHospital(t, Config{}, pathways)
+	defer hospital.Close()
+	p, err := hospital.PathwayManager.GetPathway(testPathwayName)
+	if err != nil {
+		t.Fatalf("GetPathway(%s) failed with %v", testPathwayName, err)
+	}
+
+	messages, errFn := hospital.Messages(context.Background(), p)
+	var got []string
+	for m := range messages {
+		got = append(got, fmt.Sprintf("%s^%s", m.Type.MessageType, m.Type.TriggerEvent))
+	}
+	if err := errFn(); err != nil {
+		t.Fatalf("Messages(%v) failed with %v", testPathwayName, err)
+	}
+
+	want := []string{"ADT^A01", "ADT^A02", "ADT^A03"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Messages(%v) got diff (-want, +got):\n%s", testPathwayName, diff)
+	}
+	if sent := hospital.Sender.GetSentMessages(); len(sent) != 0 {
+		t.Errorf("Messages(%v) sent %d messages, want 0", testPathwayName, len(sent))
+	}
+	if hospital.HasEvents() || hospital.HasMessages() {
+		t.Errorf("HasEvents() || HasMessages() got true after draining Messages(%v), want false", testPathwayName)
+	}
+}
+
+func TestMessages_Cancelled(t *testing.T) {
+	pathways := map[string]pathway.Pathway{
+		testPathwayName: {Pathway: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{Discharge: &pathway.Discharge{}},
+		}},
+	}
+	hospital := newHospital(t, Config{}, pathways)
+	defer hospital.Close()
+	p, err := hospital.PathwayManager.GetPathway(testPathwayName)
+	if err != nil {
+		t.Fatalf("GetPathway(%s) failed with %v", testPathwayName, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, errFn := hospital.Messages(ctx, p)
+	if _, ok := <-messages; !ok {
+		t.Fatalf("Messages(%v) closed the channel before yielding any message", testPathwayName)
+	}
+	// Nothing else is read from the channel, so the pathway cannot advance past the next message.
+	cancel()
+	if err := errFn(); err != context.Canceled {
+		t.Errorf("Messages(%v) after cancelling got err %v, want %v", testPathwayName, err, context.Canceled)
+	}
+}
+
 func TestStartPathway_OrderAckDelayIsRandom(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	pathways := map[string]pathway.Pathway{
 		testPathwayName: {Pathway: []pathway.Step{{
 			Order: &pathway.Order{
@@ -686,6 +913,56 @@ func TestRunPathway_StepTypes(t *testing.T) {
 				t.Errorf("hospital.LocationManager.RoomManagers[testLoc].OccupiedBeds()=%v, want %v", got, want)
 			}
 		},
+	}, {
+		name: "Temporary Transfer",
+		pathway: pathway.Pathway{Pathway: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{Transfer: &pathway.Transfer{Loc: "X-RAY", IsTemporary: true}},
+			{Transfer: &pathway.Transfer{Loc: "Hallway", IsTemporary: true}},
+		}},
+		wantMessageTypes: []string{"ADT^A01", "ADT^A02", "ADT^A02"},
+		want: func(t *testing.T, messages []string, hospital *testhospital.Hospital) {
+			firstTransferPV1, secondTransferPV1 := testhl7.PV1(t, messages[1]), testhl7.PV1(t, messages[2])
+
+			// The patient keeps their permanent location.
+			if got, want := firstTransferPV1.AssignedPatientLocation.PointOfCare.String(), hospital.LocationManager.RoomManagers[testLoc].Poc; got != want {
+				t.Errorf("firstTransferPV1.AssignedPatientLocation.PointOfCare.String()=%v, want %v", got, want)
+			}
+			if got, want := firstTransferPV1.TemporaryLocation.PointOfCare.String(), "X-RAY"; got != want {
+				t.Errorf("firstTransferPV1.TemporaryLocation.PointOfCare.String()=%v, want %v", got, want)
+			}
+			if got, want := secondTransferPV1.PriorTemporaryLocation.PointOfCare.String(), "X-RAY"; got != want {
+				t.Errorf("secondTransferPV1.PriorTemporaryLocation.PointOfCare.String()=%v, want %v", got, want)
+			}
+			if got, want := secondTransferPV1.TemporaryLocation.PointOfCare.String(), "Hallway"; got != want {
+				t.Errorf("secondTransferPV1.TemporaryLocation.PointOfCare.String()=%v, want %v", got, want)
+			}
+			if got, want := hospital.LocationManager.RoomManagers[testLoc].OccupiedBeds(), 1; got != want {
+				t.Errorf("hospital.LocationManager.RoomManagers[testLoc].OccupiedBeds()=%v, want %v", got, want)
+			}
+		},
+	}, {
+		name: "Temporary Transfer of a dead patient",
+		pathway: pathway.Pathway{Pathway: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{
+				Transfer:   &pathway.Transfer{Loc: "X-RAY", IsTemporary: true},
+				Parameters: &pathway.Parameters{Status: &pathway.DeathStatus{DeathIndicator: "Y", TimeSinceDeath: &twoHours}},
+			},
+		}},
+		wantMessageTypes: []string{"ADT^A01", "ADT^A02"},
+		want: func(t *testing.T, messages []string, hospital *testhospital.Hospital) {
+			transferPV1 := testhl7.PV1(t, messages[1])
+			if got, want := transferPV1.TemporaryLocation.PointOfCare.String(), "X-RAY"; got != want {
+				t.Errorf("transferPV1.TemporaryLocation.PointOfCare.String()=%v, want %v", got, want)
+			}
+			if transferPV1.AssignedPatientLocation != nil {
+				t.Errorf("transferPV1.AssignedPatientLocation is %+v, want <nil>", transferPV1.AssignedPatientLocation)
+			}
+			if got, want := hospital.LocationManager.RoomManagers[testLoc].OccupiedBeds(), 0; got != want {
+				t.Errorf("hospital.LocationManager.RoomManagers[testLoc].OccupiedBeds()=%v, want %v", got, want)
+			}
+		},
 	}, {
 		name: "Cancel Visit after Admission",
 		pathway: pathway.Pathway{Pathway: []pathway.Step{
@@ -1677,6 +1954,14 @@ func TestStartPathway_OccupiedBed(t *testing.T) {
 		},
 		wantMessageTypes: []string{"ADT^A02"},
 		wantOccupiedBeds: []wantOccupiedBed{{loc: testLoc, want: 1}},
+	}, {
+		name: "Transfer within the same location moves to another bed",
+		steps: []pathway.Step{
+			{Admission: &pathway.Admission{Loc: testLoc}},
+			{Transfer: &pathway.Transfer{Loc: testLoc}},
+		},
+		wantMessageTypes: []string{"ADT^A01", "ADT^A02"},
+		wantOccupiedBeds: []wantOccupiedBed{{loc: testLoc, want: 1}},
 	}, {
 		name: "Specific bed in Admission",
 		steps: []pathway.Step{
@@ -1710,11 +1995,12 @@ func TestStartPathway_OccupiedBed(t *testing.T) {
 			{Admission: &pathway.Admission{Loc: testLoc}},
 			{Transfer: &pathway.Transfer{Loc: testLocAE, Bed: "arbitrary-preoccupied-bed"}},
 		},
-		// The transfer event fails because we can't occupy an already occupied bed.
+		// The transfer event fails because we can't occupy an already occupied bed,
+		// and the patient keeps their bed.
 		wantMessageTypes: []string{"ADT^A01"},
 		wantOccupiedBeds: []wantOccupiedBed{
 			{loc: testLocAE, want: 1},
-			{loc: testLoc, want: 0},
+			{loc: testLoc, want: 1},
 		},
 	}, {
 		name: "Cancel Visit after Admission",
@@ -3891,6 +4177,33 @@ func TestRunPathwayResultsOnSameOrDifferentOrders(t *testing.T) {
 			}}},
 		wantResultStatus: [][]string{{"P", "P"}, {"F", "F"}, {"C", "C"}},
 		wantSetID:        [][]string{{"1", "2"}, {"1", "2"}, {"1", "2"}},
+	}, {
+		name: "append correction",
+		pathway: pathway.Pathway{
+			History: []pathway.Step{{
+				Result: &pathway.Results{
+					OrderID:      "uspelvis_transa_transv1",
+					OrderProfile: orderProfile,
+					Results:      []*pathway.Result{result},
+				},
+				Parameters: &pathway.Parameters{TimeFromNow: &timeFromNow},
+			}},
+			Pathway: []pathway.Step{{
+				Result: &pathway.Results{
+					OrderID:          "uspelvis_transa_transv1",
+					OrderProfile:     orderProfile,
+					Results:          []*pathway.Result{result},
+					AppendCorrection: true,
+				},
+			}, {
+				Result: &pathway.Results{
+					OrderID:      "uspelvis_transa_transv1",
+					OrderProfile: orderProfile,
+					Results:      []*pathway.Result{result},
+				},
+			}}},
+		wantResultStatus: [][]string{{"F"}, {"F", "C"}, {"C"}},
+		wantSetID:        [][]string{{"1"}, {"1", "2"}, {"3"}},
 	}} {
 		t.Run(tt.name, func(t *testing.T) {
 			pathways := map[string]pathway.Pathway{
@@ -4092,7 +4405,7 @@ func TestHasEvents_HasMessages_RunNextEventIfDue_ProcessNextMessageIfDue(t *test
 }
 
 func TestStartNextPathway(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	pathways := map[string]pathway.Pathway{
 		"pathway1": {Pathway: []pathway.Step{
 			{Admission: &pathway.Admission{Loc: testLocAE}},
@@ -208,7 +208,7 @@ func TestManagerOccupyAvailableBedReoccupyFreedBed(t *testing.T) {
 	}
 
 	if err := locationManager.FreeBed(got); err != nil {
-		t.Fatalf("FreeBed(%s) failed with %v", got, err)
+		t.Fatalf("FreeBed(%+v) failed with %v", got, err)
 	}
 	if gotCount, wantCount := locationManager.RoomManagers[aAndEID].OccupiedBeds(), 0; gotCount != wantCount {
 		t.Errorf("RoomManagers[%s].OccupiedBeds()=%d, want %d", aAndEID, gotCount, wantCount)
@@ -296,7 +296,7 @@ func TestManagerOccupySpecificBedReoccupyFreedBed(t *testing.T) {
 	}
 
 	if err := locationManager.FreeBed(got); err != nil {
-		t.Errorf("FreeBed(%s) failed with %v", got, err)
+		t.Errorf("FreeBed(%+v) failed with %v", got, err)
 	}
 	if gotCount, wantCount := locationManager.RoomManagers[aAndEID].OccupiedBeds(), 0; gotCount != wantCount {
 		t.Errorf("RoomManagers[%s].OccupiedBeds()=%d, want %d", aAndEID, gotCount, wantCount)
@@ -329,12 +329,12 @@ func TestManagerFreeBed(t *testing.T) {
 
 	// The first time we free it, everything is good.
 	if err := locationManager.FreeBed(got); err != nil {
-		t.Errorf("FreeBed(%s) failed with %v", got, err)
+		t.Errorf("FreeBed(%+v) failed with %v", got, err)
 	}
 
 	// The second time it's already free so we expect an error.
 	if err := locationManager.FreeBed(got); err == nil {
-		t.Errorf("FreeBed(%s) got nil err, want not nil error", got)
+		t.Errorf("FreeBed(%+v) got nil err, want not nil error", got)
 	}
 }
 
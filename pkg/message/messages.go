@@ -16,15 +16,23 @@ package message
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/hl7"
 	"github.com/google/simhospital/pkg/logging"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // The fields in this block are HL7 message types Simulated Hospital supports.
@@ -40,6 +48,10 @@ const (
 	ORU = "ORU"
 	// MDM represents an MDM HL7v2 message.
 	MDM = "MDM"
+	// QBP represents a QBP HL7v2 message.
+	QBP = "QBP"
+	// QRY represents a QRY HL7v2 message.
+	QRY = "QRY"
 )
 
 // DiagnosticServIDMDOC is the value of the Diagnostic Serv ID field (OBR_24) for clinical documents.
@@ -50,21 +62,192 @@ const SegmentTerminator = constants.SegmentTerminatorStr
 
 // Person represents a person.
 type Person struct {
-	Prefix         string
-	FirstName      string
-	MiddleName     string
-	Surname        string
-	Suffix         string
-	Degree         string
-	Gender         string
-	Ethnicity      *Ethnicity
-	Birth          NullTime
-	DateOfDeath    NullTime
-	Address        *Address
-	PhoneNumber    string
-	MRN            string
-	NHS            string
+	Prefix      string
+	FirstName   string
+	MiddleName  string
+	Surname     string
+	Suffix      string
+	Degree      string
+	Gender      string
+	Ethnicity   *Ethnicity
+	Birth       NullTime
+	DateOfDeath NullTime
+	Address     *Address
+	PhoneNumber string
+	MRN         string
+	// MRNsByAuthority are the person's MRNs keyed by assigning authority, for when the same person
+	// is known by different MRNs in different facilities. The MRN for the sending facility of the
+	// message is used in PID.3 instead of MRN. Not set by default.
+	MRNsByAuthority map[string]string
+	NHS             string
+	// NHSVerificationStatus is the verification status of the NHS number, e.g. "01" (traced and verified).
+	// If set, it is rendered in the Assigning Facility component of the NHS number in PID.3.
+	NHSVerificationStatus string
+	// ExternalID is the Patient ID (External ID), sent in PID.2. If empty, PID.2 is set to the MRN.
+	ExternalID string
+	// AccountNumber is the patient account number (PID.18), used for billing.
+	// It can differ from the visit number (PV1.19). Not set by default.
+	AccountNumber  string
 	DeathIndicator string
+	// NameTypeCode is the Name Type Code component of the person's name (XPN.7), e.g.
+	// NameTypeLegal or NameTypeAlias. If empty, DefaultNameTypeCode is used.
+	NameTypeCode string
+}
+
+// Values for Person.NameTypeCode, as per the HL7 table 0200 (Name Type).
+const (
+	// DefaultNameTypeCode is the name type code used if Person.NameTypeCode is not set.
+	// It is not a value in the HL7 table, but it is kept for backwards compatibility.
+	DefaultNameTypeCode = "CURRENT"
+	NameTypeLegal       = "L"
+	NameTypeMaiden      = "M"
+	NameTypeAlias       = "A"
+)
+
+// Values for Person.Gender, as per the HL7 table 0001 (Administrative Sex).
+const (
+	GenderFemale  = "F"
+	GenderMale    = "M"
+	GenderOther   = "O"
+	GenderUnknown = "U"
+)
+
+// Values for Person.DeathIndicator.
+const (
+	DeathIndicatorAlive = "N"
+	DeathIndicatorDead  = "Y"
+)
+
+// PersonOption sets a field of a Person built with NewPerson.
+type PersonOption func(*Person)
+
+// WithName sets the first name and the surname of the person.
+func WithName(firstName string, surname string) PersonOption {
+	return func(p *Person) {
+		p.FirstName = firstName
+		p.Surname = surname
+	}
+}
+
+// WithGender sets the gender of the person. It must be one of the Gender* values.
+func WithGender(gender string) PersonOption {
+	return func(p *Person) {
+		p.Gender = gender
+	}
+}
+
+// WithBirth sets the date of birth of the person.
+func WithBirth(birth time.Time) PersonOption {
+	return func(p *Person) {
+		p.Birth = NewValidTime(birth)
+	}
+}
+
+// WithDeath sets the date of death of the person.
+func WithDeath(death time.Time) PersonOption {
+	return func(p *Person) {
+		p.DateOfDeath = NewValidTime(death)
+	}
+}
+
+// WithDeathIndicator sets the death indicator of the person.
+func WithDeathIndicator(indicator string) PersonOption {
+	return func(p *Person) {
+		p.DeathIndicator = indicator
+	}
+}
+
+// WithIdentifiers sets the MRN and NHS number of the person.
+func WithIdentifiers(mrn string, nhs string) PersonOption {
+	return func(p *Person) {
+		p.MRN = mrn
+		p.NHS = nhs
+	}
+}
+
+// WithAddress sets the address of the person.
+func WithAddress(address *Address) PersonOption {
+	return func(p *Person) {
+		p.Address = address
+	}
+}
+
+// WithPhoneNumber sets the phone number of the person.
+func WithPhoneNumber(phoneNumber string) PersonOption {
+	return func(p *Person) {
+		p.PhoneNumber = phoneNumber
+	}
+}
+
+// NewPerson returns a Person with the given options applied, and defaults set for the fields
+// that are needed to render a well-formed PID segment:
+// - Gender defaults to GenderUnknown.
+// - DeathIndicator defaults to DeathIndicatorDead if there is a date of death, and to
+//   DeathIndicatorAlive otherwise.
+// It returns an error if the gender is not one of the Gender* values, or if the person has a
+// date of death but the death indicator says they are alive.
+// Person can still be constructed directly if no defaults or validation are wanted.
+func NewPerson(opts ...PersonOption) (*Person, error) {
+	p := &Person{}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.Gender == "" {
+		p.Gender = GenderUnknown
+	}
+	switch p.Gender {
+	case GenderFemale, GenderMale, GenderOther, GenderUnknown:
+	default:
+		return nil, fmt.Errorf("invalid gender %q; want one of %q, %q, %q or %q", p.Gender, GenderFemale, GenderMale, GenderOther, GenderUnknown)
+	}
+
+	if p.DeathIndicator == "" {
+		p.DeathIndicator = DeathIndicatorAlive
+		if p.DateOfDeath.Valid {
+			p.DeathIndicator = DeathIndicatorDead
+		}
+	}
+	if p.DateOfDeath.Valid && p.DeathIndicator == DeathIndicatorAlive {
+		return nil, fmt.Errorf("person with date of death %v has death indicator %q", p.DateOfDeath.Time, p.DeathIndicator)
+	}
+	return p, nil
+}
+
+// Placeholders for the demographics of unknown patients, e.g. unconscious trauma patients.
+const (
+	// UnknownName is the placeholder for the first name and the surname of unknown patients.
+	UnknownName = "UNKNOWN"
+	// TemporaryMRNPrefix is the prefix of the placeholder MRNs of unknown patients, which marks
+	// that the MRN is not the final one and is expected to be merged with the patient's real
+	// record later.
+	TemporaryMRNPrefix = "TEMP"
+)
+
+// temporaryMRNSuffixes is the number of different suffixes of temporary MRNs.
+const temporaryMRNSuffixes = 1000000000
+
+// NewUnknownPerson returns a Person for a patient whose demographics are unknown, e.g. an unconscious
+// trauma patient, with placeholder values that render a well-formed PID segment: UnknownName as the
+// first name and the surname, a temporary MRN, and no date of birth.
+// The temporary MRN is TemporaryMRNPrefix followed by a random number, e.g. TEMP254106873, so
+// that unknown patients are unlikely to share an MRN, and runs with the same seed get the same MRNs.
+// The gender is set to GenderUnknown if it is not one of the Gender* values.
+func NewUnknownPerson(gender string) *Person {
+	switch gender {
+	case GenderFemale, GenderMale, GenderOther, GenderUnknown:
+	default:
+		gender = GenderUnknown
+	}
+	return &Person{
+		FirstName:      UnknownName,
+		Surname:        UnknownName,
+		Gender:         gender,
+		Birth:          NewInvalidTime(),
+		DateOfDeath:    NewInvalidTime(),
+		MRN:            TemporaryMRNPrefix + strconv.FormatInt(random.Int63n(temporaryMRNSuffixes), 10),
+		DeathIndicator: DeathIndicatorAlive,
+	}
 }
 
 // CodedElement represents a HL7v2 Coded Element: https://hl7-definition.caristix.com/v2/HL7v2.2/DataTypes/CE.
@@ -72,7 +255,44 @@ type CodedElement struct {
 	ID            string
 	Text          string
 	CodingSystem  string
+	AlternateID   string
 	AlternateText string
+	// AlternateCodingSystem is the coding system of AlternateID, e.g. LN for LOINC.
+	AlternateCodingSystem string
+}
+
+// StructuredNumeric represents a HL7v2 Structured Numeric value: https://hl7-definition.caristix.com/v2/HL7v2.3/DataTypes/SN,
+// e.g. a titer or ratio (1:256), a range (10-20), or a number with a comparator (<0.5).
+type StructuredNumeric struct {
+	// Comparator is one of >, <, >=, <=, = or <>.
+	Comparator string
+	Num1       string
+	// Separator is one of -, +, / or :.
+	Separator string
+	Num2      string
+}
+
+// structuredNumericRegex matches structured numeric values: an optional comparator, a number,
+// and optionally a separator followed by a second number.
+var structuredNumericRegex = regexp.MustCompile(`^(<>|<=|>=|<|>|=)?\s*(-?[0-9]+(?:\.[0-9]+)?)\s*(?:([-+/:])\s*(-?[0-9]+(?:\.[0-9]+)?)?)?$`)
+
+// ParseStructuredNumeric parses a Structured Numeric value in one of the following forms:
+// a:b or a/b, e.g. a titer or a ratio;
+// a-b, e.g. a range;
+// a+, e.g. "2+";
+// <a, >a, <=a, >=a, =a or <>a, i.e., a number with a comparator;
+// a, i.e., a plain number.
+// Returns an error if s is not in any of these forms.
+func ParseStructuredNumeric(s string) (*StructuredNumeric, error) {
+	groups := structuredNumericRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if groups == nil {
+		return nil, fmt.Errorf("cannot parse %q as a structured numeric value", s)
+	}
+	sn := &StructuredNumeric{Comparator: groups[1], Num1: groups[2], Separator: groups[3], Num2: groups[4]}
+	if sn.Separator != "" && sn.Separator != "+" && sn.Num2 == "" {
+		return nil, fmt.Errorf("cannot parse %q as a structured numeric value: missing second number after %q", s, sn.Separator)
+	}
+	return sn, nil
 }
 
 // Order represents a clinical order.
@@ -88,6 +308,10 @@ type Order struct {
 	// CollectedDateTime is the
 	// OBR / OBX -> Observation Date Time (the same for all observations for one report).
 	CollectedDateTime NullTime
+	// ObservationEndDateTime is the OBR -> Observation End Date/Time.
+	// It is only set for observations that span a time interval, e.g. a 24h urine collection,
+	// in which case CollectedDateTime is the start of the interval.
+	ObservationEndDateTime NullTime
 	// ReceivedInLabDateTime is the OBR -> Specimen Received in Lab.
 	ReceivedInLabDateTime NullTime
 	// ReportedDateTime is the OBR -> Results Rpt/Status Change.
@@ -103,6 +327,11 @@ type Order struct {
 	// ResultsStatus is the OBR -> Result Status
 	// (http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&table=0123)
 	ResultsStatus string
+	// Priority is the priority component of the ORC / OBR -> Quantity/Timing, e.g. S (STAT),
+	// A (ASAP) or R (Routine).
+	// (http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&table=0027)
+	// If empty, the priority is not set.
+	Priority string
 	// Results (observations) relevant to ORU messages. They translate into OBX segments and contain
 	// clinically relevant information, for instance:
 	// "OBX|1|NM|lpdc-3384^Urea^WinPath||5.0|MMOLL|2.1 - 7.1||||F|||||".
@@ -115,31 +344,256 @@ type Order struct {
 	// NotesForORM are the notes for ORM messages. These still generate NTE segments, but such segments are located before
 	// the OBX segments and refer to the order in general instead of the results as the Notes field in
 	// the Result struct.
-	NotesForORM      []string
+	NotesForORM []string
+	// OrderingProvider is the ORC -> Ordering Provider and the OBR -> Ordering Provider.
 	OrderingProvider *Doctor
-	SpecimenSource   string
+	// EnteredBy is the ORC -> Entered By. It is optional.
+	EnteredBy      *Doctor
+	SpecimenSource string
+	// CodedSpecimenSource is the OBR -> Specimen Source with its components, e.g. the body site.
+	// If set, it takes precedence over SpecimenSource.
+	CodedSpecimenSource *SpecimenSource
+	// PrincipalInterpreter is the OBR -> Principal Result Interpreter, e.g. the pathologist
+	// reporting a cytology or histology specimen. It is optional.
+	PrincipalInterpreter *Doctor
+	// AssistantInterpreters is the OBR -> Assistant Result Interpreter. It is optional.
+	AssistantInterpreters []*Doctor
+	// CollectionVolume is the quantity of the OBR -> Collection Volume, e.g. 2500 for a 24 hour urine
+	// collection. It is optional.
+	CollectionVolume string
+	// CollectionVolumeUnit is the unit of the OBR -> Collection Volume, e.g. mL. It is only
+	// rendered if CollectionVolume is set.
+	CollectionVolumeUnit string
+	// Collector is the OBR -> Collector Identifier, i.e., the person who collected the specimen,
+	// e.g. a phlebotomist. It is optional.
+	Collector *Doctor
+	// ParentResult is the OBR -> Parent Result, set for reflex orders. It is optional.
+	ParentResult *ParentResult
+	// ParentOrder is the OBR -> Parent, set for reflex orders. It is optional.
+	ParentOrder *ParentOrder
+	// SpecimenActionCode is the OBR -> Specimen Action Code, e.g. A (Add ordered tests to the existing
+	// specimen), G (Generated order; reflex order), L (Lab to obtain specimen from patient), O (Specimen
+	// obtained by service other than Lab), P (Pending specimen), R (Revised order) or S (Schedule the
+	// tests specified below).
+	// (http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&table=0065)
+	// If empty, the specimen action code is not set.
+	SpecimenActionCode string
+	// RelevantClinicalInfo is the OBR -> Relevant Clinical Information, e.g. "On warfarin",
+	// which can inform the interpretation of the results. It is optional.
+	RelevantClinicalInfo string
 	// DiagnosticServID is the value to be set in the Diagnostic Serv Sect ID (OBR.24) field.
-	// If the value matches DiagnosticServIDMDOC, the order is for a document/clinical note.
+	// If the value matches DiagnosticServIDMDOC, the order is for a document/clinical note
+	// even if IsClinicalNote is not set.
 	DiagnosticServID string
+	// IsClinicalNote indicates that the order is for a document/clinical note, regardless of the
+	// value of DiagnosticServID.
+	IsClinicalNote bool
 	// NumberOfPreviousResults is used to keep track of how many results were already sent for this order.
 	// This allows for starting with the correct OBX SetID when sending new results linked to that order.
+	// As results can be sent in more than one OBX segment, it is the number of OBX segments of the
+	// previous results, as returned by NumberOfOBXSegments, rather than the number of results.
 	NumberOfPreviousResults int
 }
 
+// HasClinicalNote returns whether the order is for a document/clinical note, i.e., if
+// IsClinicalNote is set or DiagnosticServID is DiagnosticServIDMDOC.
+func (o *Order) HasClinicalNote() bool {
+	return o.IsClinicalNote || o.DiagnosticServID == DiagnosticServIDMDOC
+}
+
+// Validate returns an error if the dates of the order are not in chronological order, i.e.,
+// OrderDateTime <= CollectedDateTime <= ObservationEndDateTime <= ReceivedInLabDateTime <= ReportedDateTime.
+// Dates that are not valid are not checked.
+func (o *Order) Validate() error {
+	dates := []struct {
+		name string
+		t    NullTime
+	}{
+		{"OrderDateTime", o.OrderDateTime},
+		{"CollectedDateTime", o.CollectedDateTime},
+		{"ObservationEndDateTime", o.ObservationEndDateTime},
+		{"ReceivedInLabDateTime", o.ReceivedInLabDateTime},
+		{"ReportedDateTime", o.ReportedDateTime},
+	}
+	prev := -1
+	for i, d := range dates {
+		if !d.t.Valid {
+			continue
+		}
+		if prev >= 0 && d.t.Before(dates[prev].t.Time) {
+			return fmt.Errorf("%s %v is before %s %v", d.name, d.t.Time, dates[prev].name, dates[prev].t.Time)
+		}
+		prev = i
+	}
+	return nil
+}
+
 // Result represents a clinical result.
 type Result struct {
-	TestName            *CodedElement
-	Value               string
-	Unit                string
-	ValueType           string
-	Range               string
-	AbnormalFlag        string
+	TestName *CodedElement
+	// ObservationIdentifier is the OBX -> Observation Identifier, if it differs from TestName,
+	// e.g. a local code with a LOINC code as the alternate identifier.
+	// If not set, TestName is used.
+	ObservationIdentifier *CodedElement
+	Value                 string
+	// CodedValue is the OBX -> Observation Value as a Coded Element, for results with value type
+	// CE or CWE, e.g. 10828004^Positive^SCT. If set, it takes precedence over Value.
+	CodedValue *CodedElement
+	// NewlinesAsLineBreaks is whether the newlines in Value are sent as line breaks (\.br\) within a
+	// single OBX -> Observation Value, e.g. for narrative results. By default, each line of Value is
+	// sent as a repetition of the field.
+	NewlinesAsLineBreaks bool
+	// Unit is the OBX -> Units, as a plain string.
+	Unit string
+	// CodedUnit is the OBX -> Units as a Coded Element, e.g. for UCUM-coded units.
+	// If set, it takes precedence over Unit.
+	CodedUnit *CodedElement
+	ValueType string
+	// Range is the OBX -> Reference Range, as free text, e.g. "49 - 92".
+	// It is only used if neither RangeLow nor RangeHigh are set.
+	Range string
+	// RangeLow and RangeHigh are the lower and upper limits of the OBX -> Reference Range.
+	// If any of them is set, they are rendered using Options.ReferenceRangeFormat.
+	RangeLow     string
+	RangeHigh    string
+	AbnormalFlag string
+	// AbnormalFlags are several OBX -> Abnormal Flags, e.g. A (Abnormal) and H (High), rendered as
+	// repetitions of the field. If set, they are used instead of AbnormalFlag.
+	AbnormalFlags       []string
 	ObservationDateTime NullTime
+	// ProducerID is the OBX -> Producer's ID, i.e., the lab that produced the result, e.g. when
+	// results from several labs are consolidated. It is optional.
+	ProducerID *CodedElement
+	// ObservationMethod is the OBX -> Observation Method, e.g. how a vital sign was measured.
+	ObservationMethod *CodedElement
+	// AnalysisDateTime is the OBX -> Date/Time of the Analysis, i.e., when the analyzer ran.
+	// It is not rendered if not Valid.
+	AnalysisDateTime NullTime
+	// EquipmentInstanceID is the OBX -> Equipment Instance Identifier, i.e., the identifier of
+	// the analyzer that produced the result.
+	EquipmentInstanceID string
+	// ObservationType and ObservationSubType are the OBX -> Observation Type (e.g. RSLT) and
+	// OBX -> Observation Sub-Type. They only exist in HL7v2.6 and later, so they are only rendered
+	// if Options.HL7Version is 2.6 or later.
+	ObservationType    string
+	ObservationSubType string
+	// PerformingOrganization is the organization that performed the observation, e.g. a reference lab.
+	// It only exists in HL7v2.5 and later, so it is only rendered if Options.HL7Version is 2.5 or later.
+	PerformingOrganization *PerformingOrganization
 	// Status is the OBX -> Observation Result Status
 	// (http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&table=0085).
 	Status       string
 	Notes        []string
 	ClinicalNote *ClinicalNote
+	// ChildResults are results linked to this one, e.g. the antibiotic sensitivities of an organism
+	// in a microbiology result. They are rendered in OBX segments right after this result's OBX,
+	// linked via hierarchical OBX -> Observation Sub-ID values (1, 1.1, 1.2, ...).
+	// Only one level of nesting is supported: the ChildResults of a child result are ignored.
+	ChildResults []*Result
+}
+
+// PerformingOrganization is the organization that performed an observation, as sent in
+// OBX -> Performing Organization Name / Address / Medical Director.
+type PerformingOrganization struct {
+	Name string
+	// ID is the Organization Identifier component of the Performing Organization Name, e.g. the CLIA number.
+	ID              string
+	Address         *Address
+	MedicalDirector *Doctor
+}
+
+// DefaultReferenceRangeFormat is the default format used to render structured reference ranges,
+// e.g. "49-92".
+const DefaultReferenceRangeFormat = "%s-%s"
+
+// ReferenceRange returns the value of the OBX -> Reference Range field for this result.
+// If RangeLow or RangeHigh are set, they are rendered using the given format, or
+// DefaultReferenceRangeFormat if it is empty. Otherwise, the free-text Range is returned.
+func (r *Result) ReferenceRange(format string) string {
+	if r.RangeLow == "" && r.RangeHigh == "" {
+		return r.Range
+	}
+	if format == "" {
+		format = DefaultReferenceRangeFormat
+	}
+	return fmt.Sprintf(format, r.RangeLow, r.RangeHigh)
+}
+
+// VitalSign is a common vital sign, with its LOINC code, UCUM unit and normal adult range.
+// Use the predefined vital signs, e.g. HeartRate, to build results with VitalSign.Result.
+type VitalSign struct {
+	loincCode string
+	name      string
+	unit      string
+	rangeLow  string
+	rangeHigh string
+}
+
+// Common vital signs.
+var (
+	HeartRate              = VitalSign{loincCode: "8867-4", name: "Heart rate", unit: "/min", rangeLow: "60", rangeHigh: "100"}
+	RespiratoryRate        = VitalSign{loincCode: "9279-1", name: "Respiratory rate", unit: "/min", rangeLow: "12", rangeHigh: "20"}
+	SystolicBloodPressure  = VitalSign{loincCode: "8480-6", name: "Systolic blood pressure", unit: "mm[Hg]", rangeLow: "90", rangeHigh: "120"}
+	DiastolicBloodPressure = VitalSign{loincCode: "8462-4", name: "Diastolic blood pressure", unit: "mm[Hg]", rangeLow: "60", rangeHigh: "80"}
+	OxygenSaturation       = VitalSign{loincCode: "59408-5", name: "Oxygen saturation in Arterial blood by Pulse oximetry", unit: "%", rangeLow: "95", rangeHigh: "100"}
+	BodyTemperature        = VitalSign{loincCode: "8310-5", name: "Body temperature", unit: "Cel", rangeLow: "36.1", rangeHigh: "37.2"}
+)
+
+const (
+	// LOINCCodingSystem is the HL7 coding system for LOINC codes.
+	LOINCCodingSystem = "LN"
+	// UCUMCodingSystem is the HL7 coding system for UCUM units.
+	UCUMCodingSystem = "UCUM"
+)
+
+// Result returns a final numeric result for the vital sign with the given value, observed at the given time.
+// The method, e.g. how the blood pressure was measured, is optional.
+// The result's abnormal flag is not set.
+func (v VitalSign) Result(value string, method *CodedElement, observed NullTime) *Result {
+	return &Result{
+		TestName:            &CodedElement{ID: v.loincCode, Text: v.name, CodingSystem: LOINCCodingSystem},
+		Value:               value,
+		ValueType:           "NM",
+		CodedUnit:           &CodedElement{ID: v.unit, Text: v.unit, CodingSystem: UCUMCodingSystem},
+		RangeLow:            v.rangeLow,
+		RangeHigh:           v.rangeHigh,
+		ObservationDateTime: observed,
+		ObservationMethod:   method,
+		Status:              "F",
+	}
+}
+
+// SpecimenSource represents the components of the OBR -> Specimen Source field (data type CM_SPS).
+// Example: BLDV&Blood venous&HL70070^^^LA&Left Arm&HL70163^^.
+type SpecimenSource struct {
+	// Source is the Specimen Source Name or Code, e.g. BLDV (Blood venous) from HL7 table 0070.
+	Source    *CodedElement
+	Additives string
+	Freetext  string
+	// BodySite is the body site the specimen was taken from, e.g. LA (Left Arm) from HL7 table 0163.
+	BodySite     *CodedElement
+	SiteModifier *CodedElement
+	// CollectionMethod is the Collection Method Modifier Code, e.g. a venipuncture.
+	CollectionMethod *CodedElement
+}
+
+// ParentResult represents the components of the OBR -> Parent Result field, which links a reflex
+// order to the result that triggered it.
+// Example: 5671-3&Lead&LN^1^Elevated.
+type ParentResult struct {
+	// ObservationIdentifier is the OBX -> Observation Identifier of the parent result.
+	ObservationIdentifier *CodedElement
+	// SubID is the OBX -> Observation Sub-ID of the parent result.
+	SubID string
+	// Value is a part of the OBX -> Observation Value of the parent result, e.g. the organism name.
+	Value string
+}
+
+// ParentOrder represents the components of the OBR -> Parent field, i.e., the placer and filler
+// order numbers of the order that a reflex order is related to.
+type ParentOrder struct {
+	Placer string
+	Filler string
 }
 
 // ClinicalNoteContent contains data used to generate an OBX segment in a ClinicalNote HL7 message.
@@ -163,6 +617,26 @@ type ClinicalNote struct {
 	Contents      []*ClinicalNoteContent
 }
 
+// AddendumForNote returns a copy of the existing Clinical Note with the given content appended to its Contents.
+// The DocumentID, DocumentType, DocumentTitle and DateTime of the existing note are preserved.
+// Returns an error if documentID doesn't match the DocumentID of the existing note.
+func AddendumForNote(existing *ClinicalNote, documentID string, content *ClinicalNoteContent) (*ClinicalNote, error) {
+	if existing == nil {
+		return nil, errors.New("cannot create an addendum for a nil clinical note")
+	}
+	if content == nil {
+		return nil, errors.New("cannot create an addendum with nil content")
+	}
+	if existing.DocumentID != documentID {
+		return nil, fmt.Errorf("cannot create an addendum for document %q: existing note has document ID %q", documentID, existing.DocumentID)
+	}
+	addendum := *existing
+	addendum.Contents = make([]*ClinicalNoteContent, 0, len(existing.Contents)+1)
+	addendum.Contents = append(addendum.Contents, existing.Contents...)
+	addendum.Contents = append(addendum.Contents, content)
+	return &addendum, nil
+}
+
 // Document represents a generic document.
 // It is used to populate the TXA and OBX segments of an MDM message.
 type Document struct {
@@ -172,6 +646,12 @@ type Document struct {
 	DocumentType             string
 	DocumentCompletionStatus string
 	UniqueDocumentNumber     string
+	// Originator is the TXA.9 Originator Code/Name, i.e., the person who originated the document.
+	// It is optional.
+	Originator *Doctor
+	// Authenticator is the TXA.22 Authentication Person, i.e., the person who signed the document.
+	// It is optional.
+	Authenticator *Doctor
 
 	// Fields used in OBX segments.
 	// ObservationIdentifier populates the OBX.3 (Observation Identifier) field in each OBX segment.
@@ -179,6 +659,12 @@ type Document struct {
 	// ContentLine contains values to be set in the OBX.5 (Observation Value) field.
 	// Each line generates a different OBX segment.
 	ContentLine []string
+	// BinaryContent is the content of a binary document, e.g. a scanned PDF. If set, it is sent
+	// base64-encoded in a single OBX segment with value type ED (Encapsulated Data), and
+	// ContentLine is ignored.
+	BinaryContent []byte
+	// BinaryContentType is the data subtype of BinaryContent, e.g. PDF.
+	BinaryContentType string
 }
 
 const (
@@ -191,6 +677,9 @@ const (
 	escapedLineBreak             = "\\.br\\"
 	backwardSlash                = "\\"
 	escapedBackwardSlash         = "\\E\\"
+	fieldSeparator               = "|"
+	escapedFieldSeparator        = "\\F\\"
+	escapedListItemsSeparator    = "\\R\\"
 )
 
 // Ethnicity is a HL7v2 coded element to represent ethnicities.
@@ -206,6 +695,8 @@ type Address struct {
 	Country    string
 	// Type is the type of the address, eg. HOME or WORK.
 	Type string
+	// County is the county or parish code, rendered in the XAD.9 component.
+	County string
 }
 
 // HL7Message represents a HL7 Message.
@@ -218,6 +709,69 @@ type HL7Message struct {
 type Type struct {
 	MessageType  string
 	TriggerEvent string
+	// MessageStructure is the message structure component of MSH.9, e.g. ADT_A01 for an ADT^A04.
+	// If empty, it is derived from the message type and the trigger event when the HL7 version is
+	// 2.3.1 or later, as the component doesn't exist in earlier versions.
+	MessageStructure string
+}
+
+// messageStructures maps the message types and trigger events that share the message structure of
+// another trigger event to that structure, as defined in HL7 table 0354 - Message Structure.
+// The structure of the ones that are not listed is MessageType_TriggerEvent.
+var messageStructures = map[string]string{
+	"ADT^A04": "ADT_A01",
+	"ADT^A08": "ADT_A01",
+	"ADT^A13": "ADT_A01",
+	"ADT^A07": "ADT_A06",
+	"ADT^A14": "ADT_A05",
+	"ADT^A28": "ADT_A05",
+	"ADT^A31": "ADT_A05",
+	"ADT^A10": "ADT_A09",
+	"ADT^A11": "ADT_A09",
+	"ADT^A22": "ADT_A21",
+	"ADT^A23": "ADT_A21",
+	"ADT^A25": "ADT_A21",
+	"ADT^A26": "ADT_A21",
+	"ADT^A27": "ADT_A21",
+	"ADT^A29": "ADT_A21",
+	"ADT^A32": "ADT_A21",
+	"ADT^A33": "ADT_A21",
+	"ADT^A34": "ADT_A30",
+	"ADT^A35": "ADT_A30",
+	"ADT^A36": "ADT_A30",
+	"ADT^A46": "ADT_A30",
+	"ADT^A47": "ADT_A30",
+	"ADT^A48": "ADT_A30",
+	"ADT^A49": "ADT_A30",
+	"ADT^A40": "ADT_A39",
+	"ADT^A41": "ADT_A39",
+	"ADT^A42": "ADT_A39",
+	"ADT^A44": "ADT_A43",
+	"ADT^A51": "ADT_A50",
+	"ADT^A53": "ADT_A52",
+	"ADT^A55": "ADT_A52",
+	"ADT^A62": "ADT_A61",
+	"ORU^R31": "ORU_R30",
+	"ORU^R32": "ORU_R30",
+	"QBP^Q22": "QBP_Q21",
+	"QBP^Q23": "QBP_Q21",
+	"QBP^Q24": "QBP_Q21",
+	"QBP^Q25": "QBP_Q21",
+}
+
+// messageStructure returns the message structure component of MSH.9 for t, in the HL7 version
+// of the given options.
+func (t *Type) messageStructure(options *Options) string {
+	if t.MessageStructure != "" {
+		return t.MessageStructure
+	}
+	if !options.hl7VersionAtLeastMessageStructure() {
+		return ""
+	}
+	if s, ok := messageStructures[fmt.Sprintf("%s^%s", t.MessageType, t.TriggerEvent)]; ok {
+		return s
+	}
+	return fmt.Sprintf("%s_%s", t.MessageType, t.TriggerEvent)
 }
 
 // HeaderInfo contains information relevant to a header of a HL7 Message.
@@ -226,8 +780,352 @@ type HeaderInfo struct {
 	SendingFacility      string
 	ReceivingApplication string
 	ReceivingFacility    string
+	// SendingApplicationHD, SendingFacilityHD, ReceivingApplicationHD and ReceivingFacilityHD are
+	// the structured values of the corresponding fields. If set, they are used instead of the plain strings.
+	SendingApplicationHD   *HierarchicDesignator
+	SendingFacilityHD      *HierarchicDesignator
+	ReceivingApplicationHD *HierarchicDesignator
+	ReceivingFacilityHD    *HierarchicDesignator
 	// MessageControlID is the MSH -> Message Control ID.
+	// If empty, BuildMSH generates one for each message using ControlIDGenerator, without setting it
+	// in the HeaderInfo. If ControlIDGenerator is nil too, the MSH -> Message Control ID is left empty.
 	MessageControlID string
+	// ControlIDGenerator generates the Message Control IDs of the messages built with this header
+	// that don't have a MessageControlID. It should be the same generator that generated
+	// MessageControlID, if any, so that IDs don't clash.
+	ControlIDGenerator ControlIDGenerator
+	// CountryCode is the MSH -> Country Code, as a 3-letter ISO 3166 code, e.g. GBR or USA.
+	// If empty, the country code is set to 44 for backwards compatibility.
+	// It is not validated here: config.LoadHeaderConfig validates the configured country codes.
+	CountryCode string
+	// TimestampPrecision is the precision of the MSH -> Date/Time Of Message.
+	// If nil, the default is hl7.SecondPrecision.
+	TimestampPrecision *hl7.TSPrecision
+	// ClockSkew is added to the MSH -> Date/Time Of Message to simulate a sender whose clock is
+	// ahead of (positive values) or behind (negative values) the receiver's.
+	ClockSkew time.Duration
+	// Options are the options to build the messages with this header. If nil, the defaults are used.
+	Options *Options
+}
+
+// DefaultHL7Version is the default HL7 version, sent in MSH -> Version ID.
+const DefaultHL7Version = "2.3"
+
+// hl7VersionRegex matches HL7v2 versions, e.g. 2.3 or 2.5.1. The first group is the minor version.
+var hl7VersionRegex = regexp.MustCompile(`^2\.([0-9])(\.[0-9])?$`)
+
+// hl7VersionAtLeast returns whether the HL7 version of the options is 2.minor or later.
+func (o *Options) hl7VersionAtLeast(minor int) bool {
+	m := hl7VersionRegex.FindStringSubmatch(o.hl7Version())
+	if m == nil {
+		return false
+	}
+	v, err := strconv.Atoi(m[1])
+	return err == nil && v >= minor
+}
+
+// hl7VersionAtLeastMessageStructure returns whether the HL7 version of the options is 2.3.1
+// or later, i.e., whether it has the message structure component in MSH.9.
+func (o *Options) hl7VersionAtLeastMessageStructure() bool {
+	if o.hl7VersionAtLeast(4) {
+		return true
+	}
+	m := hl7VersionRegex.FindStringSubmatch(o.hl7Version())
+	return m != nil && m[1] == "3" && m[2] != ""
+}
+
+// sendingFacility returns the namespace ID of SendingFacilityHD if set, or SendingFacility otherwise.
+func (h *HeaderInfo) sendingFacility() string {
+	if h.SendingFacilityHD != nil {
+		return h.SendingFacilityHD.NamespaceID
+	}
+	return h.SendingFacility
+}
+
+// Participation represents a participation of a provider in an event, as sent in PRT segments.
+type Participation struct {
+	// Type is the PRT -> Participation, i.e., the role of the provider, e.g. ParticipationAttendingProvider.
+	Type     string
+	Provider *Doctor
+	// Begin and End are the PRT -> Participation Begin / End Date/Time.
+	Begin NullTime
+	End   NullTime
+}
+
+// Movement represents a patient movement, e.g. an admission or a transfer, as sent in ZBE segments
+// by receivers that track movements, e.g. Cerner Millennium.
+type Movement struct {
+	// ID is the ZBE -> Movement ID.
+	ID string
+	// Begin and End are the ZBE -> Start / End Movement Date/Time.
+	Begin NullTime
+	End   NullTime
+	// Action is the ZBE -> Action on the Movement, e.g. MovementActionInsert.
+	Action string
+}
+
+// Values for Movement.Action.
+const (
+	MovementActionInsert = "INSERT"
+	MovementActionUpdate = "UPDATE"
+	MovementActionCancel = "CANCEL"
+)
+
+// AppointmentTiming is the timing and status of a resource, location or provider in an appointment.
+type AppointmentTiming struct {
+	Start    NullTime
+	Duration time.Duration
+	// Status is the Filler Status Code, e.g. "Booked" or "Pending".
+	Status string
+}
+
+// AppointmentResource represents a general resource of an appointment, e.g. a piece of equipment,
+// as sent in AIG segments.
+type AppointmentResource struct {
+	Resource *CodedElement
+	AppointmentTiming
+}
+
+// AppointmentLocation represents a location of an appointment, as sent in AIL segments.
+type AppointmentLocation struct {
+	Location *PatientLocation
+	AppointmentTiming
+}
+
+// AppointmentPersonnel represents a provider that takes part in an appointment, as sent in AIP segments.
+type AppointmentPersonnel struct {
+	Provider *Doctor
+	AppointmentTiming
+}
+
+// AppointmentDetails are the resources, locations and providers of an appointment.
+type AppointmentDetails struct {
+	Resources []*AppointmentResource
+	Locations []*AppointmentLocation
+	Personnel []*AppointmentPersonnel
+}
+
+// Values for Order.OrderControl used to change existing orders, as per the HL7 table 0119 (Order Control Codes).
+const (
+	OrderControlCancel      = "CA"
+	OrderControlDiscontinue = "DC"
+)
+
+// Values for Participation.Type, as per the HL7 table 0912 (Participation).
+const (
+	ParticipationAttendingProvider = "AT"
+	ParticipationOrderingProvider  = "OP"
+)
+
+// QueryParams contains the search fields of a patient demographics query.
+// Only the fields that are set are included in the query.
+type QueryParams struct {
+	// QueryTag is the QPD -> Query Tag, which the responder echoes back to match the response
+	// with the query. If empty, the Message Control ID of the query message is used.
+	QueryTag  string
+	MRN       string
+	FirstName string
+	Surname   string
+	Birth     NullTime
+	Gender    string
+	// QuantityLimit is the maximum number of records to be returned, set in RCP -> Quantity
+	// Limited Request. If zero, no limit is set.
+	QuantityLimit int
+}
+
+// queryParameter is a search field of a query, rendered as @<field>^<value> in QPD.3.
+type queryParameter struct {
+	Field string
+	Value string
+}
+
+// parameters returns the search fields that are set, in the order of the PID fields they refer to.
+func (q *QueryParams) parameters() ([]queryParameter, error) {
+	birth, err := ToHL7Date(q.Birth)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot format date of birth")
+	}
+	var params []queryParameter
+	add := func(field string, value string) {
+		if value != "" {
+			params = append(params, queryParameter{Field: field, Value: value})
+		}
+	}
+	add("PID.3.1", q.MRN)
+	add("PID.5.1", q.Surname)
+	add("PID.5.2", q.FirstName)
+	add("PID.7", birth)
+	add("PID.8", q.Gender)
+	return params, nil
+}
+
+// ControlIDGenerator is an interface to generate unique Message Control IDs (MSH.10).
+type ControlIDGenerator interface {
+	NewMessageControlID() string
+}
+
+// MetricsCollector collects metrics about the messages that are built.
+type MetricsCollector interface {
+	// IncBuilt is called when a message of the given type is built successfully.
+	IncBuilt(t *Type)
+	// IncError is called when a message of the given type cannot be built.
+	IncError(t *Type)
+}
+
+// noopMetricsCollector is a MetricsCollector that does nothing.
+type noopMetricsCollector struct{}
+
+func (noopMetricsCollector) IncBuilt(*Type) {}
+func (noopMetricsCollector) IncError(*Type) {}
+
+// InMemoryMetricsCollector is a MetricsCollector that keeps the number of messages built and
+// failed per message type in memory, e.g. to inspect them in tests. It is safe for concurrent use.
+type InMemoryMetricsCollector struct {
+	mu     sync.Mutex
+	built  map[string]int
+	errors map[string]int
+}
+
+// NewInMemoryMetricsCollector returns a new InMemoryMetricsCollector with all counts set to 0.
+func NewInMemoryMetricsCollector() *InMemoryMetricsCollector {
+	return &InMemoryMetricsCollector{
+		built:  make(map[string]int),
+		errors: make(map[string]int),
+	}
+}
+
+// IncBuilt increments the number of messages built for the given type.
+func (c *InMemoryMetricsCollector) IncBuilt(t *Type) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.built[t.String()]++
+}
+
+// IncError increments the number of messages that failed to build for the given type.
+func (c *InMemoryMetricsCollector) IncError(t *Type) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[t.String()]++
+}
+
+// Built returns the number of messages built for the given type.
+func (c *InMemoryMetricsCollector) Built(t *Type) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.built[t.String()]
+}
+
+// Errors returns the number of messages that failed to build for the given type.
+func (c *InMemoryMetricsCollector) Errors(t *Type) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors[t.String()]
+}
+
+// Encoding contains the field separator and the encoding characters (MSH.1 and MSH.2) used to
+// separate and escape the values in HL7v2 messages.
+type Encoding struct {
+	FieldSeparator        rune
+	ComponentSeparator    rune
+	RepetitionSeparator   rune
+	EscapeCharacter       rune
+	SubComponentSeparator rune
+}
+
+// DefaultEncoding is the standard HL7v2 encoding, i.e., MSH|^~\&.
+var DefaultEncoding = Encoding{
+	FieldSeparator:        '|',
+	ComponentSeparator:    '^',
+	RepetitionSeparator:   '~',
+	EscapeCharacter:       '\\',
+	SubComponentSeparator: '&',
+}
+
+// Validate returns an error if the characters of the encoding are not distinct, or if any of
+// them is a letter, a digit or a whitespace, which would make the messages ambiguous.
+func (e Encoding) Validate() error {
+	seen := make(map[rune]bool)
+	for _, c := range e.chars() {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsSpace(c) {
+			return fmt.Errorf("invalid encoding character %q: must not be a letter, digit or whitespace", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("invalid encoding: character %q is used more than once", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// chars returns the characters of the encoding in the order in which they appear in MSH.
+func (e Encoding) chars() []rune {
+	return []rune{e.FieldSeparator, e.ComponentSeparator, e.RepetitionSeparator, e.EscapeCharacter, e.SubComponentSeparator}
+}
+
+// encode converts s, rendered with DefaultEncoding, to use the characters of this encoding.
+// Separators and escape characters are replaced with the ones in e, and any characters that
+// have a special meaning in e but not in DefaultEncoding are escaped.
+func (e Encoding) encode(s string) string {
+	if e == DefaultEncoding {
+		return s
+	}
+	standard := DefaultEncoding.chars()
+	custom := e.chars()
+	// The escape sequences are in the same order as the characters returned by chars().
+	escapeCodes := []string{"F", "S", "R", "E", "T"}
+
+	var b strings.Builder
+	for _, c := range s {
+		if i := indexRune(standard, c); i != -1 {
+			b.WriteRune(custom[i])
+			continue
+		}
+		if i := indexRune(custom, c); i != -1 {
+			b.WriteRune(e.EscapeCharacter)
+			b.WriteString(escapeCodes[i])
+			b.WriteRune(e.EscapeCharacter)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ParseEncoding returns the Encoding with the given field separator and encoding characters, in the
+// order in which they appear in MSH.1 and MSH.2, e.g. "|^~\\&" for DefaultEncoding.
+func ParseEncoding(s string) (Encoding, error) {
+	c := []rune(s)
+	if len(c) != len(DefaultEncoding.chars()) {
+		return Encoding{}, fmt.Errorf("invalid encoding %q: must have a field separator and four encoding characters", s)
+	}
+	e := Encoding{
+		FieldSeparator:        c[0],
+		ComponentSeparator:    c[1],
+		RepetitionSeparator:   c[2],
+		EscapeCharacter:       c[3],
+		SubComponentSeparator: c[4],
+	}
+	if err := e.Validate(); err != nil {
+		return Encoding{}, err
+	}
+	return e, nil
+}
+
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// HierarchicDesignator represents a HL7v2 Hierarchic Designator: https://hl7-definition.caristix.com/v2/HL7v2.3/DataTypes/HD.
+// Example: SIMHOSPITAL^2.16.840.1.113883.3.72^ISO.
+type HierarchicDesignator struct {
+	NamespaceID     string
+	UniversalID     string
+	UniversalIDType string
 }
 
 // PatientLocation represents a patient location within a clinical facility.
@@ -240,6 +1138,9 @@ type PatientLocation struct {
 	LocationType string
 	Building     string
 	Floor        string
+	// FacilityHD is the PL -> Facility as a Hierarchic Designator, e.g. with an OID to identify the
+	// site. If set, it takes precedence over Facility and it is rendered as subcomponents.
+	FacilityHD *HierarchicDesignator
 }
 
 // Doctor represents a doctor.
@@ -253,27 +1154,101 @@ type Doctor struct {
 }
 
 // AssociatedParty represents a person associated to another person.
+// Patient identifiers of the Person such as the MRN or NHS number are not included in NK1 segments.
 type AssociatedParty struct {
 	*Person
 	Relationship *CodedElement
 	ContactRole  *CodedElement
+	// EmployerName and EmployerID are the name and identifier of the associated party's employer,
+	// sent in NK1.13 Organization Name. They are optional.
+	EmployerName string
+	EmployerID   string
+}
+
+// NewContact returns an AssociatedParty for a contact person that is only known by their name,
+// phone number and relationship to the patient, e.g. an emergency contact.
+func NewContact(firstName string, surname string, phoneNumber string, relationship *CodedElement) *AssociatedParty {
+	return &AssociatedParty{
+		Person: &Person{
+			FirstName:   firstName,
+			Surname:     surname,
+			PhoneNumber: phoneNumber,
+		},
+		Relationship: relationship,
+	}
 }
 
 // Allergy represents an allergy.
 type Allergy struct {
-	Type                   string
-	Description            CodedElement
-	Severity               string
-	Reaction               string
+	Type        string
+	Description CodedElement
+	Severity    string
+	// Reaction is a single reaction to the allergen.
+	// It is only used if Reactions is empty.
+	Reaction string
+	// Reactions are the reactions to the allergen, rendered as repetitions of the AL1.5 field.
+	Reactions              []string
 	IdentificationDateTime NullTime
+	// OnsetDateTime is the date when the allergy started. It is only rendered in IAM segments.
+	OnsetDateTime NullTime
+	// ActionCode is the action to perform on the allergy (IAM.6), e.g. AllergyActionAdd.
+	// It is only rendered in IAM segments. If not set, AllergyActionAdd is used.
+	ActionCode string
+}
+
+// Allergy action codes to be set in the IAM.6 Allergy Action Code field.
+// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&table=0323
+const (
+	// AllergyActionAdd represents the addition of an allergy.
+	AllergyActionAdd = "AD"
+	// AllergyActionUpdate represents the update of an allergy.
+	AllergyActionUpdate = "UP"
+	// AllergyActionDelete represents the deletion of an allergy.
+	AllergyActionDelete = "DE"
+)
+
+// AllReactions returns the reactions to the allergen: Reactions if not empty,
+// otherwise Reaction if set.
+func (a *Allergy) AllReactions() []string {
+	if len(a.Reactions) > 0 {
+		return a.Reactions
+	}
+	if a.Reaction != "" {
+		return []string{a.Reaction}
+	}
+	return nil
 }
 
 // DiagnosisOrProcedure represents a clinical diagnosis or procedure.
 type DiagnosisOrProcedure struct {
 	Description *CodedElement
-	Type        string
-	Clinician   *Doctor
-	DateTime    NullTime
+	// Type is the DG1.6 Diagnosis Type or the PR1.6 Procedure Functional Type.
+	// For diagnoses, this is one of the HL7 table 0052 values, e.g. DiagnosisTypeAdmitting.
+	Type      string
+	Clinician *Doctor
+	DateTime  NullTime
+	// ClinicianDateTime is when the diagnosing clinician (DG1.16) attested the diagnosis, and is
+	// rendered in DG1.19 Attestation Date/Time. It is not rendered if not Valid.
+	// Only used for diagnoses.
+	ClinicianDateTime NullTime
+	// Priority is the DG1.15 Diagnosis Priority, e.g. 1 for the primary diagnosis, 2 for the
+	// secondary diagnosis and so on. 0 means that the diagnosis is not included in the ranking.
+	// Only used for diagnoses.
+	Priority int
+}
+
+// Diagnosis Types, from HL7 table 0052, to be set in DiagnosisOrProcedure.Type for diagnoses.
+const (
+	DiagnosisTypeAdmitting = "A"
+	DiagnosisTypeWorking   = "W"
+	DiagnosisTypeFinal     = "F"
+)
+
+// DiagnosisRelatedGroup represents the Diagnosis Related Group (DRG) that a patient's visit has
+// been classified into.
+type DiagnosisRelatedGroup struct {
+	Code             *CodedElement
+	AssignedDateTime NullTime
 }
 
 // PrimaryFacility represents a patient's primary clinical facility (e.g. a GP practice).
@@ -294,8 +1269,11 @@ type PatientInfo struct {
 	Type            string // values are defined per-trust if this field is used
 	VisitID         uint64
 	HospitalService string
-	Location        *PatientLocation
-	PriorLocation   *PatientLocation
+	// CodedHospitalService is the PV1.10 Hospital Service as a Coded Element.
+	// If set, it takes precedence over HospitalService.
+	CodedHospitalService *CodedElement
+	Location             *PatientLocation
+	PriorLocation        *PatientLocation
 	// PriorLocationForCancelTransfer is the patient's PriorLocation after a CancelTransfer message.
 	// After a transfer message we clear the patient's PriorLocation so that it's not included in
 	// future messages. However in a CancelTransfer we need to know it so that we can re-instate it.
@@ -317,11 +1295,177 @@ type PatientInfo struct {
 	Diagnoses                      []*DiagnosisOrProcedure
 	Procedures                     []*DiagnosisOrProcedure
 	PrimaryFacility                *PrimaryFacility
+	// DRG is the Diagnosis Related Group, sent in a DRG segment after the DG1 segments.
+	// Not set by default.
+	DRG *DiagnosisRelatedGroup
+	// PrimaryCareProvider is the patient's primary care provider (PD1.4), e.g. the GP.
+	// Not set by default.
+	PrimaryCareProvider *Doctor
+	// AdmitReason is the PV2.3 Admit Reason, e.g. for pre-admissions. Not set by default.
+	AdmitReason *CodedElement
+	// EventFacility is the facility where the event that triggers the message happened (EVN.7),
+	// if it differs from the sending facility. Not set by default.
+	EventFacility string
+	// EventReason is the EVN.4 Event Reason Code (HL7 table 0062), e.g. 01 (Patient request) or
+	// 02 (Physician/health practitioner order). Not set by default.
+	EventReason string
+	// CancellationReason is a human-readable reason for cancelling an event. If set, it is sent in
+	// an NTE segment after the visit segments of cancel messages, e.g. ADT^A11 or ADT^A13.
+	// Not set by default.
+	CancellationReason string
+	// Movement is the movement that triggers the message. If set, it is sent in a ZBE segment after
+	// the PV1 segment of admission and transfer messages. Not set by default.
+	Movement *Movement
 	// AdditionalData allows users to enter arbitrary information about a patient's medical record.
 	// It is up to the user to decide what data is stored here.
 	AdditionalData interface{}
 }
 
+// Clone returns a deep copy of the PatientInfo, so that the copy can be modified without affecting
+// the original, e.g. to simulate diverging pathways from the same patient.
+// AdditionalData is not copied deeply, as its contents are up to the user.
+func (p *PatientInfo) Clone() *PatientInfo {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Person = clonePerson(p.Person)
+	c.CodedHospitalService = cloneCodedElement(p.CodedHospitalService)
+	c.Location = cloneLocation(p.Location)
+	c.PriorLocation = cloneLocation(p.PriorLocation)
+	c.PriorLocationForCancelTransfer = cloneLocation(p.PriorLocationForCancelTransfer)
+	c.PendingLocation = cloneLocation(p.PendingLocation)
+	c.PriorPendingLocation = cloneLocation(p.PriorPendingLocation)
+	c.TemporaryLocation = cloneLocation(p.TemporaryLocation)
+	c.PriorTemporaryLocation = cloneLocation(p.PriorTemporaryLocation)
+	c.AttendingDoctor = cloneDoctor(p.AttendingDoctor)
+	c.PrimaryCareProvider = cloneDoctor(p.PrimaryCareProvider)
+	c.AdmitReason = cloneCodedElement(p.AdmitReason)
+	if p.AssociatedParties != nil {
+		c.AssociatedParties = make([]*AssociatedParty, len(p.AssociatedParties))
+		for i, ap := range p.AssociatedParties {
+			if ap == nil {
+				continue
+			}
+			cp := *ap
+			cp.Person = clonePerson(ap.Person)
+			cp.Relationship = cloneCodedElement(ap.Relationship)
+			cp.ContactRole = cloneCodedElement(ap.ContactRole)
+			c.AssociatedParties[i] = &cp
+		}
+	}
+	if p.Allergies != nil {
+		c.Allergies = make([]*Allergy, len(p.Allergies))
+		for i, a := range p.Allergies {
+			if a == nil {
+				continue
+			}
+			ca := *a
+			if a.Reactions != nil {
+				ca.Reactions = append([]string{}, a.Reactions...)
+			}
+			c.Allergies[i] = &ca
+		}
+	}
+	c.Diagnoses = cloneDiagnosesOrProcedures(p.Diagnoses)
+	c.Procedures = cloneDiagnosesOrProcedures(p.Procedures)
+	if p.PrimaryFacility != nil {
+		pf := *p.PrimaryFacility
+		c.PrimaryFacility = &pf
+	}
+	if p.DRG != nil {
+		drg := *p.DRG
+		drg.Code = cloneCodedElement(p.DRG.Code)
+		c.DRG = &drg
+	}
+	if p.Movement != nil {
+		m := *p.Movement
+		c.Movement = &m
+	}
+	return &c
+}
+
+func clonePerson(p *Person) *Person {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	if p.Ethnicity != nil {
+		e := *p.Ethnicity
+		c.Ethnicity = &e
+	}
+	if p.Address != nil {
+		a := *p.Address
+		c.Address = &a
+	}
+	if p.MRNsByAuthority != nil {
+		c.MRNsByAuthority = make(map[string]string, len(p.MRNsByAuthority))
+		for k, v := range p.MRNsByAuthority {
+			c.MRNsByAuthority[k] = v
+		}
+	}
+	return &c
+}
+
+func cloneLocation(l *PatientLocation) *PatientLocation {
+	if l == nil {
+		return nil
+	}
+	c := *l
+	if l.FacilityHD != nil {
+		hd := *l.FacilityHD
+		c.FacilityHD = &hd
+	}
+	return &c
+}
+
+// sameLocation returns whether the non-nil locations a and b have the same values, including the
+// values of their FacilityHD.
+func sameLocation(a, b *PatientLocation) bool {
+	ac, bc := *a, *b
+	ac.FacilityHD, bc.FacilityHD = nil, nil
+	if ac != bc {
+		return false
+	}
+	if a.FacilityHD == nil || b.FacilityHD == nil {
+		return a.FacilityHD == b.FacilityHD
+	}
+	return *a.FacilityHD == *b.FacilityHD
+}
+
+func cloneDoctor(d *Doctor) *Doctor {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	return &c
+}
+
+func cloneCodedElement(ce *CodedElement) *CodedElement {
+	if ce == nil {
+		return nil
+	}
+	c := *ce
+	return &c
+}
+
+func cloneDiagnosesOrProcedures(ds []*DiagnosisOrProcedure) []*DiagnosisOrProcedure {
+	if ds == nil {
+		return nil
+	}
+	c := make([]*DiagnosisOrProcedure, len(ds))
+	for i, d := range ds {
+		if d == nil {
+			continue
+		}
+		cd := *d
+		cd.Description = cloneCodedElement(d.Description)
+		cd.Clinician = cloneDoctor(d.Clinician)
+		c[i] = &cd
+	}
+	return c
+}
+
 // NullTime represents a time that can be null.
 type NullTime struct {
 	time.Time
@@ -362,25 +1506,178 @@ var (
 	log = logging.ForCallerPackage()
 
 	funcMap = template.FuncMap{
-		"HL7_date":     ToHL7Date,
-		"HL7_repeated": toHL7RepeatedField,
-		"expand_mrns":  expandMRNs,
-		"HL7_unit":     toHL7Unit,
-		"escape_HL7":   escapeHL7,
+		"HL7_date":           ToHL7Date,
+		"HL7_date_precision": ToHL7DateWithPrecision,
+		"HL7_repeated":       toHL7RepeatedField,
+		"HL7_line_breaks":    toHL7LineBreaks,
+		"expand_mrns":        expandMRNs,
+		"HL7_unit":           toHL7Unit,
+		"escape_HL7":         escapeHL7,
 	}
 )
 
-// ToHL7Date converts a date into a string with HL7 date format.
-func ToHL7Date(t Formattable) (string, error) {
-	nt, ok := t.(NullTime)
-	if ok && !nt.Valid {
-		return "", nil
+// Options are the options to build messages with, for receivers that need messages different from
+// the defaults, e.g. in a later HL7 version or with other encoding characters.
+// The zero value of each field selects its default, so a nil *Options builds the default messages.
+type Options struct {
+	// Encoding is the field separator and encoding characters used in all segments. The templates
+	// are rendered with DefaultEncoding and then converted to this encoding.
+	// If zero, DefaultEncoding is used.
+	Encoding Encoding
+	// HL7Version is the HL7 version of the messages, e.g. "2.5.1", which is sent in MSH -> Version ID.
+	// Fields that don't exist in this version, such as OBX -> Observation Type before HL7v2.6, are
+	// not rendered. If empty, DefaultHL7Version is used.
+	HL7Version string
+	// ReferenceRangeFormat is the format used to render the OBX -> Reference Range of results that
+	// have RangeLow or RangeHigh set. It must contain two %s verbs, which are replaced with the low
+	// and high limits respectively, e.g. "%s-%s" or "[%s,%s]".
+	// If empty, DefaultReferenceRangeFormat is used.
+	ReferenceRangeFormat string
+	// PseudoPV1PatientClass is the PV1 -> Patient Class of the pseudo PV1 segments of the messages
+	// that are not about a visit, e.g. "U" (Unknown) for receivers that don't accept the default.
+	// If empty, DefaultPseudoPV1PatientClass is used.
+	PseudoPV1PatientClass string
+	// MaxOBXValueLength is the maximum length, in characters, of the OBX -> Observation Value field
+	// of the results in ORU messages. Longer values are split into several consecutive OBX segments
+	// with the same Observation Identifier, linked together by their Observation Sub-ID.
+	// Zero means no limit.
+	MaxOBXValueLength int
+	// ParticipationSegments is whether the attending doctor and the ordering provider are sent in
+	// PRT (Participation Information) segments, as in HL7v2.6 and later, instead of in the
+	// PV1 -> Attending Doctor and OBR -> Ordering Provider fields.
+	ParticipationSegments bool
+	// StrictTemplates is whether building a segment fails if a field that the segment requires is
+	// missing, e.g. an OBR segment for an order without OrderProfile, instead of rendering the field
+	// empty. It is disabled by default, so that existing pathways with missing fields still produce
+	// messages.
+	StrictTemplates bool
+	// OmitEmptyPD1 is whether the PD1 segment is left out of messages for patients that have neither
+	// a PrimaryFacility nor a PrimaryCareProvider, instead of being sent with all its fields empty.
+	OmitEmptyPD1 bool
+	// Metrics is notified every time a message is built, or fails to build.
+	// If nil, no metrics are collected.
+	Metrics MetricsCollector
+}
+
+// Validate returns an error if the encoding or the HL7 version of the options are not valid, or if
+// MaxOBXValueLength is negative.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
 	}
-	if nt.Location() != time.UTC {
-		// To avoid mistakes, make sure all times are provided in UTC.
-		return "", fmt.Errorf("found time with non-UTC location: %v", nt)
+	if o.Encoding != (Encoding{}) {
+		if err := o.Encoding.Validate(); err != nil {
+			return err
+		}
 	}
-	// Get the midnight time at the HL7 Location.
+	if o.HL7Version != "" && !hl7VersionRegex.MatchString(o.HL7Version) {
+		return fmt.Errorf("invalid HL7 version %q: must be a HL7v2 version, e.g. 2.3 or 2.5.1", o.HL7Version)
+	}
+	if o.MaxOBXValueLength < 0 {
+		return fmt.Errorf("invalid maximum OBX value length %d: must not be negative", o.MaxOBXValueLength)
+	}
+	return nil
+}
+
+func (o *Options) encoding() Encoding {
+	if o == nil || o.Encoding == (Encoding{}) {
+		return DefaultEncoding
+	}
+	return o.Encoding
+}
+
+func (o *Options) hl7Version() string {
+	if o == nil || o.HL7Version == "" {
+		return DefaultHL7Version
+	}
+	return o.HL7Version
+}
+
+func (o *Options) referenceRangeFormat() string {
+	if o == nil || o.ReferenceRangeFormat == "" {
+		return DefaultReferenceRangeFormat
+	}
+	return o.ReferenceRangeFormat
+}
+
+func (o *Options) pseudoPV1PatientClass() string {
+	if o == nil || o.PseudoPV1PatientClass == "" {
+		return DefaultPseudoPV1PatientClass
+	}
+	return o.PseudoPV1PatientClass
+}
+
+func (o *Options) maxOBXValueLength() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxOBXValueLength
+}
+
+func (o *Options) participationSegments() bool {
+	return o != nil && o.ParticipationSegments
+}
+
+func (o *Options) strictTemplates() bool {
+	return o != nil && o.StrictTemplates
+}
+
+func (o *Options) omitEmptyPD1() bool {
+	return o != nil && o.OmitEmptyPD1
+}
+
+func (o *Options) metrics() MetricsCollector {
+	if o == nil || o.Metrics == nil {
+		return noopMetricsCollector{}
+	}
+	return o.Metrics
+}
+
+// recordMetrics notifies the metrics collector of the options that a message of the given type was
+// built, or failed to build if *err is not nil. It is intended to be deferred by the message builders.
+func recordMetrics(options *Options, t *Type, err *error) {
+	if *err != nil {
+		options.metrics().IncError(t)
+		return
+	}
+	options.metrics().IncBuilt(t)
+}
+
+// tsPrecisionLength is the length of the HL7 dates rendered with each precision coarser than
+// hl7.SecondPrecision.
+var tsPrecisionLength = map[hl7.TSPrecision]int{
+	hl7.YearPrecision:   len("2006"),
+	hl7.MonthPrecision:  len("200601"),
+	hl7.DayPrecision:    len("20060102"),
+	hl7.HourPrecision:   len("2006010215"),
+	hl7.MinutePrecision: len("200601021504"),
+}
+
+// ToHL7DateWithPrecision converts a date into a string with HL7 date format and the given precision.
+// If the precision is nil or finer than hl7.SecondPrecision, the date is rendered up to the second,
+// like ToHL7Date does.
+func ToHL7DateWithPrecision(t Formattable, p *hl7.TSPrecision) (string, error) {
+	s, err := ToHL7Date(t)
+	if err != nil || s == "" || p == nil {
+		return s, err
+	}
+	if l, ok := tsPrecisionLength[*p]; ok {
+		return s[:l], nil
+	}
+	return s, nil
+}
+
+// ToHL7Date converts a date into a string with HL7 date format.
+func ToHL7Date(t Formattable) (string, error) {
+	nt, ok := t.(NullTime)
+	if ok && !nt.Valid {
+		return "", nil
+	}
+	if nt.Location() != time.UTC {
+		// To avoid mistakes, make sure all times are provided in UTC.
+		return "", fmt.Errorf("found time with non-UTC location: %v", nt)
+	}
+	// Get the midnight time at the HL7 Location.
 	if nt.Midnight {
 		localT := t.In(hl7.Location)
 		// Set the location so that the conversion to hl7.Location afterwards is a no-op.
@@ -395,12 +1692,19 @@ func toHL7RepeatedField(s string) string {
 	return strings.Replace(s, "\n", listItemsSeparator, -1)
 }
 
+// toHL7LineBreaks transforms the given string, where lines are separated with \n, to a single HL7v2
+// value where lines are separated by the line break escape sequence.
+func toHL7LineBreaks(s string) string {
+	return strings.Replace(s, "\n", escapedLineBreak, -1)
+}
+
 func expandMRNs(mrns []string) (string, error) {
 	fields := make([]string, len(mrns))
 	for i, m := range mrns {
-		f, err := executeTemplate(parsedCXMRNTemplate, struct {
-			MRN string
-		}{m})
+		f, err := executeTemplate(nil, parsedCXMRNTemplate, struct {
+			MRN          string
+			MRNAuthority string
+		}{m, defaultMRNAuthority})
 		if err != nil {
 			return "", errors.Wrap(err, "cannot expand MRNs")
 		}
@@ -423,6 +1727,44 @@ func escapeHL7(s string) string {
 	return r.Replace(s)
 }
 
+// UnescapeHL7 reverses the escaping done to HL7v2 values, replacing the escape sequences
+// \S\, \T\, \.br\, \E\, \F\ and \R\ with the characters they represent.
+func UnescapeHL7(s string) string {
+	r := strings.NewReplacer(
+		escapedComponentSeparator, componentSeparator,
+		escapedSubComponentSeparator, subComponentSeparator,
+		escapedLineBreak, lineBreak,
+		escapedBackwardSlash, backwardSlash,
+		escapedFieldSeparator, fieldSeparator,
+		escapedListItemsSeparator, listItemsSeparator,
+	)
+	return r.Replace(s)
+}
+
+// UnescapeHL7Unit reverses the escaping done to units.
+func UnescapeHL7Unit(s string) string {
+	return strings.Replace(s, escapedComponentSeparator, componentSeparator, -1)
+}
+
+// ParseCodedElement parses a Coded Element in the format rendered by the CE template, i.e.,
+// ID^Text^CodingSystem^AlternateID^AlternateText^AlternateCodingSystem, and unescapes each component.
+// Missing trailing components are left empty. Returns nil if s is empty.
+func ParseCodedElement(s string) *CodedElement {
+	if s == "" {
+		return nil
+	}
+	components := make([]string, 6)
+	copy(components, strings.Split(s, componentSeparator))
+	return &CodedElement{
+		ID:                    UnescapeHL7(components[0]),
+		Text:                  UnescapeHL7(components[1]),
+		CodingSystem:          UnescapeHL7(components[2]),
+		AlternateID:           UnescapeHL7(components[3]),
+		AlternateText:         UnescapeHL7(components[4]),
+		AlternateCodingSystem: UnescapeHL7(components[5]),
+	}
+}
+
 // Constants for segments and templates.
 const (
 	MSH             = "MSH"
@@ -435,16 +1777,28 @@ const (
 	OBX             = "OBX"
 	OBXClinicalNote = "OBXClinicalNote"
 	OBXForMDM       = "OBXForMDM"
+	OBXForMDMED     = "OBXForMDMED"
 	PV1             = "PV1"
+	PseudoPV1       = "PseudoPV1"
 	PV2             = "PV2"
 	NK1             = "NK1"
 	AL1             = "AL1"
+	IAM             = "IAM"
 	NTE             = "NTE"
 	MRG             = "MRG"
 	DG1             = "DG1"
+	DRG             = "DRG"
 	PD1             = "PD1"
 	PR1             = "PR1"
 	TXA             = "TXA"
+	QPD             = "QPD"
+	QRD             = "QRD"
+	RCP             = "RCP"
+	PRT             = "PRT"
+	AIG             = "AIG"
+	AIL             = "AIL"
+	AIP             = "AIP"
+	ZBE             = "ZBE"
 )
 
 const (
@@ -454,17 +1808,27 @@ const (
 	addressTemplate    = "AddressTmpl"
 	homeNumberTemplate = "HomeNumberTmpl"
 	ceTemplate         = "CETmpl"
+	hdTemplate         = "HDTmpl"
 	ceNoteTemplate     = "CENoteTmpl"
 	cxVisitTemplate    = "CXVisitTmpl"
 	cxMRNTemplate      = "CXMRNTmpl"
+	cxAccountTemplate  = "CXAccountTmpl"
+	snTemplate         = "SNTmpl"
 	primFacTemplate    = "PrimFacTmpl"
 	noteTemplate       = "NoteTmpl"
+	timingTemplate     = "TimingTmpl"
+	ceSubTemplate      = "CESubTmpl"
+	spsTemplate        = "SPSTmpl"
 )
 
+// defaultMRNAuthority is the assigning authority of MRNs, unless the MRN comes from Person.MRNsByAuthority.
+const defaultMRNAuthority = "SIMULATOR MRN"
+
 var (
 	// locationTmpl represents the data type PL: Person Location
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PV1?version=HL7%20v2.3.1&dataType=PL
-	locationTmpl = "{{.Poc}}^{{.Room}}^{{.Bed}}^{{.Facility}}^^{{.LocationType}}^{{.Building}}^{{.Floor}}"
+	// The facility (PL.4) is a HD: Hierarchic Designator, rendered as subcomponents if FacilityHD is set.
+	locationTmpl = "{{.Poc}}^{{.Room}}^{{.Bed}}^{{with .FacilityHD}}{{escape_HL7 .NamespaceID}}&{{escape_HL7 .UniversalID}}&{{.UniversalIDType}}{{else}}{{.Facility}}{{end}}^^{{.LocationType}}^{{.Building}}^{{.Floor}}"
 
 	// doctorTmpl represents the data type XCN: Extended Composite ID Number And Name For Persons
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PV1?version=HL7%20v2.3.1&dataType=XCN
@@ -472,11 +1836,12 @@ var (
 
 	// personNameTmpl represents the data type XPN: Extended Person Name
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PID?version=HL7%20v2.3.1&dataType=XPN
-	personNameTmpl = "{{.Surname}}^{{.FirstName}}^{{.MiddleName}}^{{.Suffix}}^{{.Prefix}}^{{.Degree}}^CURRENT"
+	personNameTmpl = "{{.Surname}}^{{.FirstName}}^{{.MiddleName}}^{{.Suffix}}^{{.Prefix}}^{{.Degree}}^{{with .NameTypeCode}}{{.}}{{else}}CURRENT{{end}}"
 
 	// addressTmpl represents the data type XAD: Extended Address
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PID?version=HL7%20v2.3.1&dataType=XAD
-	addressTmpl = "{{.FirstLine}}^{{.SecondLine}}^{{.City}}^^{{.PostalCode}}^{{.Country}}^{{.Type}}"
+	// The county (XAD.9) is only rendered if set, so that addresses without one are unchanged.
+	addressTmpl = "{{.FirstLine}}^{{.SecondLine}}^{{.City}}^^{{.PostalCode}}^{{.Country}}^{{.Type}}{{with .County}}^^{{escape_HL7 .}}{{end}}"
 
 	// homeNumberTmpl represents the data type XTN: Extended Telecommunication Number
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PID?version=HL7%20v2.3.1&dataType=XTN
@@ -484,7 +1849,10 @@ var (
 
 	// ceTmpl represents the data type CE: Coded Element
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/PID?version=HL7%20v2.3.1&dataType=CE
-	ceTmpl = "{{escape_HL7 .ID}}^{{escape_HL7 .Text}}^{{.CodingSystem}}^^{{escape_HL7 .AlternateText}}"
+	ceTmpl = "{{escape_HL7 .ID}}^{{escape_HL7 .Text}}^{{.CodingSystem}}^{{escape_HL7 .AlternateID}}^{{escape_HL7 .AlternateText}}{{with .AlternateCodingSystem}}^{{.}}{{end}}"
+	// hdTmpl represents the data type HD: Hierarchic Designator
+	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/MSH?version=HL7%20v2.3.1&dataType=HD
+	hdTmpl = "{{escape_HL7 .NamespaceID}}^{{escape_HL7 .UniversalID}}^{{.UniversalIDType}}"
 	// ceNoteTmpl is the CE template for notes.
 	// When the OBX.Observation Identifier field is used to send Notes, this is the Document Type; e.g. ECG/Discharge Summary.
 	ceNoteTmpl = "{{.DocumentType}}^{{.DocumentType}}"
@@ -497,7 +1865,21 @@ var (
 	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/Default.aspx?version=HL7%20v2.5.1&dataType=CX
 	cxVisitTmpl = "{{.}}^^^^visitid"
 	// cxMRNTmpl is the template for MRNs.
-	cxMRNTmpl = "{{.MRN}}^^^SIMULATOR MRN^MRN"
+	cxMRNTmpl = "{{.MRN}}^^^{{.MRNAuthority}}^MRN"
+	// cxAccountTmpl is the template for patient account numbers.
+	cxAccountTmpl = "{{.}}^^^SIMULATOR ACCOUNT^AN"
+	// snTmpl represents the data type SN: Structured Numeric
+	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/OBX?version=HL7%20v2.3.1&dataType=SN
+	snTmpl = "{{.Comparator}}^{{.Num1}}^{{.Separator}}^{{.Num2}}"
+	// timingTmpl is the template for the Start Date/Time, Duration and Filler Status Code of the
+	// AIG, AIL and AIP segments. The offset and substitution fields in between are not populated.
+	timingTmpl = "{{HL7_date .Start}}|||{{with .DurationMinutes}}{{.}}|min{{else}}|{{end}}||{{.Status}}"
+	// ceSubTmpl represents the data type CE: Coded Element, when it is a component of another
+	// data type, so its own components are rendered as subcomponents.
+	ceSubTmpl = "{{escape_HL7 .ID}}&{{escape_HL7 .Text}}&{{.CodingSystem}}"
+	// spsTmpl represents the data type CM_SPS: Specimen Source
+	// http://hl7-definition.caristix.com:9010/HL7%20v2.3.1/segment/OBR?version=HL7%20v2.3.1&dataType=CM_SPS
+	spsTmpl = `{{template "CESubTmpl" .Source}}^{{escape_HL7 .Additives}}^{{escape_HL7 .Freetext}}^{{template "CESubTmpl" .BodySite}}^{{template "CESubTmpl" .SiteModifier}}^{{template "CESubTmpl" .CollectionMethod}}`
 	// stOBXNoteVal is the template for the OBX.Observation Value for documents.
 	stOBXNoteVal = "^^{{.ContentType}}^{{.DocumentEncoding}}^{{escape_HL7 .DocumentContent}}"
 
@@ -505,11 +1887,18 @@ var (
 )
 
 var templates = map[string]*template.Template{
-	MSH: mustParseTemplate(MSH, "MSH|^~\\&|{{.Header.SendingApplication}}|{{.Header.SendingFacility}}|{{.Header.ReceivingApplication}}|{{.Header.ReceivingFacility}}|{{HL7_date .T}}||{{.MsgType.MessageType}}^{{.MsgType.TriggerEvent}}|{{.Header.MessageControlID}}|T|2.3|||AL||44|ASCII"),
+	MSH: mustParseTemplates(MSH, map[string]string{
+		hdTemplate: hdTmpl,
+		MSH:        "MSH|^~\\&|" + hdOrString("SendingApplication") + "|" + hdOrString("SendingFacility") + "|" + hdOrString("ReceivingApplication") + "|" + hdOrString("ReceivingFacility") + "|{{HL7_date_precision .T .Header.TimestampPrecision}}||{{.MsgType.MessageType}}^{{.MsgType.TriggerEvent}}{{with .MessageStructure}}^{{.}}{{end}}|{{.Header.MessageControlID}}|T|{{.Version}}|||AL||{{with .Header.CountryCode}}{{.}}{{else}}44{{end}}|ASCII",
+	}),
 	MSA: mustParseTemplate(MSA, "MSA|AA|{{.OrderMessageControlID}}"),
+	QPD: mustParseTemplate(QPD, "QPD|Q22^Find Candidates^HL70471|{{.QueryTag}}|{{range $i, $p := .Parameters}}{{if $i}}~{{end}}@{{$p.Field}}^{{escape_HL7 $p.Value}}{{end}}"),
+	RCP: mustParseTemplate(RCP, "RCP|I|{{with .QuantityLimit}}{{.}}^RD{{end}}"),
+	QRD: mustParseTemplate(QRD, "QRD|{{HL7_date .QueryTime}}|R|I|{{escape_HL7 .QueryID}}|||{{with .QuantityLimit}}{{.}}^RD{{end}}|{{escape_HL7 .MRN}}|DEM"),
+	ZBE: mustParseTemplate(ZBE, "ZBE|{{escape_HL7 .ID}}|{{HL7_date .Begin}}|{{HL7_date .End}}|{{.Action}}"),
 	EVN: mustParseTemplates(EVN, map[string]string{
 		doctorTemplate: doctorTmpl,
-		EVN:            `EVN|{{.MsgType.TriggerEvent}}|{{HL7_date .T}}|{{HL7_date .DateTimePlannedEvent}}||{{template "DoctorTmpl" .Operator}}|{{HL7_date .EventOccurredDateTime}}`,
+		EVN:            `EVN|{{.MsgType.TriggerEvent}}|{{HL7_date .T}}|{{HL7_date .DateTimePlannedEvent}}|{{escape_HL7 .EventReason}}|{{range $i, $o := .Operators}}{{if $i}}~{{end}}{{template "DoctorTmpl" $o}}{{end}}|{{HL7_date .EventOccurredDateTime}}{{if .EventFacility}}|{{escape_HL7 .EventFacility}}{{end}}`,
 	}),
 	PID: mustParseTemplates(PID, map[string]string{
 		personNameTemplate: personNameTmpl,
@@ -517,64 +1906,114 @@ var templates = map[string]*template.Template{
 		homeNumberTemplate: homeNumberTmpl,
 		ceTemplate:         ceTmpl,
 		cxMRNTemplate:      cxMRNTmpl,
-		PID:                `PID|1|{{template "CXMRNTmpl" .}}|{{template "CXMRNTmpl" .}}~{{.NHS}}^^^NHSNBR^NHSNMBR||{{template "PersonNameTmpl" .}}||{{HL7_date .Birth}}|{{.Gender}}|||{{template "AddressTmpl" .Address}}||{{template "HomeNumberTmpl" .PhoneNumber}}|||||||||{{template "CETmpl" .Ethnicity}}|||||||{{HL7_date .DateOfDeath}}|{{.DeathIndicator}}`,
+		cxAccountTemplate:  cxAccountTmpl,
+		PID:                `PID|{{.SetID}}|{{with .ExternalID}}{{escape_HL7 .}}{{else}}{{template "CXMRNTmpl" $}}{{end}}|{{template "CXMRNTmpl" .}}~{{.NHS}}^^^NHSNBR^NHSNMBR{{with .NHSVerificationStatus}}^{{.}}{{end}}||{{template "PersonNameTmpl" .}}||{{HL7_date .Birth}}|{{.Gender}}|||{{template "AddressTmpl" .Address}}||{{template "HomeNumberTmpl" .PhoneNumber}}|||||{{template "CXAccountTmpl" .AccountNumber}}||||{{template "CETmpl" .Ethnicity}}|||||||{{HL7_date .DateOfDeath}}|{{.DeathIndicator}}`,
 	}),
 	MRG: mustParseTemplate(MRG, "MRG|{{expand_mrns .MRNs}}|"),
-	ORC: mustParseTemplate(ORC, "ORC|{{.OrderControl}}|{{.Placer}}|{{.Filler}}||{{.OrderStatus}}||||{{HL7_date .OrderDateTime}}"),
+	ORC: mustParseTemplates(ORC, map[string]string{
+		doctorTemplate: doctorTmpl,
+		// ORC-10 Entered By and ORC-12 Ordering Provider are only rendered if at least one of them is set.
+		ORC: `ORC|{{.OrderControl}}|{{.Placer}}|{{.Filler}}||{{.OrderStatus}}||{{with .Priority}}^^^^^{{.}}{{end}}||{{HL7_date .OrderDateTime}}{{if or .EnteredBy .OrderingProvider}}|{{template "DoctorTmpl" .EnteredBy}}||{{template "DoctorTmpl" .OrderingProvider}}{{end}}`,
+	}),
 	OBR: mustParseTemplates(OBR, map[string]string{
 		ceTemplate:     ceTmpl,
+		ceSubTemplate:  ceSubTmpl,
+		spsTemplate:    spsTmpl,
 		doctorTemplate: doctorTmpl,
-		OBR:            `OBR|1|{{.Placer}}|{{.Filler}}|{{template "CETmpl" .OrderProfile}}||{{HL7_date .OrderDateTime}}|{{HL7_date .CollectedDateTime}}|||||||{{HL7_date .ReceivedInLabDateTime}}|{{.SpecimenSource}}|{{template "DoctorTmpl" .OrderingProvider}}||||||{{HL7_date .ReportedDateTime}}||{{.DiagnosticServID}}|{{.ResultsStatus}}||1`,
+		OBR:            `OBR|{{.SetID}}|{{.Placer}}|{{.Filler}}|{{template "CETmpl" .OrderProfile}}||{{HL7_date .OrderDateTime}}|{{HL7_date .CollectedDateTime}}|{{HL7_date .ObservationEndDateTime}}|{{if .CollectionVolume}}{{escape_HL7 .CollectionVolume}}{{with .CollectionVolumeUnit}}^{{escape_HL7 .}}{{end}}{{end}}|{{template "DoctorTmpl" .Collector}}|{{.SpecimenActionCode}}||{{escape_HL7 .RelevantClinicalInfo}}|{{HL7_date .ReceivedInLabDateTime}}|{{if .CodedSpecimenSource}}{{template "SPSTmpl" .CodedSpecimenSource}}{{else}}{{.SpecimenSource}}{{end}}|{{template "DoctorTmpl" .OrderingProvider}}||||||{{HL7_date .ReportedDateTime}}||{{.DiagnosticServID}}|{{.ResultsStatus}}|{{with .ParentResult}}{{template "CESubTmpl" .ObservationIdentifier}}^{{escape_HL7 .SubID}}^{{escape_HL7 .Value}}{{end}}|1{{with .Priority}}^^^^^{{.}}{{end}}{{if or .ParentOrder .PrincipalInterpreter .AssistantInterpreters}}||{{with .ParentOrder}}{{escape_HL7 .Placer}}^{{escape_HL7 .Filler}}{{end}}{{if or .PrincipalInterpreter .AssistantInterpreters}}|||{{template "DoctorTmpl" .PrincipalInterpreter}}|{{range $i, $d := .AssistantInterpreters}}{{if $i}}~{{end}}{{template "DoctorTmpl" $d}}{{end}}{{end}}{{end}}`,
 	}),
 	OBRClinicalNote: mustParseTemplates(OBR, map[string]string{
 		ceTemplate:     ceTmpl,
+		ceSubTemplate:  ceSubTmpl,
+		spsTemplate:    spsTmpl,
 		doctorTemplate: doctorTmpl,
-		OBR:            `OBR|1|{{.Placer}}|{{.DocumentID}}^HNAM_CEREF~{{.DocumentID}}^HNAM_EVENTID|{{template "CETmpl" .OrderProfile}}||{{HL7_date .OrderDateTime}}|{{HL7_date .CollectedDateTime}}|||||||{{HL7_date .ReceivedInLabDateTime}}|{{.SpecimenSource}}|{{template "DoctorTmpl" .OrderingProvider}}||||||{{HL7_date .ReportedDateTime}}||{{.DiagnosticServID}}|{{.ResultsStatus}}||1`,
+		OBR:            `OBR|{{.SetID}}|{{.Placer}}|{{.DocumentID}}^HNAM_CEREF~{{.DocumentID}}^HNAM_EVENTID|{{template "CETmpl" .OrderProfile}}||{{HL7_date .OrderDateTime}}|{{HL7_date .CollectedDateTime}}|{{HL7_date .ObservationEndDateTime}}|{{if .CollectionVolume}}{{escape_HL7 .CollectionVolume}}{{with .CollectionVolumeUnit}}^{{escape_HL7 .}}{{end}}{{end}}|{{template "DoctorTmpl" .Collector}}|{{.SpecimenActionCode}}||{{escape_HL7 .RelevantClinicalInfo}}|{{HL7_date .ReceivedInLabDateTime}}|{{if .CodedSpecimenSource}}{{template "SPSTmpl" .CodedSpecimenSource}}{{else}}{{.SpecimenSource}}{{end}}|{{template "DoctorTmpl" .OrderingProvider}}||||||{{HL7_date .ReportedDateTime}}||{{.DiagnosticServID}}|{{.ResultsStatus}}|{{with .ParentResult}}{{template "CESubTmpl" .ObservationIdentifier}}^{{escape_HL7 .SubID}}^{{escape_HL7 .Value}}{{end}}|1{{with .Priority}}^^^^^{{.}}{{end}}{{if or .ParentOrder .PrincipalInterpreter .AssistantInterpreters}}||{{with .ParentOrder}}{{escape_HL7 .Placer}}^{{escape_HL7 .Filler}}{{end}}{{if or .PrincipalInterpreter .AssistantInterpreters}}|||{{template "DoctorTmpl" .PrincipalInterpreter}}|{{range $i, $d := .AssistantInterpreters}}{{if $i}}~{{end}}{{template "DoctorTmpl" $d}}{{end}}{{end}}{{end}}`,
 	}),
 	OBX: mustParseTemplates(OBX, map[string]string{
-		ceTemplate: ceTmpl,
-		OBX:        `OBX|{{.ID}}|{{.ValueType}}|{{template "CETmpl" .TestName}}||{{HL7_repeated .Value}}|{{HL7_unit .Unit}}|{{escape_HL7 .Range}}|{{.AbnormalFlag}}|||{{.Status}}|||{{HL7_date .ObservationDateTime}}||`,
+		ceTemplate:      ceTmpl,
+		snTemplate:      snTmpl,
+		addressTemplate: addressTmpl,
+		doctorTemplate:  doctorTmpl,
+		OBX:             `OBX|{{.ID}}|{{.ValueType}}|{{if .ObservationIdentifier}}{{template "CETmpl" .ObservationIdentifier}}{{else}}{{template "CETmpl" .TestName}}{{end}}|{{.SubID}}|{{if .StructuredNumeric}}{{template "SNTmpl" .StructuredNumeric}}{{else if .CodedValue}}{{template "CETmpl" .CodedValue}}{{else if .NewlinesAsLineBreaks}}{{HL7_line_breaks .Value}}{{else}}{{HL7_repeated .Value}}{{end}}|{{if .CodedUnit}}{{template "CETmpl" .CodedUnit}}{{else}}{{HL7_unit .Unit}}{{end}}|{{escape_HL7 .FormattedReferenceRange}}|{{if .AbnormalFlags}}{{range $i, $f := .AbnormalFlags}}{{if $i}}~{{end}}{{$f}}{{end}}{{else}}{{.AbnormalFlag}}{{end}}|||{{.Status}}|||{{HL7_date .ObservationDateTime}}|{{template "CETmpl" .ProducerID}}|{{if or .ObservationMethod .EquipmentInstanceID .AnalysisDateTime.Valid .WithPerformingOrganization .WithObservationType}}|{{template "CETmpl" .ObservationMethod}}|{{escape_HL7 .EquipmentInstanceID}}{{if or .AnalysisDateTime.Valid .WithPerformingOrganization .WithObservationType}}|{{HL7_date .AnalysisDateTime}}{{end}}{{end}}{{if or .WithPerformingOrganization .WithObservationType}}||||{{if .WithPerformingOrganization}}{{with .PerformingOrganization}}{{escape_HL7 .Name}}{{with .ID}}^^^^^^^^^{{escape_HL7 .}}{{end}}|{{template "AddressTmpl" .Address}}|{{template "DoctorTmpl" .MedicalDirector}}{{end}}{{else}}||{{end}}{{end}}{{if .WithObservationType}}||||{{.ObservationType}}{{with .ObservationSubType}}|{{.}}{{end}}{{end}}`,
 	}),
 	OBXClinicalNote: mustParseTemplates(OBX, map[string]string{
 		ceNoteTemplate: ceNoteTmpl,
 		noteTemplate:   stOBXNoteVal,
 		doctorTemplate: doctorTmpl,
-		OBX:            `OBX|{{.ID}}|{{.ValueType}}|{{template "CENoteTmpl" .ClinicalNote}}||{{template "NoteTmpl" .Content}}|||||||||{{HL7_date .ObservationDateTime}}||{{template "DoctorTmpl" .OrderingProvider}}`,
+		OBX:            `OBX|{{.ID}}|{{.ValueType}}|{{template "CENoteTmpl" .ClinicalNote}}|{{.SubID}}|{{template "NoteTmpl" .Content}}|||||||||{{HL7_date .ObservationDateTime}}||{{template "DoctorTmpl" .OrderingProvider}}`,
 	}),
 	OBXForMDM: mustParseTemplates(OBX, map[string]string{
 		ceTemplate: ceTmpl,
 		OBX:        `OBX|{{.ID}}|TX|{{template "CETmpl" .ObservationIdentifier}}|1|{{.Content}}||||||F||||||`,
 	}),
+	OBXForMDMED: mustParseTemplates(OBX, map[string]string{
+		ceTemplate: ceTmpl,
+		OBX:        `OBX|{{.ID}}|ED|{{template "CETmpl" .ObservationIdentifier}}|1|^^{{escape_HL7 .ContentType}}^Base64^{{.Data}}||||||F||||||`,
+	}),
 	PV1: mustParseTemplates(PV1, map[string]string{
 		locationTemplate: locationTmpl,
 		doctorTemplate:   doctorTmpl,
 		cxVisitTemplate:  cxVisitTmpl,
-		PV1:              `PV1|1|{{.Class}}|{{template "LocationTmpl" .Location}}|28b||{{template "LocationTmpl" .PriorLocation}}|{{template "DoctorTmpl" .AttendingDoctor}}|||{{.HospitalService}}|{{template "LocationTmpl" .TemporaryLocation}}|||||||{{.Type}}|{{template "CXVisitTmpl" .VisitID}}||||||||||||||||||||||{{.AccountStatus}}|{{template "LocationTmpl" .PendingLocation}}|{{template "LocationTmpl" .PriorTemporaryLocation}}|{{HL7_date .AdmissionDate}}|{{HL7_date .DischargeDate}}|`,
+		ceTemplate:       ceTmpl,
+		PV1:              `PV1|1|{{.Class}}|{{template "LocationTmpl" .Location}}|28b||{{template "LocationTmpl" .PriorLocation}}|{{template "DoctorTmpl" .AttendingDoctor}}|||{{if .CodedHospitalService}}{{template "CETmpl" .CodedHospitalService}}{{else}}{{.HospitalService}}{{end}}|{{template "LocationTmpl" .TemporaryLocation}}|||||||{{.Type}}|{{template "CXVisitTmpl" .VisitID}}||||||||||||||||||||||{{.AccountStatus}}|{{template "LocationTmpl" .PendingLocation}}|{{template "LocationTmpl" .PriorTemporaryLocation}}|{{HL7_date .AdmissionDate}}|{{HL7_date .DischargeDate}}|`,
+	}),
+	PRT: mustParseTemplates(PRT, map[string]string{
+		doctorTemplate: doctorTmpl,
+		PRT:            `PRT|{{.ID}}|UC||{{.Type}}^^HL70912|{{template "DoctorTmpl" .Provider}}||||||{{HL7_date .Begin}}|{{HL7_date .End}}`,
+	}),
+	AIG: mustParseTemplates(AIG, map[string]string{
+		ceTemplate:     ceTmpl,
+		timingTemplate: timingTmpl,
+		AIG:            `AIG|{{.ID}}||{{template "CETmpl" .Resource}}|||||{{template "TimingTmpl" .}}`,
+	}),
+	AIL: mustParseTemplates(AIL, map[string]string{
+		locationTemplate: locationTmpl,
+		timingTemplate:   timingTmpl,
+		AIL:              `AIL|{{.ID}}||{{template "LocationTmpl" .Location}}|||{{template "TimingTmpl" .}}`,
+	}),
+	AIP: mustParseTemplates(AIP, map[string]string{
+		doctorTemplate: doctorTmpl,
+		timingTemplate: timingTmpl,
+		AIP:            `AIP|{{.ID}}||{{template "DoctorTmpl" .Provider}}|||{{template "TimingTmpl" .}}`,
 	}),
+	PseudoPV1: mustParseTemplate(PseudoPV1, "PV1|1|{{.PatientClass}}|"),
 	PV2: mustParseTemplates(PV2, map[string]string{
 		locationTemplate: locationTmpl,
-		PV2:              `PV2|{{template "LocationTmpl" .PriorPendingLocation}}|||||||{{HL7_date .ExpectedAdmitDateTime}}|{{HL7_date .ExpectedDischargeDateTime}}`,
+		ceTemplate:       ceTmpl,
+		PV2:              `PV2|{{template "LocationTmpl" .PriorPendingLocation}}||{{template "CETmpl" .AdmitReason}}|||||{{HL7_date .ExpectedAdmitDateTime}}|{{HL7_date .ExpectedDischargeDateTime}}`,
 	}),
 	NK1: mustParseTemplates(NK1, map[string]string{
 		personNameTemplate: personNameTmpl,
 		addressTemplate:    addressTmpl,
 		homeNumberTemplate: homeNumberTmpl,
 		ceTemplate:         ceTmpl,
-		NK1:                `NK1|{{.ID}}|{{template "PersonNameTmpl" .}}|{{template "CETmpl" .Relationship}}|{{template "AddressTmpl" .Address}}|{{template "HomeNumberTmpl" .PhoneNumber}}||{{template "CETmpl" .ContactRole}}||||||||{{.Gender}}|`,
+		NK1:                `NK1|{{.ID}}|{{template "PersonNameTmpl" .}}|{{template "CETmpl" .Relationship}}|{{template "AddressTmpl" .Address}}|{{template "HomeNumberTmpl" .PhoneNumber}}||{{template "CETmpl" .ContactRole}}||||||{{escape_HL7 .EmployerName}}{{with .EmployerID}}^^{{escape_HL7 .}}{{end}}||{{.Gender}}|`,
 	}),
 	AL1: mustParseTemplates(AL1, map[string]string{
 		ceTemplate: ceTmpl,
 		AL1:        `AL1|{{.ID}}|{{.Type}}|{{template "CETmpl" .Description}}|{{.Severity}}|{{.Reaction}}|{{HL7_date .IdentificationDateTime}}`,
 	}),
-	NTE: mustParseTemplate(NTE, `NTE|{{.ID}}||{{.Note}}|`),
+	IAM: mustParseTemplates(IAM, map[string]string{
+		ceTemplate: ceTmpl,
+		IAM:        `IAM|{{.ID}}|{{.Type}}|{{template "CETmpl" .Description}}|{{.Severity}}|{{.Reaction}}|{{.ActionCode}}|||||{{HL7_date .OnsetDateTime}}||{{HL7_date .IdentificationDateTime}}`,
+	}),
+	NTE: mustParseTemplates(NTE, map[string]string{
+		ceTemplate: ceTmpl,
+		NTE:        `NTE|{{.ID}}||{{.Note}}|{{template "CETmpl" .CommentType}}`,
+	}),
 	DG1: mustParseTemplates(DG1, map[string]string{
 		ceTemplate:     ceTmpl,
 		doctorTemplate: doctorTmpl,
-		DG1:            `DG1|{{.ID}}|SNMCT|{{template "CETmpl" .Description}}|{{.Description.Text}}|{{HL7_date .DateTime}}|{{.Type}}|||||||||0|{{template "DoctorTmpl" .Clinician}}`,
+		DG1:            `DG1|{{.ID}}|SNMCT|{{template "CETmpl" .Description}}|{{.Description.Text}}|{{HL7_date .DateTime}}|{{.Type}}|||||||||{{.Priority}}|{{template "DoctorTmpl" .Clinician}}{{if .ClinicianDateTime.Valid}}|||{{HL7_date .ClinicianDateTime}}{{end}}`,
+	}),
+	DRG: mustParseTemplates(DRG, map[string]string{
+		ceTemplate: ceTmpl,
+		DRG:        `DRG|{{template "CETmpl" .Code}}|{{HL7_date .AssignedDateTime}}`,
 	}),
 	PD1: mustParseTemplates(PD1, map[string]string{
 		primFacTemplate: primFacTmpl,
-		PD1:             `PD1|||{{template "PrimFacTmpl" .PrimaryFacility}}|`,
+		doctorTemplate:  doctorTmpl,
+		PD1:             `PD1|||{{template "PrimFacTmpl" .PrimaryFacility}}|{{template "DoctorTmpl" .PrimaryCareProvider}}`,
 	}),
 	PR1: mustParseTemplates(PR1, map[string]string{
 		ceTemplate:     ceTmpl,
@@ -583,16 +2022,17 @@ var templates = map[string]*template.Template{
 	}),
 	TXA: mustParseTemplates(TXA, map[string]string{
 		doctorTemplate: doctorTmpl,
-		TXA:            `TXA|1|{{.DocumentType}}||{{HL7_date .ActivityDateTime}}|{{template "DoctorTmpl" .AttendingDoctor}}|||{{HL7_date .EditDateTime}}||||{{.UniqueDocumentNumber}}|||||{{.DocumentCompletionStatus}}||||||`,
+		TXA:            `TXA|1|{{.DocumentType}}||{{HL7_date .ActivityDateTime}}|{{template "DoctorTmpl" .AttendingDoctor}}|||{{HL7_date .EditDateTime}}|{{template "DoctorTmpl" .Originator}}|||{{.UniqueDocumentNumber}}|||||{{.DocumentCompletionStatus}}|||||{{template "DoctorTmpl" .Authenticator}}|`,
 	}),
 }
 
 // BuildDocumentNotificationMDMT02 builds and returns a HL7 MDM^T02 message.
-func BuildDocumentNotificationMDMT02(h *HeaderInfo, p *PatientInfo, d *Document, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildDocumentNotificationMDMT02(h *HeaderInfo, p *PatientInfo, d *Document, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  MDM,
 		TriggerEvent: "T02",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -600,32 +2040,38 @@ func BuildDocumentNotificationMDMT02(h *HeaderInfo, p *PatientInfo, d *Document,
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	txa, err := BuildTXA(p, d)
+	txa, err := buildTXA(h.Options, p, d)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build TXA segment")
 	}
 	segments = append(segments, txa)
-	for id, note := range d.ContentLine {
-		obx, err := BuildOBXForMDM(id+1, d.ObservationIdentifier, note)
+	if len(d.BinaryContent) > 0 {
+		obx, err := buildOBXForMDMBinary(h.Options, 1, d.ObservationIdentifier, d.BinaryContentType, d.BinaryContent)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build OBX segment")
 		}
 		segments = append(segments, obx)
+	} else {
+		for id, note := range d.ContentLine {
+			obx, err := buildOBXForMDM(h.Options, id+1, d.ObservationIdentifier, note)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot build OBX segment")
+			}
+			segments = append(segments, obx)
+		}
 	}
 
 	return &HL7Message{
@@ -635,11 +2081,12 @@ func BuildDocumentNotificationMDMT02(h *HeaderInfo, p *PatientInfo, d *Document,
 }
 
 // BuildResultORUR01 builds and returns a HL7 ORU^R01 message.
-func BuildResultORUR01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+func BuildResultORUR01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ORU,
 		TriggerEvent: "R01",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	segments, err := segmentsORU(h, p, o, msgTime, msgType)
 	if err != nil {
@@ -653,11 +2100,12 @@ func BuildResultORUR01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Tim
 }
 
 // BuildResultORUR03 builds and returns a HL7 ORU^R03 message.
-func BuildResultORUR03(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+func BuildResultORUR03(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ORU,
 		TriggerEvent: "R03",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	segments, err := segmentsORU(h, p, o, msgTime, msgType)
 	if err != nil {
@@ -671,11 +2119,12 @@ func BuildResultORUR03(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Tim
 }
 
 // BuildResultORUR32 builds and returns a HL7 ORU^R32 message.
-func BuildResultORUR32(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+func BuildResultORUR32(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ORU,
 		TriggerEvent: "R32",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	segments, err := segmentsORU(h, p, o, msgTime, msgType)
 	if err != nil {
@@ -688,44 +2137,102 @@ func BuildResultORUR32(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Tim
 	}, nil
 }
 
+// BuildResultORU builds and returns a HL7 ORU message whose trigger event depends on the Result
+// Status of the order: ORU^R01 for complete results, i.e., any of completeStatuses, usually the
+// configured config.ResultStatus Final and Corrected values, and ORU^R03 for any other status, as the
+// results are partial, e.g. P (Preliminary). Orders without a status result in ORU^R01.
+// ORU^R32 (Unsolicited Pre-Ordered Observation) is never selected, as none of the Result Status
+// values says that the observations were made before the order; use BuildResultORUR32 to build it.
+func BuildResultORU(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time, completeStatuses []string) (*HL7Message, error) {
+	if o.ResultsStatus == "" || isCompleteResultStatus(o.ResultsStatus, completeStatuses) {
+		return BuildResultORUR01(h, p, o, msgTime)
+	}
+	return BuildResultORUR03(h, p, o, msgTime)
+}
+
+func isCompleteResultStatus(status string, completeStatuses []string) bool {
+	for _, s := range completeStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildResultORUR01Multi builds and returns a HL7 ORU^R01 message with the results of several orders.
+// The MSH, PID and PV1 segments are only included once, followed by an ORC / OBR / OBX group for
+// each order. The OBR SetIDs are sequential across the groups, whereas the OBX SetIDs are
+// relative to their OBR, so they start from each order's NumberOfPreviousResults.
+func BuildResultORUR01Multi(h *HeaderInfo, p *PatientInfo, orders []*Order, msgTime time.Time) (_ *HL7Message, err error) {
+	msgType := &Type{
+		MessageType:  ORU,
+		TriggerEvent: "R01",
+	}
+	defer recordMetrics(h.Options, msgType, &err)
+
+	if len(orders) == 0 {
+		return nil, errors.New("cannot build ORU^R01 message without orders")
+	}
+	segments, err := segmentsORUMulti(h, p, orders, msgTime, msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HL7Message{
+		Type:    msgType,
+		Message: strings.Join(segments, SegmentTerminator),
+	}, nil
+}
+
 func segmentsORU(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time, msgType *Type) ([]string, error) {
+	return segmentsORUMulti(h, p, []*Order{o}, msgTime, msgType)
+}
+
+func segmentsORUMulti(h *HeaderInfo, p *PatientInfo, orders []*Order, msgTime time.Time, msgType *Type) ([]string, error) {
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	orc, err := BuildORC(o)
+	for i, o := range orders {
+		if segments, err = orderSegmentsORU(h.Options, i+1, o, segments); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// orderSegmentsORU appends the ORC, OBR and OBX segments for the given order to segments.
+// setID is the SetID of the OBR segment.
+func orderSegmentsORU(options *Options, setID int, o *Order, segments []string) ([]string, error) {
+	orc, err := buildORC(options, o)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build ORC segment")
 	}
 	segments = append(segments, orc)
-	obr, err := BuildOBR(o)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build OBR segment")
+	if segments, err = appendOBR(options, segments, setID, o); err != nil {
+		return nil, err
 	}
-	segments = append(segments, obr)
 
-	if o.DiagnosticServID == DiagnosticServIDMDOC {
-		return clinicalNotesOBX(o, segments)
+	if o.HasClinicalNote() {
+		return clinicalNotesOBX(options, o, segments)
 	}
-	return resultsOBX(o, segments)
+	return resultsOBX(options, o, segments)
 }
 
-func clinicalNotesOBX(o *Order, segments []string) ([]string, error) {
+func clinicalNotesOBX(options *Options, o *Order, segments []string) ([]string, error) {
 	for _, result := range o.Results {
 		for id := range result.ClinicalNote.Contents {
-			obx, err := BuildOBXForClinicalNote(id+1, id, result, o)
+			obx, err := buildOBXForClinicalNote(options, id+1, id, result, o)
 			if err != nil {
 				return nil, errors.Wrap(err, "cannot build OBX segment")
 			}
@@ -735,33 +2242,137 @@ func clinicalNotesOBX(o *Order, segments []string) ([]string, error) {
 	return segments, nil
 }
 
-func resultsOBX(o *Order, segments []string) ([]string, error) {
-	for id, result := range o.Results {
-		// We increment by 1 so that the first OBX has a SetID of 1 - that's how segment numbers starts.
-		// We use the number of previous result for the same order so that the SetIDs of OBX segments
-		// of different messages related to the same order (i.e. amendments) don't clash with the previous messages.
-		obx, err := BuildOBX(o.NumberOfPreviousResults+id+1, result, o)
+func resultsOBX(options *Options, o *Order, segments []string) ([]string, error) {
+	// We use the number of previous result for the same order so that the SetIDs of OBX segments
+	// of different messages related to the same order (i.e. amendments) don't clash with the previous messages.
+	// The SetID of the first OBX is one more than this, as that's how segment numbers starts.
+	setID := o.NumberOfPreviousResults
+	parentSubID := 0
+	var err error
+	for _, result := range o.Results {
+		// The Observation Sub-ID is only set for results with children, or whose value is split
+		// into several OBX segments, to link them together.
+		var subID string
+		if len(result.ChildResults) > 0 || splitValue(options, result) {
+			parentSubID++
+			subID = strconv.Itoa(parentSubID)
+		}
+		if segments, setID, err = appendOBXWithNotes(options, segments, setID, subID, result, o); err != nil {
+			return nil, err
+		}
+		for childID, child := range result.ChildResults {
+			if segments, setID, err = appendOBXWithNotes(options, segments, setID, fmt.Sprintf("%s.%d", subID, childID+1), child, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return segments, nil
+}
+
+// NumberOfOBXSegments returns the number of OBX segments that the given results are sent in when
+// built with the given options, i.e., the number of OBX SetIDs that they use. It is more than the
+// number of results if any of them has ChildResults, or a value that is split into several segments.
+func NumberOfOBXSegments(options *Options, results []*Result) int {
+	n := 0
+	for _, r := range results {
+		n += len(valueParts(options, r))
+		for _, child := range r.ChildResults {
+			n += len(valueParts(options, child))
+		}
+	}
+	return n
+}
+
+// splitValue returns whether the value of the given result needs to be split into several OBX segments,
+// because its rendered OBX -> Observation Value is longer than Options.MaxOBXValueLength.
+// The values of results with children are never split, so that the Sub-IDs don't clash, and neither
+// are Structured Numeric or coded values, as their parts wouldn't be valid values.
+func splitValue(options *Options, r *Result) bool {
+	max := options.maxOBXValueLength()
+	if max == 0 || len(r.ChildResults) > 0 || r.CodedValue != nil || r.ValueType == constants.StructuredNumericValueType {
+		return false
+	}
+	return utf8.RuneCountInString(observationValue(options, r.Value, r.NewlinesAsLineBreaks)) > max
+}
+
+// observationValue returns the given value as rendered in OBX -> Observation Value with the given
+// options, i.e., with its newlines converted and encoded with Options.Encoding.
+func observationValue(options *Options, value string, newlinesAsLineBreaks bool) string {
+	if newlinesAsLineBreaks {
+		return options.encoding().encode(toHL7LineBreaks(value))
+	}
+	return options.encoding().encode(toHL7RepeatedField(value))
+}
+
+// valueParts returns the parts of the value of the given result that are sent in each of its OBX
+// segments: the whole value if it doesn't need to be split, or parts whose rendered
+// OBX -> Observation Value is at most Options.MaxOBXValueLength long otherwise.
+// Each part has at least one character of the value, even if it is rendered longer than the maximum,
+// e.g. a newline rendered as a line break with a maximum length shorter than \.br\.
+func valueParts(options *Options, r *Result) []string {
+	if !splitValue(options, r) {
+		return []string{r.Value}
+	}
+	max := options.maxOBXValueLength()
+	var parts []string
+	var part strings.Builder
+	length := 0
+	for _, c := range r.Value {
+		// Newlines and encoding characters are rendered independently of the characters around them,
+		// so the length of the rendered value is the sum of the rendered length of its characters.
+		l := utf8.RuneCountInString(observationValue(options, string(c), r.NewlinesAsLineBreaks))
+		if length > 0 && length+l > max {
+			parts = append(parts, part.String())
+			part.Reset()
+			length = 0
+		}
+		part.WriteRune(c)
+		length += l
+	}
+	return append(parts, part.String())
+}
+
+// appendOBXWithNotes appends the OBX segments for the given result, followed by its NTE segments.
+// The SetIDs of the OBX segments follow the given setID, and the last one used is returned.
+// If the value of the result needs to be split, each part is sent in its own OBX segment with
+// the Sub-ID subID.1, subID.2, etc.
+func appendOBXWithNotes(options *Options, segments []string, setID int, subID string, result *Result, o *Order) ([]string, int, error) {
+	if !splitValue(options, result) {
+		setID++
+		obx, err := buildOBXWithSubID(options, setID, subID, result, o)
 		if err != nil {
-			return nil, errors.Wrap(err, "cannot build OBX segment")
+			return nil, 0, errors.Wrap(err, "cannot build OBX segment")
 		}
 		segments = append(segments, obx)
-		for noteID, note := range result.Notes {
-			nte, err := BuildNTE(noteID, note)
+	} else {
+		for i, value := range valueParts(options, result) {
+			part := *result
+			part.Value = value
+			setID++
+			obx, err := buildOBXWithSubID(options, setID, fmt.Sprintf("%s.%d", subID, i+1), &part, o)
 			if err != nil {
-				return nil, errors.Wrap(err, "cannot build NTE segment")
+				return nil, 0, errors.Wrap(err, "cannot build OBX segment")
 			}
-			segments = append(segments, nte)
+			segments = append(segments, obx)
 		}
 	}
-	return segments, nil
+	for noteID, note := range result.Notes {
+		nte, err := buildNTE(options, noteID, note)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "cannot build NTE segment")
+		}
+		segments = append(segments, nte)
+	}
+	return segments, setID, nil
 }
 
 // BuildOrderORMO01 builds and returns a HL7 ORM^O01 message.
-func BuildOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+func BuildOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ORM,
 		TriggerEvent: "O01",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -769,28 +2380,24 @@ func BuildOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	orc, err := BuildORC(o)
+	orc, err := buildORC(h.Options, o)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build ORC segment")
 	}
 	segments = append(segments, orc)
-	obr, err := BuildOBR(o)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build OBR segment")
+	if segments, err = appendOBR(h.Options, segments, 1, o); err != nil {
+		return nil, err
 	}
-	segments = append(segments, obr)
 	for noteID, note := range o.NotesForORM {
-		nte, err := BuildNTE(noteID, note)
+		nte, err := buildNTE(h.Options, noteID, note)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build NTE segment")
 		}
@@ -798,13 +2405,13 @@ func BuildOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time
 	}
 
 	for id, result := range o.ResultsForORM {
-		obx, err := BuildOBX(id+1, result, o)
+		obx, err := buildOBX(h.Options, id+1, result, o)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build OBX segment")
 		}
 		segments = append(segments, obx)
 		for noteID, note := range result.Notes {
-			nte, err := BuildNTE(noteID, note)
+			nte, err := buildNTE(h.Options, noteID, note)
 			if err != nil {
 				return nil, errors.Wrap(err, "cannot build NTE segment")
 			}
@@ -817,29 +2424,59 @@ func BuildOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time
 	}, nil
 }
 
+// BuildCancelOrderORMO01 builds and returns a HL7 ORM^O01 message that cancels the given order,
+// i.e., with the ORC -> Order Control set to OrderControlCancel.
+// The order must have the Placer and Filler numbers of the original order.
+func BuildCancelOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+	return buildOrderControlORMO01(h, p, o, msgTime, OrderControlCancel)
+}
+
+// BuildDiscontinueOrderORMO01 builds and returns a HL7 ORM^O01 message that discontinues the given
+// order, i.e., with the ORC -> Order Control set to OrderControlDiscontinue.
+// The order must have the Placer and Filler numbers of the original order.
+func BuildDiscontinueOrderORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+	return buildOrderControlORMO01(h, p, o, msgTime, OrderControlDiscontinue)
+}
+
+// buildOrderControlORMO01 builds a HL7 ORM^O01 message for a copy of the given order with the
+// ORC -> Order Control set to orderControl. It returns an error if the order doesn't have the
+// Placer or Filler numbers, as the receiver needs them to identify the original order.
+func buildOrderControlORMO01(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time, orderControl string) (*HL7Message, error) {
+	if o.Placer == "" {
+		return nil, fmt.Errorf("cannot build ORM^O01 message with order control %s: missing placer number", orderControl)
+	}
+	if o.Filler == "" {
+		return nil, fmt.Errorf("cannot build ORM^O01 message with order control %s: missing filler number", orderControl)
+	}
+	withControl := *o
+	withControl.OrderControl = orderControl
+	return BuildOrderORMO01(h, p, &withControl, msgTime)
+}
+
 // BuildPathologyORRO02 builds and returns a HL7 ORR^O02 message.
-func BuildPathologyORRO02(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (*HL7Message, error) {
+func BuildPathologyORRO02(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ORR,
 		TriggerEvent: "O02",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	msa, err := BuildMSA(o.MessageControlIDOriginalOrder)
+	msa, err := buildMSA(h.Options, o.MessageControlIDOriginalOrder)
 	if err != nil {
 		return nil, errors.Wrap(err, "MSA build MSH segment")
 	}
 	segments = append(segments, msa)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	orc, err := BuildORC(o)
+	orc, err := buildORC(h.Options, o)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build ORC segment")
 	}
@@ -852,11 +2489,12 @@ func BuildPathologyORRO02(h *HeaderInfo, p *PatientInfo, o *Order, msgTime time.
 }
 
 // BuildAdmissionADTA01 builds and returns a HL7 ADT^A01 message.
-func BuildAdmissionADTA01(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildAdmissionADTA01(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A01",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -864,35 +2502,34 @@ func BuildAdmissionADTA01(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	if segments, err = appendZBE(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 	for id, ap := range p.AssociatedParties {
-		nk1, err := BuildNK1(id, ap)
+		nk1, err := buildNK1(h.Options, id, ap)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build NK1 segment")
 		}
 		segments = append(segments, nk1)
 	}
 	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
+		al1, err := buildAL1(h.Options, id, al)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build AL1 segment")
 		}
@@ -906,38 +2543,85 @@ func BuildAdmissionADTA01(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 }
 
 // BuildTransferADTA02 builds and returns a HL7 ADT^A02 message.
-func BuildTransferADTA02(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+// It returns an error if the patient doesn't have both a Location and a PriorLocation, or if they
+// are the same, as then the message doesn't represent a transfer.
+func BuildTransferADTA02(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
+	msgType := &Type{
+		MessageType:  ADT,
+		TriggerEvent: "A02",
+	}
+	defer recordMetrics(h.Options, msgType, &err)
+
+	if p.Location == nil {
+		return nil, errors.New("the patient doesn't have a location to be transferred to")
+	}
+	if p.PriorLocation == nil {
+		return nil, errors.New("the patient doesn't have a prior location to be transferred from")
+	}
+	if sameLocation(p.PriorLocation, p.Location) {
+		return nil, fmt.Errorf("the prior location and the new location are the same: %+v", *p.Location)
+	}
+	return transferADTA02(msgType, h, p, eventTime, msgTime)
+}
+
+// BuildIncompleteTransferADTA02 builds and returns a HL7 ADT^A02 message without validating the
+// locations of the patient. It is meant for transfers in which the patient is missing the Location
+// or the PriorLocation, e.g., patients who were not admitted or who died during the transfer.
+// Use BuildTransferADTA02 for all other transfers.
+func BuildIncompleteTransferADTA02(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
+	msgType := &Type{
+		MessageType:  ADT,
+		TriggerEvent: "A02",
+	}
+	defer recordMetrics(h.Options, msgType, &err)
+	return transferADTA02(msgType, h, p, eventTime, msgTime)
+}
+
+// BuildTemporaryTransferADTA02 builds and returns a HL7 ADT^A02 message for a transfer to a temporary
+// location, e.g. radiology. The patient keeps their permanent location (PV1.3), and the temporary
+// location they are transferred to is sent in PV1.11 Temporary Location.
+func BuildTemporaryTransferADTA02(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A02",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
+
+	if p.TemporaryLocation == nil {
+		return nil, errors.New("the patient doesn't have a temporary location to be transferred to")
+	}
+	if p.PriorTemporaryLocation != nil && sameLocation(p.PriorTemporaryLocation, p.TemporaryLocation) {
+		return nil, fmt.Errorf("the prior temporary location and the new temporary location are the same: %+v", *p.TemporaryLocation)
+	}
+	return transferADTA02(msgType, h, p, eventTime, msgTime)
+}
 
+func transferADTA02(msgType *Type, h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	if segments, err = appendZBE(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -946,11 +2630,12 @@ func BuildTransferADTA02(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msg
 }
 
 // BuildDischargeADTA03 builds and returns a HL7 ADT^A03 message.
-func BuildDischargeADTA03(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildDischargeADTA03(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A03",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -958,28 +2643,24 @@ func BuildDischargeADTA03(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
+		al1, err := buildAL1(h.Options, id, al)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build AL1 segment")
 		}
@@ -993,11 +2674,12 @@ func BuildDischargeADTA03(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 }
 
 // BuildRegistrationADTA04 builds and returns a HL7 ADT^A04 message.
-func BuildRegistrationADTA04(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildRegistrationADTA04(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A04",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1005,35 +2687,31 @@ func BuildRegistrationADTA04(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 	for id, ap := range p.AssociatedParties {
-		nk1, err := BuildNK1(id, ap)
+		nk1, err := buildNK1(h.Options, id, ap)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build NK1 segment")
 		}
 		segments = append(segments, nk1)
 	}
 	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
+		al1, err := buildAL1(h.Options, id, al)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build AL1 segment")
 		}
@@ -1047,62 +2725,56 @@ func BuildRegistrationADTA04(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 }
 
 // BuildPreAdmitADTA05 builds and returns a HL7 ADT^A05 message.
-func BuildPreAdmitADTA05(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildPreAdmitADTA05(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A05",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, p.ExpectedAdmitDateTime, p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, p.ExpectedAdmitDateTime, p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
 	segments = append(segments, pv2)
 	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
+		al1, err := buildAL1(h.Options, id, al)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build AL1 segment")
 		}
 		segments = append(segments, al1)
 	}
 	for id, ap := range p.AssociatedParties {
-		nk1, err := BuildNK1(id, ap)
+		nk1, err := buildNK1(h.Options, id, ap)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build NK1 segment")
 		}
 		segments = append(segments, nk1)
 	}
-	for id, d := range p.Diagnoses {
-		dg1, err := BuildDG1(id, d)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot build DG1 segment")
-		}
-		segments = append(segments, dg1)
+	segments, err = appendDiagnoses(h.Options, segments, p)
+	if err != nil {
+		return nil, err
 	}
 	return &HL7Message{
 		Type:    msgType,
@@ -1112,10 +2784,21 @@ func BuildPreAdmitADTA05(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msg
 
 // BuildUpdatePatientADTA08 builds and returns a HL7 ADT^A08 message.
 func BuildUpdatePatientADTA08(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+	return updatePatientADTA08(h, p, eventTime, msgTime, false)
+}
+
+// BuildUpdatePatientADTA08WithIAM builds and returns a HL7 ADT^A08 message where the allergies are sent
+// in IAM segments instead of AL1 segments.
+func BuildUpdatePatientADTA08WithIAM(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+	return updatePatientADTA08(h, p, eventTime, msgTime, true)
+}
+
+func updatePatientADTA08(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, useIAM bool) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A08",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1123,33 +2806,32 @@ func BuildUpdatePatientADTA08(h *HeaderInfo, p *PatientInfo, eventTime time.Time
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	segments = append(segments, BuildPseudoPV1())
-	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot build AL1 segment")
-		}
-		segments = append(segments, al1)
+	pv1, err := buildPseudoPV1(h.Options)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PV1 segment")
 	}
-	for id, d := range p.Diagnoses {
-		dg1, err := BuildDG1(id, d)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot build DG1 segment")
-		}
-		segments = append(segments, dg1)
+	segments = append(segments, pv1)
+	allergies, err := allergySegments(h.Options, p, useIAM)
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, allergies...)
+	segments, err = appendDiagnoses(h.Options, segments, p)
+	if err != nil {
+		return nil, err
 	}
 	for id, p := range p.Procedures {
-		pr1, err := BuildPR1(id, p)
+		pr1, err := buildPR1(h.Options, id, p)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build PR1 segment")
 		}
@@ -1163,11 +2845,12 @@ func BuildUpdatePatientADTA08(h *HeaderInfo, p *PatientInfo, eventTime time.Time
 }
 
 // BuildTrackDepartureADTA09 builds and returns a HL7 ADT^A09 message.
-func BuildTrackDepartureADTA09(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildTrackDepartureADTA09(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A09",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1175,26 +2858,22 @@ func BuildTrackDepartureADTA09(h *HeaderInfo, p *PatientInfo, eventTime time.Tim
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1203,11 +2882,12 @@ func BuildTrackDepartureADTA09(h *HeaderInfo, p *PatientInfo, eventTime time.Tim
 }
 
 // BuildTrackArrivalADTA10 builds and returns a HL7 ADT^A10 message.
-func BuildTrackArrivalADTA10(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildTrackArrivalADTA10(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A10",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1215,26 +2895,22 @@ func BuildTrackArrivalADTA10(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1243,11 +2919,12 @@ func BuildTrackArrivalADTA10(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 }
 
 // BuildCancelVisitADTA11 builds and returns a HL7 ADT^A11 message.
-func BuildCancelVisitADTA11(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelVisitADTA11(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A11",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1255,26 +2932,25 @@ func BuildCancelVisitADTA11(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.AdmissionDate)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.AdmissionDate, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1283,11 +2959,12 @@ func BuildCancelVisitADTA11(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 }
 
 // BuildBedSwapADTA17 builds and returns a HL7 ADT^A17 message.
-func BuildBedSwapADTA17(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, otherP *PatientInfo) (*HL7Message, error) {
+func BuildBedSwapADTA17(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, otherP *PatientInfo) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A17",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1295,37 +2972,33 @@ func BuildBedSwapADTA17(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgT
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	otherPID, err := BuildPID(otherP.Person)
+	otherPID, err := buildPIDWithSetID(h.Options, 2, otherP.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, otherPID)
-	segments = append(segments, pd1)
-	otherPV1, err := BuildPV1(otherP)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPD1(h.Options, segments, otherP); err != nil {
+		return nil, err
+	}
+	if segments, err = appendPV1(h.Options, segments, otherP); err != nil {
+		return nil, err
 	}
-	segments = append(segments, otherPV1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1334,11 +3007,12 @@ func BuildBedSwapADTA17(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgT
 }
 
 // BuildAddPersonADTA28 builds and returns a HL7 ADT^A28 message.
-func BuildAddPersonADTA28(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildAddPersonADTA28(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A28",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1346,24 +3020,26 @@ func BuildAddPersonADTA28(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	pv1, err := buildPseudoPV1(h.Options)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+		return nil, errors.Wrap(err, "cannot build PV1 segment")
 	}
-	segments = append(segments, pd1)
-	segments = append(segments, BuildPseudoPV1())
+	segments = append(segments, pv1)
 	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
+		al1, err := buildAL1(h.Options, id, al)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build AL1 segment")
 		}
@@ -1378,43 +3054,71 @@ func BuildAddPersonADTA28(h *HeaderInfo, p *PatientInfo, eventTime time.Time, ms
 
 // BuildUpdatePersonADTA31 builds and returns a HL7 ADT^A31 message.
 func BuildUpdatePersonADTA31(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+	return updatePersonADTA31(h, p, eventTime, msgTime, false)
+}
+
+// BuildUpdatePersonADTA31WithIAM builds and returns a HL7 ADT^A31 message where the allergies are sent
+// in IAM segments instead of AL1 segments.
+func BuildUpdatePersonADTA31WithIAM(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+	return updatePersonADTA31(h, p, eventTime, msgTime, true)
+}
+
+// BuildPersonLifecycle builds and returns a HL7 ADT^A28 message followed by a HL7 ADT^A31 message for
+// the same person, e.g. to load a person into a Master Patient Index.
+// Each message gets a new Message Control ID from h.ControlIDGenerator, so the MessageControlID of h
+// is ignored, and h is not modified.
+func BuildPersonLifecycle(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) ([]*HL7Message, error) {
+	header := *h
+	header.MessageControlID = ""
+	a28, err := BuildAddPersonADTA28(&header, p, eventTime, msgTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build ADT^A28 message")
+	}
+	a31, err := BuildUpdatePersonADTA31(&header, p, eventTime, msgTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build ADT^A31 message")
+	}
+	return []*HL7Message{a28, a31}, nil
+}
+
+func updatePersonADTA31(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, useIAM bool) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A31",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	segments = append(segments, BuildPseudoPV1())
-	for id, al := range p.Allergies {
-		al1, err := BuildAL1(id, al)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot build AL1 segment")
-		}
-		segments = append(segments, al1)
+	pv1, err := buildPseudoPV1(h.Options)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PV1 segment")
 	}
-	for id, d := range p.Diagnoses {
-		dg1, err := BuildDG1(id, d)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot build DG1 segment")
-		}
-		segments = append(segments, dg1)
+	segments = append(segments, pv1)
+	allergies, err := allergySegments(h.Options, p, useIAM)
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, allergies...)
+	segments, err = appendDiagnoses(h.Options, segments, p)
+	if err != nil {
+		return nil, err
 	}
 	for id, p := range p.Procedures {
-		pr1, err := BuildPR1(id, p)
+		pr1, err := buildPR1(h.Options, id, p)
 		if err != nil {
 			return nil, errors.Wrap(err, "cannot build PR1 segment")
 		}
@@ -1428,11 +3132,12 @@ func BuildUpdatePersonADTA31(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 }
 
 // BuildCancelTransferADTA12 builds and returns a HL7 ADT^A12 message.
-func BuildCancelTransferADTA12(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelTransferADTA12(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A12",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1440,26 +3145,25 @@ func BuildCancelTransferADTA12(h *HeaderInfo, p *PatientInfo, eventTime time.Tim
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.TransferDate)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.TransferDate, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1468,11 +3172,12 @@ func BuildCancelTransferADTA12(h *HeaderInfo, p *PatientInfo, eventTime time.Tim
 }
 
 // BuildCancelDischargeADTA13 builds and returns a HL7 ADT^A13 message.
-func BuildCancelDischargeADTA13(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelDischargeADTA13(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A13",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1480,26 +3185,25 @@ func BuildCancelDischargeADTA13(h *HeaderInfo, p *PatientInfo, eventTime time.Ti
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.DischargeDate)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.DischargeDate, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1508,11 +3212,12 @@ func BuildCancelDischargeADTA13(h *HeaderInfo, p *PatientInfo, eventTime time.Ti
 }
 
 // BuildPendingAdmissionADTA14 builds and returns a HL7 ADT^A14 message.
-func BuildPendingAdmissionADTA14(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildPendingAdmissionADTA14(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A14",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
@@ -1523,27 +3228,23 @@ func BuildPendingAdmissionADTA14(h *HeaderInfo, p *PatientInfo, eventTime time.T
 	// http://www.hl7.eu/refactored/segEVN.html
 	// We add it in the EVN as well for consistency with the PendingTransfer message that doesn't have
 	// an equivalent in PV2.
-	evn, err := BuildEVN(eventTime, msgType, p.ExpectedAdmitDateTime, p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, p.ExpectedAdmitDateTime, p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
@@ -1556,37 +3257,34 @@ func BuildPendingAdmissionADTA14(h *HeaderInfo, p *PatientInfo, eventTime time.T
 }
 
 // BuildPendingTransferADTA15 builds and returns a HL7 ADT^A15 message.
-func BuildPendingTransferADTA15(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildPendingTransferADTA15(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A15",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, p.ExpectedTransferDateTime, p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, p.ExpectedTransferDateTime, p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1595,11 +3293,12 @@ func BuildPendingTransferADTA15(h *HeaderInfo, p *PatientInfo, eventTime time.Ti
 }
 
 // BuildPendingDischargeADTA16 builds and returns a HL7 ADT^A16 message.
-func BuildPendingDischargeADTA16(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildPendingDischargeADTA16(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A16",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
@@ -1607,27 +3306,23 @@ func BuildPendingDischargeADTA16(h *HeaderInfo, p *PatientInfo, eventTime time.T
 	}
 	segments = append(segments, msh)
 	// See BuildPendingAdmissionADTA14 for why we send ExpectedDischargeDateTime here.
-	evn, err := BuildEVN(eventTime, msgType, p.ExpectedDischargeDateTime, p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, p.ExpectedDischargeDateTime, p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
@@ -1640,32 +3335,31 @@ func BuildPendingDischargeADTA16(h *HeaderInfo, p *PatientInfo, eventTime time.T
 }
 
 // BuildDeleteVisitADTA23 builds and returns a HL7 ADT^A23 message.
-func BuildDeleteVisitADTA23(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildDeleteVisitADTA23(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A23",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
 	return &HL7Message{
 		Type:    msgType,
 		Message: strings.Join(segments, SegmentTerminator),
@@ -1673,42 +3367,42 @@ func BuildDeleteVisitADTA23(h *HeaderInfo, p *PatientInfo, eventTime time.Time,
 }
 
 // BuildCancelPendingDischargeADTA25 builds and returns a HL7 ADT^A25 message.
-func BuildCancelPendingDischargeADTA25(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelPendingDischargeADTA25(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A25",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedDischargeDateTime)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedDischargeDateTime, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
 	segments = append(segments, pv2)
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
+	}
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1717,42 +3411,42 @@ func BuildCancelPendingDischargeADTA25(h *HeaderInfo, p *PatientInfo, eventTime
 }
 
 // BuildCancelPendingTransferADTA26 builds and returns a HL7 ADT^A26 message.
-func BuildCancelPendingTransferADTA26(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelPendingTransferADTA26(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A26",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedTransferDateTime)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedTransferDateTime, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
 	segments = append(segments, pv2)
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
+	}
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1761,42 +3455,42 @@ func BuildCancelPendingTransferADTA26(h *HeaderInfo, p *PatientInfo, eventTime t
 }
 
 // BuildCancelPendingAdmitADTA27 builds and returns a HL7 ADT^A27 message.
-func BuildCancelPendingAdmitADTA27(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (*HL7Message, error) {
+func BuildCancelPendingAdmitADTA27(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A27",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedAdmitDateTime)
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, p.ExpectedAdmitDateTime, p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	pv1, err := BuildPV1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pv1)
-	pv2, err := BuildPV2(p)
+	pv2, err := buildPV2(h.Options, p)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PV2 segment")
 	}
 	segments = append(segments, pv2)
+	if segments, err = appendCancellationReason(h.Options, segments, p); err != nil {
+		return nil, err
+	}
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1805,11 +3499,12 @@ func BuildCancelPendingAdmitADTA27(h *HeaderInfo, p *PatientInfo, eventTime time
 }
 
 // BuildMergeADTA34 builds and returns a HL7 ADT^A34 message.
-func BuildMergeADTA34(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, withMRN string) (*HL7Message, error) {
+func BuildMergeADTA34(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, withMRN string) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A34",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1817,22 +3512,20 @@ func BuildMergeADTA34(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTim
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	mrg, err := BuildMRG([]string{withMRN})
+	mrg, err := buildMRG(h.Options, []string{withMRN})
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MRG segment")
 	}
@@ -1845,11 +3538,12 @@ func BuildMergeADTA34(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTim
 }
 
 // BuildMergeADTA40 builds and returns a HL7 ADT^A40 message.
-func BuildMergeADTA40(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, withMRN []string) (*HL7Message, error) {
+func BuildMergeADTA40(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTime time.Time, withMRN []string) (_ *HL7Message, err error) {
 	msgType := &Type{
 		MessageType:  ADT,
 		TriggerEvent: "A40",
 	}
+	defer recordMetrics(h.Options, msgType, &err)
 
 	var segments []string
 	msh, err := BuildMSH(msgTime, msgType, h)
@@ -1857,31 +3551,102 @@ func BuildMergeADTA40(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTim
 		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
 	segments = append(segments, msh)
-	evn, err := BuildEVN(eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime())
+	evn, err := buildEVN(h.Options, eventTime, msgType, NewInvalidTime(), p.AttendingDoctor, NewInvalidTime(), p.evnOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build EVN segment")
 	}
 	segments = append(segments, evn)
-	pid, err := BuildPID(p.Person)
+	pid, err := buildPIDForFacility(h.Options, p.Person, h.sendingFacility())
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build PID segment")
 	}
 	segments = append(segments, pid)
-	pd1, err := BuildPD1(p)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	if segments, err = appendPD1(h.Options, segments, p); err != nil {
+		return nil, err
 	}
-	segments = append(segments, pd1)
-	mrg, err := BuildMRG(withMRN)
+	mrg, err := buildMRG(h.Options, withMRN)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot build MRG segment")
 	}
 	segments = append(segments, mrg)
-	pv1, err := BuildPV1(p)
+	if segments, err = appendPV1(h.Options, segments, p); err != nil {
+		return nil, err
+	}
+
+	return &HL7Message{
+		Type:    msgType,
+		Message: strings.Join(segments, SegmentTerminator),
+	}, nil
+}
+
+// BuildPatientQueryQBPQ22 builds and returns a HL7 QBP^Q22 (Find Candidates) message, to query
+// a patient demographics query responder for the patients that match the given parameters.
+func BuildPatientQueryQBPQ22(h *HeaderInfo, q *QueryParams, msgTime time.Time) (_ *HL7Message, err error) {
+	msgType := &Type{
+		MessageType:  QBP,
+		TriggerEvent: "Q22",
+	}
+	defer recordMetrics(h.Options, msgType, &err)
+
+	// The Message Control ID is generated here so that the same one is used as the query tag.
+	h = withMessageControlID(h)
+	var segments []string
+	msh, err := BuildMSH(msgTime, msgType, h)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot build PV1 segment")
+		return nil, errors.Wrap(err, "cannot build MSH segment")
 	}
-	segments = append(segments, pv1)
+	segments = append(segments, msh)
+	queryTag := q.QueryTag
+	if queryTag == "" {
+		queryTag = h.MessageControlID
+	}
+	qpd, err := buildQPD(h.Options, queryTag, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build QPD segment")
+	}
+	segments = append(segments, qpd)
+	rcp, err := buildRCP(h.Options, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build RCP segment")
+	}
+	segments = append(segments, rcp)
+
+	return &HL7Message{
+		Type:    msgType,
+		Message: strings.Join(segments, SegmentTerminator),
+	}, nil
+}
+
+// BuildPatientQueryQRYA19 builds and returns a HL7 QRY^A19 (Patient Query) message, to query a
+// responder for the demographics of the patient with q.MRN. The rest of the search fields are ignored,
+// as QRY^A19 only supports querying by patient identifier. It returns an error if q.MRN is empty.
+func BuildPatientQueryQRYA19(h *HeaderInfo, q *QueryParams, msgTime time.Time) (_ *HL7Message, err error) {
+	msgType := &Type{
+		MessageType:  QRY,
+		TriggerEvent: "A19",
+	}
+	defer recordMetrics(h.Options, msgType, &err)
+
+	if q.MRN == "" {
+		return nil, errors.New("cannot build QRY^A19 message without a MRN to query")
+	}
+	// The Message Control ID is generated here so that the same one is used as the query ID.
+	h = withMessageControlID(h)
+	var segments []string
+	msh, err := BuildMSH(msgTime, msgType, h)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build MSH segment")
+	}
+	segments = append(segments, msh)
+	queryID := q.QueryTag
+	if queryID == "" {
+		queryID = h.MessageControlID
+	}
+	qrd, err := buildQRD(h.Options, msgTime, queryID, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build QRD segment")
+	}
+	segments = append(segments, qrd)
 
 	return &HL7Message{
 		Type:    msgType,
@@ -1890,57 +3655,318 @@ func BuildMergeADTA40(h *HeaderInfo, p *PatientInfo, eventTime time.Time, msgTim
 }
 
 // BuildMSH builds and returns a HL7 MSH segment.
+// If header.MessageControlID is empty, a new one is generated for this segment only: the header
+// is not modified, so that each message built with the same header gets a different ID.
 func BuildMSH(t time.Time, messageType *Type, header *HeaderInfo) (string, error) {
-	return executeTemplate(templates[MSH], struct {
-		T       *time.Time
-		MsgType *Type
-		Header  *HeaderInfo
-	}{&t, messageType, header})
+	header = withMessageControlID(header)
+	t = t.Add(header.ClockSkew)
+	return executeTemplate(header.Options, templates[MSH], struct {
+		T                *time.Time
+		MsgType          *Type
+		MessageStructure string
+		Header           *HeaderInfo
+		Version          string
+	}{&t, messageType, messageType.messageStructure(header.Options), header, header.Options.hl7Version()})
+}
+
+// withMessageControlID returns the given header if it has a Message Control ID or no
+// ControlIDGenerator, or a copy of it with a new Message Control ID from its ControlIDGenerator otherwise.
+func withMessageControlID(h *HeaderInfo) *HeaderInfo {
+	if h.MessageControlID != "" || h.ControlIDGenerator == nil {
+		return h
+	}
+	withID := *h
+	withID.MessageControlID = h.ControlIDGenerator.NewMessageControlID()
+	return &withID
 }
 
 // BuildMSA builds and returns a HL7 MSA segment.
 func BuildMSA(orderMessageControlID string) (string, error) {
-	return executeTemplate(templates[MSA], struct {
+	return buildMSA(nil, orderMessageControlID)
+}
+
+func buildMSA(options *Options, orderMessageControlID string) (string, error) {
+	return executeTemplate(options, templates[MSA], struct {
 		OrderMessageControlID string
 	}{OrderMessageControlID: orderMessageControlID})
 }
 
+// AssembleMessage returns a HL7 message of the given type made of the given segments joined with
+// SegmentTerminator, e.g. the outputs of the Build* segment functions.
+// The segments are used as they are: their order and cardinality are not validated, which allows
+// building messages with reordered or duplicated segments.
+func AssembleMessage(t *Type, segments []string) *HL7Message {
+	return &HL7Message{
+		Type:    t,
+		Message: strings.Join(segments, SegmentTerminator),
+	}
+}
+
+// Receiver is a receiver of a broadcast message, sent in MSH.5 Receiving Application and
+// MSH.6 Receiving Facility.
+type Receiver struct {
+	// Application is the receiving application. If empty, the receiving application of the
+	// broadcast message is kept.
+	Application string
+	Facility    string
+}
+
+// Indexes of the fields of a MSH segment split by the field separator. They are one less than the
+// field numbers, as MSH.1 is the field separator itself.
+const (
+	mshReceivingApplicationIndex = 4
+	mshReceivingFacilityIndex    = 5
+	mshMessageControlIDIndex     = 9
+)
+
+// Broadcast returns a copy of the given message for each of the receivers, e.g. to send the same event
+// to several receiving facilities without building the message again.
+// Each copy has the receiving application and facility of its receiver, and a new Message Control ID
+// from g. The rest of the message is the same as base.
+// The values of the receivers are escaped with the encoding of base, as set in its MSH segment.
+func Broadcast(base *HL7Message, receivers []Receiver, g ControlIDGenerator) ([]*HL7Message, error) {
+	if base == nil {
+		return nil, errors.New("cannot broadcast a nil message")
+	}
+	if g == nil {
+		return nil, errors.New("cannot broadcast without a ControlIDGenerator")
+	}
+	encoding, err := messageEncoding(base)
+	if err != nil {
+		return nil, err
+	}
+	separator := string(encoding.FieldSeparator)
+	segments := strings.Split(base.Message, SegmentTerminator)
+	msh := strings.Split(segments[0], separator)
+	if msh[0] != MSH || len(msh) <= mshMessageControlIDIndex {
+		return nil, fmt.Errorf("cannot broadcast message with invalid MSH segment %q", segments[0])
+	}
+	msgs := make([]*HL7Message, 0, len(receivers))
+	for _, r := range receivers {
+		fields := append([]string(nil), msh...)
+		if r.Application != "" {
+			fields[mshReceivingApplicationIndex] = encoding.encode(escapeHL7(r.Application))
+		}
+		fields[mshReceivingFacilityIndex] = encoding.encode(escapeHL7(r.Facility))
+		fields[mshMessageControlIDIndex] = g.NewMessageControlID()
+		msgSegments := append([]string{strings.Join(fields, separator)}, segments[1:]...)
+		msgs = append(msgs, AssembleMessage(base.Type, msgSegments))
+	}
+	return msgs, nil
+}
+
+// messageEncoding returns the encoding of the given message, as set in MSH.1 and MSH.2.
+func messageEncoding(m *HL7Message) (Encoding, error) {
+	msh := strings.SplitN(m.Message, SegmentTerminator, 2)[0]
+	chars := []rune(strings.TrimPrefix(msh, MSH))
+	if !strings.HasPrefix(msh, MSH) || len(chars) < len(DefaultEncoding.chars()) {
+		return Encoding{}, fmt.Errorf("cannot get the encoding of message with invalid MSH segment %q", msh)
+	}
+	return ParseEncoding(string(chars[:len(DefaultEncoding.chars())]))
+}
+
+// EVNOptions contains the optional fields of an EVN segment.
+type EVNOptions struct {
+	// EventReason is the EVN.4 Event Reason Code. The field is left empty if this is empty.
+	EventReason string
+	// EventFacility is the EVN.7 Event Facility. The field is only included if this is not empty.
+	EventFacility string
+}
+
+// evnOptions returns the optional EVN fields for the patient's messages.
+func (p *PatientInfo) evnOptions() EVNOptions {
+	return EVNOptions{EventReason: p.EventReason, EventFacility: p.EventFacility}
+}
+
 // BuildEVN builds and returns a HL7 EVN segment.
-func BuildEVN(t time.Time, messageType *Type, planned NullTime, operator *Doctor, occurred NullTime) (string, error) {
-	return executeTemplate(templates[EVN], struct {
+func BuildEVN(t time.Time, messageType *Type, planned NullTime, operator *Doctor, occurred NullTime, opts EVNOptions) (string, error) {
+	return buildEVN(nil, t, messageType, planned, operator, occurred, opts)
+}
+
+func buildEVN(options *Options, t time.Time, messageType *Type, planned NullTime, operator *Doctor, occurred NullTime, opts EVNOptions) (string, error) {
+	return buildEVNWithOperators(options, t, messageType, planned, []*Doctor{operator}, occurred, opts)
+}
+
+// BuildEVNWithOperators builds and returns a HL7 EVN segment where the Operator ID field (EVN.5)
+// has one repetition for each of the given operators, e.g. a clinician and a clerk.
+func BuildEVNWithOperators(t time.Time, messageType *Type, planned NullTime, operators []*Doctor, occurred NullTime, opts EVNOptions) (string, error) {
+	return buildEVNWithOperators(nil, t, messageType, planned, operators, occurred, opts)
+}
+
+func buildEVNWithOperators(options *Options, t time.Time, messageType *Type, planned NullTime, operators []*Doctor, occurred NullTime, opts EVNOptions) (string, error) {
+	return executeTemplate(options, templates[EVN], struct {
 		T                     *time.Time
 		MsgType               *Type
 		DateTimePlannedEvent  NullTime
-		Operator              *Doctor
+		Operators             []*Doctor
 		EventOccurredDateTime NullTime
-	}{&t, messageType, planned, operator, occurred})
+		EVNOptions
+	}{&t, messageType, planned, operators, occurred, opts})
 }
 
-// BuildPID builds and returns a HL7 PID segment.
+// BuildPID builds and returns a HL7 PID segment with Set ID 1.
 func BuildPID(p *Person) (string, error) {
-	return executeTemplate(templates[PID], p)
+	return buildPID(nil, p)
+}
+
+func buildPID(options *Options, p *Person) (string, error) {
+	return buildPIDWithMRNAuthority(options, 1, p, defaultMRNAuthority)
+}
+
+// BuildPIDForFacility builds and returns a HL7 PID segment with Set ID 1 for a message sent by the given facility.
+// If the person has an MRN for that facility in MRNsByAuthority, that MRN is used in PID.3 with the
+// facility as the assigning authority. Otherwise, the segment is the same as the one built with BuildPID.
+func BuildPIDForFacility(p *Person, facility string) (string, error) {
+	return buildPIDForFacility(nil, p, facility)
+}
+
+func buildPIDForFacility(options *Options, p *Person, facility string) (string, error) {
+	return buildPIDWithSetID(options, 1, p, facility)
+}
+
+// BuildPIDWithSetID builds and returns a HL7 PID segment like BuildPIDForFacility, with the given
+// PID.1 Set ID. Messages with more than one PID segment, e.g. ADT^A17, number them from 1.
+// If p is nil, the template is executed on nil, as BuildPID used to do.
+func BuildPIDWithSetID(setID int, p *Person, facility string) (string, error) {
+	return buildPIDWithSetID(nil, setID, p, facility)
+}
+
+func buildPIDWithSetID(options *Options, setID int, p *Person, facility string) (string, error) {
+	if p == nil {
+		return executeTemplate(options, templates[PID], p)
+	}
+	mrn, ok := p.MRNsByAuthority[facility]
+	if !ok {
+		return buildPIDWithMRNAuthority(options, setID, p, defaultMRNAuthority)
+	}
+	withMRN := *p
+	withMRN.MRN = mrn
+	return buildPIDWithMRNAuthority(options, setID, &withMRN, facility)
+}
+
+func buildPIDWithMRNAuthority(options *Options, setID int, p *Person, mrnAuthority string) (string, error) {
+	return executeTemplate(options, templates[PID], struct {
+		*Person
+		SetID        int
+		MRNAuthority string
+	}{Person: p, SetID: setID, MRNAuthority: mrnAuthority})
 }
 
-// BuildPV1 builds and returns a HL7 PV1 segment.
+// BuildPV1 builds and returns a HL7 PV1 segment with the default Options.
 func BuildPV1(p *PatientInfo) (string, error) {
-	return executeTemplate(templates[PV1], p)
+	return buildPV1(nil, p)
 }
 
+// buildPV1 builds and returns a HL7 PV1 segment.
+// If Options.ParticipationSegments is set, the Attending Doctor field (PV1.7) is left empty, as the
+// attending doctor is sent in a PRT segment instead.
+func buildPV1(options *Options, p *PatientInfo) (string, error) {
+	if !options.participationSegments() {
+		return executeTemplate(options, templates[PV1], p)
+	}
+	return executeTemplate(options, templates[PV1], struct {
+		*PatientInfo
+		AttendingDoctor *Doctor
+	}{PatientInfo: p})
+}
+
+// appendPD1 appends the PD1 segment for the given patient to segments.
+// If Options.OmitEmptyPD1 is set, the segment is not appended if
+// the patient has neither a primary facility nor a primary care provider.
+func appendPD1(options *Options, segments []string, p *PatientInfo) ([]string, error) {
+	if options.omitEmptyPD1() && p.PrimaryFacility == nil && p.PrimaryCareProvider == nil {
+		return segments, nil
+	}
+	pd1, err := buildPD1(options, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PD1 segment")
+	}
+	return append(segments, pd1), nil
+}
+
+// appendPV1 appends the PV1 segment for the given patient to segments.
+// If Options.ParticipationSegments is set, it is followed by a PRT
+// segment for the attending doctor, if any.
+func appendPV1(options *Options, segments []string, p *PatientInfo) ([]string, error) {
+	pv1, err := buildPV1(options, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PV1 segment")
+	}
+	segments = append(segments, pv1)
+	if !options.participationSegments() || p.AttendingDoctor == nil {
+		return segments, nil
+	}
+	prt, err := buildPRT(options, 1, &Participation{
+		Type:     ParticipationAttendingProvider,
+		Provider: p.AttendingDoctor,
+		Begin:    p.AdmissionDate,
+		End:      p.DischargeDate,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PRT segment")
+	}
+	return append(segments, prt), nil
+}
+
+// appendZBE appends a ZBE segment with the patient's Movement to the given segments, if set.
+func appendZBE(options *Options, segments []string, p *PatientInfo) ([]string, error) {
+	if p.Movement == nil {
+		return segments, nil
+	}
+	zbe, err := buildZBE(options, p.Movement)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build ZBE segment")
+	}
+	return append(segments, zbe), nil
+}
+
+// appendCancellationReason appends an NTE segment with the patient's CancellationReason to the
+// given segments, if set.
+func appendCancellationReason(options *Options, segments []string, p *PatientInfo) ([]string, error) {
+	if p.CancellationReason == "" {
+		return segments, nil
+	}
+	nte, err := buildNTE(options, 1, p.CancellationReason)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build NTE segment")
+	}
+	return append(segments, nte), nil
+}
+
+// DefaultPseudoPV1PatientClass is the default patient class of the PV1 segments built with
+// BuildPseudoPV1: N - Not applicable.
+const DefaultPseudoPV1PatientClass = "N"
+
 // BuildPseudoPV1 builds and returns a HL7 PV1 segment without any patient information.
 // A PV1 that some messages need to send for backwards compatibility but where the visit is not
-// relevant to the message, e.g. ADT^08. The PatientClass is set to N - Not applicable.
-func BuildPseudoPV1() string {
-	return `PV1|1|N|`
+// relevant to the message, e.g. ADT^08. The PatientClass is set to DefaultPseudoPV1PatientClass,
+// N - Not applicable, unless a different one is set in Options.PseudoPV1PatientClass.
+func BuildPseudoPV1() (string, error) {
+	return buildPseudoPV1(nil)
+}
+
+func buildPseudoPV1(options *Options) (string, error) {
+	return executeTemplate(options, templates[PseudoPV1], struct {
+		PatientClass string
+	}{options.pseudoPV1PatientClass()})
 }
 
 // BuildPV2 builds and returns a HL7 PV2 segment.
 func BuildPV2(p *PatientInfo) (string, error) {
-	return executeTemplate(templates[PV2], p)
+	return buildPV2(nil, p)
+}
+
+func buildPV2(options *Options, p *PatientInfo) (string, error) {
+	return executeTemplate(options, templates[PV2], p)
 }
 
 // BuildNK1 builds and returns a HL7 NK1 segment.
 func BuildNK1(id int, p *AssociatedParty) (string, error) {
-	return executeTemplate(templates[NK1], struct {
+	return buildNK1(nil, id, p)
+}
+
+func buildNK1(options *Options, id int, p *AssociatedParty) (string, error) {
+	return executeTemplate(options, templates[NK1], struct {
 		*AssociatedParty
 		ID int
 	}{p, id})
@@ -1948,97 +3974,302 @@ func BuildNK1(id int, p *AssociatedParty) (string, error) {
 
 // BuildAL1 builds and returns a HL7 AL1 segment.
 func BuildAL1(id int, a *Allergy) (string, error) {
-	return executeTemplate(templates[AL1], struct {
+	return buildAL1(nil, id, a)
+}
+
+func buildAL1(options *Options, id int, a *Allergy) (string, error) {
+	return executeTemplate(options, templates[AL1], struct {
 		*Allergy
-		ID int
-	}{a, id})
+		ID       int
+		Reaction string
+	}{a, id, strings.Join(a.AllReactions(), listItemsSeparator)})
+}
+
+// BuildIAM builds and returns a HL7 IAM segment.
+// IAM segments can be used instead of AL1 segments to send allergies with an action code.
+func BuildIAM(id int, a *Allergy) (string, error) {
+	return buildIAM(nil, id, a)
+}
+
+func buildIAM(options *Options, id int, a *Allergy) (string, error) {
+	actionCode := a.ActionCode
+	if actionCode == "" {
+		actionCode = AllergyActionAdd
+	}
+	return executeTemplate(options, templates[IAM], struct {
+		*Allergy
+		ID         int
+		Reaction   string
+		ActionCode string
+	}{a, id, strings.Join(a.AllReactions(), listItemsSeparator), actionCode})
+}
+
+// allergySegments builds and returns the segments for the allergies of the given patient, either as
+// IAM segments if useIAM is true, or as AL1 segments otherwise.
+func allergySegments(options *Options, p *PatientInfo, useIAM bool) ([]string, error) {
+	var segments []string
+	for id, al := range p.Allergies {
+		if useIAM {
+			iam, err := buildIAM(options, id, al)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot build IAM segment")
+			}
+			segments = append(segments, iam)
+			continue
+		}
+		al1, err := buildAL1(options, id, al)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot build AL1 segment")
+		}
+		segments = append(segments, al1)
+	}
+	return segments, nil
 }
 
 // BuildORC builds and returns a HL7 ORC segment.
 func BuildORC(o *Order) (string, error) {
-	return executeTemplate(templates[ORC], &o)
+	return buildORC(nil, o)
+}
+
+func buildORC(options *Options, o *Order) (string, error) {
+	return executeTemplate(options, templates[ORC], &o)
 }
 
 // BuildOBR builds and returns a HL7 OBR segment.
 func BuildOBR(o *Order) (string, error) {
+	return buildOBR(nil, o)
+}
+
+func buildOBR(options *Options, o *Order) (string, error) {
+	return buildOBRWithSetID(options, 1, o)
+}
+
+// buildOBR builds and returns a HL7 OBR segment with the given SetID.
+func buildOBRWithSetID(options *Options, setID int, o *Order) (string, error) {
 	// If this order is sending a ClinicalNote, use the appropriate OBR template.
 	var key, documentID string
-	if o.DiagnosticServID == DiagnosticServIDMDOC {
+	if o.HasClinicalNote() {
 		key = OBRClinicalNote
 		documentID = o.Results[0].ClinicalNote.DocumentID
 	} else {
 		key = OBR
 	}
-	return executeTemplate(templates[key], struct {
+	// If participation segments are enabled, the ordering provider is sent in a PRT segment instead.
+	orderingProvider := o.OrderingProvider
+	if options.participationSegments() {
+		orderingProvider = nil
+	}
+	return executeTemplate(options, templates[key], struct {
 		*Order
-		DocumentID string
-	}{o, documentID})
+		SetID            int
+		DocumentID       string
+		OrderingProvider *Doctor
+	}{o, setID, documentID, orderingProvider})
+}
+
+// appendOBR appends the OBR segment with the given SetID for the given order to segments.
+// If Options.ParticipationSegments is set, it is followed by a PRT
+// segment for the ordering provider, if any.
+func appendOBR(options *Options, segments []string, setID int, o *Order) ([]string, error) {
+	obr, err := buildOBRWithSetID(options, setID, o)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build OBR segment")
+	}
+	segments = append(segments, obr)
+	if !options.participationSegments() || o.OrderingProvider == nil {
+		return segments, nil
+	}
+	prt, err := buildPRT(options, 1, &Participation{Type: ParticipationOrderingProvider, Provider: o.OrderingProvider})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build PRT segment")
+	}
+	return append(segments, prt), nil
 }
 
 // BuildOBX builds and returns a HL7 OBX segment.
 func BuildOBX(id int, r *Result, o *Order) (string, error) {
-	return executeTemplate(templates[OBX], struct {
+	return buildOBX(nil, id, r, o)
+}
+
+func buildOBX(options *Options, id int, r *Result, o *Order) (string, error) {
+	return buildOBXWithSubID(options, id, "", r, o)
+}
+
+// BuildOBXWithSubID builds and returns a HL7 OBX segment with the given Observation Sub-ID.
+// If the value type of the result is SN (Structured Numeric), the value is parsed with
+// ParseStructuredNumeric and rendered as its components.
+func BuildOBXWithSubID(id int, subID string, r *Result, o *Order) (string, error) {
+	return buildOBXWithSubID(nil, id, subID, r, o)
+}
+
+func buildOBXWithSubID(options *Options, id int, subID string, r *Result, o *Order) (string, error) {
+	var sn *StructuredNumeric
+	if r.ValueType == constants.StructuredNumericValueType && r.Value != "" {
+		var err error
+		if sn, err = ParseStructuredNumeric(r.Value); err != nil {
+			return "", err
+		}
+	}
+	withObservationType := options.hl7VersionAtLeast(6) && (r.ObservationType != "" || r.ObservationSubType != "")
+	withPerformingOrganization := options.hl7VersionAtLeast(5) && r.PerformingOrganization != nil
+	return executeTemplate(options, templates[OBX], struct {
 		*Result
-		ID                  int
-		ObservationDateTime NullTime
-		OrderingProvider    *Doctor
-	}{r, id, r.ObservationDateTime, o.OrderingProvider})
+		ID                         int
+		SubID                      string
+		ObservationDateTime        NullTime
+		OrderingProvider           *Doctor
+		StructuredNumeric          *StructuredNumeric
+		WithObservationType        bool
+		WithPerformingOrganization bool
+		FormattedReferenceRange    string
+	}{r, id, subID, r.ObservationDateTime, o.OrderingProvider, sn, withObservationType, withPerformingOrganization, r.ReferenceRange(options.referenceRangeFormat())})
 }
 
 // BuildOBXForClinicalNote build and returns a HL7 OBX segment for a Clinical Note.
+// All the contents of a note share the same Observation Identifier, so if the note has more than
+// one content, the Observation Sub-ID (OBX.4) is set to the 1-based index of the content to tell them apart.
 func BuildOBXForClinicalNote(id, contentIndex int, r *Result, o *Order) (string, error) {
-	return executeTemplate(templates[OBXClinicalNote], struct {
+	return buildOBXForClinicalNote(nil, id, contentIndex, r, o)
+}
+
+func buildOBXForClinicalNote(options *Options, id, contentIndex int, r *Result, o *Order) (string, error) {
+	var subID string
+	if len(r.ClinicalNote.Contents) > 1 {
+		subID = strconv.Itoa(contentIndex + 1)
+	}
+	return executeTemplate(options, templates[OBXClinicalNote], struct {
 		*Result
 		ID                  int
+		SubID               string
 		Content             *ClinicalNoteContent
 		ObservationDateTime NullTime
 		DiagnosticServID    string
 		OrderingProvider    *Doctor
-	}{r, id, r.ClinicalNote.Contents[contentIndex], r.ObservationDateTime, o.DiagnosticServID, o.OrderingProvider})
+	}{r, id, subID, r.ClinicalNote.Contents[contentIndex], r.ObservationDateTime, o.DiagnosticServID, o.OrderingProvider})
 }
 
 // BuildOBXForMDM builds and returns a HL7 OBX segment for MDMT02 type for an MDM message.
 func BuildOBXForMDM(id int, o *CodedElement, line string) (string, error) {
-	return executeTemplate(templates[OBXForMDM], struct {
+	return buildOBXForMDM(nil, id, o, line)
+}
+
+func buildOBXForMDM(options *Options, id int, o *CodedElement, line string) (string, error) {
+	return executeTemplate(options, templates[OBXForMDM], struct {
 		ID                    int
 		ObservationIdentifier *CodedElement
 		Content               string
 	}{id, o, line})
 }
 
+// BuildOBXForMDMBinary builds and returns a HL7 OBX segment for MDMT02 type for an MDM message,
+// with value type ED (Encapsulated Data) and the given binary content encoded in base64.
+func BuildOBXForMDMBinary(id int, o *CodedElement, contentType string, content []byte) (string, error) {
+	return buildOBXForMDMBinary(nil, id, o, contentType, content)
+}
+
+func buildOBXForMDMBinary(options *Options, id int, o *CodedElement, contentType string, content []byte) (string, error) {
+	return executeTemplate(options, templates[OBXForMDMED], struct {
+		ID                    int
+		ObservationIdentifier *CodedElement
+		ContentType           string
+		Data                  string
+	}{id, o, contentType, base64.StdEncoding.EncodeToString(content)})
+}
+
 // BuildNTE builds and returns a HL7 NTE segment.
 func BuildNTE(id int, note string) (string, error) {
-	return executeTemplate(templates[NTE], struct {
-		Note string
-		ID   int
-	}{note, id})
+	return buildNTE(nil, id, note)
+}
+
+func buildNTE(options *Options, id int, note string) (string, error) {
+	return buildNTEWithType(options, id, note, nil)
+}
+
+// BuildNTEWithType builds and returns a HL7 NTE segment with the given Comment Type (NTE.4),
+// e.g. 1R (Primary Reason) or GI (General Instructions). The comment type is left empty if nil.
+func BuildNTEWithType(id int, note string, commentType *CodedElement) (string, error) {
+	return buildNTEWithType(nil, id, note, commentType)
+}
+
+func buildNTEWithType(options *Options, id int, note string, commentType *CodedElement) (string, error) {
+	return executeTemplate(options, templates[NTE], struct {
+		Note        string
+		ID          int
+		CommentType *CodedElement
+	}{note, id, commentType})
 }
 
 // BuildPD1 builds and returns a HL7 PD1 segment.
 func BuildPD1(p *PatientInfo) (string, error) {
-	return executeTemplate(templates[PD1], struct {
+	return buildPD1(nil, p)
+}
+
+func buildPD1(options *Options, p *PatientInfo) (string, error) {
+	return executeTemplate(options, templates[PD1], struct {
 		*PrimaryFacility
-	}{p.PrimaryFacility})
+		PrimaryCareProvider *Doctor
+	}{p.PrimaryFacility, p.PrimaryCareProvider})
 }
 
 // BuildMRG builds and returns a HL7 MRG segment.
 func BuildMRG(mrns []string) (string, error) {
-	return executeTemplate(templates[MRG], struct {
+	return buildMRG(nil, mrns)
+}
+
+func buildMRG(options *Options, mrns []string) (string, error) {
+	return executeTemplate(options, templates[MRG], struct {
 		MRNs []string
 	}{mrns})
 }
 
 // BuildDG1 builds and returns a HL7 DG1 segment.
 func BuildDG1(id int, diagnose *DiagnosisOrProcedure) (string, error) {
-	return executeTemplate(templates[DG1], struct {
+	return buildDG1(nil, id, diagnose)
+}
+
+func buildDG1(options *Options, id int, diagnose *DiagnosisOrProcedure) (string, error) {
+	return executeTemplate(options, templates[DG1], struct {
 		*DiagnosisOrProcedure
 		ID int
 	}{DiagnosisOrProcedure: diagnose, ID: id})
 }
 
+// BuildDRG builds and returns a HL7 DRG segment.
+func BuildDRG(drg *DiagnosisRelatedGroup) (string, error) {
+	return buildDRG(nil, drg)
+}
+
+func buildDRG(options *Options, drg *DiagnosisRelatedGroup) (string, error) {
+	return executeTemplate(options, templates[DRG], drg)
+}
+
+// appendDiagnoses appends a DG1 segment for each of the patient's diagnoses to the given segments,
+// followed by a DRG segment if the patient has a Diagnosis Related Group.
+func appendDiagnoses(options *Options, segments []string, p *PatientInfo) ([]string, error) {
+	for id, d := range p.Diagnoses {
+		dg1, err := buildDG1(options, id, d)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot build DG1 segment")
+		}
+		segments = append(segments, dg1)
+	}
+	if p.DRG == nil {
+		return segments, nil
+	}
+	drg, err := buildDRG(options, p.DRG)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build DRG segment")
+	}
+	return append(segments, drg), nil
+}
+
 // BuildPR1 builds and returns a HL7 PR1 segment.
 func BuildPR1(id int, procedure *DiagnosisOrProcedure) (string, error) {
-	return executeTemplate(templates[PR1], struct {
+	return buildPR1(nil, id, procedure)
+}
+
+func buildPR1(options *Options, id int, procedure *DiagnosisOrProcedure) (string, error) {
+	return executeTemplate(options, templates[PR1], struct {
 		*DiagnosisOrProcedure
 		ID int
 	}{DiagnosisOrProcedure: procedure, ID: id})
@@ -2046,12 +4277,219 @@ func BuildPR1(id int, procedure *DiagnosisOrProcedure) (string, error) {
 
 // BuildTXA builds and returns a HL7 TXA segment.
 func BuildTXA(p *PatientInfo, d *Document) (string, error) {
-	return executeTemplate(templates[TXA], struct {
+	return buildTXA(nil, p, d)
+}
+
+func buildTXA(options *Options, p *PatientInfo, d *Document) (string, error) {
+	return executeTemplate(options, templates[TXA], struct {
 		*Document
 		AttendingDoctor *Doctor
 	}{d, p.AttendingDoctor})
 }
 
+// BuildQPD builds and returns a HL7 QPD segment for a QBP^Q22 query with the given query tag.
+func BuildQPD(queryTag string, q *QueryParams) (string, error) {
+	return buildQPD(nil, queryTag, q)
+}
+
+func buildQPD(options *Options, queryTag string, q *QueryParams) (string, error) {
+	params, err := q.parameters()
+	if err != nil {
+		return "", err
+	}
+	return executeTemplate(options, templates[QPD], struct {
+		QueryTag   string
+		Parameters []queryParameter
+	}{queryTag, params})
+}
+
+// BuildQRD builds and returns a HL7 QRD segment for a QRY^A19 query with the given query ID,
+// in record-oriented format, with Immediate priority, and for the demographics of the patient
+// with q.MRN.
+func BuildQRD(queryTime time.Time, queryID string, q *QueryParams) (string, error) {
+	return buildQRD(nil, queryTime, queryID, q)
+}
+
+func buildQRD(options *Options, queryTime time.Time, queryID string, q *QueryParams) (string, error) {
+	return executeTemplate(options, templates[QRD], struct {
+		QueryTime     NullTime
+		QueryID       string
+		QuantityLimit int
+		MRN           string
+	}{NewValidTime(queryTime), queryID, q.QuantityLimit, q.MRN})
+}
+
+// BuildZBE builds and returns a ZBE segment, which carries the movement that triggers a message.
+func BuildZBE(m *Movement) (string, error) {
+	return buildZBE(nil, m)
+}
+
+func buildZBE(options *Options, m *Movement) (string, error) {
+	return executeTemplate(options, templates[ZBE], m)
+}
+
+// BuildRCP builds and returns a HL7 RCP segment, with Immediate priority.
+func BuildRCP(q *QueryParams) (string, error) {
+	return buildRCP(nil, q)
+}
+
+func buildRCP(options *Options, q *QueryParams) (string, error) {
+	return executeTemplate(options, templates[RCP], q)
+}
+
+// BuildPRT builds and returns a HL7 PRT segment.
+func BuildPRT(id int, p *Participation) (string, error) {
+	return buildPRT(nil, id, p)
+}
+
+func buildPRT(options *Options, id int, p *Participation) (string, error) {
+	return executeTemplate(options, templates[PRT], struct {
+		*Participation
+		ID int
+	}{p, id})
+}
+
+// BuildAIG builds and returns a HL7 AIG segment.
+func BuildAIG(id int, r *AppointmentResource) (string, error) {
+	return buildAIG(nil, id, r)
+}
+
+func buildAIG(options *Options, id int, r *AppointmentResource) (string, error) {
+	return executeTemplate(options, templates[AIG], struct {
+		*AppointmentResource
+		ID              int
+		DurationMinutes int
+	}{r, id, int(r.Duration.Minutes())})
+}
+
+// BuildAIL builds and returns a HL7 AIL segment.
+func BuildAIL(id int, l *AppointmentLocation) (string, error) {
+	return buildAIL(nil, id, l)
+}
+
+func buildAIL(options *Options, id int, l *AppointmentLocation) (string, error) {
+	return executeTemplate(options, templates[AIL], struct {
+		*AppointmentLocation
+		ID              int
+		DurationMinutes int
+	}{l, id, int(l.Duration.Minutes())})
+}
+
+// BuildAIP builds and returns a HL7 AIP segment.
+func BuildAIP(id int, p *AppointmentPersonnel) (string, error) {
+	return buildAIP(nil, id, p)
+}
+
+func buildAIP(options *Options, id int, p *AppointmentPersonnel) (string, error) {
+	return executeTemplate(options, templates[AIP], struct {
+		*AppointmentPersonnel
+		ID              int
+		DurationMinutes int
+	}{p, id, int(p.Duration.Minutes())})
+}
+
+// BuildAppointmentDetailSegments builds and returns the AIG, AIL and AIP segments for the resources,
+// locations and providers of an appointment, in this order, as sent in SIU messages.
+// Set IDs are 1-based and independent for each segment type.
+func BuildAppointmentDetailSegments(d *AppointmentDetails) ([]string, error) {
+	return buildAppointmentDetailSegments(nil, d)
+}
+
+func buildAppointmentDetailSegments(options *Options, d *AppointmentDetails) ([]string, error) {
+	var segments []string
+	for i, r := range d.Resources {
+		aig, err := buildAIG(options, i+1, r)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot build AIG segment")
+		}
+		segments = append(segments, aig)
+	}
+	for i, l := range d.Locations {
+		ail, err := buildAIL(options, i+1, l)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot build AIL segment")
+		}
+		segments = append(segments, ail)
+	}
+	for i, p := range d.Personnel {
+		aip, err := buildAIP(options, i+1, p)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot build AIP segment")
+		}
+		segments = append(segments, aip)
+	}
+	return segments, nil
+}
+
+// DebugSegments builds every segment that applies to the given patient and order independently,
+// and returns a map from segment name to the rendered segment. Segments that repeat, e.g. NK1 or
+// OBX, are keyed by the segment name and their 1-based position, e.g. "OBX.2".
+// If a segment cannot be built, the value in the map is the error instead.
+// Either p or o can be nil, in which case the segments built from them are not included.
+// This is intended as a debugging aid to inspect how individual segments are rendered, and it is
+// not used to build messages.
+func DebugSegments(p *PatientInfo, o *Order) map[string]string {
+	segments := make(map[string]string)
+	add := func(name string, segment string, err error) {
+		if err != nil {
+			segments[name] = fmt.Sprintf("error: %v", err)
+			return
+		}
+		segments[name] = segment
+	}
+	repeated := func(name string, i int) string {
+		return fmt.Sprintf("%s.%d", name, i+1)
+	}
+
+	if p != nil {
+		pid, err := buildPID(nil, p.Person)
+		add(PID, pid, err)
+		pd1, err := buildPD1(nil, p)
+		add(PD1, pd1, err)
+		pv1, err := buildPV1(nil, p)
+		add(PV1, pv1, err)
+		pv2, err := buildPV2(nil, p)
+		add(PV2, pv2, err)
+		for i, ap := range p.AssociatedParties {
+			nk1, err := buildNK1(nil, i, ap)
+			add(repeated(NK1, i), nk1, err)
+		}
+		for i, al := range p.Allergies {
+			al1, err := buildAL1(nil, i, al)
+			add(repeated(AL1, i), al1, err)
+		}
+		for i, d := range p.Diagnoses {
+			dg1, err := buildDG1(nil, i, d)
+			add(repeated(DG1, i), dg1, err)
+		}
+		if p.DRG != nil {
+			drg, err := buildDRG(nil, p.DRG)
+			add(DRG, drg, err)
+		}
+		for i, pr := range p.Procedures {
+			pr1, err := buildPR1(nil, i, pr)
+			add(repeated(PR1, i), pr1, err)
+		}
+	}
+	if o != nil {
+		orc, err := buildORC(nil, o)
+		add(ORC, orc, err)
+		obr, err := buildOBR(nil, o)
+		add(OBR, obr, err)
+		for i, r := range o.Results {
+			obx, err := buildOBX(nil, i+1, r, o)
+			add(repeated(OBX, i), obx, err)
+		}
+	}
+	return segments
+}
+
+// hdOrString returns a template that renders the structured value of the given HeaderInfo field
+// if set, or the plain string otherwise.
+func hdOrString(field string) string {
+	return fmt.Sprintf(`{{if .Header.%[1]sHD}}{{template "HDTmpl" .Header.%[1]sHD}}{{else}}{{.Header.%[1]s}}{{end}}`, field)
+}
+
 func mustParseTemplate(name string, t string) *template.Template {
 	tmpl, err := template.New(name).Funcs(funcMap).Parse(t)
 	if err != nil {
@@ -2084,13 +4522,92 @@ func mustParseTemplates(name string, templates map[string]string) *template.Temp
 	return tmpl
 }
 
-func executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+// requiredFields are the fields of the data passed to each template that must be set if strict
+// templates are enabled with Options.StrictTemplates.
+// These are the fields that HL7 requires in each segment and that SH does not always populate,
+// e.g. OBR.4 Universal Service Identifier or PID.3 Patient Identifier List.
+// Each requirement lists the fields that can populate the HL7 field: it is met if any of them is set.
+// The entries are keyed by template rather than by template name, because several templates share
+// the same name, e.g. the OBX templates for results and for clinical notes.
+// It is populated in init, as the templates cannot refer to it during initialization.
+var requiredFields map[*template.Template][][]string
+
+func init() {
+	requiredFields = map[*template.Template][][]string{
+		templates[PID]:             {{"MRN"}},
+		templates[PV1]:             {{"Class"}},
+		templates[OBR]:             {{"OrderProfile"}},
+		templates[OBRClinicalNote]: {{"OrderProfile"}},
+		templates[OBX]:             {{"ObservationIdentifier", "TestName"}},
+		templates[DG1]:             {{"Description"}},
+		templates[PR1]:             {{"Description"}},
+	}
+}
+
+// isMissingField returns whether the field with the given name of data, which is a struct or a
+// pointer to a struct, is nil or an empty string. The fields of a nil pointer to a struct, and the
+// fields promoted from a nil embedded struct, are also considered missing.
+func isMissingField(data interface{}, name string) bool {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		t := v.Type().Elem()
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		_, ok := t.FieldByName(name)
+		return ok
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := v.Type().FieldByName(name)
+	if !ok {
+		return false
+	}
+	for _, i := range f.Index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return true
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	case reflect.String:
+		return v.String() == ""
+	}
+	return false
+}
+
+// isMissingFields returns whether all the fields with the given names of data are missing,
+// as defined by isMissingField.
+func isMissingFields(data interface{}, names []string) bool {
+	for _, name := range names {
+		if !isMissingField(data, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func executeTemplate(options *Options, tmpl *template.Template, data interface{}) (string, error) {
+	if options.strictTemplates() {
+		for _, names := range requiredFields[tmpl] {
+			if isMissingFields(data, names) {
+				return "", fmt.Errorf("cannot execute the template: %s: missing required field %s", tmpl.Name(), strings.Join(names, " or "))
+			}
+		}
+	}
 	var buffer bytes.Buffer
 	err := tmpl.Execute(&buffer, data)
 	if err != nil {
 		return "", errors.Wrapf(err, "cannot execute the template: %s", tmpl.Name())
 	}
-	return buffer.String(), nil
+	return options.encoding().encode(buffer.String()), nil
 }
 
 func (m Type) String() string {
@@ -2101,3 +4618,21 @@ func (m HL7Message) String() string {
 	return fmt.Sprintf("message:[type:%v msg:%v]",
 		m.Type, strings.Replace(m.Message, SegmentTerminator, " ", -1))
 }
+
+// SegmentCount returns the number of segments in the message.
+// Empty segments, e.g. after a trailing segment terminator, are not counted.
+func (m HL7Message) SegmentCount() int {
+	n := 0
+	for _, s := range strings.Split(m.Message, SegmentTerminator) {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// ByteLen returns the length in bytes of the message as it is sent, including the segment
+// terminators. It can be used to reject messages that are over the size limit of the receiver.
+func (m HL7Message) ByteLen() int {
+	return len(m.Message)
+}
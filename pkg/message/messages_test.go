@@ -16,11 +16,16 @@ package message
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/hl7"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test/testhl7"
 )
 
@@ -56,6 +61,70 @@ func TestMain(m *testing.M) {
 	os.Exit(retCode)
 }
 
+func TestNewPerson(t *testing.T) {
+	birth := time.Date(1994, 7, 4, 13, 35, 18, 0, time.UTC)
+	death := time.Date(2020, 5, 26, 20, 28, 28, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		opts    []PersonOption
+		want    *Person
+		wantErr bool
+	}{{
+		name: "Defaults",
+		want: &Person{Gender: GenderUnknown, DeathIndicator: DeathIndicatorAlive},
+	}, {
+		name: "All options",
+		opts: []PersonOption{
+			WithName("Helen", "Smiths"),
+			WithGender(GenderFemale),
+			WithBirth(birth),
+			WithIdentifiers("12529150521124992", "3333381389"),
+			WithAddress(&Address{FirstLine: "1 Goodwill Hunting Road", City: "London"}),
+			WithPhoneNumber("020 7031 3000"),
+		},
+		want: &Person{
+			FirstName:      "Helen",
+			Surname:        "Smiths",
+			Gender:         GenderFemale,
+			Birth:          NewValidTime(birth),
+			MRN:            "12529150521124992",
+			NHS:            "3333381389",
+			Address:        &Address{FirstLine: "1 Goodwill Hunting Road", City: "London"},
+			PhoneNumber:    "020 7031 3000",
+			DeathIndicator: DeathIndicatorAlive,
+		},
+	}, {
+		name: "Date of death sets death indicator",
+		opts: []PersonOption{WithGender(GenderMale), WithDeath(death)},
+		want: &Person{Gender: GenderMale, DateOfDeath: NewValidTime(death), DeathIndicator: DeathIndicatorDead},
+	}, {
+		name: "Explicit death indicator",
+		opts: []PersonOption{WithDeath(death), WithDeathIndicator("DECEASED")},
+		want: &Person{Gender: GenderUnknown, DateOfDeath: NewValidTime(death), DeathIndicator: "DECEASED"},
+	}, {
+		name:    "Invalid gender",
+		opts:    []PersonOption{WithGender("Female")},
+		wantErr: true,
+	}, {
+		name:    "Alive with date of death",
+		opts:    []PersonOption{WithDeath(death), WithDeathIndicator(DeathIndicatorAlive)},
+		wantErr: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewPerson(tc.opts...)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("NewPerson() got err %v, want err? %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("NewPerson() diff (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestBuildPID(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -80,6 +149,56 @@ func TestBuildPID(t *testing.T) {
 			}
 		},
 		want: "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^^^Miss^^CURRENT|||F||||||||||||||||||||||",
+	}, {
+		name: "NHS Verification Status",
+		setup: func() *Person {
+			return &Person{
+				Prefix:                "Miss",
+				FirstName:             "Helen",
+				Surname:               "Smiths",
+				Gender:                "F",
+				MRN:                   "12529150521124992",
+				NHS:                   "3333381389",
+				NHSVerificationStatus: "01",
+			}
+		},
+		want: "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR^01||Smiths^Helen^^^Miss^^CURRENT|||F||||||||||||||||||||||",
+	}, {
+		name: "Legal Name",
+		setup: func() *Person {
+			return &Person{
+				Prefix:       "Miss",
+				FirstName:    "Helen",
+				Surname:      "Smiths",
+				Gender:       "F",
+				MRN:          "12529150521124992",
+				NHS:          "3333381389",
+				NameTypeCode: NameTypeLegal,
+			}
+		},
+		want: "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^^^Miss^^L|||F||||||||||||||||||||||",
+	}, {
+		name: "Alias Name",
+		setup: func() *Person {
+			return &Person{
+				FirstName:    "Nell",
+				Surname:      "Smith",
+				Gender:       "F",
+				MRN:          "12529150521124992",
+				NHS:          "3333381389",
+				NameTypeCode: NameTypeAlias,
+			}
+		},
+		want: "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR||Smith^Nell^^^^^A|||F||||||||||||||||||||||",
+	}, {
+		name: "Address With County",
+		setup: func() *Person {
+			p := testPersonFemale()
+			p.Address.County = "Greater London"
+			return p
+		},
+		// County is XAD.9.
+		want: "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^Matilda^Junior^Miss^Dr^CURRENT||19940704133518|F|||1 Goodwill Hunting Road^Kings Cross^London^^N1C 4AG^GBR^HOME^^Greater London||020 7031 3000^HOME|||||||||A^White British^^^|||||||20200526202828|DECEASED",
 	}}
 
 	for _, tc := range tests {
@@ -96,296 +215,2119 @@ func TestBuildPID(t *testing.T) {
 	}
 }
 
-func TestBuildMSH(t *testing.T) {
-	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
-	header := testHeader()
-	mt := &Type{"ORU", "R01"}
+func TestBuildPIDForFacility(t *testing.T) {
+	p := &Person{
+		Surname:         "Smiths",
+		FirstName:       "Helen",
+		MRN:             "12529150521124992",
+		NHS:             "3333381389",
+		MRNsByAuthority: map[string]string{"RAL": "RAL0001", "UCLH": "UCLH0002"},
+	}
 
-	want := "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"
-	got, err := BuildMSH(now, mt, header)
-	if err != nil {
-		t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+	tests := []struct {
+		facility string
+		want     string
+	}{{
+		facility: "RAL",
+		want:     "PID|1|RAL0001^^^RAL^MRN|RAL0001^^^RAL^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^^^^^CURRENT|||||||||||||||||||||||||",
+	}, {
+		facility: "UCLH",
+		want:     "PID|1|UCLH0002^^^UCLH^MRN|UCLH0002^^^UCLH^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^^^^^CURRENT|||||||||||||||||||||||||",
+	}, {
+		facility: "OTHER",
+		want:     "PID|1|12529150521124992^^^SIMULATOR MRN^MRN|12529150521124992^^^SIMULATOR MRN^MRN~3333381389^^^NHSNBR^NHSNMBR||Smiths^Helen^^^^^CURRENT|||||||||||||||||||||||||",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.facility, func(t *testing.T) {
+			got, err := BuildPIDForFacility(p, tc.facility)
+			if err != nil {
+				t.Fatalf("BuildPIDForFacility(%v, %q) failed with %v", p, tc.facility, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildPIDForFacility(%v, %q)=%v, want %v", p, tc.facility, got, tc.want)
+			}
+		})
 	}
-	if got != want {
-		t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, want)
+	if got, want := p.MRN, "12529150521124992"; got != want {
+		t.Errorf("p.MRN=%v, want %v; BuildPIDForFacility should not modify the person", got, want)
 	}
 }
 
-func TestBuildMSA(t *testing.T) {
-	want := "MSA|AA|1"
-	got, err := BuildMSA("1")
-	if err != nil {
-		t.Fatalf("BuildMSA(%v) failed with %v", "1", err)
+func TestBuildAdmissionADTA01_NilPerson(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	header := &HeaderInfo{MessageControlID: "1", SendingFacility: "RAL"}
+	if _, err := BuildAdmissionADTA01(header, &PatientInfo{}, now, now); err != nil {
+		t.Errorf("BuildAdmissionADTA01(%v, %v, %v, %v) failed with %v, want <nil>", header, &PatientInfo{}, now, now, err)
 	}
-	if got != want {
-		t.Errorf("BuildMSA(%v)=%v, want %v", "1", got, want)
+}
+
+func TestBuildUpdatePatientA08_MRNPerSendingFacility(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	patientInfo.Person.MRNsByAuthority = map[string]string{"RAL": "RAL0001", "UCLH": "UCLH0002"}
+
+	tests := []struct {
+		name   string
+		header *HeaderInfo
+		want   string
+	}{{
+		name:   "SendingFacility",
+		header: &HeaderInfo{SendingApplication: "CERNER", SendingFacility: "RAL"},
+		want:   "RAL0001^^^RAL^MRN",
+	}, {
+		name:   "SendingFacilityHD",
+		header: &HeaderInfo{SendingApplication: "CERNER", SendingFacilityHD: &HierarchicDesignator{NamespaceID: "UCLH", UniversalID: "1.2.3", UniversalIDType: "ISO"}},
+		want:   "UCLH0002^^^UCLH^MRN",
+	}, {
+		name:   "Unknown facility",
+		header: &HeaderInfo{SendingApplication: "CERNER", SendingFacility: "OTHER"},
+		want:   patientInfo.Person.MRN + "^^^SIMULATOR MRN^MRN",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			adt, err := BuildUpdatePatientADTA08(tc.header, patientInfo, now, msgTime)
+			if err != nil {
+				t.Fatalf("BuildUpdatePatientADTA08(%v, %v, %v, %v) failed with %v", tc.header, patientInfo, now, msgTime, err)
+			}
+			var pid string
+			for _, segment := range strings.Split(adt.Message, SegmentTerminator) {
+				if strings.HasPrefix(segment, "PID|") {
+					pid = segment
+				}
+			}
+			if got := strings.Split(pid, "|")[3]; !strings.HasPrefix(got, tc.want+"~") {
+				t.Errorf("BuildUpdatePatientADTA08(%v, %v, %v, %v) got PID.3 %q, want it to start with %q", tc.header, patientInfo, now, msgTime, got, tc.want)
+			}
+		})
 	}
 }
 
-func TestBuildEVN(t *testing.T) {
+func TestBuildMSH(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
-	occurred := NewValidTime(time.Date(2018, 1, 26, 15, 24, 23, 0, time.UTC))
-	planned := NewValidTime(time.Date(2018, 1, 26, 15, 24, 22, 0, time.UTC))
-	operator := testDoctor()
-	mt := &Type{"ORU", "R01"}
+	header := testHeader()
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
 
-	want := "EVN|R01|20180126152421|20180126152422||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423"
-	got, err := BuildEVN(now, mt, planned, operator, occurred)
+	want := "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"
+	got, err := BuildMSH(now, mt, header)
 	if err != nil {
-		t.Fatalf("BuildEVN(%v, %v, %v, %v, %v) failed with %v", now, mt, planned, operator, occurred, err)
+		t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
 	}
 	if got != want {
-		t.Errorf("BuildEVN(%v, %v, %v, %v, %v)=%v, want %v", now, mt, planned, operator, occurred, got, want)
+		t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, want)
 	}
 }
 
-func TestBuildEVN_NoOccurredOrPlannedTime(t *testing.T) {
+func TestBuildMSH_CountryCode(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
-	operator := testDoctor()
-	invalidTime := NewInvalidTime()
-	mt := &Type{"ORU", "R01"}
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
 
-	want := "EVN|R01|20180126152421|||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|"
-	got, err := BuildEVN(now, mt, invalidTime, operator, invalidTime)
-	if err != nil {
-		t.Fatalf("BuildEVN(%v, %v, %v, %v, %v) failed with %v", now, mt, invalidTime, operator, invalidTime, err)
+	tests := []struct {
+		countryCode string
+		want        string
+	}{
+		{countryCode: "GBR", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||GBR|ASCII"},
+		{countryCode: "USA", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||USA|ASCII"},
+		{countryCode: "", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
 	}
-	if got != want {
-		t.Errorf("BuildEVN(%v, %v, %v, %v, %v)=%v, want %v", now, mt, invalidTime, operator, invalidTime, got, want)
+	for _, tc := range tests {
+		t.Run(tc.countryCode, func(t *testing.T) {
+			header := testHeader()
+			header.CountryCode = tc.countryCode
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
+			}
+		})
 	}
 }
 
-func TestBuildORC(t *testing.T) {
+func TestBuildMSH_TimestampPrecision(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
-	o := testOrder(now)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
 
-	want := "ORC|RE|9984058|1902082||IP||||20180126152421"
-	got, err := BuildORC(o)
-	if err != nil {
-		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+	tests := []struct {
+		name      string
+		precision *hl7.TSPrecision
+		want      string
+	}{
+		{name: "default", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "second", precision: tsPrecision(hl7.SecondPrecision), want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "millisecond", precision: tsPrecision(hl7.ThousandthSecondPrecision), want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "minute", precision: tsPrecision(hl7.MinutePrecision), want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|201801261524||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "day", precision: tsPrecision(hl7.DayPrecision), want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "year", precision: tsPrecision(hl7.YearPrecision), want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|2018||ORU^R01|1|T|2.3|||AL||44|ASCII"},
 	}
-	if got != want {
-		t.Errorf("BuildORC(%v)=%v, want %v", o, got, want)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeader()
+			header.TimestampPrecision = tc.precision
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
+			}
+		})
 	}
 }
 
-func TestBuildORC_NoOrderDateTime(t *testing.T) {
-	o := &Order{
-		Placer:       "9984058",
-		Filler:       "1902082",
-		OrderControl: "RE",
-		OrderStatus:  "IP",
-	}
-	want := "ORC|RE|9984058|1902082||IP||||"
-	got, err := BuildORC(o)
-	if err != nil {
-		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+func TestBuildMSH_ClockSkew(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	tests := []struct {
+		name string
+		skew time.Duration
+		want string
+	}{
+		{name: "none", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "ahead", skew: 90 * time.Second, want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152551||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+		{name: "behind", skew: -time.Hour, want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126142421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
 	}
-	if got != want {
-		t.Errorf("BuildORC(%v)=%v, want %v", o, got, want)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeader()
+			header.ClockSkew = tc.skew
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
+			}
+		})
 	}
 }
 
-func TestBuildOBR(t *testing.T) {
+func TestBuildMSH_MessageStructure(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
 
 	tests := []struct {
 		name    string
-		setup   func() *Order
+		version string
+		mt      *Type
 		want    string
-		wantErr bool
 	}{{
-		name: "Regular",
-		setup: func() *Order {
-			return testOrder(now)
-		},
-		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C||1",
+		name:    "derived",
+		version: "2.3.1",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A01"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A01^ADT_A01|1|T|2.3.1|||AL||44|ASCII",
 	}, {
-		name: "AllDates",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
-			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
-			o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 51, 21, 0, time.UTC))
-			return o
-		},
-		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523|||||||20180126163255||||||||20180126165121|||C||1",
+		name:    "derived from a shared structure",
+		version: "2.3.1",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A08"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A08^ADT_A01|1|T|2.3.1|||AL||44|ASCII",
 	}, {
-		name: "NoTimezone",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.CollectedDateTime = NewValidTime(time.Now())
-			return o
-		},
-		wantErr: true,
+		name:    "derived from another shared structure",
+		version: "2.5",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A31"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A31^ADT_A05|1|T|2.5|||AL||44|ASCII",
 	}, {
-		name: "Midnight Dates",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.CollectedDateTime = NewMidnightTime(time.Date(2018, 1, 26, 23, 45, 23, 0, time.UTC))
-			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
-			o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 51, 21, 0, time.UTC))
-			return o
-		},
-		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126000000|||||||20180126163255||||||||20180126165121|||C||1",
+		name:    "explicit",
+		version: "2.3.1",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A04", MessageStructure: "ADT_A01"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A04^ADT_A01|1|T|2.3.1|||AL||44|ASCII",
 	}, {
-		name: "WithOrderingProvider",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.OrderingProvider = testDoctor()
-			return o
-		},
-		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421||||||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||||||||C||1",
+		name:    "not derived before 2.3.1",
+		version: "2.3",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A01"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A01|1|T|2.3|||AL||44|ASCII",
 	}, {
-		name: "WithSpecimenSource",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.SpecimenSource = "source"
-			return o
-		},
-		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||source||||||||||C||1",
+		name:    "explicit before 2.3.1",
+		version: "2.3",
+		mt:      &Type{MessageType: "ADT", TriggerEvent: "A04", MessageStructure: "ADT_A01"},
+		want:    "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ADT^A04^ADT_A01|1|T|2.3|||AL||44|ASCII",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeader()
+			header.Options = &Options{HL7Version: tc.version}
+			got, err := BuildMSH(now, tc.mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, tc.mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, tc.mt, header, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildMSH_HierarchicDesignator(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	cases := []struct {
+		name   string
+		header func() *HeaderInfo
+		want   string
+	}{{
+		name:   "plain strings",
+		header: testHeader,
+		want:   "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII",
 	}, {
-		name: "ClinicalNote",
-		setup: func() *Order {
-			return orderWithClinicalNote(now, "content")
+		name: "sending application",
+		header: func() *HeaderInfo {
+			h := testHeader()
+			h.SendingApplicationHD = &HierarchicDesignator{NamespaceID: "CERNER", UniversalID: "2.16.840.1.113883.3.72", UniversalIDType: "ISO"}
+			return h
 		},
-		want: "OBR|1||document_id^HNAM_CEREF~document_id^HNAM_EVENTID|document-type^document-type^^^document-title||||||||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||||||||MDOC|||1",
+		want: "MSH|^~\\&|CERNER^2.16.840.1.113883.3.72^ISO|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII",
 	}, {
-		// We use BuildOBR, but we could use any method that uses the ToHL7Date method.
-		name: "No UTC",
-		setup: func() *Order {
-			now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.Local)
-			return testOrder(now)
+		name: "all fields",
+		header: func() *HeaderInfo {
+			h := testHeader()
+			h.SendingApplicationHD = &HierarchicDesignator{NamespaceID: "app1", UniversalID: "1.1", UniversalIDType: "ISO"}
+			h.SendingFacilityHD = &HierarchicDesignator{NamespaceID: "fac1", UniversalID: "1.2", UniversalIDType: "ISO"}
+			h.ReceivingApplicationHD = &HierarchicDesignator{NamespaceID: "app2", UniversalID: "2.1", UniversalIDType: "ISO"}
+			h.ReceivingFacilityHD = &HierarchicDesignator{NamespaceID: "fac2", UniversalID: "2.2", UniversalIDType: "ISO"}
+			return h
 		},
-		wantErr: true,
+		want: "MSH|^~\\&|app1^1.1^ISO|fac1^1.2^ISO|app2^2.1^ISO|fac2^2.2^ISO|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII",
 	}, {
-		name: "Escape OrderProfile",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.OrderProfile = &CodedElement{
-				ID:            "Urea & Electrolytes",
-				Text:          "Creatinine & Glucose",
-				CodingSystem:  "& not escaped",
-				AlternateText: "Some text with &",
-			}
-			return o
+		name: "namespace only",
+		header: func() *HeaderInfo {
+			h := testHeader()
+			h.ReceivingFacilityHD = &HierarchicDesignator{NamespaceID: "RAL"}
+			return h
 		},
-		want: "OBR|1|9984058|1902082|Urea \\T\\ Electrolytes^Creatinine \\T\\ Glucose^& not escaped^^Some text with \\T\\||20180126152421|||||||||||||||||||C||1",
+		want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL^^|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII",
 	}}
 
-	for _, tc := range tests {
+	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			o := tc.setup()
-			got, err := BuildOBR(o)
-			if gotErr := err != nil; gotErr != tc.wantErr {
-				t.Fatalf("BuildOBR(%v) failed with error %v, want error? %t", o, err, tc.wantErr)
+			header := tc.header()
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
 			}
 			if got != tc.want {
-				t.Errorf("BuildOBR(%v)=%v, want %v", o, got, tc.want)
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
 			}
 		})
 	}
 }
 
-func TestBuildOBR_MidnightDatesAndDifferentTimezone(t *testing.T) {
-	originalTz := hl7.Timezone
-	if err := hl7.TimezoneAndLocation("Europe/Madrid"); err != nil {
-		t.Fatalf("hl7.TimezoneAndLocation(%q) failed with %v", "Europe/Madrid", err)
-	}
-	defer hl7.TimezoneAndLocation(originalTz)
-
+func TestBuildMSH_EmptyMessageControlIDIsGenerated(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
-	o := testOrder(now)
-	o.CollectedDateTime = NewMidnightTime(time.Date(2018, 1, 26, 23, 45, 23, 0, time.UTC))
-	o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 23, 32, 55, 0, time.UTC))
-	o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 23, 51, 21, 0, time.UTC))
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
 
-	// Some of the dates should be set the day after (27th).
-	want := "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126162421|20180127000000|||||||20180127003255||||||||20180127005121|||C||1"
-	got, err := BuildOBR(o)
+	// The same header is used for all the messages, as the hospital does.
+	header := testHeader()
+	header.MessageControlID = ""
+	header.ControlIDGenerator = &sequentialControlIDGenerator{}
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		got, err := BuildMSH(now, mt, header)
+		if err != nil {
+			t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+		}
+		id := strings.Split(got, "|")[9]
+		if id == "" {
+			t.Fatalf("BuildMSH(%v, %v, %v)=%v, want non-empty Message Control ID", now, mt, header, got)
+		}
+		if header.MessageControlID != "" {
+			t.Fatalf("header.MessageControlID=%q, want empty; the header must not be modified", header.MessageControlID)
+		}
+		if seen[id] {
+			t.Fatalf("BuildMSH(%v, %v, %v) generated duplicate Message Control ID %q", now, mt, header, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestBuildMSH_ControlIDGenerator(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	tests := []struct {
+		name      string
+		generator ControlIDGenerator
+		want      string
+	}{{
+		name:      "with generator",
+		generator: &sequentialControlIDGenerator{},
+		want:      "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII",
+	}, {
+		name: "without generator",
+		want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01||T|2.3|||AL||44|ASCII",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeader()
+			header.MessageControlID = ""
+			header.ControlIDGenerator = tc.generator
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOptions_Encoding(t *testing.T) {
+	custom := Encoding{
+		FieldSeparator:        '#',
+		ComponentSeparator:    '!',
+		RepetitionSeparator:   '@',
+		EscapeCharacter:       '$',
+		SubComponentSeparator: '%',
+	}
+	options := &Options{Encoding: custom}
+
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+	header := testHeader()
+	header.Options = options
+	wantMSH := "MSH#!@$%#CERNER#RAL1#STREAMS#RAL#20180126152421##ORU!R01#1#T#2.3###AL##44#ASCII"
+	gotMSH, err := BuildMSH(now, mt, header)
+	if err != nil {
+		t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+	}
+	if gotMSH != wantMSH {
+		t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, gotMSH, wantMSH)
+	}
+
+	o := testOrderWithResult(now)
+	o.Results[0].Value = "100% #1"
+	o.Results[0].Range = "39.00 ^ 308.00"
+	o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+	wantOBX := "OBX#1#NM#lpdc-2011!Creatinine!WinPath!!##100$T$ $F$1#UML#39.00 $S$ 308.00#HIGH###F###20180126154523##"
+	gotOBX, err := buildOBX(options, 1, o.Results[0], o)
+	if err != nil {
+		t.Fatalf("buildOBX(%v, %v, %v, %v) failed with %v", options, 1, o.Results[0], o, err)
+	}
+	if gotOBX != wantOBX {
+		t.Errorf("buildOBX(%v, %v, %v, %v)=%v, want %v", options, 1, o.Results[0], o, gotOBX, wantOBX)
+	}
+
+	gotPV1, err := buildPseudoPV1(options)
+	if err != nil {
+		t.Fatalf("buildPseudoPV1(%v) failed with %v", options, err)
+	}
+	if want := "PV1#1#N#"; gotPV1 != want {
+		t.Errorf("buildPseudoPV1(%v)=%v, want %v", options, gotPV1, want)
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, o := range []*Options{
+		{Encoding: Encoding{FieldSeparator: '|', ComponentSeparator: '^', RepetitionSeparator: '^', EscapeCharacter: '\\', SubComponentSeparator: '&'}},
+		{Encoding: Encoding{FieldSeparator: 'A', ComponentSeparator: '^', RepetitionSeparator: '~', EscapeCharacter: '\\', SubComponentSeparator: '&'}},
+		{Encoding: Encoding{FieldSeparator: ' ', ComponentSeparator: '^', RepetitionSeparator: '~', EscapeCharacter: '\\', SubComponentSeparator: '&'}},
+		{HL7Version: "3.0"},
+		{HL7Version: "2.5.1.1"},
+		{HL7Version: "2"},
+		{MaxOBXValueLength: -1},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v.Validate() got nil error, want error", o)
+		}
+	}
+	for _, o := range []*Options{nil, {}, {Encoding: DefaultEncoding, HL7Version: "2.5.1", MaxOBXValueLength: 10}} {
+		if err := o.Validate(); err != nil {
+			t.Errorf("%+v.Validate() failed with %v", o, err)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    Encoding
+		wantErr bool
+	}{
+		{s: "|^~\\&", want: DefaultEncoding},
+		{s: "#!@$%", want: Encoding{FieldSeparator: '#', ComponentSeparator: '!', RepetitionSeparator: '@', EscapeCharacter: '$', SubComponentSeparator: '%'}},
+		{s: "|^~\\", wantErr: true},
+		{s: "|^~\\&#", wantErr: true},
+		{s: "|^^\\&", wantErr: true},
+	} {
+		got, err := ParseEncoding(tc.s)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Fatalf("ParseEncoding(%q) got err %v, want err? %t", tc.s, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ParseEncoding(%q)=%v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestOptions_Metrics(t *testing.T) {
+	c := NewInMemoryMetricsCollector()
+
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+	header.Options = &Options{Metrics: c}
+	patientInfo := testPatientInfo()
+	for i := 0; i < 2; i++ {
+		if _, err := BuildAdmissionADTA01(header, patientInfo, eventTime, msgTime); err != nil {
+			t.Fatalf("BuildAdmissionADTA01(%v, %v, %v, %v) failed with %v", header, patientInfo, eventTime, msgTime, err)
+		}
+	}
+	if _, err := BuildResultORUR01(header, patientInfo, testOrderWithResult(eventTime), msgTime); err != nil {
+		t.Fatalf("BuildResultORUR01() failed with %v", err)
+	}
+	// Dates not in UTC cannot be rendered.
+	badOrder := testOrder(time.Date(2018, 1, 26, 15, 24, 21, 0, time.Local))
+	if _, err := BuildResultORUR01(header, patientInfo, badOrder, msgTime); err == nil {
+		t.Fatal("BuildResultORUR01() got nil error, want error")
+	}
+
+	adtA01 := &Type{MessageType: ADT, TriggerEvent: "A01"}
+	oruR01 := &Type{MessageType: ORU, TriggerEvent: "R01"}
+	for _, tc := range []struct {
+		t          *Type
+		wantBuilt  int
+		wantErrors int
+	}{
+		{t: adtA01, wantBuilt: 2, wantErrors: 0},
+		{t: oruR01, wantBuilt: 1, wantErrors: 1},
+		{t: &Type{MessageType: ADT, TriggerEvent: "A03"}, wantBuilt: 0, wantErrors: 0},
+	} {
+		if got := c.Built(tc.t); got != tc.wantBuilt {
+			t.Errorf("Built(%v)=%d, want %d", tc.t, got, tc.wantBuilt)
+		}
+		if got := c.Errors(tc.t); got != tc.wantErrors {
+			t.Errorf("Errors(%v)=%d, want %d", tc.t, got, tc.wantErrors)
+		}
+	}
+}
+
+func TestBuildMSA(t *testing.T) {
+	want := "MSA|AA|1"
+	got, err := BuildMSA("1")
+	if err != nil {
+		t.Fatalf("BuildMSA(%v) failed with %v", "1", err)
+	}
+	if got != want {
+		t.Errorf("BuildMSA(%v)=%v, want %v", "1", got, want)
+	}
+}
+
+func TestAssembleMessage(t *testing.T) {
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A01"}
+	msh := "MSH|^~\\&|SIMHOSP|SFAC|RAPP|RFAC|20180126152421||ADT^A01|1|T|2.3|||AL||44|ASCII"
+	pid := "PID|1|2590157853^^^SIMULATOR MRN^MRN|2590157853^^^SIMULATOR MRN^MRN~2478684691^^^NHSNBR^NHSNMBR||Smith^John"
+	segments := []string{msh, pid, pid}
+
+	got := AssembleMessage(mt, segments)
+	want := &HL7Message{
+		Type:    mt,
+		Message: msh + "\r" + pid + "\r" + pid,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("AssembleMessage(%v, %v) diff (-want, +got):\n%s", mt, segments, diff)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A01"}
+	pid := "PID|1|2590157853^^^SIMULATOR MRN^MRN"
+	base := AssembleMessage(mt, []string{
+		"MSH|^~\\&|SIMHOSP|SFAC|RAPP|RFAC|20180126152421||ADT^A01|100|T|2.3|||AL||44|ASCII",
+		pid,
+	})
+	receivers := []Receiver{{Facility: "FAC1"}, {Facility: "FAC2"}, {Application: "OTHERAPP", Facility: "FAC3"}}
+
+	got, err := Broadcast(base, receivers, &sequentialControlIDGenerator{})
+	if err != nil {
+		t.Fatalf("Broadcast(%v, %v) failed with %v", base, receivers, err)
+	}
+	want := []*HL7Message{{
+		Type:    mt,
+		Message: "MSH|^~\\&|SIMHOSP|SFAC|RAPP|FAC1|20180126152421||ADT^A01|1|T|2.3|||AL||44|ASCII\r" + pid,
+	}, {
+		Type:    mt,
+		Message: "MSH|^~\\&|SIMHOSP|SFAC|RAPP|FAC2|20180126152421||ADT^A01|2|T|2.3|||AL||44|ASCII\r" + pid,
+	}, {
+		Type:    mt,
+		Message: "MSH|^~\\&|SIMHOSP|SFAC|OTHERAPP|FAC3|20180126152421||ADT^A01|3|T|2.3|||AL||44|ASCII\r" + pid,
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Broadcast(%v, %v) diff (-want, +got):\n%s", base, receivers, diff)
+	}
+}
+
+func TestBroadcast_EscapedReceivers(t *testing.T) {
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A01"}
+	base := AssembleMessage(mt, []string{"MSH|^~\\&|SIMHOSP|SFAC|RAPP|RFAC|20180126152421||ADT^A01|100|T|2.3"})
+	receivers := []Receiver{{Application: "APP^1", Facility: "FAC&2"}}
+
+	got, err := Broadcast(base, receivers, &sequentialControlIDGenerator{})
+	if err != nil {
+		t.Fatalf("Broadcast(%v, %v) failed with %v", base, receivers, err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Broadcast(%v, %v) got %d messages, want 1", base, receivers, len(got))
+	}
+	if got, want := got[0].Message, "MSH|^~\\&|SIMHOSP|SFAC|APP\\S\\1|FAC\\T\\2|20180126152421||ADT^A01|1|T|2.3"; got != want {
+		t.Errorf("Broadcast(%v, %v) got message %q, want %q", base, receivers, got, want)
+	}
+}
+
+func TestBroadcast_CustomEncoding(t *testing.T) {
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A01"}
+	base := AssembleMessage(mt, []string{"MSH#^~\\&#SIMHOSP#SFAC#RAPP#RFAC#20180126152421##ADT^A01#100#T#2.3"})
+	receivers := []Receiver{{Facility: "FAC#1"}}
+
+	got, err := Broadcast(base, receivers, &sequentialControlIDGenerator{})
+	if err != nil {
+		t.Fatalf("Broadcast(%v, %v) failed with %v", base, receivers, err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Broadcast(%v, %v) got %d messages, want 1", base, receivers, len(got))
+	}
+	if got, want := got[0].Message, "MSH#^~\\&#SIMHOSP#SFAC#RAPP#FAC\\F\\1#20180126152421##ADT^A01#1#T#2.3"; got != want {
+		t.Errorf("Broadcast(%v, %v) got message %q, want %q", base, receivers, got, want)
+	}
+}
+
+func TestBroadcast_InvalidMessage(t *testing.T) {
+	receivers := []Receiver{{Facility: "FAC1"}}
+	for _, base := range []*HL7Message{nil, {Message: "PID|1"}, {Message: "MSH|^~\\&|SIMHOSP"}} {
+		if got, err := Broadcast(base, receivers, &sequentialControlIDGenerator{}); err == nil {
+			t.Errorf("Broadcast(%v, %v)=%v, <nil>, want error", base, receivers, got)
+		}
+	}
+}
+
+func TestBuildEVN(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	occurred := NewValidTime(time.Date(2018, 1, 26, 15, 24, 23, 0, time.UTC))
+	planned := NewValidTime(time.Date(2018, 1, 26, 15, 24, 22, 0, time.UTC))
+	operator := testDoctor()
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	want := "EVN|R01|20180126152421|20180126152422||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423"
+	got, err := BuildEVN(now, mt, planned, operator, occurred, EVNOptions{})
+	if err != nil {
+		t.Fatalf("BuildEVN(%v, %v, %v, %v, %v, %+v) failed with %v", now, mt, planned, operator, occurred, EVNOptions{}, err)
+	}
+	if got != want {
+		t.Errorf("BuildEVN(%v, %v, %v, %v, %v, %+v)=%v, want %v", now, mt, planned, operator, occurred, EVNOptions{}, got, want)
+	}
+}
+
+func TestBuildEVNWithOperators(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	occurred := NewValidTime(time.Date(2018, 1, 26, 15, 24, 23, 0, time.UTC))
+	planned := NewValidTime(time.Date(2018, 1, 26, 15, 24, 22, 0, time.UTC))
+	clerk := &Doctor{ID: "C123", Surname: "Jones", FirstName: "Mary"}
+	operators := []*Doctor{testDoctor(), clerk}
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A01"}
+
+	want := "EVN|A01|20180126152421|20180126152422||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR~C123^Jones^Mary^^^^^^DRNBR^PRSNL^^^ORGDR|20180126152423"
+	got, err := BuildEVNWithOperators(now, mt, planned, operators, occurred, EVNOptions{})
+	if err != nil {
+		t.Fatalf("BuildEVNWithOperators(%v, %v, %v, %v, %v, %+v) failed with %v", now, mt, planned, operators, occurred, EVNOptions{}, err)
+	}
+	if got != want {
+		t.Errorf("BuildEVNWithOperators(%v, %v, %v, %v, %v, %+v)=%v, want %v", now, mt, planned, operators, occurred, EVNOptions{}, got, want)
+	}
+}
+
+func TestBuildEVN_Options(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	occurred := NewValidTime(time.Date(2018, 1, 26, 15, 24, 23, 0, time.UTC))
+	planned := NewValidTime(time.Date(2018, 1, 26, 15, 24, 22, 0, time.UTC))
+	operator := testDoctor()
+	mt := &Type{MessageType: "ADT", TriggerEvent: "A02"}
+
+	tests := []struct {
+		name string
+		opts EVNOptions
+		want string
+	}{{
+		name: "event facility",
+		opts: EVNOptions{EventFacility: "RAL RF"},
+		want: "EVN|A02|20180126152421|20180126152422||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423|RAL RF",
+	}, {
+		name: "event reason",
+		opts: EVNOptions{EventReason: "02"},
+		want: "EVN|A02|20180126152421|20180126152422|02|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423",
+	}, {
+		name: "event reason and facility",
+		opts: EVNOptions{EventReason: "02", EventFacility: "RAL RF"},
+		want: "EVN|A02|20180126152421|20180126152422|02|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423|RAL RF",
+	}, {
+		name: "event facility with separators",
+		opts: EVNOptions{EventFacility: "RAL^RF&1"},
+		want: "EVN|A02|20180126152421|20180126152422||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|20180126152423|RAL\\S\\RF\\T\\1",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildEVN(now, mt, planned, operator, occurred, tc.opts)
+			if err != nil {
+				t.Fatalf("BuildEVN(%v, %v, %v, %v, %v, %+v) failed with %v", now, mt, planned, operator, occurred, tc.opts, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildEVN(%v, %v, %v, %v, %v, %+v)=%v, want %v", now, mt, planned, operator, occurred, tc.opts, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildEVN_NoOccurredOrPlannedTime(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	operator := testDoctor()
+	invalidTime := NewInvalidTime()
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	want := "EVN|R01|20180126152421|||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|"
+	got, err := BuildEVN(now, mt, invalidTime, operator, invalidTime, EVNOptions{})
+	if err != nil {
+		t.Fatalf("BuildEVN(%v, %v, %v, %v, %v, %+v) failed with %v", now, mt, invalidTime, operator, invalidTime, EVNOptions{}, err)
+	}
+	if got != want {
+		t.Errorf("BuildEVN(%v, %v, %v, %v, %v, %+v)=%v, want %v", now, mt, invalidTime, operator, invalidTime, EVNOptions{}, got, want)
+	}
+}
+
+func TestBuildORC(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+
+	want := "ORC|RE|9984058|1902082||IP||||20180126152421"
+	got, err := BuildORC(o)
+	if err != nil {
+		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+	}
+	if got != want {
+		t.Errorf("BuildORC(%v)=%v, want %v", o, got, want)
+	}
+}
+
+func TestBuildORC_Priority(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+	o.Priority = "S"
+
+	want := "ORC|RE|9984058|1902082||IP||^^^^^S||20180126152421"
+	got, err := BuildORC(o)
+	if err != nil {
+		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+	}
+	if got != want {
+		t.Errorf("BuildORC(%v)=%v, want %v", o, got, want)
+	}
+}
+
+func TestBuildORC_Providers(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	enteredBy := &Doctor{ID: "123", Surname: "Smith", FirstName: "Jane", Prefix: "Dr"}
+
+	tests := []struct {
+		name             string
+		enteredBy        *Doctor
+		orderingProvider *Doctor
+		want             string
+	}{{
+		name:             "OrderingProvider",
+		orderingProvider: testDoctor(),
+		want:             "ORC|RE|9984058|1902082||IP||||20180126152421|||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}, {
+		name:      "EnteredBy",
+		enteredBy: enteredBy,
+		want:      "ORC|RE|9984058|1902082||IP||||20180126152421|123^Smith^Jane^^^Dr^^^DRNBR^PRSNL^^^ORGDR||",
+	}, {
+		name:             "Both",
+		enteredBy:        enteredBy,
+		orderingProvider: testDoctor(),
+		want:             "ORC|RE|9984058|1902082||IP||||20180126152421|123^Smith^Jane^^^Dr^^^DRNBR^PRSNL^^^ORGDR||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOrder(now)
+			o.EnteredBy = tc.enteredBy
+			o.OrderingProvider = tc.orderingProvider
+
+			got, err := BuildORC(o)
+			if err != nil {
+				t.Fatalf("BuildORC(%v) failed with %v", o, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildORC(%v)=%v, want %v", o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildORC_OrderingProviderMatchesOBR(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+	o.OrderingProvider = testDoctor()
+
+	orc, err := BuildORC(o)
+	if err != nil {
+		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+	}
+	obr, err := BuildOBR(o)
 	if err != nil {
 		t.Fatalf("BuildOBR(%v) failed with %v", o, err)
 	}
-	if got != want {
-		t.Errorf("BuildOBR(%v)=%v, want %v", o, got, want)
+	orcFields := strings.Split(orc, "|")
+	obrFields := strings.Split(obr, "|")
+	if len(orcFields) <= 12 || len(obrFields) <= 16 {
+		t.Fatalf("BuildORC(%v)=%v and BuildOBR(%v)=%v, want at least 12 and 16 fields", o, orc, o, obr)
+	}
+	if got, want := orcFields[12], obrFields[16]; got != want {
+		t.Errorf("ORC-12=%q, want OBR-16=%q", got, want)
+	}
+}
+
+func TestBuildORC_NoOrderDateTime(t *testing.T) {
+	o := &Order{
+		Placer:       "9984058",
+		Filler:       "1902082",
+		OrderControl: "RE",
+		OrderStatus:  "IP",
+	}
+	want := "ORC|RE|9984058|1902082||IP||||"
+	got, err := BuildORC(o)
+	if err != nil {
+		t.Fatalf("BuildORC(%v) failed with %v", o, err)
+	}
+	if got != want {
+		t.Errorf("BuildORC(%v)=%v, want %v", o, got, want)
+	}
+}
+
+func TestBuildOBR(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		setup   func() *Order
+		want    string
+		wantErr bool
+	}{{
+		name: "Regular",
+		setup: func() *Order {
+			return testOrder(now)
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C||1",
+	}, {
+		name: "AllDates",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
+			o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 51, 21, 0, time.UTC))
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523|||||||20180126163255||||||||20180126165121|||C||1",
+	}, {
+		name: "SpecimenActionCode",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
+			o.SpecimenActionCode = "A"
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523||||A|||20180126163255|||||||||||C||1",
+	}, {
+		name: "RelevantClinicalInfo",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
+			o.RelevantClinicalInfo = "On warfarin^INR 2.5 & stable"
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523||||||On warfarin\\S\\INR 2.5 \\T\\ stable|20180126163255|||||||||||C||1",
+	}, {
+		name: "CodedSpecimenSource",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
+			o.SpecimenSource = "Blood"
+			o.CodedSpecimenSource = &SpecimenSource{
+				Source:   &CodedElement{ID: "BLDV", Text: "Blood venous", CodingSystem: "HL70070"},
+				BodySite: &CodedElement{ID: "LA", Text: "Left Arm", CodingSystem: "HL70163"},
+			}
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523|||||||20180126163255|BLDV&Blood venous&HL70070^^^LA&Left Arm&HL70163^^||||||||||C||1",
+	}, {
+		name: "ResultInterpreters",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.PrincipalInterpreter = testDoctor()
+			o.AssistantInterpreters = []*Doctor{{ID: "C5678", Surname: "Smith", FirstName: "Jane", Prefix: "Dr"}}
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C||1|||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|C5678^Smith^Jane^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}, {
+		name: "CollectionVolumeAndCollector",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectionVolume = "2500"
+			o.CollectionVolumeUnit = "mL"
+			o.Collector = &Doctor{ID: "P4321", Surname: "Jones", FirstName: "Mary"}
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||2500^mL|P4321^Jones^Mary^^^^^^DRNBR^PRSNL^^^ORGDR|||||||||||||||C||1",
+	}, {
+		name: "ReflexOrder",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.ParentResult = &ParentResult{
+				ObservationIdentifier: &CodedElement{ID: "5671-3", Text: "Lead", CodingSystem: "LN"},
+				SubID:                 "1",
+				Value:                 "Elevated",
+			}
+			o.ParentOrder = &ParentOrder{Placer: "9984057", Filler: "1902081"}
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C|5671-3&Lead&LN^1^Elevated|1||9984057^1902081",
+	}, {
+		name: "ReflexOrderWithResultInterpreter",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.ParentOrder = &ParentOrder{Placer: "9984057", Filler: "1902081"}
+			o.PrincipalInterpreter = testDoctor()
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C||1||9984057^1902081|||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|",
+	}, {
+		name: "ObservationStartAndEndDates",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.ObservationEndDateTime = NewValidTime(time.Date(2018, 1, 27, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126154523|20180127154523|||||||||||||||||C||1",
+	}, {
+		name: "NoTimezone",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewValidTime(time.Now())
+			return o
+		},
+		wantErr: true,
+	}, {
+		name: "Midnight Dates",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.CollectedDateTime = NewMidnightTime(time.Date(2018, 1, 26, 23, 45, 23, 0, time.UTC))
+			o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC))
+			o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 51, 21, 0, time.UTC))
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|20180126000000|||||||20180126163255||||||||20180126165121|||C||1",
+	}, {
+		name: "WithOrderingProvider",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.OrderingProvider = testDoctor()
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421||||||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||||||||C||1",
+	}, {
+		name: "WithSpecimenSource",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.SpecimenSource = "source"
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||source||||||||||C||1",
+	}, {
+		name: "WithPriority",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.Priority = "S"
+			return o
+		},
+		want: "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126152421|||||||||||||||||||C||1^^^^^S",
+	}, {
+		name: "ClinicalNote",
+		setup: func() *Order {
+			return orderWithClinicalNote(now, "content")
+		},
+		want: "OBR|1||document_id^HNAM_CEREF~document_id^HNAM_EVENTID|document-type^document-type^^^document-title||||||||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||||||||MDOC|||1",
+	}, {
+		name: "ClinicalNote with explicit flag",
+		setup: func() *Order {
+			o := orderWithClinicalNote(now, "content")
+			o.DiagnosticServID = "DOC"
+			o.IsClinicalNote = true
+			return o
+		},
+		want: "OBR|1||document_id^HNAM_CEREF~document_id^HNAM_EVENTID|document-type^document-type^^^document-title||||||||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||||||||DOC|||1",
+	}, {
+		// We use BuildOBR, but we could use any method that uses the ToHL7Date method.
+		name: "No UTC",
+		setup: func() *Order {
+			now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.Local)
+			return testOrder(now)
+		},
+		wantErr: true,
+	}, {
+		name: "Escape OrderProfile",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.OrderProfile = &CodedElement{
+				ID:            "Urea & Electrolytes",
+				Text:          "Creatinine & Glucose",
+				CodingSystem:  "& not escaped",
+				AlternateText: "Some text with &",
+			}
+			return o
+		},
+		want: "OBR|1|9984058|1902082|Urea \\T\\ Electrolytes^Creatinine \\T\\ Glucose^& not escaped^^Some text with \\T\\||20180126152421|||||||||||||||||||C||1",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := tc.setup()
+			got, err := BuildOBR(o)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("BuildOBR(%v) failed with error %v, want error? %t", o, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("BuildOBR(%v)=%v, want %v", o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrderValidate(t *testing.T) {
+	orderTime := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	collectedTime := time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC)
+	receivedTime := time.Date(2018, 1, 26, 16, 32, 55, 0, time.UTC)
+	reportedTime := time.Date(2018, 1, 26, 16, 51, 21, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		order   *Order
+		wantErr bool
+	}{{
+		name: "All dates in order",
+		order: &Order{
+			OrderDateTime:         NewValidTime(orderTime),
+			CollectedDateTime:     NewValidTime(collectedTime),
+			ReceivedInLabDateTime: NewValidTime(receivedTime),
+			ReportedDateTime:      NewValidTime(reportedTime),
+		},
+	}, {
+		name: "Equal dates",
+		order: &Order{
+			OrderDateTime:         NewValidTime(orderTime),
+			CollectedDateTime:     NewValidTime(orderTime),
+			ReceivedInLabDateTime: NewValidTime(orderTime),
+			ReportedDateTime:      NewValidTime(orderTime),
+		},
+	}, {
+		name:  "No dates",
+		order: &Order{},
+	}, {
+		name: "Invalid dates are ignored",
+		order: &Order{
+			OrderDateTime:         NewValidTime(orderTime),
+			CollectedDateTime:     NewInvalidTime(),
+			ReceivedInLabDateTime: NewValidTime(receivedTime),
+			ReportedDateTime:      NewInvalidTime(),
+		},
+	}, {
+		name: "Received before collected",
+		order: &Order{
+			OrderDateTime:         NewValidTime(orderTime),
+			CollectedDateTime:     NewValidTime(receivedTime),
+			ReceivedInLabDateTime: NewValidTime(collectedTime),
+			ReportedDateTime:      NewValidTime(reportedTime),
+		},
+		wantErr: true,
+	}, {
+		name: "Reported before ordered with dates in between not set",
+		order: &Order{
+			OrderDateTime:    NewValidTime(reportedTime),
+			ReportedDateTime: NewValidTime(orderTime),
+		},
+		wantErr: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.order.Validate()
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("Validate() got err %v, want error? %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptions_StrictTemplates(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		strict  bool
+		build   func(options *Options) (string, error)
+		wantErr bool
+	}{
+		{name: "lenient, nil OrderProfile", strict: false, build: func(options *Options) (string, error) {
+			o := testOrder(now)
+			o.OrderProfile = nil
+			return buildOBR(options, o)
+		}},
+		{name: "strict, nil OrderProfile", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			o := testOrder(now)
+			o.OrderProfile = nil
+			return buildOBR(options, o)
+		}},
+		{name: "strict, with OrderProfile", strict: true, build: func(options *Options) (string, error) {
+			return buildOBR(options, testOrder(now))
+		}},
+		{name: "strict, nil TestName", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			o := testOrderWithResult(now)
+			o.Results[0].TestName = nil
+			return buildOBX(options, 1, o.Results[0], o)
+		}},
+		{name: "strict, with TestName", strict: true, build: func(options *Options) (string, error) {
+			o := testOrderWithResult(now)
+			return buildOBX(options, 1, o.Results[0], o)
+		}},
+		{name: "strict, nil TestName with ObservationIdentifier", strict: true, build: func(options *Options) (string, error) {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationIdentifier = o.Results[0].TestName
+			o.Results[0].TestName = nil
+			return buildOBX(options, 1, o.Results[0], o)
+		}},
+		{name: "strict, clinical note", strict: true, build: func(options *Options) (string, error) {
+			o := orderWithClinicalNote(now, "content")
+			return buildOBXForClinicalNote(options, 1, 0, o.Results[0], o)
+		}},
+		{name: "strict, empty MRN", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			p := testPatientInfo()
+			p.Person.MRN = ""
+			return buildPID(options, p.Person)
+		}},
+		{name: "strict, nil Person", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			return buildPID(options, nil)
+		}},
+		{name: "strict, nil Person for facility", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			return buildPIDForFacility(options, nil, "RAL")
+		}},
+		{name: "strict, with MRN", strict: true, build: func(options *Options) (string, error) {
+			return buildPID(options, testPatientInfo().Person)
+		}},
+		{name: "strict, empty Class", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			p := testPatientInfo()
+			p.Class = ""
+			return buildPV1(options, p)
+		}},
+		{name: "strict, with Class", strict: true, build: func(options *Options) (string, error) {
+			return buildPV1(options, testPatientInfo())
+		}},
+		{name: "strict, nil diagnosis Description", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			d := testDiagnosis()
+			d.Description = nil
+			return buildDG1(options, 1, d)
+		}},
+		{name: "strict, nil procedure Description", strict: true, wantErr: true, build: func(options *Options) (string, error) {
+			pr := testProcedure()
+			pr.Description = nil
+			return buildPR1(options, 1, pr)
+		}},
+		{name: "strict, with procedure Description", strict: true, build: func(options *Options) (string, error) {
+			return buildPR1(options, 1, testProcedure())
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{StrictTemplates: tc.strict}
+			if _, err := tc.build(options); (err != nil) != tc.wantErr {
+				t.Errorf("build(%+v) got err %v, want err? %t", options, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildOBR_MidnightDatesAndDifferentTimezone(t *testing.T) {
+	originalTz := hl7.Timezone
+	if err := hl7.TimezoneAndLocation("Europe/Madrid"); err != nil {
+		t.Fatalf("hl7.TimezoneAndLocation(%q) failed with %v", "Europe/Madrid", err)
+	}
+	defer hl7.TimezoneAndLocation(originalTz)
+
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+	o.CollectedDateTime = NewMidnightTime(time.Date(2018, 1, 26, 23, 45, 23, 0, time.UTC))
+	o.ReceivedInLabDateTime = NewValidTime(time.Date(2018, 1, 26, 23, 32, 55, 0, time.UTC))
+	o.ReportedDateTime = NewValidTime(time.Date(2018, 1, 26, 23, 51, 21, 0, time.UTC))
+
+	// Some of the dates should be set the day after (27th).
+	want := "OBR|1|9984058|1902082|lpdc-3969^UREA AND ELECTROLYTES^WinPath^^||20180126162421|20180127000000|||||||20180127003255||||||||20180127005121|||C||1"
+	got, err := BuildOBR(o)
+	if err != nil {
+		t.Fatalf("BuildOBR(%v) failed with %v", o, err)
+	}
+	if got != want {
+		t.Errorf("BuildOBR(%v)=%v, want %v", o, got, want)
+	}
+}
+
+func TestOrderHasClinicalNote(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *Order
+		want  bool
+	}{
+		{name: "MDOC", order: &Order{DiagnosticServID: DiagnosticServIDMDOC}, want: true},
+		{name: "explicit flag", order: &Order{DiagnosticServID: "DOC", IsClinicalNote: true}, want: true},
+		{name: "not a clinical note", order: &Order{DiagnosticServID: "LAB"}, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.order.HasClinicalNote(); got != tc.want {
+				t.Errorf("%+v.HasClinicalNote()=%t, want %t", tc.order, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddendumForNote(t *testing.T) {
+	first := &ClinicalNoteContent{ContentType: "txt", DocumentContent: "first"}
+	second := &ClinicalNoteContent{ContentType: "txt", DocumentContent: "second"}
+	addendum := &ClinicalNoteContent{ContentType: "pdf", DocumentContent: "addendum", DocumentEncoding: "base64"}
+	dateTime := NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+	existing := &ClinicalNote{
+		DateTime:      dateTime,
+		DocumentTitle: "Discharge Summary",
+		DocumentType:  "DS",
+		DocumentID:    "doc-1",
+		Contents:      []*ClinicalNoteContent{first, second},
+	}
+
+	got, err := AddendumForNote(existing, "doc-1", addendum)
+	if err != nil {
+		t.Fatalf("AddendumForNote(%+v, %q, %+v) failed with %v", existing, "doc-1", addendum, err)
+	}
+	want := &ClinicalNote{
+		DateTime:      dateTime,
+		DocumentTitle: "Discharge Summary",
+		DocumentType:  "DS",
+		DocumentID:    "doc-1",
+		Contents:      []*ClinicalNoteContent{first, second, addendum},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("AddendumForNote(%+v, %q, %+v) got diff (-want, +got):\n%s", existing, "doc-1", addendum, diff)
+	}
+	if got, want := len(existing.Contents), 2; got != want {
+		t.Errorf("len(existing.Contents)=%d, want %d; the existing note must not be modified", got, want)
+	}
+}
+
+func TestAddendumForNote_Invalid(t *testing.T) {
+	existing := &ClinicalNote{DocumentID: "doc-1", Contents: []*ClinicalNoteContent{{DocumentContent: "first"}}}
+	content := &ClinicalNoteContent{DocumentContent: "addendum"}
+
+	cases := []struct {
+		name       string
+		existing   *ClinicalNote
+		documentID string
+		content    *ClinicalNoteContent
+	}{
+		{name: "nil note", existing: nil, documentID: "doc-1", content: content},
+		{name: "nil content", existing: existing, documentID: "doc-1", content: nil},
+		{name: "different document ID", existing: existing, documentID: "doc-2", content: content},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := AddendumForNote(tc.existing, tc.documentID, tc.content); err == nil {
+				t.Errorf("AddendumForNote(%+v, %q, %+v) got nil error, want non-nil", tc.existing, tc.documentID, tc.content)
+			}
+		})
+	}
+}
+
+func TestBuildOBX(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		setup func() *Order
+		want  string
+	}{{
+		name: "Regular",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name: "Escape Unit",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].Unit = "10^9 g/L"
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|10\\S\\9 g/L|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name: "Coded Unit",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].Unit = "UML"
+			o.Results[0].CodedUnit = &CodedElement{ID: "mmol/L", Text: "mmol per litre", CodingSystem: "UCUM"}
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|mmol/L^mmol per litre^UCUM^^|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name: "Coded Value",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ValueType = "CE"
+			o.Results[0].Value = "positive"
+			o.Results[0].CodedValue = &CodedElement{ID: "10828004", Text: "Positive", CodingSystem: "SCT"}
+			o.Results[0].Unit = ""
+			o.Results[0].Range = ""
+			o.Results[0].AbnormalFlag = ""
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|CE|lpdc-2011^Creatinine^WinPath^^||10828004^Positive^SCT^^||||||F|||20180126154523||",
+	}, {
+		name: "Plain String Coded Value",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ValueType = "CE"
+			o.Results[0].Value = "positive"
+			o.Results[0].Unit = ""
+			o.Results[0].Range = ""
+			o.Results[0].AbnormalFlag = ""
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|CE|lpdc-2011^Creatinine^WinPath^^||positive||||||F|||20180126154523||",
+	}, {
+		name: "Multi-line Value As Repetitions",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ValueType = "TX"
+			o.Results[0].Value = "First line\nSecond line"
+			o.Results[0].Unit = ""
+			o.Results[0].Range = ""
+			o.Results[0].AbnormalFlag = ""
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|TX|lpdc-2011^Creatinine^WinPath^^||First line~Second line||||||F|||20180126154523||",
+	}, {
+		name: "Multi-line Value As Line Breaks",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ValueType = "TX"
+			o.Results[0].Value = "First line\nSecond line"
+			o.Results[0].NewlinesAsLineBreaks = true
+			o.Results[0].Unit = ""
+			o.Results[0].Range = ""
+			o.Results[0].AbnormalFlag = ""
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: `OBX|1|TX|lpdc-2011^Creatinine^WinPath^^||First line\.br\Second line||||||F|||20180126154523||`,
+	}, {
+		name: "Producer ID",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ProducerID = &CodedElement{ID: "LAB2", Text: "North Lab", CodingSystem: "LOCAL"}
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|LAB2^North Lab^LOCAL^^|",
+	}, {
+		name: "Observation Identifier",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationIdentifier = &CodedElement{ID: "CRE", Text: "Creatinine", CodingSystem: "LOCAL", AlternateID: "2160-0", AlternateText: "Creatinine", AlternateCodingSystem: "LN"}
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|CRE^Creatinine^LOCAL^2160-0^Creatinine^LN||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name: "Multiple Abnormal Flags",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].AbnormalFlags = []string{"A", "H"}
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|A~H|||F|||20180126154523||",
+	}, {
+		name: "Escape Reference Range",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].Range = "39.00 ^ 308.00"
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 \\S\\ 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name: "Escape TestName",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].TestName = &CodedElement{
+				ID:            "Urea & Electrolytes",
+				Text:          "Creatinine & Glucose",
+				CodingSystem:  "& not escaped",
+				AlternateText: "Some text with &",
+			}
+			return o
+		},
+		want: "OBX|1|NM|Urea \\T\\ Electrolytes^Creatinine \\T\\ Glucose^& not escaped^^Some text with \\T\\||700|UML|39.00 - 308.00|HIGH|||F|||||",
+	}, {
+		name: "Replace New Line",
+		setup: func() *Order {
+			o := testOrder(now)
+			o.Results = []*Result{{
+				TestName: &CodedElement{
+					ID:           "lpdc-2011",
+					Text:         "Creatinine",
+					CodingSystem: "WinPath",
+				},
+				Value:               "This is the result.\nAnd this is second line.",
+				ValueType:           "TX",
+				Status:              "F",
+				ObservationDateTime: NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC)),
+			}}
+			return o
+		},
+		want: "OBX|1|TX|lpdc-2011^Creatinine^WinPath^^||This is the result.~And this is second line.||||||F|||20180126154523||",
+	}, {
+		name: "Analysis Date Time",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.Results[0].AnalysisDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 10, 0, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|||||20180126161000",
+	}, {
+		name: "Equipment Instance Identifier",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.Results[0].EquipmentInstanceID = "ANALYZER-07"
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||||ANALYZER-07",
+	}, {
+		name: "Equipment Instance Identifier And Analysis Date Time",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.Results[0].AnalysisDateTime = NewValidTime(time.Date(2018, 1, 26, 16, 10, 0, 0, time.UTC))
+			o.Results[0].EquipmentInstanceID = "ANALYZER-07"
+			return o
+		},
+		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||||ANALYZER-07|20180126161000",
+	}, {
+		name: "Structured Numeric",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].Value = "1:256"
+			o.Results[0].ValueType = "SN"
+			o.Results[0].Unit = ""
+			o.Results[0].Range = ""
+			o.Results[0].AbnormalFlag = ""
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|SN|lpdc-2011^Creatinine^WinPath^^||^1^:^256||||||F|||20180126154523||",
+	}, {
+		name: "Structured Numeric With Comparator",
+		setup: func() *Order {
+			o := testOrderWithResult(now)
+			o.Results[0].Value = ">=100"
+			o.Results[0].ValueType = "SN"
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			return o
+		},
+		want: "OBX|1|SN|lpdc-2011^Creatinine^WinPath^^||>=^100^^|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := tc.setup()
+			got, err := BuildOBX(1, o.Results[0], o)
+			if err != nil {
+				t.Fatalf("BuildOBX(%v,%v,%v) failed with %v", 1, o.Results[0], o, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildOBX(%v,%v,%v)=%v, want %v", 1, o.Results[0], o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildOBX_VitalSign(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	observed := NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+
+	tests := []struct {
+		name   string
+		result *Result
+		want   string
+	}{{
+		name:   "Heart Rate",
+		result: HeartRate.Result("72", nil, observed),
+		want:   "OBX|1|NM|8867-4^Heart rate^LN^^||72|/min^/min^UCUM^^|60-100||||F|||20180126154523||",
+	}, {
+		name:   "Heart Rate With Method",
+		result: HeartRate.Result("72", &CodedElement{ID: "PULSEOX", Text: "Pulse oximeter", CodingSystem: "LOCAL"}, observed),
+		want:   "OBX|1|NM|8867-4^Heart rate^LN^^||72|/min^/min^UCUM^^|60-100||||F|||20180126154523|||PULSEOX^Pulse oximeter^LOCAL^^|",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOrder(now)
+			got, err := BuildOBX(1, tc.result, o)
+			if err != nil {
+				t.Fatalf("BuildOBX(%v,%v,%v) failed with %v", 1, tc.result, o, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildOBX(%v,%v,%v)=%v, want %v", 1, tc.result, o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildOBX_PerformingOrganization(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	org := &PerformingOrganization{
+		Name:            "Reference Lab",
+		ID:              "05D0123456",
+		Address:         &Address{FirstLine: "1 Lab Road", City: "London", PostalCode: "AB1 2CD", Country: "UK", Type: "BA"},
+		MedicalDirector: testDoctor(),
+	}
+
+	tests := []struct {
+		name            string
+		version         string
+		observationType string
+		want            string
+	}{{
+		name:    "Version 2.5",
+		version: "2.5",
+		want:    "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|||||||||Reference Lab^^^^^^^^^05D0123456|1 Lab Road^^London^^AB1 2CD^UK^BA|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}, {
+		name:            "Version 2.7 with Observation Type",
+		version:         "2.7",
+		observationType: "RSLT",
+		want:            "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|||||||||Reference Lab^^^^^^^^^05D0123456|1 Lab Road^^London^^AB1 2CD^UK^BA|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||||RSLT",
+	}, {
+		name:    "Version 2.3",
+		version: "2.3",
+		want:    "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{HL7Version: tc.version}
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.Results[0].ObservationType = tc.observationType
+			o.Results[0].PerformingOrganization = org
+			got, err := buildOBX(options, 1, o.Results[0], o)
+			if err != nil {
+				t.Fatalf("buildOBX(%v,%v,%v,%v) failed with %v", options, 1, o.Results[0], o, err)
+			}
+			if got != tc.want {
+				t.Errorf("buildOBX(%v,%v,%v,%v)=%v, want %v", options, 1, o.Results[0], o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildOBX_ObservationType(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		version            string
+		observationType    string
+		observationSubType string
+		want               string
+	}{{
+		name:               "Version 2.7",
+		version:            "2.7",
+		observationType:    "RSLT",
+		observationSubType: "MDM",
+		want:               "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|||||||||||||||RSLT|MDM",
+	}, {
+		name:            "Version 2.7 without Sub-Type",
+		version:         "2.7",
+		observationType: "RSLT",
+		want:            "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523|||||||||||||||RSLT",
+	}, {
+		name:    "Version 2.7 without Observation Type",
+		version: "2.7",
+		want:    "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}, {
+		name:               "Version 2.3",
+		version:            "2.3",
+		observationType:    "RSLT",
+		observationSubType: "MDM",
+		want:               "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{HL7Version: tc.version}
+			o := testOrderWithResult(now)
+			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+			o.Results[0].ObservationType = tc.observationType
+			o.Results[0].ObservationSubType = tc.observationSubType
+			got, err := buildOBX(options, 1, o.Results[0], o)
+			if err != nil {
+				t.Fatalf("buildOBX(%v,%v,%v,%v) failed with %v", options, 1, o.Results[0], o, err)
+			}
+			if got != tc.want {
+				t.Errorf("buildOBX(%v,%v,%v,%v)=%v, want %v", options, 1, o.Results[0], o, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOptions_HL7Version(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	mt := &Type{MessageType: "ORU", TriggerEvent: "R01"}
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{version: "2.5.1", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01^ORU_R01|1|T|2.5.1|||AL||44|ASCII"},
+		{version: "2.7", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01^ORU_R01|1|T|2.7|||AL||44|ASCII"},
+		{version: "", want: "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180126152421||ORU^R01|1|T|2.3|||AL||44|ASCII"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.version, func(t *testing.T) {
+			header := testHeader()
+			header.Options = &Options{HL7Version: tc.version}
+			got, err := BuildMSH(now, mt, header)
+			if err != nil {
+				t.Fatalf("BuildMSH(%v, %v, %v) failed with %v", now, mt, header, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildMSH(%v, %v, %v)=%v, want %v", now, mt, header, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResultsOBX_ChildResults(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+	o.Results = []*Result{{
+		TestName:  &CodedElement{ID: "org", Text: "Organism", CodingSystem: "WinPath"},
+		Value:     "Escherichia coli",
+		ValueType: "TX",
+		Status:    "F",
+		ChildResults: []*Result{{
+			TestName:  &CodedElement{ID: "amox", Text: "Amoxicillin", CodingSystem: "WinPath"},
+			Value:     "R",
+			ValueType: "ST",
+			Status:    "F",
+		}, {
+			TestName:  &CodedElement{ID: "gent", Text: "Gentamicin", CodingSystem: "WinPath"},
+			Value:     "S",
+			ValueType: "ST",
+			Status:    "F",
+		}},
+	}, {
+		TestName:  &CodedElement{ID: "gram", Text: "Gram stain", CodingSystem: "WinPath"},
+		Value:     "Gram negative",
+		ValueType: "TX",
+		Status:    "F",
+	}}
+
+	want := []string{
+		"OBX|1|TX|org^Organism^WinPath^^|1|Escherichia coli||||||F|||||",
+		"OBX|2|ST|amox^Amoxicillin^WinPath^^|1.1|R||||||F|||||",
+		"OBX|3|ST|gent^Gentamicin^WinPath^^|1.2|S||||||F|||||",
+		"OBX|4|TX|gram^Gram stain^WinPath^^||Gram negative||||||F|||||",
+	}
+	got, err := resultsOBX(nil, o, nil)
+	if err != nil {
+		t.Fatalf("resultsOBX(nil, %v, nil) failed with %v", o, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("resultsOBX(nil, %v, nil) diff (-want, +got):\n%s", o, diff)
+	}
+}
+
+func TestResultsOBX_MaxValueLength(t *testing.T) {
+	options := &Options{MaxOBXValueLength: 10}
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := testOrder(now)
+	o.Results = []*Result{{
+		TestName:  &CodedElement{ID: "short", Text: "Short", CodingSystem: "WinPath"},
+		Value:     "0123456789",
+		ValueType: "TX",
+		Status:    "F",
+	}, {
+		TestName:  &CodedElement{ID: "comment", Text: "Comment", CodingSystem: "WinPath"},
+		Value:     "No growth after 48 hours",
+		ValueType: "TX",
+		Status:    "F",
+		Notes:     []string{"note"},
+	}}
+
+	want := []string{
+		"OBX|1|TX|short^Short^WinPath^^||0123456789||||||F|||||",
+		"OBX|2|TX|comment^Comment^WinPath^^|1.1|No growth ||||||F|||||",
+		"OBX|3|TX|comment^Comment^WinPath^^|1.2|after 48 h||||||F|||||",
+		"OBX|4|TX|comment^Comment^WinPath^^|1.3|ours||||||F|||||",
+		"NTE|0||note|",
+	}
+	got, err := resultsOBX(options, o, nil)
+	if err != nil {
+		t.Fatalf("resultsOBX(%v, %v, nil) failed with %v", options, o, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("resultsOBX(%v, %v, nil) diff (-want, +got):\n%s", options, o, diff)
+	}
+}
+
+func TestResultsOBX_MaxValueLengthOfRenderedValue(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	testName := &CodedElement{ID: "comment", Text: "Comment", CodingSystem: "WinPath"}
+	customEncoding := Encoding{FieldSeparator: '#', ComponentSeparator: '^', RepetitionSeparator: '~', EscapeCharacter: '\\', SubComponentSeparator: '&'}
+
+	tests := []struct {
+		name    string
+		options *Options
+		result  *Result
+		// wantValues are the OBX -> Observation Value of each OBX segment.
+		wantValues []string
+	}{{
+		name:       "newlines as line breaks",
+		options:    &Options{MaxOBXValueLength: 10},
+		result:     &Result{TestName: testName, Value: "line one\nline two", ValueType: "TX", NewlinesAsLineBreaks: true},
+		wantValues: []string{"line one", "\\.br\\line ", "two"},
+	}, {
+		name:       "newlines as repetitions",
+		options:    &Options{MaxOBXValueLength: 10},
+		result:     &Result{TestName: testName, Value: "line one\nline two", ValueType: "TX"},
+		wantValues: []string{"line one~l", "ine two"},
+	}, {
+		name:       "escaped with custom encoding",
+		options:    &Options{MaxOBXValueLength: 6, Encoding: customEncoding},
+		result:     &Result{TestName: testName, Value: "1#2#3", ValueType: "TX"},
+		wantValues: []string{"1\\F\\2", "\\F\\3"},
+	}, {
+		name:       "structured numeric",
+		options:    &Options{MaxOBXValueLength: 3},
+		result:     &Result{TestName: testName, Value: ">=1:128", ValueType: constants.StructuredNumericValueType},
+		wantValues: []string{">=^1^:^128"},
+	}, {
+		name:       "coded value",
+		options:    &Options{MaxOBXValueLength: 3},
+		result:     &Result{TestName: testName, CodedValue: &CodedElement{ID: "260373001", Text: "Detected", CodingSystem: "SCT"}, ValueType: "CE"},
+		wantValues: []string{"260373001^Detected^SCT^^"},
+	}, {
+		name:    "child results",
+		options: &Options{MaxOBXValueLength: 3},
+		result: &Result{TestName: testName, Value: "parent", ValueType: "TX", ChildResults: []*Result{
+			{TestName: testName, Value: "child", ValueType: "TX"},
+			{TestName: testName, Value: "R", ValueType: "ST"},
+		}},
+		wantValues: []string{"parent", "chi", "ld", "R"},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOrder(now)
+			o.Results = []*Result{tc.result}
+			got, err := resultsOBX(tc.options, o, nil)
+			if err != nil {
+				t.Fatalf("resultsOBX(%v, %v, nil) failed with %v", tc.options, o, err)
+			}
+			var gotValues []string
+			for _, segment := range got {
+				gotValues = append(gotValues, strings.Split(segment, string(tc.options.encoding().FieldSeparator))[5])
+			}
+			if diff := cmp.Diff(tc.wantValues, gotValues); diff != "" {
+				t.Errorf("resultsOBX(%v, %v, nil) got OBX values diff (-want, +got):\n%s", tc.options, o, diff)
+			}
+			if got, want := NumberOfOBXSegments(tc.options, o.Results), len(tc.wantValues); got != want {
+				t.Errorf("NumberOfOBXSegments(%v, %v)=%d, want %d", tc.options, o.Results, got, want)
+			}
+		})
+	}
+}
+
+func TestBuildAppointmentDetailSegments(t *testing.T) {
+	start := NewValidTime(time.Date(2018, 1, 26, 15, 30, 0, 0, time.UTC))
+
+	tests := []struct {
+		name    string
+		details *AppointmentDetails
+		want    []string
+	}{{
+		name:    "Empty",
+		details: &AppointmentDetails{},
+		want:    nil,
+	}, {
+		name: "Resource, location and provider",
+		details: &AppointmentDetails{
+			Resources: []*AppointmentResource{{
+				Resource:          &CodedElement{ID: "MRI-1", Text: "MRI Scanner", CodingSystem: "LOCAL"},
+				AppointmentTiming: AppointmentTiming{Start: start, Duration: 45 * time.Minute, Status: "Booked"},
+			}},
+			Locations: []*AppointmentLocation{{
+				Location:          &PatientLocation{Poc: "RAD", Room: "Room 1", Facility: "Simulated Hospital"},
+				AppointmentTiming: AppointmentTiming{Start: start, Duration: 45 * time.Minute, Status: "Booked"},
+			}},
+			Personnel: []*AppointmentPersonnel{{
+				Provider:          testDoctor(),
+				AppointmentTiming: AppointmentTiming{Start: start, Status: "Pending"},
+			}},
+		},
+		want: []string{
+			"AIG|1||MRI-1^MRI Scanner^LOCAL^^|||||20180126153000|||45|min||Booked",
+			"AIL|1||RAD^Room 1^^Simulated Hospital^^^^|||20180126153000|||45|min||Booked",
+			"AIP|1||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||20180126153000||||||Pending",
+		},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildAppointmentDetailSegments(tc.details)
+			if err != nil {
+				t.Fatalf("BuildAppointmentDetailSegments(%v) failed with %v", tc.details, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("BuildAppointmentDetailSegments(%v) got diff (-want, +got):\n%s", tc.details, diff)
+			}
+		})
+	}
+}
+
+func TestHL7MessageSegmentCountAndByteLen(t *testing.T) {
+	tests := []struct {
+		name             string
+		message          string
+		wantSegmentCount int
+		wantByteLen      int
+	}{
+		{name: "empty", message: "", wantSegmentCount: 0, wantByteLen: 0},
+		{name: "one segment", message: "MSH|^~\\&|", wantSegmentCount: 1, wantByteLen: 9},
+		{name: "several segments", message: "MSH|^~\\&|\rPID|1|\rPV1|1|N|", wantSegmentCount: 3, wantByteLen: 25},
+		{name: "trailing terminator", message: "MSH|^~\\&|\rPID|1|\r", wantSegmentCount: 2, wantByteLen: 17},
+		{name: "multi-byte characters", message: "MSH|^~\\&|\rPID|1||||Muñoz", wantSegmentCount: 2, wantByteLen: 25},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := HL7Message{Type: &Type{MessageType: ADT, TriggerEvent: "A08"}, Message: tc.message}
+			if got := m.SegmentCount(); got != tc.wantSegmentCount {
+				t.Errorf("HL7Message{Message: %q}.SegmentCount()=%d, want %d", tc.message, got, tc.wantSegmentCount)
+			}
+			if got := m.ByteLen(); got != tc.wantByteLen {
+				t.Errorf("HL7Message{Message: %q}.ByteLen()=%d, want %d", tc.message, got, tc.wantByteLen)
+			}
+		})
+	}
+}
+
+func TestHL7MessageSegmentCount_BuiltMessage(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	header := testHeader()
+	adt, err := BuildUpdatePatientADTA08(header, patientInfo, now, now)
+	if err != nil {
+		t.Fatalf("BuildUpdatePatientADTA08(%v, %v, %v, %v) failed with %v", header, patientInfo, now, now, err)
+	}
+	if got, want := adt.SegmentCount(), len(strings.Split(adt.Message, SegmentTerminator)); got != want {
+		t.Errorf("SegmentCount()=%d, want %d", got, want)
+	}
+	if got, want := adt.ByteLen(), len([]byte(adt.Message)); got != want {
+		t.Errorf("ByteLen()=%d, want %d", got, want)
+	}
+}
+
+func TestDebugSegments(t *testing.T) {
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	p := testPatientInfo()
+	o := testOrderWithResult(now)
+
+	got := DebugSegments(p, o)
+
+	var gotKeys []string
+	for k := range got {
+		gotKeys = append(gotKeys, k)
+	}
+	wantKeys := []string{"PID", "PD1", "PV1", "PV2", "NK1.1", "AL1.1", "DG1.1", "PR1.1", "ORC", "OBR", "OBX.1", "OBX.2"}
+	if diff := cmp.Diff(wantKeys, gotKeys, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("DebugSegments(%v, %v) got keys diff (-want, +got):\n%s", p, o, diff)
+	}
+
+	wantPID, err := BuildPID(p.Person)
+	if err != nil {
+		t.Fatalf("BuildPID(%v) failed with %v", p.Person, err)
+	}
+	if got, want := got[PID], wantPID; got != want {
+		t.Errorf("DebugSegments(%v, %v)[%q]=%v, want %v", p, o, PID, got, want)
+	}
+	wantOBX, err := BuildOBX(2, o.Results[1], o)
+	if err != nil {
+		t.Fatalf("BuildOBX(%v, %v, %v) failed with %v", 2, o.Results[1], o, err)
+	}
+	if got, want := got["OBX.2"], wantOBX; got != want {
+		t.Errorf("DebugSegments(%v, %v)[%q]=%v, want %v", p, o, "OBX.2", got, want)
+	}
+}
+
+func TestDebugSegments_Error(t *testing.T) {
+	// Dates not in UTC cannot be rendered.
+	o := testOrder(time.Date(2018, 1, 26, 15, 24, 21, 0, time.Local))
+
+	got := DebugSegments(nil, o)
+	if len(got) != 2 {
+		t.Errorf("DebugSegments(nil, %v)=%v, want only ORC and OBR", o, got)
+	}
+	if !strings.HasPrefix(got[OBR], "error:") {
+		t.Errorf("DebugSegments(nil, %v)[%q]=%v, want error", o, OBR, got[OBR])
+	}
+}
+
+func TestUnescapeHL7(t *testing.T) {
+	cases := []struct {
+		escaped string
+		want    string
+	}{
+		{escaped: "no escape sequences", want: "no escape sequences"},
+		{escaped: "10\\S\\9", want: "10^9"},
+		{escaped: "Urea \\T\\ Electrolytes", want: "Urea & Electrolytes"},
+		{escaped: "line 1\\.br\\line 2", want: "line 1\\nline 2"},
+		{escaped: "back\\E\\slash", want: "back\\slash"},
+		{escaped: "a\\F\\b", want: "a|b"},
+		{escaped: "a\\R\\b", want: "a~b"},
+		{escaped: "\\E\\S\\E\\", want: "\\S\\"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.escaped, func(t *testing.T) {
+			if got := UnescapeHL7(tc.escaped); got != tc.want {
+				t.Errorf("UnescapeHL7(%q)=%q, want %q", tc.escaped, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeHL7_RoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"plain text",
+		"10^9 g/L",
+		"Urea & Electrolytes",
+		"line 1\\nline 2",
+		"back\\slash",
+		"all ^ & \\n \\ together",
+		"\\S\\ is not an escape sequence here",
+	} {
+		if got := UnescapeHL7(escapeHL7(s)); got != s {
+			t.Errorf("UnescapeHL7(escapeHL7(%q))=%q, want %q", s, got, s)
+		}
+	}
+}
+
+func TestUnescapeHL7Unit_RoundTrip(t *testing.T) {
+	for _, s := range []string{"", "UML", "10^9 g/L", "10^12/L"} {
+		if got := UnescapeHL7Unit(toHL7Unit(s)); got != s {
+			t.Errorf("UnescapeHL7Unit(toHL7Unit(%q))=%q, want %q", s, got, s)
+		}
+	}
+}
+
+func TestPatientInfoClone(t *testing.T) {
+	original := testPatientInfo()
+	original.Person.MRNsByAuthority = map[string]string{"RAL": "123"}
+	original.Allergies[0].Reactions = []string{"Rash"}
+	original.Movement = &Movement{ID: "MOV1", Action: MovementActionInsert}
+	want := testPatientInfo()
+	want.Person.MRNsByAuthority = map[string]string{"RAL": "123"}
+	want.Allergies[0].Reactions = []string{"Rash"}
+	want.Movement = &Movement{ID: "MOV1", Action: MovementActionInsert}
+
+	clone := original.Clone()
+	if diff := cmp.Diff(original, clone); diff != "" {
+		t.Fatalf("Clone() got diff (-original, +clone):\n%s", diff)
+	}
+
+	clone.Person.Surname = "Changed"
+	clone.Person.Address.City = "Changed"
+	clone.Person.MRNsByAuthority["RAL"] = "changed"
+	clone.Location.Bed = "Changed"
+	clone.PriorLocation.Bed = "Changed"
+	clone.AttendingDoctor.Surname = "Changed"
+	clone.AssociatedParties[0].Person.FirstName = "Changed"
+	clone.AssociatedParties[0].Relationship.ID = "Changed"
+	clone.AssociatedParties = append(clone.AssociatedParties, &AssociatedParty{})
+	clone.Allergies[0].Severity = "Changed"
+	clone.Allergies[0].Reactions[0] = "Changed"
+	clone.Diagnoses[0].Description.Text = "Changed"
+	clone.Procedures[0].Clinician.Surname = "Changed"
+	clone.Movement.ID = "Changed"
+
+	if diff := cmp.Diff(want, original); diff != "" {
+		t.Errorf("original PatientInfo changed after modifying its clone, diff (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPatientInfoClone_Nil(t *testing.T) {
+	var p *PatientInfo
+	if got := p.Clone(); got != nil {
+		t.Errorf("Clone() of nil PatientInfo = %v, want nil", got)
+	}
+}
+
+func TestParseCodedElement(t *testing.T) {
+	cases := []struct {
+		in   string
+		want *CodedElement
+	}{
+		{in: "", want: nil},
+		{in: "lpdc-2011", want: &CodedElement{ID: "lpdc-2011"}},
+		{in: "lpdc-2011^Creatinine", want: &CodedElement{ID: "lpdc-2011", Text: "Creatinine"}},
+		{in: "lpdc-2011^Creatinine^WinPath", want: &CodedElement{ID: "lpdc-2011", Text: "Creatinine", CodingSystem: "WinPath"}},
+		{in: "lpdc-2011^Creatinine^WinPath^^Creat", want: &CodedElement{ID: "lpdc-2011", Text: "Creatinine", CodingSystem: "WinPath", AlternateText: "Creat"}},
+		{in: "lpdc-2011^Creatinine^WinPath^2160-0^Creatinine^LN", want: &CodedElement{ID: "lpdc-2011", Text: "Creatinine", CodingSystem: "WinPath", AlternateID: "2160-0", AlternateText: "Creatinine", AlternateCodingSystem: "LN"}},
+		{in: "^Creatinine^^^", want: &CodedElement{Text: "Creatinine"}},
+		{in: "Urea \\T\\ Electrolytes^10\\S\\9 g/L^WinPath", want: &CodedElement{ID: "Urea & Electrolytes", Text: "10^9 g/L", CodingSystem: "WinPath"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, ParseCodedElement(tc.in)); diff != "" {
+				t.Errorf("ParseCodedElement(%q) got diff (-want, +got):\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+func TestParseStructuredNumeric(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    *StructuredNumeric
+		wantErr bool
+	}{
+		{in: "12", want: &StructuredNumeric{Num1: "12"}},
+		{in: "<0.5", want: &StructuredNumeric{Comparator: "<", Num1: "0.5"}},
+		{in: ">= 100", want: &StructuredNumeric{Comparator: ">=", Num1: "100"}},
+		{in: "1:256", want: &StructuredNumeric{Num1: "1", Separator: ":", Num2: "256"}},
+		{in: "1/2", want: &StructuredNumeric{Num1: "1", Separator: "/", Num2: "2"}},
+		{in: "10-20", want: &StructuredNumeric{Num1: "10", Separator: "-", Num2: "20"}},
+		{in: "-5--3", want: &StructuredNumeric{Num1: "-5", Separator: "-", Num2: "-3"}},
+		{in: "2+", want: &StructuredNumeric{Num1: "2", Separator: "+"}},
+		{in: "", wantErr: true},
+		{in: "positive", wantErr: true},
+		{in: "1:", wantErr: true},
+		{in: "1:2:3", wantErr: true},
+		{in: "<", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseStructuredNumeric(tc.in)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("ParseStructuredNumeric(%q) got err %v, want err? %t", tc.in, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseStructuredNumeric(%q) got diff (-want, +got):\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+func TestParseCodedElement_RoundTrip(t *testing.T) {
+	tmpl := mustParseTemplates("CE", map[string]string{
+		ceTemplate: ceTmpl,
+		"CE":       `{{template "CETmpl" .}}`,
+	})
+	cases := []*CodedElement{
+		{ID: "lpdc-2011", Text: "Creatinine", CodingSystem: "WinPath"},
+		{ID: "lpdc-2011", Text: "Creatinine", CodingSystem: "WinPath", AlternateText: "Creat"},
+		{Text: "Creatinine"},
+		{ID: "Urea & Electrolytes", Text: "10^9 g/L", CodingSystem: "WinPath", AlternateText: "Line 1\\nLine 2 \\ slash"},
+	}
+	for _, ce := range cases {
+		t.Run(ce.ID+ce.Text, func(t *testing.T) {
+			s, err := executeTemplate(nil, tmpl, ce)
+			if err != nil {
+				t.Fatalf("executeTemplate(%+v) failed with %v", ce, err)
+			}
+			if diff := cmp.Diff(ce, ParseCodedElement(s)); diff != "" {
+				t.Errorf("ParseCodedElement(%q) got diff (-want, +got):\n%s", s, diff)
+			}
+		})
 	}
 }
 
-func TestBuildOBX(t *testing.T) {
+func TestBuildOBX_ReferenceRange(t *testing.T) {
 	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
 
 	tests := []struct {
-		name  string
-		setup func() *Order
-		want  string
+		name      string
+		format    string
+		rangeText string
+		low       string
+		high      string
+		want      string
 	}{{
-		name: "Regular",
-		setup: func() *Order {
-			o := testOrderWithResult(now)
-			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
-			return o
-		},
-		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 - 308.00|HIGH|||F|||20180126154523||",
-	}, {
-		name: "Escape Unit",
-		setup: func() *Order {
-			o := testOrderWithResult(now)
-			o.Results[0].Unit = "10^9 g/L"
-			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
-			return o
-		},
-		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|10\\S\\9 g/L|39.00 - 308.00|HIGH|||F|||20180126154523||",
+		name:      "free text",
+		rangeText: "49 - 92",
+		want:      "49 - 92",
 	}, {
-		name: "Escape Reference Range",
-		setup: func() *Order {
-			o := testOrderWithResult(now)
-			o.Results[0].Range = "39.00 ^ 308.00"
-			o.Results[0].ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
-			return o
-		},
-		want: "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|39.00 \\S\\ 308.00|HIGH|||F|||20180126154523||",
+		name:      "structured takes precedence over free text",
+		rangeText: "49 - 92",
+		low:       "49",
+		high:      "92",
+		want:      "49-92",
 	}, {
-		name: "Escape TestName",
-		setup: func() *Order {
-			o := testOrderWithResult(now)
-			o.Results[0].TestName = &CodedElement{
-				ID:            "Urea & Electrolytes",
-				Text:          "Creatinine & Glucose",
-				CodingSystem:  "& not escaped",
-				AlternateText: "Some text with &",
-			}
-			return o
-		},
-		want: "OBX|1|NM|Urea \\T\\ Electrolytes^Creatinine \\T\\ Glucose^& not escaped^^Some text with \\T\\||700|UML|39.00 - 308.00|HIGH|||F|||||",
+		name:   "structured with custom format",
+		format: "[%s,%s]",
+		low:    "49",
+		high:   "92",
+		want:   "[49,92]",
 	}, {
-		name: "Replace New Line",
-		setup: func() *Order {
-			o := testOrder(now)
-			o.Results = []*Result{{
-				TestName: &CodedElement{
-					ID:           "lpdc-2011",
-					Text:         "Creatinine",
-					CodingSystem: "WinPath",
-				},
-				Value:               "This is the result.\nAnd this is second line.",
-				ValueType:           "TX",
-				Status:              "F",
-				ObservationDateTime: NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC)),
-			}}
-			return o
-		},
-		want: "OBX|1|TX|lpdc-2011^Creatinine^WinPath^^||This is the result.~And this is second line.||||||F|||20180126154523||",
+		name: "structured with only upper limit",
+		high: "92",
+		want: "-92",
 	}}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			o := tc.setup()
-			got, err := BuildOBX(1, o.Results[0], o)
+			options := &Options{ReferenceRangeFormat: tc.format}
+			o := testOrderWithResult(now)
+			r := o.Results[0]
+			r.Range = tc.rangeText
+			r.RangeLow = tc.low
+			r.RangeHigh = tc.high
+			r.ObservationDateTime = NewValidTime(time.Date(2018, 1, 26, 15, 45, 23, 0, time.UTC))
+
+			got, err := buildOBX(options, 1, r, o)
 			if err != nil {
-				t.Fatalf("BuildOBX(%v,%v,%v) failed with %v", 1, o.Results[0], o, err)
+				t.Fatalf("buildOBX(%v, %v, %v, %v) failed with %v", options, 1, r, o, err)
 			}
-			if got != tc.want {
-				t.Errorf("BuildOBX(%v,%v,%v)=%v, want %v", 1, o.Results[0], o, got, tc.want)
+			want := "OBX|1|NM|lpdc-2011^Creatinine^WinPath^^||700|UML|" + tc.want + "|HIGH|||F|||20180126154523||"
+			if got != want {
+				t.Errorf("buildOBX(%v, %v, %v, %v)=%v, want %v", options, 1, r, o, got, want)
 			}
 		})
 	}
@@ -402,14 +2344,14 @@ func TestBuildOBXForClinicalNote(t *testing.T) {
 			orderTime := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
 			return orderWithClinicalNote(orderTime, "some-content")
 		},
-		want: "OBX|1||ECG^ECG||^^PNG^BASE64^some-content|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+		want: "OBX|1||ECG^ECG|1|^^PNG^BASE64^some-content|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
 	}, {
 		name: "clinical note with an rtf file",
 		setup: func() *Order {
 			orderTime := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
 			return orderWithClinicalNote(orderTime, `{\rtf1\ansi{\fonttbl\f0\fswiss Helvetica;}\f0\pard\nThis is some {\b bold} text.\par\n}`)
 		},
-		want: `OBX|1||ECG^ECG||^^PNG^BASE64^{\E\rtf1\E\ansi{\E\fonttbl\E\f0\E\fswiss Helvetica;}\E\f0\E\pard\.br\This is some {\E\b bold} text.\E\par\.br\}|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR`,
+		want: `OBX|1||ECG^ECG|1|^^PNG^BASE64^{\E\rtf1\E\ansi{\E\fonttbl\E\f0\E\fswiss Helvetica;}\E\f0\E\pard\.br\This is some {\E\b bold} text.\E\par\.br\}|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR`,
 	}}
 
 	for _, tc := range tests {
@@ -426,6 +2368,167 @@ func TestBuildOBXForClinicalNote(t *testing.T) {
 	}
 }
 
+func TestBuildResultORUR01_ClinicalNoteMultipleContents(t *testing.T) {
+	header := testHeader()
+	patientInfo := testPatientInfo()
+	now := time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)
+	o := orderWithClinicalNote(now, "content")
+	o.Results[0].ClinicalNote.Contents = []*ClinicalNoteContent{{
+		ContentType:     "rtf",
+		DocumentContent: "body",
+	}, {
+		ContentType:      "pdf",
+		DocumentContent:  "YWRkZW5kdW0=",
+		DocumentEncoding: "BASE64",
+	}}
+
+	oru, err := BuildResultORUR01(header, patientInfo, o, now)
+	if err != nil {
+		t.Fatalf("BuildResultORUR01(%v, %v, %v, %v) failed with %v", header, patientInfo, o, now, err)
+	}
+	var got []string
+	for _, seg := range strings.Split(oru.Message, SegmentTerminator) {
+		if strings.HasPrefix(seg, OBX) {
+			got = append(got, seg)
+		}
+	}
+	want := []string{
+		"OBX|1||ECG^ECG|1|^^rtf^^body|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+		"OBX|2||ECG^ECG|2|^^pdf^BASE64^YWRkZW5kdW0=|||||||||20180126152421||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("BuildResultORUR01(%v, %v, %v, %v) got OBX segments diff (-want, +got):\n%s", header, patientInfo, o, now, diff)
+	}
+}
+
+func TestBuildPIDWithSetID(t *testing.T) {
+	p := testPatientInfo().Person
+
+	pid, err := BuildPIDWithSetID(2, p, "")
+	if err != nil {
+		t.Fatalf("BuildPIDWithSetID(2, %v, %q) failed with %v", p, "", err)
+	}
+	fields := strings.Split(pid, "|")
+	if got, want := fields[1], "2"; got != want {
+		t.Errorf("BuildPIDWithSetID(2, %v, %q) PID.1=%q, want %q", p, "", got, want)
+	}
+	if got, want := fields[2], fields[3][:strings.Index(fields[3], "~")]; got != want {
+		t.Errorf("BuildPIDWithSetID(2, %v, %q) PID.2=%q, want the MRN %q", p, "", got, want)
+	}
+
+	p.ExternalID = "EXT123"
+	pid, err = BuildPIDWithSetID(1, p, "")
+	if err != nil {
+		t.Fatalf("BuildPIDWithSetID(1, %v, %q) failed with %v", p, "", err)
+	}
+	fields = strings.Split(pid, "|")
+	if got, want := fields[1], "1"; got != want {
+		t.Errorf("BuildPIDWithSetID(1, %v, %q) PID.1=%q, want %q", p, "", got, want)
+	}
+	if got, want := fields[2], "EXT123"; got != want {
+		t.Errorf("BuildPIDWithSetID(1, %v, %q) PID.2=%q, want %q", p, "", got, want)
+	}
+}
+
+func TestBuildPID_UnknownPerson(t *testing.T) {
+	tests := []struct {
+		gender     string
+		wantGender string
+	}{
+		{gender: GenderMale, wantGender: GenderMale},
+		{gender: GenderFemale, wantGender: GenderFemale},
+		{gender: "", wantGender: GenderUnknown},
+		{gender: "invalid", wantGender: GenderUnknown},
+	}
+	wantFields := len(strings.Split(mustBuildPID(t, testPatientInfo().Person), "|"))
+	for _, tc := range tests {
+		t.Run(tc.gender, func(t *testing.T) {
+			p := NewUnknownPerson(tc.gender)
+			pid := mustBuildPID(t, p)
+			if strings.Contains(pid, "<no value>") {
+				t.Errorf("BuildPID(%v)=%q, want no <no value>", p, pid)
+			}
+			fields := strings.Split(pid, "|")
+			if got := len(fields); got != wantFields {
+				t.Fatalf("BuildPID(%v) got %d fields, want %d", p, got, wantFields)
+			}
+			if got, want := fields[3], p.MRN+"^^^"; !strings.HasPrefix(got, want) {
+				t.Errorf("BuildPID(%v) PID.3=%q, want prefix %q", p, got, want)
+			}
+			if got, want := fields[5], "UNKNOWN^UNKNOWN^"; !strings.HasPrefix(got, want) {
+				t.Errorf("BuildPID(%v) PID.5=%q, want prefix %q", p, got, want)
+			}
+			if got := fields[7]; got != "" {
+				t.Errorf("BuildPID(%v) PID.7=%q, want empty", p, got)
+			}
+			if got, want := fields[8], tc.wantGender; got != want {
+				t.Errorf("BuildPID(%v) PID.8=%q, want %q", p, got, want)
+			}
+		})
+	}
+}
+
+func TestNewUnknownPerson_TemporaryMRN(t *testing.T) {
+	p1 := NewUnknownPerson(GenderMale)
+	p2 := NewUnknownPerson(GenderMale)
+	for _, p := range []*Person{p1, p2} {
+		if !strings.HasPrefix(p.MRN, TemporaryMRNPrefix) || len(p.MRN) == len(TemporaryMRNPrefix) {
+			t.Errorf("NewUnknownPerson(%q).MRN=%q, want prefix %q followed by a suffix", GenderMale, p.MRN, TemporaryMRNPrefix)
+		}
+	}
+	if p1.MRN == p2.MRN {
+		t.Errorf("NewUnknownPerson(%q) returned the same MRN %q twice, want different MRNs", GenderMale, p1.MRN)
+	}
+
+	random.Seed(1)
+	seeded1 := NewUnknownPerson(GenderMale)
+	random.Seed(1)
+	seeded2 := NewUnknownPerson(GenderMale)
+	if seeded1.MRN != seeded2.MRN {
+		t.Errorf("NewUnknownPerson(%q) after random.Seed(1) got MRNs %q and %q, want the same MRN", GenderMale, seeded1.MRN, seeded2.MRN)
+	}
+}
+
+func mustBuildPID(t *testing.T, p *Person) string {
+	t.Helper()
+	pid, err := BuildPID(p)
+	if err != nil {
+		t.Fatalf("BuildPID(%v) failed with %v", p, err)
+	}
+	return pid
+}
+
+func TestBuildPID_AccountNumber(t *testing.T) {
+	patientInfo := testPatientInfo()
+	patientInfo.Person.AccountNumber = "AC123456"
+
+	pid, err := BuildPID(patientInfo.Person)
+	if err != nil {
+		t.Fatalf("BuildPID(%v) failed with %v", patientInfo.Person, err)
+	}
+	pv1, err := BuildPV1(patientInfo)
+	if err != nil {
+		t.Fatalf("BuildPV1(%v) failed with %v", patientInfo, err)
+	}
+	pidFields := strings.Split(pid, "|")
+	pv1Fields := strings.Split(pv1, "|")
+	if got, want := pidFields[18], "AC123456^^^SIMULATOR ACCOUNT^AN"; got != want {
+		t.Errorf("BuildPID(%v) PID.18=%q, want %q", patientInfo.Person, got, want)
+	}
+	if got, want := pv1Fields[19], "12341234^^^^visitid"; got != want {
+		t.Errorf("BuildPV1(%v) PV1.19=%q, want %q", patientInfo, got, want)
+	}
+
+	patientInfo.Person.AccountNumber = ""
+	pid, err = BuildPID(patientInfo.Person)
+	if err != nil {
+		t.Fatalf("BuildPID(%v) failed with %v", patientInfo.Person, err)
+	}
+	if got := strings.Split(pid, "|")[18]; got != "" {
+		t.Errorf("BuildPID(%v) PID.18=%q, want empty", patientInfo.Person, got)
+	}
+}
+
 func TestBuildPV1(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -495,6 +2598,37 @@ func TestBuildPV1(t *testing.T) {
 			}
 		},
 		want: "PV1|1|OUTPATIENT||28b||||||180||||||||||||||||||||||||||||||||||||",
+	}, {
+		name: "Coded Hospital Service",
+		setup: func() *PatientInfo {
+			return &PatientInfo{
+				Class:                "OUTPATIENT",
+				HospitalService:      "180",
+				CodedHospitalService: &CodedElement{ID: "180", Text: "Emergency Medicine", CodingSystem: "NHSTFC"},
+				AdmissionDate:        NewInvalidTime(),
+			}
+		},
+		want: "PV1|1|OUTPATIENT||28b||||||180^Emergency Medicine^NHSTFC^^||||||||||||||||||||||||||||||||||||",
+	}, {
+		name: "Coded Facility",
+		setup: func() *PatientInfo {
+			return &PatientInfo{
+				Class:           "INPATIENT",
+				HospitalService: "180",
+				Location: &PatientLocation{
+					Poc:          "RAL 12 West",
+					Room:         "Bay01",
+					Bed:          "Bed10",
+					Facility:     "RAL RF",
+					FacilityHD:   &HierarchicDesignator{NamespaceID: "RAL", UniversalID: "2.16.840.1.113883.3.72", UniversalIDType: "ISO"},
+					LocationType: "BED",
+					Building:     "RFH",
+					Floor:        "Floor1",
+				},
+				AdmissionDate: NewInvalidTime(),
+			}
+		},
+		want: "PV1|1|INPATIENT|RAL 12 West^Bay01^Bed10^RAL&2.16.840.1.113883.3.72&ISO^^BED^RFH^Floor1|28b||||||180||||||||||||||||||||||||||||||||||||",
 	}}
 
 	for _, tc := range tests {
@@ -513,11 +2647,40 @@ func TestBuildPV1(t *testing.T) {
 
 func TestBuildPseudoPV1(t *testing.T) {
 	want := "PV1|1|N|"
-	if got := BuildPseudoPV1(); got != want {
+	got, err := BuildPseudoPV1()
+	if err != nil {
+		t.Fatalf("BuildPseudoPV1() failed with %v", err)
+	}
+	if got != want {
 		t.Errorf("BuildPseudoPV1()=%v, want %v", got, want)
 	}
 }
 
+func TestOptions_PseudoPV1PatientClass(t *testing.T) {
+	options := &Options{PseudoPV1PatientClass: "U"}
+
+	want := "PV1|1|U|"
+	got, err := buildPseudoPV1(options)
+	if err != nil {
+		t.Fatalf("buildPseudoPV1(%v) failed with %v", options, err)
+	}
+	if got != want {
+		t.Errorf("buildPseudoPV1(%v)=%v, want %v", options, got, want)
+	}
+
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	header := testHeader()
+	header.Options = options
+	adt, err := BuildUpdatePatientADTA08(header, patientInfo, now, now)
+	if err != nil {
+		t.Fatalf("BuildUpdatePatientADTA08(%v, %v, %v, %v) failed with %v", header, patientInfo, now, now, err)
+	}
+	if !strings.Contains(adt.Message, SegmentTerminator+want+SegmentTerminator) {
+		t.Errorf("BuildUpdatePatientADTA08(%v, %v, %v, %v) got message %q, want it to contain the segment %q", header, patientInfo, now, now, adt.Message, want)
+	}
+}
+
 func TestBuildPV2(t *testing.T) {
 	patientInfo := &PatientInfo{
 		PriorPendingLocation: &PatientLocation{
@@ -577,6 +2740,48 @@ func TestBuildNK1(t *testing.T) {
 	}
 }
 
+func TestBuildNK1_Employer(t *testing.T) {
+	tests := []struct {
+		name         string
+		employerName string
+		employerID   string
+		want         string
+	}{{
+		name: "No Employer",
+		want: "NK1|1|Smiths^John^^^^^CURRENT|||020 7031 4000^HOME||||||||||M|",
+	}, {
+		name:         "Employer Name",
+		employerName: "Acme Ltd",
+		want:         "NK1|1|Smiths^John^^^^^CURRENT|||020 7031 4000^HOME||||||||Acme Ltd||M|",
+	}, {
+		name:         "Employer Name And ID",
+		employerName: "Acme Ltd",
+		employerID:   "12345",
+		want:         "NK1|1|Smiths^John^^^^^CURRENT|||020 7031 4000^HOME||||||||Acme Ltd^^12345||M|",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &AssociatedParty{
+				Person: &Person{
+					FirstName:   "John",
+					Surname:     "Smiths",
+					Gender:      "M",
+					PhoneNumber: "020 7031 4000",
+				},
+				EmployerName: tc.employerName,
+				EmployerID:   tc.employerID,
+			}
+			got, err := BuildNK1(1, p)
+			if err != nil {
+				t.Fatalf("BuildNK1(%v, %v) failed with %v", 1, p, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildNK1(%v, %v)=%v, want %v", 1, p, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestBuildNK1_missingData(t *testing.T) {
 	p := &AssociatedParty{
 		Person: &Person{
@@ -599,6 +2804,35 @@ func TestBuildNK1_missingData(t *testing.T) {
 	}
 }
 
+func TestBuildNK1_contact(t *testing.T) {
+	p := NewContact("John", "Smiths", "020 7031 4000", &CodedElement{ID: "S", Text: "SPOUSE"})
+
+	want := "NK1|3|Smiths^John^^^^^CURRENT|S^SPOUSE^^^||020 7031 4000^HOME|||||||||||"
+	got, err := BuildNK1(3, p)
+	if err != nil {
+		t.Fatalf("BuildNK1(%v, %v) failed with %v", 3, p, err)
+	}
+	if got != want {
+		t.Errorf("BuildNK1(%v, %v)=%v, want %v", 3, p, got, want)
+	}
+}
+
+func TestBuildNK1_noPatientIdentifiers(t *testing.T) {
+	p := NewContact("John", "Smiths", "020 7031 4000", &CodedElement{ID: "S", Text: "SPOUSE"})
+	p.MRN = "21124992125291505"
+	p.NHS = "3338933381"
+
+	got, err := BuildNK1(3, p)
+	if err != nil {
+		t.Fatalf("BuildNK1(%v, %v) failed with %v", 3, p, err)
+	}
+	for _, id := range []string{p.MRN, p.NHS} {
+		if strings.Contains(got, id) {
+			t.Errorf("BuildNK1(%v, %v)=%v, want no identifier %q", 3, p, got, id)
+		}
+	}
+}
+
 func TestBuildAL1(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -637,6 +2871,27 @@ func TestBuildAL1(t *testing.T) {
 			},
 			"AL1|2|MA|E^eggshell-containing liquid^ZAL^^|MI|Skin boils|",
 		},
+		{
+			"Multiple reactions",
+			&Allergy{
+				Type:        "FA",
+				Description: CodedElement{ID: "E", Text: "egg-containing compound", CodingSystem: "ZAL"},
+				Severity:    "MO",
+				Reactions:   []string{"Skin rash", "Swelling"},
+			},
+			"AL1|2|FA|E^egg-containing compound^ZAL^^|MO|Skin rash~Swelling|",
+		},
+		{
+			"Reactions take precedence over Reaction",
+			&Allergy{
+				Type:        "FA",
+				Description: CodedElement{ID: "E", Text: "egg-containing compound", CodingSystem: "ZAL"},
+				Severity:    "MO",
+				Reaction:    "Rash",
+				Reactions:   []string{"Skin rash", "Swelling"},
+			},
+			"AL1|2|FA|E^egg-containing compound^ZAL^^|MO|Skin rash~Swelling|",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -651,6 +2906,46 @@ func TestBuildAL1(t *testing.T) {
 	}
 }
 
+func TestBuildIAM(t *testing.T) {
+	tests := []struct {
+		name    string
+		allergy *Allergy
+		want    string
+	}{{
+		name: "Delete action code",
+		allergy: &Allergy{
+			Type:                   "FA",
+			Description:            CodedElement{ID: "E", Text: "egg-containing compound", CodingSystem: "ZAL"},
+			Severity:               "MO",
+			Reactions:              []string{"Skin rash", "Swelling"},
+			IdentificationDateTime: NewValidTime(time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)),
+			OnsetDateTime:          NewValidTime(time.Date(2018, 4, 20, 10, 0, 0, 0, time.UTC)),
+			ActionCode:             AllergyActionDelete,
+		},
+		want: "IAM|2|FA|E^egg-containing compound^ZAL^^|MO|Skin rash~Swelling|DE|||||20180420110000||20180428233844",
+	}, {
+		name: "Default action code",
+		allergy: &Allergy{
+			Type:        "DA",
+			Description: CodedElement{ID: "E", Text: "egg-containing drug", CodingSystem: "ZAL"},
+			Severity:    "SV",
+			Reaction:    "Rash",
+		},
+		want: "IAM|2|DA|E^egg-containing drug^ZAL^^|SV|Rash|AD|||||||",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildIAM(2, tc.allergy)
+			if err != nil {
+				t.Fatalf("BuildIAM(%v, %v) failed with %v", 2, tc.allergy, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildIAM(%v, %v)=%v, want %v", 2, tc.allergy, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestBuildNTE(t *testing.T) {
 	want := "NTE|2||Test note|"
 	got, err := BuildNTE(2, "Test note")
@@ -662,6 +2957,35 @@ func TestBuildNTE(t *testing.T) {
 	}
 }
 
+func TestBuildNTEWithType(t *testing.T) {
+	cases := []struct {
+		name        string
+		commentType *CodedElement
+		want        string
+	}{
+		{
+			name: "No Comment Type",
+			want: "NTE|2||Test note|",
+		}, {
+			name:        "With Comment Type",
+			commentType: &CodedElement{ID: "1R", Text: "Primary Reason", CodingSystem: "HL70364"},
+			want:        "NTE|2||Test note|1R^Primary Reason^HL70364^^",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildNTEWithType(2, "Test note", tc.commentType)
+			if err != nil {
+				t.Fatalf("BuildNTEWithType(%v, %v, %v) failed with %v", 2, "Test note", tc.commentType, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildNTEWithType(%v, %v, %v)=%v, want %v", 2, "Test note", tc.commentType, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestBuildMRG_OneMRN(t *testing.T) {
 	mrns := []string{"123"}
 
@@ -700,6 +3024,107 @@ func TestBuildDG1(t *testing.T) {
 	}
 }
 
+func TestBuildDG1_Priority(t *testing.T) {
+	diagnose := testDiagnosis()
+	diagnose.Priority = 1
+	want := "DG1|2|SNMCT|A01.0^Typhoid fever^^^|Typhoid fever|20170128152424|Admitting|||||||||1|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR"
+	got, err := BuildDG1(2, diagnose)
+	if err != nil {
+		t.Fatalf("BuildDG1(%v, %v) failed with %v", 2, diagnose, err)
+	}
+	if got != want {
+		t.Errorf("BuildDG1(%v, %v)=%v, want %v", 2, diagnose, got, want)
+	}
+}
+
+func TestBuildDG1_TypesAndClinicianDateTime(t *testing.T) {
+	tests := []struct {
+		name              string
+		diagnosisType     string
+		clinicianDateTime NullTime
+		want              string
+	}{{
+		name:              "Admitting",
+		diagnosisType:     DiagnosisTypeAdmitting,
+		clinicianDateTime: NewValidTime(time.Date(2017, 1, 28, 16, 10, 0, 0, time.UTC)),
+		want:              "DG1|1|SNMCT|A01.0^Typhoid fever^^^|Typhoid fever|20170128152424|A|||||||||0|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||20170128161000",
+	}, {
+		name:              "Final",
+		diagnosisType:     DiagnosisTypeFinal,
+		clinicianDateTime: NewValidTime(time.Date(2017, 2, 3, 9, 30, 0, 0, time.UTC)),
+		want:              "DG1|1|SNMCT|A01.0^Typhoid fever^^^|Typhoid fever|20170128152424|F|||||||||0|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||20170203093000",
+	}, {
+		name:              "No Clinician Date Time",
+		diagnosisType:     DiagnosisTypeWorking,
+		clinicianDateTime: NewInvalidTime(),
+		want:              "DG1|1|SNMCT|A01.0^Typhoid fever^^^|Typhoid fever|20170128152424|W|||||||||0|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			diagnose := testDiagnosis()
+			diagnose.Type = tc.diagnosisType
+			diagnose.ClinicianDateTime = tc.clinicianDateTime
+			got, err := BuildDG1(1, diagnose)
+			if err != nil {
+				t.Fatalf("BuildDG1(%v, %v) failed with %v", 1, diagnose, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildDG1(%v, %v)=%v, want %v", 1, diagnose, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildDRG(t *testing.T) {
+	drg := &DiagnosisRelatedGroup{
+		Code:             &CodedElement{ID: "470", Text: "Major joint replacement", CodingSystem: "MS-DRG"},
+		AssignedDateTime: NewValidTime(time.Date(2018, 1, 28, 22, 38, 14, 0, time.UTC)),
+	}
+	want := "DRG|470^Major joint replacement^MS-DRG^^|20180128223814"
+	got, err := BuildDRG(drg)
+	if err != nil {
+		t.Fatalf("BuildDRG(%v) failed with %v", drg, err)
+	}
+	if got != want {
+		t.Errorf("BuildDRG(%v)=%v, want %v", drg, got, want)
+	}
+}
+
+func TestBuildUpdatePatientA08_RankedDiagnosesAndDRG(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	primary := testDiagnosis()
+	primary.Priority = 1
+	secondary := testDiagnosis()
+	secondary.Description = &CodedElement{ID: "E11.9", Text: "Type 2 diabetes mellitus"}
+	secondary.Priority = 2
+	patientInfo := testPatientInfo()
+	patientInfo.Diagnoses = []*DiagnosisOrProcedure{primary, secondary}
+	patientInfo.DRG = &DiagnosisRelatedGroup{Code: &CodedElement{ID: "470", CodingSystem: "MS-DRG"}}
+	header := testHeader()
+
+	adt, err := BuildUpdatePatientADTA08(header, patientInfo, now, msgTime)
+	if err != nil {
+		t.Fatalf("BuildUpdatePatientADTA08(%v, %v, %v, %v) failed with %v", header, patientInfo, now, msgTime, err)
+	}
+
+	var got []string
+	for _, segment := range strings.Split(adt.Message, SegmentTerminator) {
+		if strings.HasPrefix(segment, "DG1|") || strings.HasPrefix(segment, "DRG|") {
+			got = append(got, segment)
+		}
+	}
+	want := []string{
+		"DG1|0|SNMCT|A01.0^Typhoid fever^^^|Typhoid fever|20170128152424|Admitting|||||||||1|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+		"DG1|1|SNMCT|E11.9^Type 2 diabetes mellitus^^^|Type 2 diabetes mellitus|20170128152424|Admitting|||||||||2|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+		"DRG|470^^MS-DRG^^|",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("BuildUpdatePatientADTA08(%v, %v, %v, %v) got DG1 and DRG segments diff (-want, +got):\n%s", header, patientInfo, now, msgTime, diff)
+	}
+}
+
 func TestBuildPR1(t *testing.T) {
 	procedure := testProcedure()
 	want := "PR1|2|SNMCT|A01.1^Hemispherectomy^^^|Hemispherectomy|20170129152424|A||||||216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||0||"
@@ -731,6 +3156,29 @@ func TestBuildTXA(t *testing.T) {
 	}
 }
 
+func TestBuildTXA_OriginatorAndAuthenticator(t *testing.T) {
+	d := document()
+	d.Originator = &Doctor{ID: "216865551019", Surname: "Osman", FirstName: "Arthur", Prefix: "Dr"}
+	d.Authenticator = &Doctor{ID: "743857BT34", Surname: "Davis", FirstName: "Olive"}
+	p := &PatientInfo{}
+
+	got, err := BuildTXA(p, d)
+	if err != nil {
+		t.Fatalf("BuildTXA(%v, %v) failed with %v", p, d, err)
+	}
+	want := "TXA|1|DS||20190615091340||||20191104081340|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR|||9298345CE5003|||||DO|||||743857BT34^Davis^Olive^^^^^^DRNBR^PRSNL^^^ORGDR|"
+	if got != want {
+		t.Errorf("BuildTXA(%v, %v) = %v, want %v", p, d, got, want)
+	}
+	fields := strings.Split(got, "|")
+	if got, want := fields[9], "216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR"; got != want {
+		t.Errorf("TXA.9 Originator = %v, want %v", got, want)
+	}
+	if got, want := fields[22], "743857BT34^Davis^Olive^^^^^^DRNBR^PRSNL^^^ORGDR"; got != want {
+		t.Errorf("TXA.22 Authentication Person = %v, want %v", got, want)
+	}
+}
+
 func TestBuildOBXForMDM(t *testing.T) {
 	observationIdentifier := &CodedElement{
 		ID:           "Established Patient 15",
@@ -748,15 +3196,34 @@ func TestBuildOBXForMDM(t *testing.T) {
 	}
 }
 
+func TestBuildOBXForMDMBinary(t *testing.T) {
+	observationIdentifier := &CodedElement{
+		ID:           "Scanned Document",
+		Text:         "Scanned Document",
+		CodingSystem: "Simulation",
+	}
+	content := []byte{0x25, 0x50, 0x44, 0x46, 0x00, 0xff, 0x7c, 0x5e}
+	want := "OBX|1|ED|Scanned Document^Scanned Document^Simulation^^|1|^^PDF^Base64^JVBERgD/fF4=||||||F||||||"
+	got, err := BuildOBXForMDMBinary(1, observationIdentifier, "PDF", content)
+	if err != nil {
+		t.Fatalf("BuildOBXForMDMBinary(%v, %v, %v, %v) failed with %v", 1, observationIdentifier, "PDF", content, err)
+	}
+	if got != want {
+		t.Errorf("BuildOBXForMDMBinary(%v, %v, %v, %v) = %v, want %v", 1, observationIdentifier, "PDF", content, got, want)
+	}
+}
+
 func TestPD1(t *testing.T) {
 	tests := []struct {
-		name            string
-		primaryFacility *PrimaryFacility
-		expected        string
+		name                string
+		primaryFacility     *PrimaryFacility
+		primaryCareProvider *Doctor
+		expected            string
 	}{
 		{
 			"Nil primary facility",
 			nil,
+			nil,
 			"PD1||||",
 		},
 		{
@@ -765,6 +3232,7 @@ func TestPD1(t *testing.T) {
 				Organization: "ORG",
 				ID:           "12345",
 			},
+			nil,
 			"PD1|||ORG^^12345|",
 		},
 		{
@@ -773,13 +3241,24 @@ func TestPD1(t *testing.T) {
 				Organization: "",
 				ID:           "",
 			},
+			nil,
 			"PD1|||^^|",
 		},
+		{
+			"Populated Primary Facility and Primary Care Provider",
+			&PrimaryFacility{
+				Organization: "ORG",
+				ID:           "12345",
+			},
+			testDoctor(),
+			"PD1|||ORG^^12345|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			patientInfo := testPatientInfo()
 			patientInfo.PrimaryFacility = test.primaryFacility
+			patientInfo.PrimaryCareProvider = test.primaryCareProvider
 
 			pd1, err := BuildPD1(patientInfo)
 			if err != nil {
@@ -792,6 +3271,60 @@ func TestPD1(t *testing.T) {
 	}
 }
 
+func TestOptions_OmitEmptyPD1(t *testing.T) {
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name                string
+		omit                bool
+		primaryFacility     *PrimaryFacility
+		primaryCareProvider *Doctor
+		wantPD1             bool
+	}{{
+		name:    "disabled, no data",
+		omit:    false,
+		wantPD1: true,
+	}, {
+		name:    "enabled, no data",
+		omit:    true,
+		wantPD1: false,
+	}, {
+		name:            "enabled, primary facility",
+		omit:            true,
+		primaryFacility: &PrimaryFacility{Organization: "ORG", ID: "12345"},
+		wantPD1:         true,
+	}, {
+		name:                "enabled, primary care provider",
+		omit:                true,
+		primaryCareProvider: testDoctor(),
+		wantPD1:             true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header.Options = &Options{OmitEmptyPD1: tc.omit}
+			patientInfo := testPatientInfo()
+			patientInfo.PrimaryFacility = tc.primaryFacility
+			patientInfo.PrimaryCareProvider = tc.primaryCareProvider
+
+			adt, err := BuildAdmissionADTA01(header, patientInfo, eventTime, msgTime)
+			if err != nil {
+				t.Fatalf("BuildAdmissionADTA01(%v, %v, %v, %v) failed with %v", header, patientInfo, eventTime, msgTime, err)
+			}
+			var gotPD1 bool
+			for _, segment := range strings.Split(adt.Message, SegmentTerminator) {
+				if strings.HasPrefix(segment, PD1) {
+					gotPD1 = true
+				}
+			}
+			if gotPD1 != tc.wantPD1 {
+				t.Errorf("BuildAdmissionADTA01(%v, %v, %v, %v) got PD1 segment: %t, want %t", header, patientInfo, eventTime, msgTime, gotPD1, tc.wantPD1)
+			}
+		})
+	}
+}
+
 func TestBuildPathologyORRO02(t *testing.T) {
 	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
@@ -1030,6 +3563,287 @@ func TestBuildTransferADTA02(t *testing.T) {
 	}
 }
 
+func TestBuildZBE(t *testing.T) {
+	begin := time.Date(2018, 1, 28, 22, 38, 14, 0, time.UTC)
+	end := time.Date(2018, 1, 29, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		m    *Movement
+		want string
+	}{{
+		name: "insert",
+		m:    &Movement{ID: "MOV123", Begin: NewValidTime(begin), Action: MovementActionInsert},
+		want: "ZBE|MOV123|20180128223814||INSERT",
+	}, {
+		name: "update with end",
+		m:    &Movement{ID: "MOV123", Begin: NewValidTime(begin), End: NewValidTime(end), Action: MovementActionUpdate},
+		want: "ZBE|MOV123|20180128223814|20180129100000|UPDATE",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildZBE(tc.m)
+			if err != nil {
+				t.Fatalf("BuildZBE(%+v) failed with %v", tc.m, err)
+			}
+			if got != tc.want {
+				t.Errorf("BuildZBE(%+v)=%v, want %v", tc.m, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildTransferADTA02_EventReason(t *testing.T) {
+	transferTime := time.Date(2018, 1, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 1, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+	patientInfo := testPatientInfo()
+	patientInfo.EventReason = "02"
+
+	adt, err := BuildTransferADTA02(header, patientInfo, transferTime, msgTime)
+	if err != nil {
+		t.Fatalf("BuildTransferADTA02(%v, %v, %v, %v) failed with %v", header, patientInfo, transferTime, msgTime, err)
+	}
+	segments := strings.Split(adt.Message, SegmentTerminator)
+	if len(segments) < 2 {
+		t.Fatalf("BuildTransferADTA02(%v, %v, %v, %v) got %d segments, want at least 2", header, patientInfo, transferTime, msgTime, len(segments))
+	}
+	evn := strings.Split(segments[1], "|")
+	if got, want := evn[4], "02"; got != want {
+		t.Errorf("BuildTransferADTA02(%v, %v, %v, %v) got EVN.4=%q, want %q", header, patientInfo, transferTime, msgTime, got, want)
+	}
+}
+
+func TestBuildTransferADTA02_Movement(t *testing.T) {
+	transferTime := time.Date(2018, 1, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 1, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name     string
+		movement *Movement
+		want     []string
+	}{{
+		name: "no movement",
+		want: []string{"MSH", "EVN", "PID", "PD1", "PV1"},
+	}, {
+		name:     "movement",
+		movement: &Movement{ID: "MOV123", Begin: NewValidTime(transferTime), Action: MovementActionInsert},
+		want:     []string{"MSH", "EVN", "PID", "PD1", "PV1", "ZBE|MOV123|20180128223814||INSERT"},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			patientInfo.Movement = tc.movement
+
+			adt, err := BuildTransferADTA02(header, patientInfo, transferTime, msgTime)
+			if err != nil {
+				t.Fatalf("BuildTransferADTA02(%v, %v, %v, %v) failed with %v", header, patientInfo, transferTime, msgTime, err)
+			}
+			segments := strings.Split(adt.Message, SegmentTerminator)
+			var got []string
+			for _, seg := range segments {
+				if strings.HasPrefix(seg, ZBE) {
+					got = append(got, seg)
+					continue
+				}
+				got = append(got, seg[:3])
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("BuildTransferADTA02(%v, %v, %v, %v) got segments diff (-want, +got):\n%s", header, patientInfo, transferTime, msgTime, diff)
+			}
+		})
+	}
+}
+
+func TestBuildTransferADTA02_Locations(t *testing.T) {
+	transferTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name    string
+		setup   func(p *PatientInfo)
+		wantErr bool
+	}{{
+		name:  "Different locations",
+		setup: func(p *PatientInfo) {},
+	}, {
+		name: "Same ward, different bed",
+		setup: func(p *PatientInfo) {
+			prior := *p.Location
+			prior.Bed = "Bed99"
+			p.PriorLocation = &prior
+		},
+	}, {
+		name: "Same facility, different site",
+		setup: func(p *PatientInfo) {
+			p.Location.FacilityHD = &HierarchicDesignator{NamespaceID: "RAL", UniversalID: "1.2.3"}
+			prior := *p.Location
+			prior.FacilityHD = &HierarchicDesignator{NamespaceID: "RAL", UniversalID: "1.2.4"}
+			p.PriorLocation = &prior
+		},
+	}, {
+		name: "No prior location",
+		setup: func(p *PatientInfo) {
+			p.PriorLocation = nil
+		},
+		wantErr: true,
+	}, {
+		name: "Same location",
+		setup: func(p *PatientInfo) {
+			prior := *p.Location
+			p.PriorLocation = &prior
+		},
+		wantErr: true,
+	}, {
+		name: "Same location with a copy of the facility",
+		setup: func(p *PatientInfo) {
+			p.Location.FacilityHD = &HierarchicDesignator{NamespaceID: "RAL", UniversalID: "1.2.3"}
+			prior := *p.Location
+			prior.FacilityHD = &HierarchicDesignator{NamespaceID: "RAL", UniversalID: "1.2.3"}
+			p.PriorLocation = &prior
+		},
+		wantErr: true,
+	}, {
+		name: "No location",
+		setup: func(p *PatientInfo) {
+			p.Location = nil
+		},
+		wantErr: true,
+	}, {
+		name: "No location for a dead patient",
+		setup: func(p *PatientInfo) {
+			p.Person.DateOfDeath = NewValidTime(transferTime)
+			p.Location = nil
+		},
+		wantErr: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			tc.setup(patientInfo)
+			_, err := BuildTransferADTA02(header, patientInfo, transferTime, msgTime)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("BuildTransferADTA02(%v, %v, %v, %v) got err %v, want err? %t", header, patientInfo, transferTime, msgTime, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildIncompleteTransferADTA02(t *testing.T) {
+	transferTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name  string
+		setup func(p *PatientInfo)
+	}{{
+		name: "No prior location",
+		setup: func(p *PatientInfo) {
+			p.PriorLocation = nil
+		},
+	}, {
+		name: "No location for a dead patient",
+		setup: func(p *PatientInfo) {
+			p.Person.DateOfDeath = NewValidTime(transferTime)
+			p.Location = nil
+		},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			tc.setup(patientInfo)
+			adt, err := BuildIncompleteTransferADTA02(header, patientInfo, transferTime, msgTime)
+			if err != nil {
+				t.Fatalf("BuildIncompleteTransferADTA02(%v, %v, %v, %v) failed with %v", header, patientInfo, transferTime, msgTime, err)
+			}
+			if got, want := adt.Type.TriggerEvent, "A02"; got != want {
+				t.Errorf("BuildIncompleteTransferADTA02(%v, %v, %v, %v).Type.TriggerEvent=%q, want %q", header, patientInfo, transferTime, msgTime, got, want)
+			}
+		})
+	}
+}
+
+func TestBuildTemporaryTransferADTA02(t *testing.T) {
+	transferTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+	patientInfo := testPatientInfo()
+	patientInfo.PriorLocation = nil
+	patientInfo.TemporaryLocation = &PatientLocation{Poc: "X-RAY"}
+
+	adt, err := BuildTemporaryTransferADTA02(header, patientInfo, transferTime, msgTime)
+	if err != nil {
+		t.Fatalf("BuildTemporaryTransferADTA02(%v, %v, %v, %v) failed with %v", header, patientInfo, transferTime, msgTime, err)
+	}
+	permanent, err := BuildPV1(testPatientInfo())
+	if err != nil {
+		t.Fatalf("BuildPV1(%v) failed with %v", testPatientInfo(), err)
+	}
+	var pv1 []string
+	for _, segment := range strings.Split(adt.Message, SegmentTerminator) {
+		if strings.HasPrefix(segment, PV1) {
+			pv1 = strings.Split(segment, "|")
+		}
+	}
+	if pv1 == nil {
+		t.Fatalf("BuildTemporaryTransferADTA02(%v, %v, %v, %v) got no PV1 segment", header, patientInfo, transferTime, msgTime)
+	}
+	if got, want := pv1[3], strings.Split(permanent, "|")[3]; got != want {
+		t.Errorf("BuildTemporaryTransferADTA02(%v, %v, %v, %v) got PV1.3=%q, want the unchanged location %q", header, patientInfo, transferTime, msgTime, got, want)
+	}
+	if got, want := pv1[11], "X-RAY"; !strings.HasPrefix(got, want) {
+		t.Errorf("BuildTemporaryTransferADTA02(%v, %v, %v, %v) got PV1.11=%q, want prefix %q", header, patientInfo, transferTime, msgTime, got, want)
+	}
+}
+
+func TestBuildTemporaryTransferADTA02_Locations(t *testing.T) {
+	transferTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name    string
+		setup   func(p *PatientInfo)
+		wantErr bool
+	}{{
+		name:  "New temporary location",
+		setup: func(p *PatientInfo) { p.TemporaryLocation = &PatientLocation{Poc: "X-RAY"} },
+	}, {
+		name: "Different temporary locations",
+		setup: func(p *PatientInfo) {
+			p.PriorTemporaryLocation = &PatientLocation{Poc: "CT"}
+			p.TemporaryLocation = &PatientLocation{Poc: "X-RAY"}
+		},
+	}, {
+		name: "Same temporary location",
+		setup: func(p *PatientInfo) {
+			p.PriorTemporaryLocation = &PatientLocation{Poc: "X-RAY"}
+			p.TemporaryLocation = &PatientLocation{Poc: "X-RAY"}
+		},
+		wantErr: true,
+	}, {
+		name:    "No temporary location",
+		setup:   func(p *PatientInfo) { p.TemporaryLocation = nil },
+		wantErr: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			tc.setup(patientInfo)
+			_, err := BuildTemporaryTransferADTA02(header, patientInfo, transferTime, msgTime)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("BuildTemporaryTransferADTA02(%v, %v, %v, %v) got err %v, want err? %t", header, patientInfo, transferTime, msgTime, err, tc.wantErr)
+			}
+		})
+	}
+}
+
 func TestBuildDischargeADTA03(t *testing.T) {
 	dischargeTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
@@ -1576,6 +4390,51 @@ func TestBuildCancelDischargeADTA13(t *testing.T) {
 	}
 }
 
+func TestBuildCancelDischargeADTA13_CancellationReason(t *testing.T) {
+	cancelDischargeTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name    string
+		reason  string
+		wantNTE string
+	}{{
+		name:    "No reason",
+		reason:  "",
+		wantNTE: "",
+	}, {
+		name:    "Reason",
+		reason:  "Discharged in error",
+		wantNTE: "NTE|1||Discharged in error|",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			patientInfo.CancellationReason = tc.reason
+
+			adt, err := BuildCancelDischargeADTA13(header, patientInfo, cancelDischargeTime, msgTime)
+			if err != nil {
+				t.Fatalf("BuildCancelDischargeADTA13(%v, %v, %v, %v) failed with %v", header, patientInfo, cancelDischargeTime, msgTime, err)
+			}
+			segments := strings.Split(adt.Message, SegmentTerminator)
+			var gotNTE string
+			for _, s := range segments {
+				if strings.HasPrefix(s, "NTE|") {
+					gotNTE = s
+				}
+			}
+			if gotNTE != tc.wantNTE {
+				t.Errorf("BuildCancelDischargeADTA13(%v, %v, %v, %v) got NTE segment %q, want %q", header, patientInfo, cancelDischargeTime, msgTime, gotNTE, tc.wantNTE)
+			}
+			if tc.wantNTE != "" && segments[len(segments)-1] != tc.wantNTE {
+				t.Errorf("BuildCancelDischargeADTA13(%v, %v, %v, %v) got last segment %q, want the NTE segment %q", header, patientInfo, cancelDischargeTime, msgTime, segments[len(segments)-1], tc.wantNTE)
+			}
+		})
+	}
+}
+
 func TestBuildPendingAdmissionA14(t *testing.T) {
 	pendingAdmissionTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
@@ -1744,6 +4603,45 @@ func TestBuildPreAdmitA05(t *testing.T) {
 	}
 }
 
+func TestBuildPreAdmitA05_AdmitReason(t *testing.T) {
+	preAdmitTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	patientInfo.AdmitReason = &CodedElement{ID: "HIP", Text: "Elective hip replacement", CodingSystem: "LOCAL"}
+	header := testHeader()
+
+	adt, err := BuildPreAdmitADTA05(header, patientInfo, preAdmitTime, msgTime)
+	if err != nil {
+		t.Fatalf("BuildPreAdmitADTA05(%v, %v, %v, %v) failed with %v", header, patientInfo, preAdmitTime, msgTime, err)
+	}
+	mo := hl7.NewParseMessageOptions()
+	mo.TimezoneLoc = time.UTC
+	m, err := hl7.ParseMessageWithOptions([]byte(adt.Message), mo)
+	if err != nil {
+		t.Fatalf("ParseMessageWithOptions(%v, %v) failed with %v", adt.Message, mo, err)
+	}
+
+	pv2, err := m.PV2()
+	if err != nil {
+		t.Fatalf("PV2() failed with %v", err)
+	}
+	if pv2 == nil {
+		t.Fatal("PV2() got nil PV2 segment, want non nil")
+	}
+	if pv2.AdmitReason == nil {
+		t.Fatal("pv2.AdmitReason is <nil>, want non nil")
+	}
+	if got, want := pv2.AdmitReason.Identifier.String(), "HIP"; got != want {
+		t.Errorf("pv2.AdmitReason.Identifier.String()=%v, want %v", got, want)
+	}
+	if got, want := pv2.AdmitReason.Text.String(), "Elective hip replacement"; got != want {
+		t.Errorf("pv2.AdmitReason.Text.String()=%v, want %v", got, want)
+	}
+	if got, want := pv2.ExpectedAdmitDateTime.Time, patientInfo.ExpectedAdmitDateTime.Time; !got.Equal(want) {
+		t.Errorf("pv2.ExpectedAdmitDateTime.Time=%v, want %v", got, want)
+	}
+}
+
 func TestBuildPendingDischargeA16(t *testing.T) {
 	pendingDischargeTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
@@ -2553,6 +5451,382 @@ func TestBuildUpdatePersonADTA31(t *testing.T) {
 	}
 }
 
+func TestBuildPersonLifecycle(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	header := testHeader()
+	header.ControlIDGenerator = &sequentialControlIDGenerator{}
+
+	msgs, err := BuildPersonLifecycle(header, patientInfo, now, msgTime)
+	if err != nil {
+		t.Fatalf("BuildPersonLifecycle(%v, %v, %v, %v) failed with %v", header, patientInfo, now, msgTime, err)
+	}
+	if got, want := len(msgs), 2; got != want {
+		t.Fatalf("len(BuildPersonLifecycle(%v, %v, %v, %v))=%d, want %d", header, patientInfo, now, msgTime, got, want)
+	}
+
+	mo := hl7.NewParseMessageOptions()
+	mo.TimezoneLoc = time.UTC
+	wantTriggerEvents := []string{"A28", "A31"}
+	wantControlIDs := []string{"1", "2"}
+	var pids []*hl7.PID
+	for i, msg := range msgs {
+		m, err := hl7.ParseMessageWithOptions([]byte(msg.Message), mo)
+		if err != nil {
+			t.Fatalf("ParseMessageWithOptions(%v, %v) failed with %v", msg.Message, mo, err)
+		}
+		msh, err := m.MSH()
+		if err != nil {
+			t.Fatalf("MSH() failed with %v", err)
+		}
+		if got, want := msh.MessageType.TriggerEvent.String(), wantTriggerEvents[i]; got != want {
+			t.Errorf("msh.MessageType.TriggerEvent.String()=%v, want %v", got, want)
+		}
+		if got, want := msh.MessageControlID.String(), wantControlIDs[i]; got != want {
+			t.Errorf("msh.MessageControlID.String()=%v, want %v", got, want)
+		}
+		pid, err := m.PID()
+		if err != nil {
+			t.Fatalf("PID() failed with %v", err)
+		}
+		pids = append(pids, pid)
+	}
+	if diff := cmp.Diff(pids[0], pids[1]); diff != "" {
+		t.Errorf("ADT^A28 and ADT^A31 got PID diff (-A28, +A31):\n%s", diff)
+	}
+	if got, want := header.MessageControlID, testHeader().MessageControlID; got != want {
+		t.Errorf("header.MessageControlID=%q, want %q; the header must not be modified", got, want)
+	}
+}
+
+func TestBuildUpdatePersonADTA31WithIAM(t *testing.T) {
+	now := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	patientInfo.Allergies[0].ActionCode = AllergyActionDelete
+	header := testHeader()
+
+	adt, err := BuildUpdatePersonADTA31WithIAM(header, patientInfo, now, msgTime)
+	if err != nil {
+		t.Fatalf("BuildUpdatePersonADTA31WithIAM(%v, %v, %v, %v) failed with %v", header, patientInfo, now, msgTime, err)
+	}
+	mo := hl7.NewParseMessageOptions()
+	mo.TimezoneLoc = time.UTC
+	m, err := hl7.ParseMessageWithOptions([]byte(adt.Message), mo)
+	if err != nil {
+		t.Fatalf("ParseMessageWithOptions(%v, %v) failed with %v", adt.Message, mo, err)
+	}
+
+	al1, err := m.AL1()
+	if err != nil {
+		t.Fatalf("AL1() failed with %v", err)
+	}
+	if al1 != nil {
+		t.Errorf("AL1() got %v, want nil", al1)
+	}
+	iam, err := m.IAM()
+	if err != nil {
+		t.Fatalf("IAM() failed with %v", err)
+	}
+	if iam == nil {
+		t.Fatal("IAM() got nil IAM segment, want non nil")
+	}
+	if got, want := iam.AllergyActionCode.Identifier.String(), AllergyActionDelete; got != want {
+		t.Errorf("iam.AllergyActionCode.Identifier.String()=%v, want %v", got, want)
+	}
+}
+
+func TestBuildResultORUR01Multi(t *testing.T) {
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	patientInfo := testPatientInfo()
+	header := testHeader()
+	first := testOrderWithResult(eventTime)
+	second := testOrderWithResult(eventTime)
+	second.Placer = "9984059"
+	second.Results = second.Results[:1]
+	orders := []*Order{first, second}
+
+	msg, err := BuildResultORUR01Multi(header, patientInfo, orders, msgTime)
+	if err != nil {
+		t.Fatalf("BuildResultORUR01Multi(%v, %v, %v, %v) failed with %v", header, patientInfo, orders, msgTime, err)
+	}
+
+	// Segment name and SetID (or Placer for ORC) of each segment, skipping NTEs.
+	var got []string
+	for _, segment := range strings.Split(msg.Message, SegmentTerminator) {
+		fields := strings.Split(segment, "|")
+		switch fields[0] {
+		case MSH, PID, PV1:
+			got = append(got, fields[0])
+		case ORC:
+			got = append(got, fields[0]+" "+fields[2])
+		case OBR, OBX:
+			got = append(got, fields[0]+" "+fields[1])
+		}
+	}
+	want := []string{MSH, PID, PV1, "ORC 9984058", "OBR 1", "OBX 1", "OBX 2", "ORC 9984059", "OBR 2", "OBX 1"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("BuildResultORUR01Multi(%v, %v, %v, %v) got segments diff (-want, +got):\n%s", header, patientInfo, orders, msgTime, diff)
+	}
+	if got, want := msg.Type.String(), "ORU^R01"; got != want {
+		t.Errorf("BuildResultORUR01Multi(%v, %v, %v, %v).Type=%v, want %v", header, patientInfo, orders, msgTime, got, want)
+	}
+}
+
+func TestBuildResultORUR01Multi_NoOrders(t *testing.T) {
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	if _, err := BuildResultORUR01Multi(testHeader(), testPatientInfo(), nil, msgTime); err == nil {
+		t.Error("BuildResultORUR01Multi() with no orders got nil error, want error")
+	}
+}
+
+func TestBuildResultORU_TriggerEvent(t *testing.T) {
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		completeStatuses []string
+		resultsStatus    string
+		want             string
+	}{
+		{name: "final", resultsStatus: "F", want: "ORU^R01"},
+		{name: "corrected", resultsStatus: "C", want: "ORU^R01"},
+		{name: "preliminary", resultsStatus: "P", want: "ORU^R03"},
+		{name: "some results available", resultsStatus: "A", want: "ORU^R03"},
+		{name: "no results available", resultsStatus: "I", want: "ORU^R03"},
+		{name: "not yet verified", resultsStatus: "R", want: "ORU^R03"},
+		{name: "no status", resultsStatus: "", want: "ORU^R01"},
+		{name: "configured final", completeStatuses: []string{"FINAL", "CORRECTED"}, resultsStatus: "FINAL", want: "ORU^R01"},
+		{name: "configured corrected", completeStatuses: []string{"FINAL", "CORRECTED"}, resultsStatus: "CORRECTED", want: "ORU^R01"},
+		{name: "default final not configured", completeStatuses: []string{"FINAL", "CORRECTED"}, resultsStatus: "F", want: "ORU^R03"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			completeStatuses := tc.completeStatuses
+			if completeStatuses == nil {
+				completeStatuses = []string{"F", "C"}
+			}
+			patientInfo := testPatientInfo()
+			header := testHeader()
+			o := testOrderWithResult(eventTime)
+			o.ResultsStatus = tc.resultsStatus
+
+			msg, err := BuildResultORU(header, patientInfo, o, msgTime, completeStatuses)
+			if err != nil {
+				t.Fatalf("BuildResultORU(%v, %v, %v, %v, %v) failed with %v", header, patientInfo, o, msgTime, completeStatuses, err)
+			}
+			if got := msg.Type.String(); got != tc.want {
+				t.Errorf("BuildResultORU(%v, %v, %v, %v, %v).Type=%v, want %v", header, patientInfo, o, msgTime, completeStatuses, got, tc.want)
+			}
+			if !strings.Contains(msg.Message, "|"+tc.want+"|") {
+				t.Errorf("BuildResultORU(%v, %v, %v, %v, %v) got message %q, want MSH message type %v", header, patientInfo, o, msgTime, completeStatuses, msg.Message, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildPRT(t *testing.T) {
+	p := &Participation{
+		Type:     ParticipationAttendingProvider,
+		Provider: testDoctor(),
+		Begin:    NewValidTime(time.Date(2018, 1, 26, 15, 24, 21, 0, time.UTC)),
+	}
+	want := "PRT|1|UC||AT^^HL70912|216865551019^Osman^Arthur^^^Dr^^^DRNBR^PRSNL^^^ORGDR||||||20180126152421|"
+	got, err := BuildPRT(1, p)
+	if err != nil {
+		t.Fatalf("BuildPRT(%d, %+v) failed with %v", 1, p, err)
+	}
+	if got != want {
+		t.Errorf("BuildPRT(%d, %+v)=%v, want %v", 1, p, got, want)
+	}
+}
+
+func TestOptions_ParticipationSegments(t *testing.T) {
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+	header.Options = &Options{ParticipationSegments: true}
+	patientInfo := testPatientInfo()
+	order := testOrderWithResult(eventTime)
+	order.OrderingProvider = testDoctor()
+
+	// fields returns the name of each segment of the message, followed by the given field for
+	// the segments that have it.
+	fields := func(msg *HL7Message, field map[string]int) []string {
+		var got []string
+		for _, segment := range strings.Split(msg.Message, SegmentTerminator) {
+			f := strings.Split(segment, "|")
+			if i, ok := field[f[0]]; ok {
+				got = append(got, f[0]+" "+f[i])
+			}
+		}
+		return got
+	}
+
+	adt, err := BuildAdmissionADTA01(header, patientInfo, eventTime, msgTime)
+	if err != nil {
+		t.Fatalf("BuildAdmissionADTA01(%v, %v, %v, %v) failed with %v", header, patientInfo, eventTime, msgTime, err)
+	}
+	// PV1.7 is the Attending Doctor, PRT.4 is the Participation.
+	want := []string{"PV1 ", "PRT AT^^HL70912"}
+	if diff := cmp.Diff(want, fields(adt, map[string]int{PV1: 7, PRT: 4})); diff != "" {
+		t.Errorf("BuildAdmissionADTA01(%v, %v, %v, %v) diff (-want, +got):\n%s", header, patientInfo, eventTime, msgTime, diff)
+	}
+
+	oru, err := BuildResultORUR01(header, patientInfo, order, msgTime)
+	if err != nil {
+		t.Fatalf("BuildResultORUR01(%v, %v, %v, %v) failed with %v", header, patientInfo, order, msgTime, err)
+	}
+	// OBR.16 is the Ordering Provider, PRT.4 is the Participation.
+	want = []string{"PRT AT^^HL70912", "OBR ", "PRT OP^^HL70912"}
+	if diff := cmp.Diff(want, fields(oru, map[string]int{OBR: 16, PRT: 4})); diff != "" {
+		t.Errorf("BuildResultORUR01(%v, %v, %v, %v) diff (-want, +got):\n%s", header, patientInfo, order, msgTime, diff)
+	}
+}
+
+func TestBuildPatientQueryQBPQ22(t *testing.T) {
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+	header.MessageControlID = "123"
+
+	tests := []struct {
+		name    string
+		params  *QueryParams
+		wantQPD string
+		wantRCP string
+	}{{
+		name: "all search fields",
+		params: &QueryParams{
+			QueryTag:      "query-1",
+			MRN:           "MRN-1",
+			FirstName:     "Elisa",
+			Surname:       "O^Brien",
+			Birth:         NewValidTime(time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)),
+			Gender:        GenderFemale,
+			QuantityLimit: 10,
+		},
+		wantQPD: "QPD|Q22^Find Candidates^HL70471|query-1|@PID.3.1^MRN-1~@PID.5.1^O\\S\\Brien~@PID.5.2^Elisa~@PID.7^19800101000000~@PID.8^F",
+		wantRCP: "RCP|I|10^RD",
+	}, {
+		name:    "default query tag and no limit",
+		params:  &QueryParams{Surname: "Smith"},
+		wantQPD: "QPD|Q22^Find Candidates^HL70471|123|@PID.5.1^Smith",
+		wantRCP: "RCP|I|",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := BuildPatientQueryQBPQ22(header, tc.params, msgTime)
+			if err != nil {
+				t.Fatalf("BuildPatientQueryQBPQ22(%v, %v, %v) failed with %v", header, tc.params, msgTime, err)
+			}
+			segments := strings.Split(msg.Message, SegmentTerminator)
+			if got, want := len(segments), 3; got != want {
+				t.Fatalf("BuildPatientQueryQBPQ22(%v, %v, %v) got %d segments, want %d", header, tc.params, msgTime, got, want)
+			}
+			if got, want := segments[0], "MSH|^~\\&|CERNER|RAL1|STREAMS|RAL|20180428233944||QBP^Q22|123|T|2.3|||AL||44|ASCII"; got != want {
+				t.Errorf("BuildPatientQueryQBPQ22(%v, %v, %v) MSH=%v, want %v", header, tc.params, msgTime, got, want)
+			}
+			if got := segments[1]; got != tc.wantQPD {
+				t.Errorf("BuildPatientQueryQBPQ22(%v, %v, %v) QPD=%v, want %v", header, tc.params, msgTime, got, tc.wantQPD)
+			}
+			if got := segments[2]; got != tc.wantRCP {
+				t.Errorf("BuildPatientQueryQBPQ22(%v, %v, %v) RCP=%v, want %v", header, tc.params, msgTime, got, tc.wantRCP)
+			}
+		})
+	}
+}
+
+func TestBuildPatientQueryQRYA19(t *testing.T) {
+	msgTime := time.Date(2018, 1, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+	header.MessageControlID = "123"
+
+	tests := []struct {
+		name    string
+		params  *QueryParams
+		wantQRD string
+	}{{
+		name:    "query tag and limit",
+		params:  &QueryParams{QueryTag: "query-1", MRN: "MRN-1", Surname: "Smith", QuantityLimit: 1},
+		wantQRD: "QRD|20180128223944|R|I|query-1|||1^RD|MRN-1|DEM",
+	}, {
+		name:    "default query ID and no limit",
+		params:  &QueryParams{MRN: "MRN^1"},
+		wantQRD: "QRD|20180128223944|R|I|123||||MRN\\S\\1|DEM",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := BuildPatientQueryQRYA19(header, tc.params, msgTime)
+			if err != nil {
+				t.Fatalf("BuildPatientQueryQRYA19(%v, %v, %v) failed with %v", header, tc.params, msgTime, err)
+			}
+			segments := strings.Split(msg.Message, SegmentTerminator)
+			if got, want := len(segments), 2; got != want {
+				t.Fatalf("BuildPatientQueryQRYA19(%v, %v, %v) got %d segments, want %d", header, tc.params, msgTime, got, want)
+			}
+			if got, want := strings.Split(segments[0], "|")[8], "QRY^A19"; got != want {
+				t.Errorf("BuildPatientQueryQRYA19(%v, %v, %v) MSH.9=%v, want %v", header, tc.params, msgTime, got, want)
+			}
+			if got := segments[1]; got != tc.wantQRD {
+				t.Errorf("BuildPatientQueryQRYA19(%v, %v, %v) QRD=%v, want %v", header, tc.params, msgTime, got, tc.wantQRD)
+			}
+		})
+	}
+}
+
+func TestBuildPatientQuery_NoMessageControlID(t *testing.T) {
+	msgTime := time.Date(2018, 1, 28, 22, 39, 44, 0, time.UTC)
+	params := &QueryParams{MRN: "MRN-1"}
+
+	tests := []struct {
+		name string
+		// build builds the query message.
+		build func(*HeaderInfo, *QueryParams, time.Time) (*HL7Message, error)
+		// queryIDField is the index of the query tag or query ID in the second segment.
+		queryIDField int
+	}{
+		{name: "QBP^Q22", build: BuildPatientQueryQBPQ22, queryIDField: 2},
+		{name: "QRY^A19", build: BuildPatientQueryQRYA19, queryIDField: 4},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeader()
+			header.MessageControlID = ""
+			header.ControlIDGenerator = &sequentialControlIDGenerator{}
+			msg, err := tc.build(header, params, msgTime)
+			if err != nil {
+				t.Fatalf("Build %s (%v, %v, %v) failed with %v", tc.name, header, params, msgTime, err)
+			}
+			segments := strings.Split(msg.Message, SegmentTerminator)
+			controlID := strings.Split(segments[0], "|")[9]
+			if controlID == "" {
+				t.Errorf("Build %s (%v, %v, %v) MSH.10 is empty, want a generated ID", tc.name, header, params, msgTime)
+			}
+			if got := strings.Split(segments[1], "|")[tc.queryIDField]; got != controlID {
+				t.Errorf("Build %s (%v, %v, %v) query ID=%q, want the Message Control ID %q", tc.name, header, params, msgTime, got, controlID)
+			}
+			if header.MessageControlID != "" {
+				t.Errorf("Build %s modified the header: MessageControlID=%q, want empty", tc.name, header.MessageControlID)
+			}
+		})
+	}
+}
+
+func TestBuildPatientQueryQRYA19_NoMRN(t *testing.T) {
+	msgTime := time.Date(2018, 1, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+	params := &QueryParams{Surname: "Smith"}
+	if got, err := BuildPatientQueryQRYA19(header, params, msgTime); err == nil {
+		t.Errorf("BuildPatientQueryQRYA19(%v, %v, %v)=%v, <nil>, want error", header, params, msgTime, got)
+	}
+}
+
 func TestBuildResultORU(t *testing.T) {
 	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
@@ -2865,13 +6139,79 @@ func TestBuildOrderORMO01(t *testing.T) {
 	}
 }
 
+func TestBuildCancelAndDiscontinueOrderORMO01(t *testing.T) {
+	eventTime := time.Date(2018, 4, 28, 22, 38, 44, 0, time.UTC)
+	msgTime := time.Date(2018, 4, 28, 22, 39, 44, 0, time.UTC)
+	header := testHeader()
+
+	tests := []struct {
+		name             string
+		build            func(*HeaderInfo, *PatientInfo, *Order, time.Time) (*HL7Message, error)
+		wantOrderControl string
+	}{
+		{name: "Cancel", build: BuildCancelOrderORMO01, wantOrderControl: "CA"},
+		{name: "Discontinue", build: BuildDiscontinueOrderORMO01, wantOrderControl: "DC"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			patientInfo := testPatientInfo()
+			order := testOrder(eventTime)
+
+			orm, err := tc.build(header, patientInfo, order, msgTime)
+			if err != nil {
+				t.Fatalf("%s(%v, %v, %v, %v) failed with %v", tc.name, header, patientInfo, order, msgTime, err)
+			}
+			mo := hl7.NewParseMessageOptions()
+			mo.TimezoneLoc = time.UTC
+			m, err := hl7.ParseMessageWithOptions([]byte(orm.Message), mo)
+			if err != nil {
+				t.Fatalf("ParseMessageWithOptions(%v, %v) failed with %v", orm.Message, mo, err)
+			}
+			orc, err := m.ORC()
+			if err != nil {
+				t.Fatalf("ORC() failed with %v", err)
+			}
+			if orc == nil {
+				t.Fatal("ORC() got nil ORC segment, want non nil")
+			}
+			if got, want := orc.OrderControl.String(), tc.wantOrderControl; got != want {
+				t.Errorf("orc.OrderControl.String()=%v, want %v", got, want)
+			}
+			if got, want := orc.PlacerOrderNumber.EntityIdentifier.String(), order.Placer; got != want {
+				t.Errorf("orc.PlacerOrderNumber.EntityIdentifier.String()=%v, want %v", got, want)
+			}
+			if got, want := orc.FillerOrderNumber.EntityIdentifier.String(), order.Filler; got != want {
+				t.Errorf("orc.FillerOrderNumber.EntityIdentifier.String()=%v, want %v", got, want)
+			}
+			if got, want := order.OrderControl, "RE"; got != want {
+				t.Errorf("order.OrderControl=%v, want %v; the original order should not be modified", got, want)
+			}
+
+			missingFiller := testOrder(eventTime)
+			missingFiller.Filler = ""
+			if _, err := tc.build(header, patientInfo, missingFiller, msgTime); err == nil {
+				t.Errorf("%s(%v, %v, %v, %v) got nil error for an order without filler number, want error", tc.name, header, patientInfo, missingFiller, msgTime)
+			}
+
+			missingPlacer := testOrder(eventTime)
+			missingPlacer.Placer = ""
+			if _, err := tc.build(header, patientInfo, missingPlacer, msgTime); err == nil {
+				t.Errorf("%s(%v, %v, %v, %v) got nil error for an order without placer number, want error", tc.name, header, patientInfo, missingPlacer, msgTime)
+			}
+		})
+	}
+}
+
 func TestBuildBedSwapADTA17(t *testing.T) {
 	mergeTime := time.Date(2018, 4, 28, 22, 38, 14, 0, time.UTC)
 	msgTime := time.Date(2018, 4, 28, 22, 39, 14, 0, time.UTC)
 	patientInfo := testPatientInfo()
 	patientInfo.Location.Poc = "onc-poc"
+	patientInfo.PrimaryFacility = &PrimaryFacility{Organization: "ORG-1", ID: "1"}
 	otherPatientInfo := testPatientInfo()
 	otherPatientInfo.Location.Poc = "another-poc"
+	otherPatientInfo.PrimaryFacility = &PrimaryFacility{Organization: "ORG-2", ID: "2"}
 	header := testHeader()
 
 	adt, err := BuildBedSwapADTA17(header, patientInfo, mergeTime, msgTime, otherPatientInfo)
@@ -2924,6 +6264,11 @@ func TestBuildBedSwapADTA17(t *testing.T) {
 	if got, want := len(pids), 2; got != want {
 		t.Fatalf("len(pids)=%v, want %v", got, want)
 	}
+	for i, pid := range pids {
+		if got, want := pid.SetIDPID.Value, uint64(i+1); got != want {
+			t.Errorf("pids[%d].SetIDPID.Value=%v, want %v", i, got, want)
+		}
+	}
 
 	pv1s, err := m.AllPV1()
 	if err != nil {
@@ -2935,6 +6280,19 @@ func TestBuildBedSwapADTA17(t *testing.T) {
 	if diff := cmp.Diff(pv1s[0].AssignedPatientLocation, pv1s[1].AssignedPatientLocation); diff == "" {
 		t.Error("PV1.AssignedPatientLocation returned no diff between the two PV1 segments; want diff")
 	}
+
+	pd1s, err := m.AllPD1()
+	if err != nil {
+		t.Fatalf("AllPD1() failed with %v", err)
+	}
+	if got, want := len(pd1s), 2; got != want {
+		t.Fatalf("len(pd1s)=%v, want %v", got, want)
+	}
+	for i, want := range []string{"ORG-1", "ORG-2"} {
+		if got := pd1s[i].PatientPrimaryFacility[0].OrganizationName.String(); got != want {
+			t.Errorf("pd1s[%d].PatientPrimaryFacility[0].OrganizationName.String()=%v, want %v", i, got, want)
+		}
+	}
 }
 
 func TestBuildMergeADTA34(t *testing.T) {
@@ -3363,6 +6721,21 @@ func testDoctor() *Doctor {
 	}
 }
 
+func tsPrecision(p hl7.TSPrecision) *hl7.TSPrecision {
+	return &p
+}
+
+// sequentialControlIDGenerator is a ControlIDGenerator that generates incremental integer IDs
+// starting with 1.
+type sequentialControlIDGenerator struct {
+	nextID int
+}
+
+func (g *sequentialControlIDGenerator) NewMessageControlID() string {
+	g.nextID++
+	return strconv.Itoa(g.nextID)
+}
+
 func testHeader() *HeaderInfo {
 	return &HeaderInfo{
 		SendingApplication:   "CERNER",
@@ -18,13 +18,14 @@ package orderprofile
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"sort"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/message"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // OrderProfiles contains Order Profile information.
@@ -84,6 +85,8 @@ func New(m map[string]*OrderProfile) *OrderProfiles {
 	for k := range m {
 		keys = append(keys, k)
 	}
+	// Sort the names so that picking a random order profile only depends on the source of randomness.
+	sort.Strings(keys)
 
 	return &OrderProfiles{
 		op:    m,
@@ -104,7 +107,7 @@ func (op *OrderProfiles) Get(name string) (*OrderProfile, bool) {
 // Otherwise, returns CodedElement with ID and Text equal to given name.
 func (op *OrderProfiles) Generate(name string) *message.CodedElement {
 	if name == constants.RandomString {
-		name = op.names[rand.Intn(len(op.names))]
+		name = op.names[random.Intn(len(op.names))]
 	}
 	if v, ok := op.op[name]; ok {
 		return &v.UniversalService
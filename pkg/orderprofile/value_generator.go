@@ -16,11 +16,12 @@ package orderprofile
 
 import (
 	"fmt"
-	"math/rand"
+	"math"
 	"regexp"
 
 	"github.com/pkg/errors"
 	"github.com/google/simhospital/pkg/constants"
+	"github.com/google/simhospital/pkg/random"
 )
 
 const valueFormat = "%.2f"
@@ -242,11 +243,41 @@ func (g *ValueGenerator) AbnormalHigh() (string, error) {
 	return randomFromRange(from, to)
 }
 
+// PercentOfRange returns the value that lies pct percent of the way between the start and the end
+// of the range, formatted as string, ie: from + pct/100 x (to - from).
+// The value is deterministic given the range, and it is clamped to the range after formatting.
+// Returns an error in any of the following situations:
+// - the receiver is nil
+// - either the start or the end of the range is open
+// - pct is not within [0, 100]
+func (g *ValueGenerator) PercentOfRange(pct float64) (string, error) {
+	if g == nil {
+		return "", errors.New("cannot generate percent of range value for nil ValueGenerator")
+	}
+	if !g.from.valid || !g.to.valid {
+		return "", errors.New("cannot generate percent of range value for open range")
+	}
+	if pct < 0 || pct > 100 {
+		return "", fmt.Errorf("percent %v out of range; it must be between 0 and 100", pct)
+	}
+	f := g.from.value + pct/100*(g.to.value-g.from.value)
+	// Formatting rounds the value to two decimal places, which can take it out of the range if the
+	// range has more decimal places, e.g. 1.004 is formatted as 1.00 for [1.004 - 2].
+	s := fmt.Sprintf(valueFormat, f)
+	switch afterFormatting, _ := floatFromString(s); {
+	case afterFormatting < g.from.value:
+		s = fmt.Sprintf(valueFormat, math.Ceil(g.from.value*100)/100)
+	case afterFormatting > g.to.value:
+		s = fmt.Sprintf(valueFormat, math.Floor(g.to.value*100)/100)
+	}
+	return s, nil
+}
+
 func randomFromRange(from float64, to float64) (string, error) {
 	for i := 0; i < 100; i++ {
-		f := rand.Float64()*(to-from) + from
+		f := random.Float64()*(to-from) + from
 
-		// The rand.Float64() returns value between [0.0, 1.0), ie the start of the range is inclusive, while
+		// The random.Float64() returns value between [0.0, 1.0), ie the start of the range is inclusive, while
 		// the number generated by the ValueGenerator needs to be exclusive.
 		// Furthermore, the value is formatted as a string, when it loses some precisions, ie. it is formatted
 		// to 2 decimal places only.
@@ -429,6 +429,44 @@ func TestValueGenerator_Random(t *testing.T) {
 	}
 }
 
+func TestValueGenerator_PercentOfRange(t *testing.T) {
+	cases := []struct {
+		name    string
+		inRange string
+		pct     float64
+		want    string
+		wantErr bool
+	}{
+		{name: "0%", inRange: "12 - 24", pct: 0, want: "12.00"},
+		{name: "50%", inRange: "12 - 24", pct: 50, want: "18.00"},
+		{name: "90%", inRange: "12 - 24", pct: 90, want: "22.80"},
+		{name: "100%", inRange: "12 - 24", pct: 100, want: "24.00"},
+		{name: "negative range", inRange: "-2 - 3", pct: 50, want: "0.50"},
+		{name: "0% rounded below the range", inRange: "1.004 - 1.996", pct: 0, want: "1.01"},
+		{name: "100% rounded above the range", inRange: "1.004 - 1.996", pct: 100, want: "1.99"},
+		{name: "above 100%", inRange: "12 - 24", pct: 101, wantErr: true},
+		{name: "below 0%", inRange: "12 - 24", pct: -1, wantErr: true},
+		{name: "open range", inRange: "[>12]", pct: 50, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			vg, err := ValueGeneratorFromRange(tc.inRange)
+			if err != nil {
+				t.Fatalf("ValueGeneratorFromRange(%s) failed with err %v", tc.inRange, err)
+			}
+
+			got, err := vg.PercentOfRange(tc.pct)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("PercentOfRange(%v) got err %v, want err? %t", tc.pct, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("PercentOfRange(%v) = %q, want %q", tc.pct, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestValueGenerator_IsNormal_IsHigh_IsLow(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -15,12 +15,12 @@
 package pathway
 
 import (
-	"math/rand"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/simhospital/pkg/random"
 )
 
 func TestNewDeterministicManager(t *testing.T) {
@@ -175,7 +175,7 @@ func TestDeterministicManager_PathwayNames(t *testing.T) {
 }
 
 func TestDeterministicManager_NextPathway(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	steps := []Step{
 		{Admission: &Admission{}},
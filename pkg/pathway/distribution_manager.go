@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -87,7 +88,14 @@ func calculateDistribution(pathways map[string]Pathway, include []*regexp.Regexp
 	accPercentage := 0.0
 	// We'll later share the remaining percentage budget among the pathways without an explicit one.
 	var noPercentage []string
-	for k, v := range pathways {
+	// Iterate over the pathways in a fixed order, so that the distribution is always the same.
+	names := make([]string, 0, len(pathways))
+	for k := range pathways {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := pathways[k]
 		switch {
 		case len(include) > 0 && !matches(k, include) || matches(k, exclude):
 			log.WithField("pathway_name", k).Debug("Pathway disabled")
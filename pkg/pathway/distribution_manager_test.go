@@ -16,12 +16,12 @@ package pathway
 
 import (
 	"math"
-	"math/rand"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/simhospital/pkg/random"
 )
 
 func TestDistributionManager_GetPathway(t *testing.T) {
@@ -158,7 +158,7 @@ func TestDistributionManager_PathwayNames(t *testing.T) {
 }
 
 func TestDistributionManager_NextPathway(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	pathway1, pathway2, pathway3 := "pathway1", "pathway2", "pathway3"
 	cases := []struct {
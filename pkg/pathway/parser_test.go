@@ -17,13 +17,13 @@ package pathway
 import (
 	"fmt"
 	"math"
-	"math/rand"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/simhospital/pkg/random"
 	"github.com/google/simhospital/pkg/test/testclock"
 	"github.com/google/simhospital/pkg/test/testlocation"
 	"github.com/google/simhospital/pkg/test/testwrite"
@@ -1540,7 +1540,7 @@ random_pathway:
 }
 
 func TestParseAutoGenerateGetPathwayDifferentEveryTime(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 
 	pathwayDefinition := []byte(`
 pathway_autogenerate:
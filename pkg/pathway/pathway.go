@@ -18,11 +18,11 @@ package pathway
 
 import (
 	"fmt"
-	"math/rand"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -30,6 +30,7 @@ import (
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/logging"
 	"github.com/google/simhospital/pkg/orderprofile"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // The following constants represent step types.
@@ -266,6 +267,12 @@ type Results struct {
 	// If ExpectCorrection is set, you can use OrderStatus and ResultStatus to set a value that
 	// indicates to downstream processing systems that the order/results will be corrected later.
 	ExpectCorrection bool `yaml:"expect_correction"`
+	// AppendCorrection indicates that the results are a correction that is appended to the
+	// results previously sent for the same order, instead of replacing them.
+	// The message will contain both the previous and the corrected results, with sequential
+	// SetIDs for the OBXs.
+	// Optional.
+	AppendCorrection bool `yaml:"append_correction"`
 }
 
 // Result represents a single test result.
@@ -290,6 +297,11 @@ type Result struct {
 	// Unit is a unit of the Value.
 	// Requires if Value is numerical.
 	Unit string
+	// ValueType is the type of the Value. If not specified, it is derived from the Value.
+	// Optional.
+	// The only value type that can be specified is SN (structured numeric), for values such as
+	// titers or ratios (1:256), ranges (10-20), or numbers with comparators (<0.5).
+	ValueType string `yaml:"value_type"`
 	// ObservationDateTimeOffset is the duration e.g. "+1h" which will set the time
 	// relative to the CollectedDateTime within the enclosing Results.
 	// Optional.
@@ -305,7 +317,7 @@ type Result struct {
 	// NORMAL or empty string are both mapped to the normal flag (ie an empty string in HL7 message).
 	// If AbnormalFlag is set to DEFAULT, it will be derived from reference ranges
 	// (either custom, or from order profile) and the value.
-	// The AbnormalFlag cannot be set to DEFAULT for the textual or empty value.
+	// The AbnormalFlag cannot be set to DEFAULT for textual, structured numeric or empty values.
 	AbnormalFlag constants.AbnormalFlag `yaml:"abnormal_flag"`
 	// Notes are the notes that will be used to populate the NTE segments associated with this result.
 	// Optional.
@@ -328,6 +340,10 @@ type Transfer struct {
 	// Required.
 	Loc string
 	Bed string
+	// IsTemporary indicates whether Loc is a temporary location (e.g. X-RAY), in which case the
+	// patient keeps their permanent location and bed, and Loc is sent as the temporary location.
+	// Loc must still be a known location, but Bed cannot be set if IsTemporary is set.
+	IsTemporary bool `yaml:"is_temporary"`
 }
 
 // Discharge is a step to discharge the patient. It produces an ADT^A03 message.
@@ -686,9 +702,12 @@ type Allergy struct {
 	// Either Code or Description (or both) is required.
 	// If Code is missing and the Description specified is on the list of allergies
 	// loaded from the allergies config file, the Code will be derived from the Description.
-	Description            string
-	Severity               string
-	Reaction               string
+	Description string
+	Severity    string
+	Reaction    string
+	// Reactions can be used instead of Reaction to specify multiple reactions.
+	// If Reactions is set, Reaction is ignored.
+	Reactions              []string
 	CodingSystem           string    `yaml:"coding_system,omitempty"`
 	IdentificationDateTime *DateTime `yaml:"identification_datetime,omitempty"`
 }
@@ -857,17 +876,50 @@ func (r *Result) GetRandomType() (string, error) {
 }
 
 // GetValueType returns the type of the Value of the Result,
-// ie: either constants.NumericalValueType or constants.TextualValueType.
+// ie: either constants.NumericalValueType or constants.TextualValueType,
+// or ValueType if it is set explicitly.
+// Numbers with a leading comparator, e.g. "<0.5" or ">=100", are numerical; the comparator is
+// kept in the value.
 func (r *Result) GetValueType() string {
 	if r.Value == constants.EmptyString {
 		return ""
 	}
+	if r.ValueType != "" {
+		return r.ValueType
+	}
+	if r.IsValuePercentOfRange() {
+		return constants.NumericalValueType
+	}
 	if _, _, err := orderprofile.ValueFromString(r.Value); err == nil {
 		return constants.NumericalValueType
 	}
 	return constants.TextualValueType
 }
 
+// IsValuePercentOfRange returns whether the Value is specified as a percentage of the
+// reference range, ie: it starts with constants.PercentOfRangePrefix.
+func (r *Result) IsValuePercentOfRange() bool {
+	return strings.HasPrefix(r.Value, constants.PercentOfRangePrefix)
+}
+
+// GetPercentOfRange returns the percentage of the reference range specified in the Value,
+// e.g. 90 for "pct:90".
+// It returns an error if the Value is not a percent-of-range specification, or if the
+// percentage is not a number between 0 and 100.
+func (r *Result) GetPercentOfRange() (float64, error) {
+	if !r.IsValuePercentOfRange() {
+		return 0, fmt.Errorf("value %q is not a percent of range", r.Value)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimPrefix(r.Value, constants.PercentOfRangePrefix), 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot parse percent of range from value %q", r.Value)
+	}
+	if pct < 0 || pct > 100 {
+		return 0, fmt.Errorf("percent of range %v in value %q must be between 0 and 100", pct, r.Value)
+	}
+	return pct, nil
+}
+
 // IsValueRandom returns whether the Value is random,
 // ie: normal, abnormal high or abnormal low.
 func (r *Result) IsValueRandom() bool {
@@ -884,7 +936,7 @@ func (d *Delay) Random() time.Duration {
 	if d.From == d.To {
 		return d.From
 	}
-	return time.Duration(rand.Int63n(int64(d.To)-int64(d.From)) + int64(d.From))
+	return time.Duration(random.Int63n(int64(d.To)-int64(d.From)) + int64(d.From))
 }
 
 // Random returns random int between [i.From, i.To).
@@ -893,7 +945,7 @@ func (i *Interval) Random() int {
 	if i.From == i.To {
 		return i.From
 	}
-	return rand.Intn(i.To-i.From) + i.From
+	return random.Intn(i.To-i.From) + i.From
 }
 
 // random returns random int between [a.From, a.To).
@@ -902,7 +954,7 @@ func (a *Age) random() int {
 	if a.From == a.To {
 		return a.From
 	}
-	return rand.Intn(a.To-a.From) + a.From
+	return random.Intn(a.To-a.From) + a.From
 }
 
 // getDayOfYear returns the 0-indexed day of the year the person was born;
@@ -911,7 +963,7 @@ func (a *Age) getDayOfYear() int {
 	if a.DayOfYear > 0 {
 		return a.DayOfYear - 1
 	}
-	return rand.Intn(365)
+	return random.Intn(365)
 }
 
 // Birthdate returns the date of birth for the givem age given a clock.
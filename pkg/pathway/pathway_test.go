@@ -176,6 +176,18 @@ func TestResultGetValueTypeAndUnit(t *testing.T) {
 			wantValue: "the value",
 			wantType:  "TX",
 			wantUnit:  "",
+		}, {
+			name:      "numerical value below the detection limit",
+			r:         &Result{TestName: "Creatinine", Value: "<0.5", Unit: "UMOLL"},
+			wantValue: "<0.5",
+			wantType:  "NM",
+			wantUnit:  "UMOLL",
+		}, {
+			name:      "numerical value above the detection limit",
+			r:         &Result{TestName: "Creatinine", Value: ">=100", Unit: "UMOLL"},
+			wantValue: ">=100",
+			wantType:  "NM",
+			wantUnit:  "UMOLL",
 		}, {
 			name:      "empty value",
 			r:         &Result{TestName: "Creatinine", Value: constants.EmptyString, Unit: constants.EmptyString},
@@ -326,6 +338,36 @@ func TestResultIsValueRandom(t *testing.T) {
 	}
 }
 
+func TestResultGetPercentOfRange(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "pct:0", want: 0},
+		{value: "pct:50", want: 50},
+		{value: "pct:100", want: 100},
+		{value: "pct:12.5", want: 12.5},
+		{value: "pct:101", wantErr: true},
+		{value: "pct:-1", wantErr: true},
+		{value: "pct:abc", wantErr: true},
+		{value: "50", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.value, func(t *testing.T) {
+			r := Result{Value: tc.value}
+			got, err := r.GetPercentOfRange()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("[%+v].GetPercentOfRange() got err %v, want err? %t", r, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("[%+v].GetPercentOfRange()=%v, want %v", r, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestStepStepType(t *testing.T) {
 	cases := []struct {
 		step Step
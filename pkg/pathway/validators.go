@@ -16,7 +16,6 @@ package pathway
 
 import (
 	"fmt"
-	"math/rand"
 	"reflect"
 	"strconv"
 	"strings"
@@ -24,14 +23,18 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/google/simhospital/pkg/clock"
+	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/doctor"
 	"github.com/google/simhospital/pkg/location"
 	"github.com/google/simhospital/pkg/message"
 	"github.com/google/simhospital/pkg/orderprofile"
+	"github.com/google/simhospital/pkg/random"
 )
 
-func (d *Delay) valid() error {
+// Valid returns an error if d is not a valid delay, i.e., if From is negative or greater than To.
+// A nil delay is valid.
+func (d *Delay) Valid() error {
 	if d == nil {
 		return nil
 	}
@@ -117,6 +120,10 @@ func (t *Transfer) valid(lm *location.Manager) error {
 	if err := validLocation(t.Loc, lm); err != nil {
 		return errors.Wrap(err, "error validating location in transfer")
 	}
+	// The patient keeps their bed in temporary transfers, so they aren't transferred to a new one.
+	if t.IsTemporary && t.Bed != "" {
+		return fmt.Errorf("transfer bed is %q; bed cannot be set for temporary transfers", t.Bed)
+	}
 	return nil
 }
 
@@ -284,6 +291,9 @@ func validateResultValue(r *Result) error {
 	if r.Value == "" {
 		return fmt.Errorf("parameter Value is missing in result: %v. If value is to be randomised, it should be set to one of: %v", r, randomValues)
 	}
+	if r.ValueType != "" && r.ValueType != constants.StructuredNumericValueType {
+		return fmt.Errorf("invalid value type %q in result: %v. Only %s can be specified", r.ValueType, r, constants.StructuredNumericValueType)
+	}
 
 	if r.IsValueRandom() {
 		var ec error
@@ -306,6 +316,26 @@ func validateResultValue(r *Result) error {
 		return ec
 	}
 
+	if r.IsValuePercentOfRange() {
+		var ec error
+		if _, err := r.GetPercentOfRange(); err != nil {
+			ec = combineErrors(ec, err)
+		}
+		if r.AbnormalFlag != "" {
+			ec = combineErrors(ec, fmt.Errorf("parameter Value set to %s, but AbnormalFlag is specified. AbnormalFlag can only be "+
+				"overridden when Value is not a percent of range", r.Value))
+		}
+		return ec
+	}
+
+	if r.GetValueType() == constants.StructuredNumericValueType {
+		// The unit is optional for structured numeric values, e.g. titers don't have units.
+		if _, err := message.ParseStructuredNumeric(r.Value); err != nil {
+			return errors.Wrapf(err, "invalid structured numeric value in result: %v", r)
+		}
+		return nil
+	}
+
 	if r.GetValueType() == constants.NumericalValueType {
 		if r.Unit == "" {
 			return fmt.Errorf("parameter Unit missing for numerical value in result: %v", r)
@@ -328,7 +358,7 @@ func validateResultAgainstOrderProfile(r *Result, orderProfile *orderprofile.Ord
 	var ec error
 	if orderProfile == nil {
 		// no matching order profile
-		if r.IsValueRandom() && r.ReferenceRange == "" {
+		if (r.IsValueRandom() || r.IsValuePercentOfRange()) && r.ReferenceRange == "" {
 			ec = combineErrors(ec, fmt.Errorf("parameter Value set to %s, but no order profile found and no custom reference ranges set", r.Value))
 		}
 		if r.ReferenceRange != "" {
@@ -343,6 +373,8 @@ func validateResultAgainstOrderProfile(r *Result, orderProfile *orderprofile.Ord
 				ec = combineErrors(ec, r.validValueAndRefRange(r.ReferenceRange))
 			} else if tt.RefRange != "" {
 				ec = combineErrors(ec, r.validValueAndRefRange(tt.RefRange))
+			} else if r.IsValuePercentOfRange() {
+				ec = combineErrors(ec, fmt.Errorf("parameter Value set to %s, but no reference range is set for test type %q", r.Value, r.TestName))
 			} else if r.AbnormalFlag == constants.AbnormalFlagDefault {
 				ec = combineErrors(ec, errors.New("cannot derive abnormal flag if the reference range is not specified"))
 			}
@@ -362,12 +394,12 @@ func (r *Result) valid(orderProfile *orderprofile.OrderProfile) error {
 	if r.TestName == "" {
 		ec = combineErrors(ec, fmt.Errorf("parameter TestName is missing in result: %v", r))
 	}
-	if r.AbnormalFlag == constants.AbnormalFlagDefault && (r.Value == constants.EmptyString || r.GetValueType() == constants.TextualValueType) {
+	if r.AbnormalFlag == constants.AbnormalFlagDefault && (r.Value == constants.EmptyString || r.GetValueType() != constants.NumericalValueType) {
 		// If the value is textual or set to empty string, it doesn't matter what the ref range is set to; all values:
 		// HIGH / LOW / NORMAL for abnormal flag are acceptable, as this is the only way to indicate whether the value
 		// is normal or abnormal.
 		// Only DEFAULT value is not accepted in this case, as there is no way to derive it from the textual value.
-		ec = combineErrors(ec, fmt.Errorf("cannot derive abnormal flag from textual or empty value: %q", r.AbnormalFlag))
+		ec = combineErrors(ec, fmt.Errorf("cannot derive abnormal flag from non-numerical or empty value: %q", r.AbnormalFlag))
 	}
 	if _, ok := constants.AbnormalFlagValues[r.AbnormalFlag]; !ok {
 		ec = combineErrors(ec, fmt.Errorf("invalid abnormal flag %v. Abnormal flag should be set to one of: %v", r.AbnormalFlag, constants.AbnormalFlagValues))
@@ -393,11 +425,23 @@ func (r *Result) validValueAndRefRange(refRange string) error {
 		if r.IsValueRandom() {
 			return errors.Wrapf(err, "cannot generate random value from invalid reference range %q", refRange)
 		}
+		if r.IsValuePercentOfRange() {
+			return errors.Wrapf(err, "cannot generate percent of range value from invalid reference range %q", refRange)
+		}
 	} else if r.IsValueRandom() {
 		_, err := g.Random(r.Value)
 		if err != nil {
 			return errors.Wrap(err, "cannot generate random value")
 		}
+	} else if r.IsValuePercentOfRange() {
+		pct, err := r.GetPercentOfRange()
+		if err != nil {
+			// Already reported by validateResultValue.
+			return nil
+		}
+		if _, err := g.PercentOfRange(pct); err != nil {
+			return errors.Wrap(err, "cannot generate percent of range value")
+		}
 	} else if r.GetValueType() == constants.NumericalValueType && r.AbnormalFlag != constants.AbnormalFlagDefault {
 		_, v, _ := orderprofile.ValueFromString(r.Value)
 		if g.IsNormal(v) && !constants.IsNormalFlag(r.AbnormalFlag) {
@@ -626,7 +670,7 @@ func (s Step) valid(now time.Time, lm *location.Manager) error {
 	}
 
 	if s.Parameters != nil {
-		if err := s.Parameters.DelayMessage.valid(); err != nil {
+		if err := s.Parameters.DelayMessage.Valid(); err != nil {
 			return errors.Wrapf(err, "invalid delay in parameters.delay_message")
 		}
 		if s.Parameters.Status != nil && s.Parameters.Status.TimeOfDeath != nil && s.Parameters.Status.TimeSinceDeath != nil {
@@ -662,7 +706,7 @@ func (s Step) valid(now time.Time, lm *location.Manager) error {
 	if err := s.TrackArrival.valid(lm); err != nil {
 		return errors.Wrap(err, "invalid TrackArrival step")
 	}
-	if err := s.Delay.valid(); err != nil {
+	if err := s.Delay.Valid(); err != nil {
 		return errors.Wrap(err, "invalid Delay step")
 	}
 	if err := s.UpdatePerson.valid(now); err != nil {
@@ -819,7 +863,7 @@ func newConsultantID(doctors *doctor.Doctors) string {
 		var sb strings.Builder
 		sb.WriteString("C")
 		for i := 0; i < 7; i++ {
-			sb.WriteString(strconv.Itoa(rand.Intn(10)))
+			sb.WriteString(strconv.Itoa(random.Intn(10)))
 		}
 		newID := sb.String()
 		doctor := doctors.GetByID(newID)
@@ -927,6 +971,25 @@ func validatePathway(pathway []Step, clock clock.Clock, lm *location.Manager, va
 	return ec
 }
 
+// ValidPatientClasses returns a function to be used as Parser.Valid that checks that the patient
+// classes of the registration steps in a pathway are either configured codes or in the mapping
+// of the given configuration, so that unknown classes are reported when the pathway is parsed.
+func ValidPatientClasses(c config.PatientClass) func(*Pathway) error {
+	return func(p *Pathway) error {
+		for _, steps := range [][]Step{p.History, p.Pathway} {
+			for _, s := range steps {
+				if s.Registration == nil || s.Registration.PatientClass == "" {
+					continue
+				}
+				if _, err := c.Code(s.Registration.PatientClass); err != nil {
+					return errors.Wrap(err, "invalid Registration step")
+				}
+			}
+		}
+		return nil
+	}
+}
+
 // Valid returns whether the pathway is valid.
 // It applies custom validation that depends on whether the steps are historical or not.
 // Returns an error if the pathway is invalid.
@@ -22,6 +22,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/pkg/errors"
+	"github.com/google/simhospital/pkg/config"
 	"github.com/google/simhospital/pkg/constants"
 	"github.com/google/simhospital/pkg/doctor"
 	"github.com/google/simhospital/pkg/message"
@@ -135,6 +136,15 @@ func TestResultValid(t *testing.T) {
 		{r: &Result{TestName: "Open Start", Value: constants.AbnormalHigh, Unit: "UMOLL", ReferenceRange: "<5"}, op: emptyOP, wantErr: false},
 		{r: &Result{TestName: "Open Start", Value: constants.NormalValue, Unit: "UMOLL", ReferenceRange: "<5"}, op: emptyOP, wantErr: false},
 		{r: &Result{TestName: "Open Start", Value: constants.AbnormalLow, Unit: "UMOLL", ReferenceRange: "<5"}, op: emptyOP, wantErr: true},
+		// valid: structured numeric value, with or without unit
+		{r: &Result{TestName: "Titer", Value: "1:256", ValueType: "SN"}, op: emptyOP, wantErr: false},
+		{r: &Result{TestName: "Creatinine", Value: ">=100", ValueType: "SN", Unit: "UMOLL"}, op: emptyOP, wantErr: false},
+		{r: &Result{TestName: "Creatinine", Value: "10-20", ValueType: "SN", Unit: "UMOLL"}, op: ureaOP, wantErr: false},
+		// invalid: value cannot be parsed as structured numeric
+		{r: &Result{TestName: "Titer", Value: "Positive", ValueType: "SN"}, op: emptyOP, wantErr: true},
+		{r: &Result{TestName: "Titer", Value: "1:", ValueType: "SN"}, op: emptyOP, wantErr: true},
+		// invalid: unsupported value type
+		{r: &Result{TestName: "Creatinine", Value: "12", ValueType: "NM", Unit: "UMOLL"}, op: emptyOP, wantErr: true},
 		// invalid: non-existing test type in pre-defined order profile
 		{r: &Result{TestName: "Sodium", Value: "52", Unit: "UMOLL"}, op: ureaOP, wantErr: true},
 		{r: &Result{TestName: "Sodium", Value: "52", Unit: "UMOLL"}, op: emptyOP, wantErr: false},
@@ -204,6 +214,38 @@ func TestResultValidRandomValue(t *testing.T) {
 	}
 }
 
+func TestResultValidPercentOfRangeValue(t *testing.T) {
+	cases := []struct {
+		name    string
+		r       *Result
+		op      *orderprofile.OrderProfiles
+		wantErr bool
+	}{
+		{name: "order profile range", r: &Result{TestName: "Creatinine", Value: "pct:90"}, op: ureaOP, wantErr: false},
+		{name: "overridden range", r: &Result{TestName: "Creatinine", Value: "pct:90", ReferenceRange: "500 - 700", Unit: "UMOLL"}, op: emptyOP, wantErr: false},
+		{name: "no range", r: &Result{TestName: "Creatinine", Value: "pct:90"}, op: emptyOP, wantErr: true},
+		{name: "open range", r: &Result{TestName: "Creatinine", Value: "pct:90", ReferenceRange: "[>500]", Unit: "UMOLL"}, op: emptyOP, wantErr: true},
+		{name: "out of range percent", r: &Result{TestName: "Creatinine", Value: "pct:120"}, op: ureaOP, wantErr: true},
+		{name: "abnormal flag set", r: &Result{TestName: "Creatinine", Value: "pct:90", AbnormalFlag: constants.AbnormalFlagHigh}, op: ureaOP, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := Pathway{
+				Pathway: []Step{
+					{Result: &Results{OrderProfile: "UREA AND ELECTROLYTES", Results: []*Result{tc.r}}},
+				},
+			}
+			p.Init(pathwayName)
+
+			err := p.Valid(defaultClock, tc.op, emptyDoctors, defaultLocationManager, defaultValid)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("[%+v].Valid(_, %+v, _, _) got err %v; want err? %t", p, tc.op, err, tc.wantErr)
+			}
+		})
+	}
+}
+
 func TestResultValidReferenceRange(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -608,6 +650,10 @@ func TestPathwayValidStep(t *testing.T) {
 		{step: Step{Transfer: &Transfer{Loc: "ED"}}},
 		{step: Step{Transfer: &Transfer{Loc: "nonexistent-location"}}, wantErr: true},
 		{step: Step{Transfer: &Transfer{}}, wantErr: true},
+		{step: Step{Transfer: &Transfer{Loc: "ED", IsTemporary: true}}},
+		{step: Step{Transfer: &Transfer{Loc: "nonexistent-location", IsTemporary: true}}, wantErr: true},
+		{step: Step{Transfer: &Transfer{Loc: "ED", Bed: "Bed1", IsTemporary: true}}, wantErr: true},
+		{step: Step{Transfer: &Transfer{IsTemporary: true}}, wantErr: true},
 		{step: Step{TransferInError: &TransferInError{Loc: "ED"}}},
 		{step: Step{TransferInError: &TransferInError{Loc: "nonexistent-location"}}, wantErr: true},
 		{step: Step{TransferInError: &TransferInError{}}, wantErr: true},
@@ -1000,6 +1046,36 @@ func TestPathwayValidFn(t *testing.T) {
 	}
 }
 
+func TestValidPatientClasses(t *testing.T) {
+	c := config.PatientClass{
+		Outpatient: "O",
+		Inpatient:  "I",
+		Mapping:    map[string]string{"INPATIENT": "I", "EMERGENCY": "E"},
+	}
+	cases := []struct {
+		desc    string
+		steps   []Step
+		history []Step
+		wantErr bool
+	}{
+		{desc: "mapped class", steps: []Step{{Registration: &Registration{PatientClass: "EMERGENCY"}}}},
+		{desc: "configured code", steps: []Step{{Registration: &Registration{PatientClass: "I"}}}},
+		{desc: "no class", steps: []Step{{Registration: &Registration{}}}},
+		{desc: "unknown class", steps: []Step{{Registration: &Registration{PatientClass: "RECURRING"}}}, wantErr: true},
+		{desc: "unknown class in history", history: []Step{{Registration: &Registration{PatientClass: "RECURRING"}}}, wantErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.desc, func(t *testing.T) {
+			pathway := &Pathway{Pathway: tt.steps, History: tt.history}
+			err := ValidPatientClasses(c)(pathway)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("ValidPatientClasses(%+v)(%+v) got err %v; want err? %t", c, pathway, err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestPathwayValidPercentage(t *testing.T) {
 	cases := []struct {
 		percentage *Percentage
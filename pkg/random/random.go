@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package random provides the source of randomness shared by all the randomized components of
+// Simulated Hospital, e.g., the generators of names, addresses, orders and notes, and the random
+// delays in pathways. Seeding it with Seed makes a whole simulation run reproducible.
+// The functions in this package are safe for concurrent use.
+package random
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedSource is a rand.Source that is safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+var (
+	source = &lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)}
+	r      = rand.New(source)
+)
+
+// Seed seeds the shared source of randomness.
+// Given the same seed, the functions in this package return the same sequence of values.
+func Seed(seed int64) {
+	source.Seed(seed)
+}
+
+// Intn returns, as an int, a non-negative pseudo-random number in [0,n). It panics if n <= 0.
+func Intn(n int) int {
+	return r.Intn(n)
+}
+
+// Int63n returns, as an int64, a non-negative pseudo-random number in [0,n). It panics if n <= 0.
+func Int63n(n int64) int64 {
+	return r.Int63n(n)
+}
+
+// Uint32 returns a pseudo-random 32-bit value as a uint32.
+func Uint32() uint32 {
+	return r.Uint32()
+}
+
+// Uint64 returns a pseudo-random 64-bit value as a uint64.
+func Uint64() uint64 {
+	return r.Uint64()
+}
+
+// Float64 returns, as a float64, a pseudo-random number in [0.0,1.0).
+func Float64() float64 {
+	return r.Float64()
+}
+
+// Read fills b with pseudo-random bytes. It always returns len(b) and a nil error.
+func Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r.Int63())
+	}
+	return len(b), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package random
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSeed(t *testing.T) {
+	values := func() []interface{} {
+		Seed(1)
+		b := make([]byte, 4)
+		Read(b)
+		return []interface{}{Intn(100), Int63n(100), Uint32(), Uint64(), Float64(), b}
+	}
+
+	first := values()
+	second := values()
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("values with the same seed diff (-first, +second):\n%s", diff)
+	}
+}
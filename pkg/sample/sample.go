@@ -16,7 +16,7 @@
 package sample
 
 import (
-	"math/rand"
+	"github.com/google/simhospital/pkg/random"
 )
 
 // WeightedValue represents the value and its frequency.
@@ -38,9 +38,9 @@ func (d DiscreteDistribution) total() uint {
 	return total
 }
 
-// randUint returns, as an uint, a pseudo-random number in [0,n) from the default Source.
+// randUint returns, as an uint, a pseudo-random number in [0,n) from the shared source of randomness.
 func randUint(n uint) uint {
-	return uint(rand.Intn(int(n)))
+	return uint(random.Intn(int(n)))
 }
 
 // Random samples the DiscreteDistribution and returns the resulting value.
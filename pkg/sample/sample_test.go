@@ -15,8 +15,9 @@
 package sample
 
 import (
-	"math/rand"
 	"testing"
+
+	"github.com/google/simhospital/pkg/random"
 )
 
 func TestDiscreteDistribution_Random_IsFromDistribution(t *testing.T) {
@@ -42,7 +43,7 @@ func TestDiscreteDistribution_Random_IsFromDistribution(t *testing.T) {
 }
 
 func TestDiscreteDistribution_Random_IsProportionateToDistribution(t *testing.T) {
-	rand.Seed(1)
+	random.Seed(1)
 	testResults := []WeightedValue{
 		{Value: "Red", Frequency: 1},
 		{Value: "Orange", Frequency: 1},
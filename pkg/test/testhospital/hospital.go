@@ -122,7 +122,9 @@ func WithTime(t *testing.T, cfg Config, now time.Time) *Hospital {
 		c.Sender = &testhl7.Sender{}
 	}
 	c.AdditionalConfig = cfg.AdditionalConfig
-	c.AdditionalConfig.AddressGenerator = &testaddress.ArbitraryGenerator
+	if c.AdditionalConfig.AddressGenerator == nil {
+		c.AdditionalConfig.AddressGenerator = &testaddress.ArbitraryGenerator
+	}
 	c.AdditionalConfig.MRNGenerator = &testid.Generator{}
 	c.AdditionalConfig.PlacerGenerator = &testid.Generator{}
 	c.AdditionalConfig.FillerGenerator = &testid.Generator{}